@@ -18,30 +18,30 @@ func GetStatusUrlForUuid(uuid, cfgPath string) string {
 }
 
 func InsertJobsRow(job JobEntry, driver database.DbDriver) error {
-	allJobColumns := []string{"uuid", "artifact_url", "tests_repo", "tests_repo_branch", "tests_plans", "image_url", "reporter", "status", "submitted_at", "requester", "debug", "priority"}
-	queryString := fmt.Sprintf(
-		`INSERT INTO jobs (%v) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
-		strings.Join(allJobColumns, ", "),
-	)
-	stmt, err := driver.PrepareQuery(queryString)
-	if err != nil { // coverage-ignore
-		return err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-	_, err = stmt.Exec(
+	allJobColumns := []string{"uuid", "artifact_url", "tests_repo", "tests_repo_branch", "tests_plans", "image_url", "testbed_alias", "reporter", "status", "submitted_at", "requester", "debug", "priority", "retries"}
+	_, err := driver.Exec(database.Insert("jobs", allJobColumns...).Values(
 		job.Uuid,
 		job.ArtifactUrl,
 		job.TestsRepo,
 		job.TestsRepoBranch,
 		fmt.Sprintf(`{%v}`, strings.Join(job.TestsPlans, ",")),
 		job.ImageUrl,
+		job.TestbedAlias,
 		job.Reporter,
 		job.Status,
 		job.SubmittedAt,
 		job.Requester,
 		job.Debug,
 		job.Priority,
-	)
+		job.Retries,
+	))
+	return err
+}
+
+// InsertReporterRow records where the results of a job are reported to, which
+// the reporter picks the job up from once it's finished
+func InsertReporterRow(uuid, reportingUrl string, driver database.DbDriver) error {
+	_, err := driver.Exec(database.Insert("reporter", "uuid", "base_reporting_url").Values(uuid, reportingUrl))
 	return err
 }
 
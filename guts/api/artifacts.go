@@ -2,86 +2,112 @@ package api
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
 	"io"
+	"io/fs"
+	"mime"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	DirSize int
+	// used when tarball_download_workers isn't set
+	DefaultTarballDownloadWorkers = 4
+	// the biggest file that's served out of the artifacts of a test case
+	ArtifactFileMaxSize int64 = 4000000
 )
 
-func CollateArtifacts(uuidToFind string, driver database.DbDriver, gutsCfg GutsApiConfig) ([]byte, error) { // coverage-ignore
-	// Collates several .tar.gz files from separate tests into one .tar.gz file
-	var gzippedTarBytes []byte
+// DownloadedTarball is a test's tarball, downloaded to a temporary file
+type DownloadedTarball struct {
+	Path string
+	Err  error
+}
+
+// CollateArtifacts streams a .tar.gz of the artifacts of every test in a job to
+// w, and caches it for the next download. The tarballs of the tests are
+// downloaded concurrently, and merged as they arrive, so the artifacts never
+// have to fit in memory. Nothing is written to w if the first tarball can't
+// be downloaded
+func CollateArtifacts(uuidToFind string, driver database.DbDriver, gutsCfg GutsApiConfig, w io.Writer) error { // coverage-ignore
 	uuidCacheDir := fmt.Sprintf("%v%v", gutsCfg.Tarball.TarballCachePath, uuidToFind)
 	cachedTarFile := fmt.Sprintf("%v/results.tar.gz", uuidCacheDir)
 	cachedLastDownloadedFile := fmt.Sprintf("%v/%v.last_downloaded", uuidCacheDir, uuidToFind)
 
 	if utils.AllFilesExist(uuidCacheDir, cachedTarFile, cachedLastDownloadedFile) {
-		dat, err := os.ReadFile(cachedTarFile)
+		f, err := os.Open(cachedTarFile)
 		if err != nil {
-			return dat, err
+			return err
 		}
-		err = RefreshLastDownloadedFile(cachedLastDownloadedFile)
+		defer utils.DeferredErrCheck(f.Close)
+		_, err = io.Copy(w, f)
 		if err != nil {
-			return dat, err
+			return err
 		}
-		return dat, err
+		return RefreshLastDownloadedFile(cachedLastDownloadedFile)
 	}
 
 	urls, err := FindArtifactUrlsByUuid(uuidToFind, driver)
 	if err != nil {
-		return gzippedTarBytes, err
+		return err
 	}
 
 	directoryNames, err := CreateOutputDirectoriesFromUrls(urls)
 	if err != nil {
-		return gzippedTarBytes, err
-	}
-
-	allTarFilesBytes, err := DownloadTarFiles(urls)
-	if err != nil {
-		return gzippedTarBytes, err
-	}
-
-	allFilesInTarBytes, err := TarUpFilesInGivenDirectories(directoryNames, allTarFilesBytes)
-	if err != nil {
-		return gzippedTarBytes, err
-	}
-
-	gzippedTarBytes, err = utils.GzipTarArchiveBytes(allFilesInTarBytes)
-	if err != nil {
-		return gzippedTarBytes, err
+		return err
 	}
 
 	err = utils.CreateDirIfNotExists(gutsCfg.Tarball.TarballCachePath)
 	if err != nil {
-		return gzippedTarBytes, err
+		return err
 	}
 
-	err = WriteTarballToCache(gzippedTarBytes, uuidToFind, uuidCacheDir, cachedTarFile, cachedLastDownloadedFile)
-	if err != nil {
-		return gzippedTarBytes, err
+	workers := gutsCfg.Tarball.TarballDownloadWorkers
+	if workers <= 0 {
+		workers = DefaultTarballDownloadWorkers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tarballs := DownloadTarFiles(ctx, urls, workers)
+	// stop any downloads still going if the merge fails part way
+	defer RemoveDownloadedTarFiles(tarballs)
+	defer cancel()
+
+	// everything sent to the client is written to the cache as well
+	cacheReader, cacheWriter := io.Pipe()
+	cacheErr := make(chan error, 1)
+	go func() {
+		err := WriteTarballToCache(cacheReader, uuidToFind, uuidCacheDir, cachedTarFile, cachedLastDownloadedFile)
+		// keep reading if the cache can't be written, so the client still
+		// gets its artifacts
+		_, _ = io.Copy(io.Discard, cacheReader)
+		cacheErr <- err
+	}()
+
+	err = MergeTarFiles(directoryNames, tarballs, io.MultiWriter(w, cacheWriter))
+	// closing with a nil error tells the cache the tarball is complete
+	_ = cacheWriter.CloseWithError(err)
+	if cacheErr := <-cacheErr; err == nil && cacheErr != nil {
+		err = cacheErr
 	}
-
-	err = CacheRetentionPolicy(gutsCfg.Tarball.TarballCachePath, gutsCfg.Tarball.TarballCacheReductionThreshold, gutsCfg.Tarball.TarballCacheMaxSize)
 	if err != nil {
-		return gzippedTarBytes, err
+		return err
 	}
 
-	return gzippedTarBytes, nil
+	return CacheRetentionPolicy(gutsCfg.Tarball.TarballCachePath, gutsCfg.Tarball.TarballCacheReductionThreshold, gutsCfg.Tarball.TarballCacheMaxSize)
 }
 
 func CacheRetentionPolicy(cacheDirectory string, reduceTo, maxSize int) error {
@@ -100,11 +126,15 @@ func CacheRetentionPolicy(cacheDirectory string, reduceTo, maxSize int) error {
 	}
 
 	uuidEpochMap := make(map[int]string)
-	sliceOfStamps := make([]int, len(entries))
+	sliceOfStamps := make([]int, 0, len(entries))
 
-	for idx, e := range entries {
+	for _, e := range entries {
 		entryLastUpdatedFile := fmt.Sprintf("%v/%v/%v.last_downloaded", cacheDirectory, e.Name(), e.Name())
 		dat, err := os.ReadFile(entryLastUpdatedFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the entry is still being downloaded
+			continue
+		}
 		if err != nil { // coverage-ignore
 			return err
 		}
@@ -113,7 +143,7 @@ func CacheRetentionPolicy(cacheDirectory string, reduceTo, maxSize int) error {
 			return err
 		}
 		uuidEpochMap[lastUpdated] = e.Name()
-		sliceOfStamps[idx] = lastUpdated
+		sliceOfStamps = append(sliceOfStamps, lastUpdated)
 	}
 
 	sort.Ints(sliceOfStamps)
@@ -146,7 +176,7 @@ func RefreshLastDownloadedFile(cachedLastDownloadedFile string) error {
 	return nil
 }
 
-func WriteTarballToCache(tarBall []byte, uuid string, uuidCacheDir string, cachedTarFile string, cachedLastDownloadedFile string) error {
+func WriteTarballToCache(tarBall io.Reader, uuid string, uuidCacheDir string, cachedTarFile string, cachedLastDownloadedFile string) error {
 	if utils.AllFilesExist(uuidCacheDir, cachedTarFile, cachedLastDownloadedFile) {
 		err := RefreshLastDownloadedFile(cachedLastDownloadedFile)
 		if err != nil { // coverage-ignore
@@ -155,18 +185,15 @@ func WriteTarballToCache(tarBall []byte, uuid string, uuidCacheDir string, cache
 		return nil
 	}
 
-	err := os.RemoveAll(uuidCacheDir)
+	err := utils.CreateDirIfNotExists(uuidCacheDir)
 	if err != nil { // coverage-ignore
 		return err
 	}
 
-	err = os.Mkdir(uuidCacheDir, 0755)
-	if err != nil { // coverage-ignore
-		return err
-	}
-
-	err = utils.AtomicWrite(tarBall, cachedTarFile)
-	if err != nil { // coverage-ignore
+	err = utils.AtomicWriteFromReader(tarBall, cachedTarFile)
+	if err != nil {
+		// only drop the entry if nothing else, like per-test tarballs, is in it
+		_ = os.Remove(uuidCacheDir)
 		return err
 	}
 
@@ -195,64 +222,169 @@ func CreateOutputDirectoriesFromUrls(urls []string) ([]string, error) {
 	return listOfFilenames, nil
 }
 
-func DownloadTarFiles(tarfileUrls []string) ([]map[string][]byte, error) {
-	var allFilesMaps []map[string][]byte
+// DownloadTarFiles downloads tarballs to temporary files, at most workers at
+// a time. Each url gets its own channel, which is sent its tarball as soon as
+// it's downloaded, so the tarballs can be used in order without waiting for
+// all of them
+func DownloadTarFiles(ctx context.Context, tarfileUrls []string, workers int) []chan DownloadedTarball {
+	tarballs := make([]chan DownloadedTarball, len(tarfileUrls))
+	for idx := range tarballs {
+		tarballs[idx] = make(chan DownloadedTarball, 1)
+	}
 
-	for _, url := range tarfileUrls {
-		var b []byte
-		b, err := utils.DownloadFile(url)
-		if err != nil {
-			return allFilesMaps, err
+	queue := make(chan int)
+	go func() {
+		defer close(queue)
+		for idx := range tarfileUrls {
+			select {
+			case queue <- idx:
+			case <-ctx.Done():
+				return
+			}
 		}
-		tarFiles, err := ExtractTarfiles(b)
-		if err != nil {
-			return allFilesMaps, err
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				path, err := DownloadTarFile(ctx, tarfileUrls[idx])
+				tarballs[idx] <- DownloadedTarball{Path: path, Err: err}
+			}
+		}()
+	}
+	// anything the workers didn't get round to was cancelled
+	go func() {
+		wg.Wait()
+		for _, tarball := range tarballs {
+			select {
+			case tarball <- DownloadedTarball{Err: context.Canceled}:
+			default:
+			}
+			close(tarball)
+		}
+	}()
+
+	return tarballs
+}
+
+func DownloadTarFile(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer utils.DeferredErrCheck(resp.Body.Close)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %v returned %v", url, resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "artifacts-*.tar.gz")
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	size, err := io.Copy(f, resp.Body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && size == 0 {
+		err = fmt.Errorf("file at %v is empty", url)
+	}
+	if err != nil {
+		utils.DeferredErrCheckStringArg(utils.RemoveIfExists, f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// RemoveDownloadedTarFiles waits for every download to finish and removes the
+// tarballs, whether or not they were used
+func RemoveDownloadedTarFiles(tarballs []chan DownloadedTarball) {
+	for _, tarball := range tarballs {
+		for downloaded := range tarball {
+			if downloaded.Path != "" {
+				utils.DeferredErrCheckStringArg(utils.RemoveIfExists, downloaded.Path)
+			}
 		}
-		allFilesMaps = append(allFilesMaps, tarFiles)
 	}
-	return allFilesMaps, nil
 }
 
-func TarUpFilesInGivenDirectories(dirsForFiles []string, inputFiles []map[string][]byte) ([]byte, error) {
-	var returnBytes []byte
-	if !reflect.DeepEqual(len(dirsForFiles), len(inputFiles)) {
-		return returnBytes, errors.New("length of variables doesn't add up")
+// MergeTarFiles streams the files of each downloaded tarball, in order, into a
+// single gzipped tarball written to w, with the files of each tarball in their
+// own directory
+func MergeTarFiles(dirsForFiles []string, tarballs []chan DownloadedTarball, w io.Writer) error {
+	if len(dirsForFiles) != len(tarballs) {
+		return errors.New("length of variables doesn't add up")
 	}
 
-	// initialise tar writer
-	tarBuffer := &bytes.Buffer{}
-	tarWriter := tar.NewWriter(tarBuffer)
+	// neither writer writes anything until the first file is added
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
 
 	for idx, entry := range dirsForFiles {
-		tarFiles := inputFiles[idx]
-		for fileName, fileBytes := range tarFiles {
-			hdr := &tar.Header{
-				Name: entry + "/" + fileName,
-				Mode: 0644,
-				Size: int64(len(fileBytes)),
-			}
-			// write tar header
-			err := tarWriter.WriteHeader(hdr)
-			if err != nil { // coverage-ignore
-				return returnBytes, err
-			}
-			// write tar data
-			_, err = tarWriter.Write(fileBytes)
-			if err != nil { // coverage-ignore
-				return returnBytes, err
-			}
+		downloaded := <-tarballs[idx]
+		if downloaded.Err != nil {
+			return downloaded.Err
+		}
+		err := AppendTarFile(tarWriter, entry, downloaded.Path)
+		utils.DeferredErrCheckStringArg(utils.RemoveIfExists, downloaded.Path)
+		if err != nil {
+			return err
 		}
 	}
 
-	// close tar writer
 	err := tarWriter.Close()
 	if err != nil { // coverage-ignore
-		return returnBytes, err
+		return err
 	}
+	return gzipWriter.Close()
+}
 
-	returnBytes = tarBuffer.Bytes()
-
-	return returnBytes, nil
+// AppendTarFile copies the files in a .tar.gz into tarWriter under directory
+func AppendTarFile(tarWriter *tar.Writer, directory, tarFilePath string) error {
+	f, err := os.Open(tarFilePath)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	defer utils.DeferredErrCheck(f.Close)
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(gzipReader.Close)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil { // coverage-ignore
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		hdr := &tar.Header{
+			Name:    directory + "/" + filepath.Base(header.Name),
+			Mode:    0644,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+		}
+		err = tarWriter.WriteHeader(hdr)
+		if err != nil { // coverage-ignore
+			return err
+		}
+		_, err = io.Copy(tarWriter, tarReader)
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func FindArtifactUrlsByUuid(uuidToFind string, driver database.DbDriver) ([]string, error) {
@@ -279,33 +411,290 @@ func FindArtifactUrlsByUuid(uuidToFind string, driver database.DbDriver) ([]stri
 	return result_urls, nil
 }
 
-func ExtractTarfiles(tarFileBytes []byte) (map[string][]byte, error) {
-	returnData := make(map[string][]byte)
+// TarfileHeaders reads the headers of the files in a .tar.gz, skipping over
+// their contents
+func TarfileHeaders(r io.Reader) ([]*tar.Header, error) {
+	var headers []*tar.Header
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return headers, err
+	}
+	defer utils.DeferredErrCheck(gzipReader.Close)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return headers, nil
+		}
+		if err != nil { // coverage-ignore
+			return headers, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			headers = append(headers, header)
+		}
+	}
+}
 
-	r := bytes.NewReader(tarFileBytes)
+// ExtractTarfile reads the file called name out of a .tar.gz, without reading
+// any of the other files into memory. Files bigger than maxBytes aren't read
+func ExtractTarfile(r io.Reader, name string, maxBytes int64) ([]byte, error) {
 	gzipReader, err := gzip.NewReader(r)
 	if err != nil {
-		return returnData, err
+		return nil, err
 	}
 	defer utils.DeferredErrCheck(gzipReader.Close)
 	tarReader := tar.NewReader(gzipReader)
-	var maxBytes int64 = 4000000
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
-			break
+			return nil, os.ErrNotExist
 		}
 		if err != nil { // coverage-ignore
-			return returnData, err
+			return nil, err
 		}
-		limFileReader := io.LimitReader(tarReader, maxBytes)
-		data, err := io.ReadAll(limFileReader)
-		if err != nil {
-			return returnData, err
+		if header.Typeflag != tar.TypeReg || header.Name != name {
+			continue
 		}
-		if len(data) != 0 {
-			returnData[filepath.Base(header.Name)] = data
+		if header.Size > maxBytes {
+			return nil, ArtifactFileTooLargeError{path: name, size: header.Size, maxSize: maxBytes}
 		}
+		return io.ReadAll(io.LimitReader(tarReader, maxBytes))
+	}
+}
+
+// ArtifactPaths maps the names of the files in a test's tarball to paths
+// relative to its artifacts directory. The runner tars up the artifacts
+// directory under its absolute path, so the directories every file shares
+// are dropped
+func ArtifactPaths(names []string) map[string]string {
+	paths := make(map[string]string)
+	var common []string
+	for idx, name := range names {
+		parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+		dirs := parts[:len(parts)-1]
+		if idx == 0 {
+			common = dirs
+			continue
+		}
+		shared := 0
+		for shared < len(common) && shared < len(dirs) && common[shared] == dirs[shared] {
+			shared++
+		}
+		common = common[:shared]
+	}
+	for _, name := range names {
+		parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+		paths[name] = strings.Join(parts[len(common):], "/")
+	}
+	return paths
+}
+
+type ArtifactFile struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+}
+
+type ArtifactTree struct {
+	Uuid     string         `json:"uuid"`
+	TestCase string         `json:"test_case"`
+	Files    []ArtifactFile `json:"files"`
+}
+
+func (a ArtifactTree) ToJson() string {
+	b, err := json.Marshal(a)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return string(b)
+}
+
+// FindArtifactUrlForTestCase finds the tarball holding the artifacts of a test
+// case. When a job runs the same test case from more than one plan, the
+// first one with artifacts is used
+func FindArtifactUrlForTestCase(uuidToFind, testCase string, driver database.DbDriver) (string, error) {
+	if _, err := FindJobByUuid(uuidToFind, driver); err != nil {
+		return "", err
+	}
+	rows, err := driver.GetRows(database.Select("tests", "results_url").Where("uuid=?", uuidToFind).Where("test_case=?", testCase).OrderBy("id"))
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	found := false
+	for rows.Next() {
+		found = true
+		var resultsUrl sql.NullString
+		if err = rows.Scan(&resultsUrl); err != nil { // coverage-ignore
+			return "", err
+		}
+		if resultsUrl.String != "" {
+			return resultsUrl.String, nil
+		}
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return "", err
+	}
+	if !found {
+		return "", TestCaseNotFoundError{uuid: uuidToFind, testCase: testCase}
+	}
+	return "", ArtifactsNotFoundError{uuid: uuidToFind, testCase: testCase}
+}
+
+// StreamTestCaseArtifacts copies the .tar.gz of a test case to w as it's
+// downloaded. Nothing is written to w if the download can't be started
+func StreamTestCaseArtifacts(uuidToFind, testCase string, driver database.DbDriver, w io.Writer) error {
+	resultsUrl, err := FindArtifactUrlForTestCase(uuidToFind, testCase, driver)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Get(resultsUrl)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	defer utils.DeferredErrCheck(resp.Body.Close)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %v returned %v", resultsUrl, resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// CachedTestCaseTarball opens the .tar.gz of a test case, downloading it into
+// the cache of its job if it isn't there yet, so browsing the artifacts of a
+// test only downloads them once
+func CachedTestCaseTarball(uuidToFind, testCase string, driver database.DbDriver, gutsCfg GutsApiConfig) (*os.File, error) {
+	resultsUrl, err := FindArtifactUrlForTestCase(uuidToFind, testCase, driver)
+	if err != nil {
+		return nil, err
+	}
+	uuidCacheDir := fmt.Sprintf("%v%v", gutsCfg.Tarball.TarballCachePath, uuidToFind)
+	cachedTarFile := fmt.Sprintf("%v/%v", uuidCacheDir, path.Base(resultsUrl))
+	cachedLastDownloadedFile := fmt.Sprintf("%v/%v.last_downloaded", uuidCacheDir, uuidToFind)
+
+	if !utils.AllFilesExist(uuidCacheDir, cachedTarFile, cachedLastDownloadedFile) {
+		err = utils.CreateDirIfNotExists(gutsCfg.Tarball.TarballCachePath)
+		if err != nil { // coverage-ignore
+			return nil, err
+		}
+		err = utils.CreateDirIfNotExists(uuidCacheDir)
+		if err != nil { // coverage-ignore
+			return nil, err
+		}
+		err = DownloadTarFileTo(resultsUrl, cachedTarFile)
+		if err != nil {
+			// only drop the entry if nothing else, like results.tar.gz, is in it
+			_ = os.Remove(uuidCacheDir)
+			return nil, err
+		}
+	}
+	err = RefreshLastDownloadedFile(cachedLastDownloadedFile)
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	// the tarball stays readable once it's open, even if the retention policy
+	// removes it
+	f, err := os.Open(cachedTarFile)
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	err = CacheRetentionPolicy(gutsCfg.Tarball.TarballCachePath, gutsCfg.Tarball.TarballCacheReductionThreshold, gutsCfg.Tarball.TarballCacheMaxSize)
+	if err != nil { // coverage-ignore
+		return nil, errors.Join(err, f.Close())
+	}
+	return f, nil
+}
+
+// DownloadTarFileTo downloads a tarball straight to filename
+func DownloadTarFileTo(url, filename string) error {
+	resp, err := http.Get(url)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	defer utils.DeferredErrCheck(resp.Body.Close)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %v returned %v", url, resp.StatusCode)
+	}
+	return utils.AtomicWriteFromReader(resp.Body, filename)
+}
+
+// TestCaseArtifactNames maps the paths of the files in the artifacts of a test
+// case to their headers in its tarball
+func TestCaseArtifactNames(f *os.File) (map[string]*tar.Header, error) {
+	headers, err := TarfileHeaders(f)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	artifactPaths := ArtifactPaths(names)
+	artifactNames := make(map[string]*tar.Header)
+	for _, header := range headers {
+		artifactNames[artifactPaths[header.Name]] = header
+	}
+	return artifactNames, nil
+}
+
+// ListTestCaseArtifacts lists the files in the artifacts of a test case
+func ListTestCaseArtifacts(uuidToFind, testCase string, driver database.DbDriver, gutsCfg GutsApiConfig) (ArtifactTree, error) {
+	tree := ArtifactTree{Uuid: uuidToFind, TestCase: testCase, Files: []ArtifactFile{}}
+	f, err := CachedTestCaseTarball(uuidToFind, testCase, driver, gutsCfg)
+	if err != nil {
+		return tree, err
+	}
+	defer utils.DeferredErrCheck(f.Close)
+	artifactNames, err := TestCaseArtifactNames(f)
+	if err != nil {
+		return tree, err
+	}
+	for filePath, header := range artifactNames {
+		tree.Files = append(tree.Files, ArtifactFile{Path: filePath, Size: int(header.Size)})
+	}
+	sort.Slice(tree.Files, func(i, j int) bool {
+		return tree.Files[i].Path < tree.Files[j].Path
+	})
+	return tree, nil
+}
+
+// GetTestCaseArtifactFile gets a single file out of the artifacts of a test
+// case, along with its content type. Files bigger than ArtifactFileMaxSize
+// have to be downloaded with the rest of the artifacts of the test case
+func GetTestCaseArtifactFile(uuidToFind, testCase, filePath string, driver database.DbDriver, gutsCfg GutsApiConfig) ([]byte, string, error) {
+	f, err := CachedTestCaseTarball(uuidToFind, testCase, driver, gutsCfg)
+	if err != nil {
+		return nil, "", err
+	}
+	defer utils.DeferredErrCheck(f.Close)
+	artifactNames, err := TestCaseArtifactNames(f)
+	if err != nil {
+		return nil, "", err
+	}
+	filePath = strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	header, ok := artifactNames[filePath]
+	if !ok {
+		return nil, "", ArtifactFileNotFoundError{testCase: testCase, path: filePath}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil { // coverage-ignore
+		return nil, "", err
+	}
+	data, err := ExtractTarfile(f, header.Name, ArtifactFileMaxSize)
+	if errors.As(err, &ArtifactFileTooLargeError{}) {
+		return nil, "", ArtifactFileTooLargeError{path: filePath, size: header.Size, maxSize: ArtifactFileMaxSize}
+	}
+	if err != nil { // coverage-ignore
+		return nil, "", err
+	}
+	return data, ArtifactContentType(filePath, data), nil
+}
+
+// ArtifactContentType goes by the file extension, and sniffs the content of
+// files with an extension it doesn't know
+func ArtifactContentType(filePath string, data []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+		return contentType
 	}
-	return returnData, nil
+	return http.DetectContentType(data)
 }
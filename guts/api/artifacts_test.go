@@ -1,23 +1,27 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
+	"io"
 	"os"
 	"os/exec"
 	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestFindArtifactUrlsByUuid(t *testing.T) {
 	Uuid := "eccd3988-490d-4414-be97-605d1ac81073"
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -41,18 +45,21 @@ func TestCollateArtifacts(t *testing.T) {
 
 	// Get output artifacts for given uuid
 	Uuid := "27549483-e8f5-497f-a05d-e6d8e67a8e8a"
-	GutsCfg, Driver, _, err := Setup()
+	GutsCfg, _, _, err := Setup()
+	utils.CheckError(err)
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
 		utils.CheckError(err)
 	}
-	artifactsTarGz, err := CollateArtifacts(Uuid, Driver, GutsCfg)
-	utils.CheckError(err)
-
-	// Write the tar to a file
+	// Stream the tar to a file
 	tempTarName := "/tmp/test-tar.tar.gz"
-	err = os.WriteFile(tempTarName, artifactsTarGz, 0644)
+	f, err := os.Create(tempTarName)
+	utils.CheckError(err)
+	err = CollateArtifacts(Uuid, Driver, GutsCfg, f)
+	utils.CheckError(err)
+	err = f.Close()
 	utils.CheckError(err)
 
 	if _, err := os.Stat(tempTarName); errors.Is(err, os.ErrNotExist) {
@@ -90,7 +97,9 @@ func TestCollateArtifacts(t *testing.T) {
 
 func TestCollateArtifactsDownloadFails(t *testing.T) {
 	Uuid := "44eea936-1e4a-4e20-b25d-ab0df9978ada"
-	GutsCfg, Driver, _, err := Setup()
+	GutsCfg, _, _, err := Setup()
+	utils.CheckError(err)
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -100,9 +109,11 @@ func TestCollateArtifactsDownloadFails(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
 
-	artifactsTarGz, err := CollateArtifacts(Uuid, Driver, GutsCfg)
-	if len(artifactsTarGz) != 0 {
-		t.Errorf("Variable should have length 0 but instead has length %v", len(artifactsTarGz))
+	var artifactsTarGz bytes.Buffer
+	err = CollateArtifacts(Uuid, Driver, GutsCfg, &artifactsTarGz)
+	// nothing should have been sent before the download failed
+	if artifactsTarGz.Len() != 0 {
+		t.Errorf("Variable should have length 0 but instead has length %v", artifactsTarGz.Len())
 	}
 	expectedErrString := "gzip: invalid header"
 	if !reflect.DeepEqual(err.Error(), expectedErrString) {
@@ -139,8 +150,27 @@ func TestDownloadTarFiles(t *testing.T) {
 		"http://localhost:9999/res-2.tar.gz",
 		"http://localhost:9999/res-3.tar.gz",
 	}
-	_, err := DownloadTarFiles(artifactUrls)
-	utils.CheckError(err)
+	tarballs := DownloadTarFiles(context.Background(), artifactUrls, 2)
+	for _, tarball := range tarballs {
+		downloaded := <-tarball
+		utils.CheckError(downloaded.Err)
+		utils.CheckError(os.Remove(downloaded.Path))
+	}
+}
+
+func TestDownloadTarFileTo(t *testing.T) {
+	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
+	defer utils.DeferredErrCheck(servingProcess.Kill)
+
+	filename := fmt.Sprintf("%v/res-1.tar.gz", t.TempDir())
+	utils.CheckError(DownloadTarFileTo("http://localhost:9999/res-1.tar.gz", filename))
+	utils.CheckError(utils.FileOrDirExists(filename))
+
+	err := DownloadTarFileTo("http://localhost:9999/does-not-exist.tar.gz", filename)
+	expectedErrString := "downloading http://localhost:9999/does-not-exist.tar.gz returned 404"
+	if err == nil || err.Error() != expectedErrString {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedErrString, err)
+	}
 }
 
 func TestCreateOutputDirectoriesFromUrlsEmptyUrls(t *testing.T) {
@@ -170,7 +200,8 @@ func TestDownloadTarFilesFails(t *testing.T) {
 	artifactUrls := []string{
 		"http://localhost:9998/does-not-exist.tar.gz",
 	}
-	_, err := DownloadTarFiles(artifactUrls)
+	tarballs := DownloadTarFiles(context.Background(), artifactUrls, 2)
+	err := (<-tarballs[0]).Err
 	expectedErrString := "connect: connection refused"
 	if err == nil {
 		t.Errorf("Downloading non-existent tar files unexpectedly succeeded!")
@@ -180,13 +211,13 @@ func TestDownloadTarFilesFails(t *testing.T) {
 	}
 }
 
-func TestTarUpFilesInGivenDirectoriesInputValidation(t *testing.T) {
-	allFilesMaps := make([]map[string][]byte, 10)
+func TestMergeTarFilesInputValidation(t *testing.T) {
+	tarballs := make([]chan DownloadedTarball, 10)
 	dirsForFiles := []string{
 		"Philip",
 		"Hubert",
 	}
-	_, err := TarUpFilesInGivenDirectories(dirsForFiles, allFilesMaps)
+	err := MergeTarFiles(dirsForFiles, tarballs, io.Discard)
 	expectedErrString := "length of variables doesn't add up"
 	if !reflect.DeepEqual(err.Error(), expectedErrString) {
 		t.Errorf("Unexpected err string!\nExpected: %v\nActual: %v", expectedErrString, err.Error())
@@ -195,7 +226,7 @@ func TestTarUpFilesInGivenDirectoriesInputValidation(t *testing.T) {
 
 func TestFindArtifactUrlsByUuidFails(t *testing.T) {
 	Uuid := "?"
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -289,7 +320,7 @@ func PopulateCacheDummyData(GutsCfg GutsApiConfig) error {
 		tarball := make([]byte, 999)
 		_, err = rand.Read(tarball)
 		utils.CheckError(err)
-		err = WriteTarballToCache(tarball, thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
+		err = WriteTarballToCache(bytes.NewReader(tarball), thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
 		utils.CheckError(err)
 		dirSize, err = utils.GetDirSize(GutsCfg.Tarball.TarballCachePath)
 		if err != nil {
@@ -309,45 +340,111 @@ func TestWriteTarballToCacheAlreadyExists(t *testing.T) {
 	tarball := make([]byte, 999)
 	_, err = rand.Read(tarball)
 	utils.CheckError(err)
-	err = WriteTarballToCache(tarball, thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
+	err = WriteTarballToCache(bytes.NewReader(tarball), thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
 	utils.CheckError(err)
 	// okay, now it's written ... run again and ensure no failure?
-	err = WriteTarballToCache(tarball, thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
+	err = WriteTarballToCache(bytes.NewReader(tarball), thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
 	utils.CheckError(err)
 }
 
-func TestTarUpFilesInGivenDirectories(t *testing.T) {
-	// create the desired directories
-	fileDirs := []string{"dir1", "dir2", "dir3"}
-	// create the slice of maps of files for each directory
-	myMap := make([]map[string][]byte, 3)
-	// Create a map for each directory
-	// var mapFiles map[string][]byte
-	mapFiles := make(map[string][]byte)
-	mapFiles["file1"] = make([]byte, 99)
-	_, err := rand.Read(mapFiles["file1"])
-	utils.CheckError(err)
-	mapFiles["file2"] = make([]byte, 99)
-	_, err = rand.Read(mapFiles["file2"])
-	utils.CheckError(err)
-	mapFiles["file3"] = make([]byte, 99)
-	_, err = rand.Read(mapFiles["file3"])
-	utils.CheckError(err)
-	// Insert map into slice
-	myMap[0] = mapFiles
-	myMap[1] = mapFiles
-	myMap[2] = mapFiles
-	// Tar up the files
-	tarBytes, err := TarUpFilesInGivenDirectories(fileDirs, myMap)
+func TestWriteTarballToCacheKeepsTestCaseTarballs(t *testing.T) {
+	thisUuid := uuid.New().String()
+	thisDir := fmt.Sprintf("%v/%v", t.TempDir(), thisUuid)
+	utils.CheckError(os.Mkdir(thisDir, 0755))
+	testCaseTarball := fmt.Sprintf("%v/test-case.tar.gz", thisDir)
+	utils.CheckError(os.WriteFile(testCaseTarball, []byte("test case"), 0644))
+
+	err := WriteTarballToCache(bytes.NewReader([]byte("results")), thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
 	utils.CheckError(err)
+	if !utils.AllFilesExist(testCaseTarball) {
+		t.Errorf("%v was removed when writing results.tar.gz", testCaseTarball)
+	}
+
+	err = WriteTarballToCache(iotest.ErrReader(errors.New("read failed")), thisUuid, thisDir, fmt.Sprintf("%v/other.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
+	if err == nil {
+		t.Errorf("writing an unreadable tarball should fail")
+	}
+	if !utils.AllFilesExist(testCaseTarball) {
+		t.Errorf("%v was removed after a failed write", testCaseTarball)
+	}
+}
+
+func TestWriteTarballToCacheFailureRemovesEmptyEntry(t *testing.T) {
+	thisUuid := uuid.New().String()
+	thisDir := fmt.Sprintf("%v/%v", t.TempDir(), thisUuid)
+	err := WriteTarballToCache(iotest.ErrReader(errors.New("read failed")), thisUuid, thisDir, fmt.Sprintf("%v/results.tar.gz", thisDir), fmt.Sprintf("%v/%v.last_downloaded", thisDir, thisUuid))
+	if err == nil {
+		t.Errorf("writing an unreadable tarball should fail")
+	}
+	if utils.AllFilesExist(thisDir) {
+		t.Errorf("%v was left behind after a failed write", thisDir)
+	}
+}
+
+func TestCacheRetentionPolicySkipsIncompleteEntries(t *testing.T) {
+	cacheDir := t.TempDir()
+	completeUuid := uuid.New().String()
+	incompleteUuid := uuid.New().String()
+	for _, thisUuid := range []string{completeUuid, incompleteUuid} {
+		utils.CheckError(os.Mkdir(fmt.Sprintf("%v/%v", cacheDir, thisUuid), 0755))
+		utils.CheckError(os.WriteFile(fmt.Sprintf("%v/%v/results.tar.gz", cacheDir, thisUuid), make([]byte, 1000), 0644))
+	}
+	utils.CheckError(os.WriteFile(fmt.Sprintf("%v/%v/%v.last_downloaded", cacheDir, completeUuid, completeUuid), []byte("1"), 0644))
+
+	err := CacheRetentionPolicy(cacheDir, 100, 200)
+	utils.CheckError(err)
+	if utils.AllFilesExist(fmt.Sprintf("%v/%v", cacheDir, completeUuid)) {
+		t.Errorf("complete entry %v should have been evicted", completeUuid)
+	}
+	if !utils.AllFilesExist(fmt.Sprintf("%v/%v", cacheDir, incompleteUuid)) {
+		t.Errorf("incomplete entry %v should have been skipped", incompleteUuid)
+	}
+}
+
+// MakeDownloadedTarball writes a .tar.gz of files with random contents, as if
+// it had just been downloaded
+func MakeDownloadedTarball(fileNames ...string) chan DownloadedTarball {
+	dir, err := os.MkdirTemp("", "artifacts")
+	utils.CheckError(err)
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, dir)
+	for _, fileName := range fileNames {
+		data := make([]byte, 99)
+		_, err = rand.Read(data)
+		utils.CheckError(err)
+		utils.CheckError(os.WriteFile(fmt.Sprintf("%v/%v", dir, fileName), data, 0644))
+	}
+	tarBytes, err := utils.TarUpDirectory(dir)
+	utils.CheckError(err)
+	gzippedTarBytes, err := utils.GzipTarArchiveBytes(tarBytes)
+	utils.CheckError(err)
+	f, err := os.CreateTemp("", "artifacts-*.tar.gz")
+	utils.CheckError(err)
+	_, err = f.Write(gzippedTarBytes)
+	utils.CheckError(err)
+	utils.CheckError(f.Close())
+
+	tarball := make(chan DownloadedTarball, 1)
+	tarball <- DownloadedTarball{Path: f.Name()}
+	close(tarball)
+	return tarball
+}
+
+func TestMergeTarFiles(t *testing.T) {
+	fileDirs := []string{"dir1", "dir2", "dir3"}
+	tarballs := []chan DownloadedTarball{
+		MakeDownloadedTarball("file1", "file2", "file3"),
+		MakeDownloadedTarball("file1", "file2", "file3"),
+		MakeDownloadedTarball("file1", "file2", "file3"),
+	}
 	// write to a tempfile
 	f, err := os.CreateTemp("", "tarfile")
 	utils.CheckError(err)
 	defer utils.DeferredErrCheckStringArg(os.Remove, f.Name())
-	_, err = f.Write(tarBytes)
+	err = MergeTarFiles(fileDirs, tarballs, f)
 	utils.CheckError(err)
+	utils.CheckError(f.Close())
 	// extract list of files in archive
-	out, err := exec.Command("tar", "-tf", f.Name()).Output()
+	out, err := exec.Command("tar", "-tzf", f.Name()).Output()
 	utils.CheckError(err)
 	// compare to expected archive
 	// The order of output from tar -tf isn't consistent, so we can't rely on the string
@@ -360,3 +457,209 @@ func TestTarUpFilesInGivenDirectories(t *testing.T) {
 		t.Errorf("Expected archive not the same as actual!\nExpected: %v\nActual: %v", expectedArchive, actualArchive)
 	}
 }
+
+func TestMergeTarFilesDownloadFails(t *testing.T) {
+	failed := make(chan DownloadedTarball, 1)
+	failed <- DownloadedTarball{Err: errors.New("connection reset by peer")}
+	tarballs := []chan DownloadedTarball{
+		failed,
+		MakeDownloadedTarball("file1"),
+	}
+	var merged bytes.Buffer
+	err := MergeTarFiles([]string{"dir1", "dir2"}, tarballs, &merged)
+	if err == nil {
+		t.Errorf("Merging a failed download unexpectedly succeeded!")
+	}
+	if merged.Len() != 0 {
+		t.Errorf("Nothing should be written when the first tarball fails, but got %v bytes", merged.Len())
+	}
+	RemoveDownloadedTarFiles(tarballs[1:])
+}
+
+func TestArtifactPaths(t *testing.T) {
+	names := []string{
+		"/tmp/artifacts123/output.xml",
+		"/tmp/artifacts123/screenshots/1.png",
+		"/tmp/artifacts123/screenshots/2.png",
+	}
+	expectedPaths := map[string]string{
+		"/tmp/artifacts123/output.xml":        "output.xml",
+		"/tmp/artifacts123/screenshots/1.png": "screenshots/1.png",
+		"/tmp/artifacts123/screenshots/2.png": "screenshots/2.png",
+	}
+	paths := ArtifactPaths(names)
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Unexpected artifact paths!\nExpected: %v\nActual: %v", expectedPaths, paths)
+	}
+}
+
+func TestExtractTarfile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "artifacts")
+	utils.CheckError(err)
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, dir)
+	utils.CheckError(os.Mkdir(fmt.Sprintf("%v/screenshots", dir), 0755))
+	utils.CheckError(os.WriteFile(fmt.Sprintf("%v/output.xml", dir), []byte("<robot/>"), 0644))
+	utils.CheckError(os.WriteFile(fmt.Sprintf("%v/screenshots/1.png", dir), []byte("not really a png"), 0644))
+	tarBytes, err := utils.TarUpDirectory(dir)
+	utils.CheckError(err)
+	gzippedTarBytes, err := utils.GzipTarArchiveBytes(tarBytes)
+	utils.CheckError(err)
+
+	headers, err := TarfileHeaders(bytes.NewReader(gzippedTarBytes))
+	utils.CheckError(err)
+	sizes := make(map[string]int64)
+	for _, header := range headers {
+		sizes[header.Name] = header.Size
+	}
+	outputXml := fmt.Sprintf("%v/output.xml", dir)
+	screenshot := fmt.Sprintf("%v/screenshots/1.png", dir)
+	expectedSizes := map[string]int64{outputXml: 8, screenshot: 16}
+	if !reflect.DeepEqual(sizes, expectedSizes) {
+		t.Errorf("Unexpected tarball headers!\nExpected: %v\nActual: %v", expectedSizes, sizes)
+	}
+
+	data, err := ExtractTarfile(bytes.NewReader(gzippedTarBytes), screenshot, 16)
+	utils.CheckError(err)
+	if string(data) != "not really a png" {
+		t.Errorf("Unexpected extracted file!\nExpected: %v\nActual: %v", "not really a png", string(data))
+	}
+
+	// the file is too large to be read into memory
+	_, err = ExtractTarfile(bytes.NewReader(gzippedTarBytes), screenshot, 15)
+	expectedErr := ArtifactFileTooLargeError{path: screenshot, size: 16, maxSize: 15}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedErr, err)
+	}
+
+	_, err = ExtractTarfile(bytes.NewReader(gzippedTarBytes), fmt.Sprintf("%v/log.html", dir), 16)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", os.ErrNotExist, err)
+	}
+
+	// neither can read something that isn't a .tar.gz
+	_, err = TarfileHeaders(bytes.NewReader(tarBytes))
+	if err == nil {
+		t.Errorf("Reading the headers of an uncompressed tarball unexpectedly succeeded!")
+	}
+	_, err = ExtractTarfile(bytes.NewReader(tarBytes), screenshot, 16)
+	if err == nil {
+		t.Errorf("Extracting from an uncompressed tarball unexpectedly succeeded!")
+	}
+}
+
+func TestArtifactContentType(t *testing.T) {
+	expectedTypes := map[string]string{
+		"output.xml":        "text/xml; charset=utf-8",
+		"log.html":          "text/html; charset=utf-8",
+		"screenshots/1.png": "image/png",
+		"yarf.log-unknown":  "text/plain; charset=utf-8",
+	}
+	for filePath, expectedType := range expectedTypes {
+		contentType := ArtifactContentType(filePath, []byte("Good news, everyone!"))
+		if contentType != expectedType {
+			t.Errorf("Unexpected content type for %v!\nExpected: %v\nActual: %v", filePath, expectedType, contentType)
+		}
+	}
+}
+
+func TestArtifactTreeToJson(t *testing.T) {
+	tree := ArtifactTree{
+		Uuid:     "27549483-e8f5-497f-a05d-e6d8e67a8e8a",
+		TestCase: "Farnsworth-Basic-1",
+		Files:    []ArtifactFile{{Path: "output.xml", Size: 8}},
+	}
+	expectedJson := `{"uuid":"27549483-e8f5-497f-a05d-e6d8e67a8e8a","test_case":"Farnsworth-Basic-1","files":[{"path":"output.xml","size":8}]}`
+	if tree.ToJson() != expectedJson {
+		t.Errorf("Unexpected json!\nExpected: %v\nActual: %v", expectedJson, tree.ToJson())
+	}
+}
+
+func TestFindArtifactUrlForTestCase(t *testing.T) {
+	Uuid := "27549483-e8f5-497f-a05d-e6d8e67a8e8a"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	resultsUrl, err := FindArtifactUrlForTestCase(Uuid, "Farnsworth-Basic-2", Driver)
+	utils.CheckError(err)
+	expectedUrl := "http://localhost:9999/res-2.tar.gz"
+	if resultsUrl != expectedUrl {
+		t.Errorf("Unexpected results url!\nExpected: %v\nActual: %v", expectedUrl, resultsUrl)
+	}
+
+	_, err = FindArtifactUrlForTestCase(Uuid, "Slurm-Basic", Driver)
+	expectedErr := TestCaseNotFoundError{uuid: Uuid, testCase: "Slurm-Basic"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedErr, err)
+	}
+}
+
+func TestListTestCaseArtifacts(t *testing.T) {
+	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
+
+	Uuid := "27549483-e8f5-497f-a05d-e6d8e67a8e8a"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		utils.CheckError(servingProcess.Kill())
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	var gutsCfg GutsApiConfig
+	gutsCfg.Tarball.TarballCachePath = t.TempDir() + "/"
+	gutsCfg.Tarball.TarballCacheMaxSize = 1000000
+	gutsCfg.Tarball.TarballCacheReductionThreshold = 500000
+
+	tree, err := ListTestCaseArtifacts(Uuid, "Farnsworth-Basic-1", Driver, gutsCfg)
+	utils.CheckError(err)
+
+	var filePaths []string
+	for _, file := range tree.Files {
+		filePaths = append(filePaths, file.Path)
+	}
+	expectedPaths := []string{"log.html", "output.xml", "report.html"}
+	if !reflect.DeepEqual(filePaths, expectedPaths) {
+		t.Errorf("Unexpected artifact files!\nExpected: %v\nActual: %v", expectedPaths, filePaths)
+	}
+
+	// the tarball was cached when the files were listed, so it isn't
+	// downloaded again
+	utils.CheckError(servingProcess.Kill())
+	_, _ = servingProcess.Wait()
+
+	_, contentType, err := GetTestCaseArtifactFile(Uuid, "Farnsworth-Basic-1", "/output.xml", Driver, gutsCfg)
+	utils.CheckError(err)
+	if contentType != "text/xml; charset=utf-8" {
+		t.Errorf("Unexpected content type!\nExpected: %v\nActual: %v", "text/xml; charset=utf-8", contentType)
+	}
+
+	_, _, err = GetTestCaseArtifactFile(Uuid, "Farnsworth-Basic-1", "/screenshots/slurm.png", Driver, gutsCfg)
+	expectedErr := ArtifactFileNotFoundError{testCase: "Farnsworth-Basic-1", path: "screenshots/slurm.png"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedErr, err)
+	}
+
+	defer func(maxSize int64) { ArtifactFileMaxSize = maxSize }(ArtifactFileMaxSize)
+	ArtifactFileMaxSize = 1
+	_, _, err = GetTestCaseArtifactFile(Uuid, "Farnsworth-Basic-1", "/output.xml", Driver, gutsCfg)
+	if !errors.As(err, &ArtifactFileTooLargeError{}) {
+		t.Errorf("Unexpected error!\nExpected: ArtifactFileTooLargeError\nActual: %v", err)
+	}
+
+	// the tarballs of other test cases still have to be downloaded
+	_, err = ListTestCaseArtifacts(Uuid, "Farnsworth-Basic-2", Driver, gutsCfg)
+	if err == nil {
+		t.Errorf("Listing artifacts that can't be downloaded unexpectedly succeeded!")
+	}
+	_, _, err = GetTestCaseArtifactFile(Uuid, "Slurm-Basic", "/output.xml", Driver, gutsCfg)
+	expectedTestCaseErr := TestCaseNotFoundError{uuid: Uuid, testCase: "Slurm-Basic"}
+	if !reflect.DeepEqual(err, expectedTestCaseErr) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedTestCaseErr, err)
+	}
+	_, err = ListTestCaseArtifacts(Uuid, "Slurm-Basic", Driver, gutsCfg)
+	if !reflect.DeepEqual(err, expectedTestCaseErr) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", expectedTestCaseErr, err)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"slices"
+	"time"
+)
+
+var (
+	FinishedJobStatuses = []string{"pass", "fail", "cancelled", "flaky"}
+	// the states of tests that are still to run, or running
+	UnfinishedTestStates = []string{"requested", "spawning", "spawned", "running"}
+)
+
+// Don't need to test this directly, it's tested by listener_test.go
+func CancelJob(apiKey, uuidToCancel string, driver database.DbDriver) (string, error) { // coverage-ignore
+	if apiKey == "" {
+		return "", EmptyApiKeyError{}
+	}
+	shakey := utils.Sha256sumOfString(apiKey)
+	userData, err := GetAuthDataForKey(shakey, driver)
+	if err != nil {
+		return "", ApiKeyNotAcceptedError{}
+	}
+	job, err := FindJobByUuid(uuidToCancel, driver)
+	if err != nil {
+		return "", err
+	}
+	if err = AssertJobCancellable(job, userData); err != nil {
+		return "", err
+	}
+	if err = SetJobCancelled(uuidToCancel, driver); err != nil {
+		return "", err
+	}
+	returnJson := fmt.Sprintf(`{"uuid": "%v", "status": "cancelled"}`, uuidToCancel)
+	return returnJson, nil
+}
+
+func AssertJobCancellable(job JobEntry, uData UserData) error {
+	// only the requester of a job may cancel it
+	if job.Requester != uData.Username {
+		return JobNotOwnedError{uuid: job.Uuid, username: uData.Username}
+	}
+	if slices.Contains(FinishedJobStatuses, job.Status) {
+		return JobAlreadyFinishedError{uuid: job.Uuid, status: job.Status}
+	}
+	return nil
+}
+
+// SetJobCancelled cancels a job along with its unfinished tests, all at once
+// or not at all
+func SetJobCancelled(uuidToCancel string, driver database.DbDriver) error {
+	return driver.WithTx(context.Background(), func(tx database.DbDriver) error {
+		_, err := tx.Exec(database.Update("jobs").Set("status", "cancelled").Where("uuid=?", uuidToCancel))
+		if err != nil { // coverage-ignore
+			return err
+		}
+
+		// the spawner and runner notice this state change during their
+		// heartbeat loops, and tear down the VM and yarf process respectively.
+		// Tests that are done already keep their outcome
+		_, err = tx.Exec(database.Update("tests").
+			Set("state", "cancelled").
+			Set("updated_at", time.Now()).
+			Where("uuid=?", uuidToCancel).
+			WhereIn("state", UnfinishedTestStates))
+		return err
+	})
+}
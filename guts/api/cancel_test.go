@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAssertJobCancellable(t *testing.T) {
+	var job JobEntry
+	job.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+	job.Requester = "andersson123"
+	job.Status = "running"
+	var uData UserData
+	uData.Username = "andersson123"
+
+	err := AssertJobCancellable(job, uData)
+	if err != nil {
+		t.Errorf("job should be cancellable but got: %v", err.Error())
+	}
+}
+
+func TestAssertJobCancellableNotOwned(t *testing.T) {
+	var job JobEntry
+	job.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+	job.Requester = "andersson123"
+	job.Status = "running"
+	var uData UserData
+	uData.Username = "farnsworth"
+
+	err := AssertJobCancellable(job, uData)
+	expectedErr := JobNotOwnedError{uuid: job.Uuid, username: uData.Username}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
+
+func TestAssertJobCancellableAlreadyFinished(t *testing.T) {
+	var job JobEntry
+	job.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+	job.Requester = "andersson123"
+	var uData UserData
+	uData.Username = "andersson123"
+
+	for _, status := range FinishedJobStatuses {
+		job.Status = status
+		err := AssertJobCancellable(job, uData)
+		expectedErr := JobAlreadyFinishedError{uuid: job.Uuid, status: status}
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+		}
+	}
+}
+
+func TestSetJobCancelled(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	andersson123KeyPreSha := "4c126f75-c7d8-4a89-9370-f065e7ff4208"
+	andersson123Key := utils.Sha256sumOfString(andersson123KeyPreSha)
+	timData, err := GetAuthDataForKey(andersson123Key, Driver)
+	utils.CheckError(err)
+
+	jobEntry := CreateJobEntry(MakeDummyJobReq(), timData)
+	err = WriteJobEntryToDb(jobEntry, "", Driver)
+	utils.CheckError(err)
+
+	// cancelling in a transaction that's rolled back leaves the job be
+	tx, err := Driver.BeginTx(context.Background())
+	utils.CheckError(err)
+	utils.CheckError(SetJobCancelled(jobEntry.Uuid, tx.DbDriver))
+	utils.CheckError(tx.Rollback())
+	job, err := FindJobByUuid(jobEntry.Uuid, Driver)
+	utils.CheckError(err)
+	if job.Status == "cancelled" {
+		t.Errorf("the cancellation of %v should have been rolled back", jobEntry.Uuid)
+	}
+
+	// a test in each state, cancelled an hour ago if it's cancelled already
+	schedulerDriver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(schedulerDriver.NukeUuid(jobEntry.Uuid))
+	}()
+	anHourAgo := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	testStates := []string{"requested", "spawning", "spawned", "running", "pass", "fail", "cancelled"}
+	for _, state := range testStates {
+		utils.CheckError(schedulerDriver.UpdateRow(`INSERT INTO tests (uuid, test_case, state, updated_at) VALUES ($1, $2, $3, $4)`, jobEntry.Uuid, state, state, anHourAgo))
+	}
+
+	err = SetJobCancelled(jobEntry.Uuid, Driver)
+	utils.CheckError(err)
+
+	job, err = FindJobByUuid(jobEntry.Uuid, Driver)
+	utils.CheckError(err)
+
+	// only the unfinished tests are cancelled, the others keep their outcome
+	// and when they got it
+	expectedStates := map[string]string{
+		"requested": "cancelled",
+		"spawning":  "cancelled",
+		"spawned":   "cancelled",
+		"running":   "cancelled",
+		"pass":      "pass",
+		"fail":      "fail",
+		"cancelled": "cancelled",
+	}
+	for testCase, expectedState := range expectedStates {
+		row, err := schedulerDriver.GetRow(database.Select("tests", "state", "updated_at").Where("uuid=?", jobEntry.Uuid).Where("test_case=?", testCase))
+		utils.CheckError(err)
+		var state string
+		var updatedAt time.Time
+		utils.CheckError(row.Scan(&state, &updatedAt))
+		if state != expectedState {
+			t.Errorf("unexpected state of the %v test!\nexpected: %v\nactual: %v", testCase, expectedState, state)
+		}
+		if !slices.Contains(UnfinishedTestStates, testCase) && !updatedAt.Equal(anHourAgo) {
+			t.Errorf("the finished %v test shouldn't have been touched, but was updated at %v", testCase, updatedAt)
+		}
+	}
+
+	expectedStatus := "cancelled"
+	if job.Status != expectedStatus {
+		t.Errorf("unexpected job status!\nexpected: %v\nactual: %v", expectedStatus, job.Status)
+	}
+}
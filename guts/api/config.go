@@ -24,7 +24,9 @@ type GutsApiConfig struct {
 		TarballCachePath               string `yaml:"tarball_cache_path"`
 		TarballCacheMaxSize            int    `yaml:"tarball_cache_max_size"`            // in bytes
 		TarballCacheReductionThreshold int    `yaml:"tarball_cache_reduction_threshold"` // in bytes
+		TarballDownloadWorkers         int    `yaml:"tarball_download_workers"`          // concurrent downloads per request
 	}
+	Testbeds []TestbedAlias `yaml:"testbeds"`
 }
 
 func Setup() (GutsApiConfig, database.DbDriver, ApiArgs, error) {
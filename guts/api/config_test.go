@@ -27,6 +27,19 @@ func TestParseConfigSuccess(t *testing.T) {
 	wanted.Tarball.TarballCachePath = "/srv/tarball-cache/"
 	wanted.Tarball.TarballCacheMaxSize = 10737418240
 	wanted.Tarball.TarballCacheReductionThreshold = 9663676416
+	wanted.Tarball.TarballDownloadWorkers = 4
+	wanted.Testbeds = []TestbedAlias{
+		{
+			Name:        "{release}-desktop-daily",
+			Url:         "https://cdimage.ubuntu.com/{release}/daily-live/current/{release}-desktop-amd64.iso",
+			Description: "Latest daily build of Ubuntu Desktop for a release",
+		},
+		{
+			Name:        "noble-desktop",
+			Url:         "https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso",
+			Description: "Ubuntu Desktop 24.04.3 LTS",
+		},
+	}
 	if !reflect.DeepEqual(GutsCfg, wanted) {
 		t.Errorf("Parsed config not the same as wanted config!\nExpected:\n%v\nActual:\n%v", GutsCfg, wanted)
 	}
@@ -49,6 +49,15 @@ func (p PlanFileNonexistentError) Error() string {
 	return fmt.Sprintf("Plan file %v doesn't exist!", p.planFile)
 }
 
+type InvalidReportingUrlError struct {
+	reporter string
+	url      string
+}
+
+func (i InvalidReportingUrlError) Error() string {
+	return fmt.Sprintf("Reporter %v needs a reporting_url to report to, %q isn't a valid url", i.reporter, i.url)
+}
+
 type InvalidArtifactTypeError struct {
 	url string
 }
@@ -56,3 +65,85 @@ type InvalidArtifactTypeError struct {
 func (i InvalidArtifactTypeError) Error() string {
 	return fmt.Sprintf("url %v contains an invalid artifact type", i.url)
 }
+
+type JobNotOwnedError struct {
+	uuid     string
+	username string
+}
+
+func (j JobNotOwnedError) Error() string {
+	return fmt.Sprintf("Job %v wasn't requested by %v", j.uuid, j.username)
+}
+
+type JobAlreadyFinishedError struct {
+	uuid   string
+	status string
+}
+
+func (j JobAlreadyFinishedError) Error() string {
+	return fmt.Sprintf("Job %v has already finished with status %v", j.uuid, j.status)
+}
+
+type InvalidQueryParameterError struct {
+	param string
+	value string
+}
+
+func (i InvalidQueryParameterError) Error() string {
+	return fmt.Sprintf("Invalid value %v for query parameter %v", i.value, i.param)
+}
+
+type TestCaseNotFoundError struct {
+	uuid     string
+	testCase string
+}
+
+func (t TestCaseNotFoundError) Error() string {
+	return fmt.Sprintf("No test case %v found for job %v", t.testCase, t.uuid)
+}
+
+type TestNotViewableError struct {
+	uuid     string
+	testCase string
+	state    string
+}
+
+func (t TestNotViewableError) Error() string {
+	return fmt.Sprintf("Test case %v of job %v has no running VM to view, its state is %v", t.testCase, t.uuid, t.state)
+}
+
+type ArtifactsNotFoundError struct {
+	uuid     string
+	testCase string
+}
+
+func (a ArtifactsNotFoundError) Error() string {
+	return fmt.Sprintf("Test case %v of job %v has no artifacts yet", a.testCase, a.uuid)
+}
+
+type ArtifactFileNotFoundError struct {
+	testCase string
+	path     string
+}
+
+func (a ArtifactFileNotFoundError) Error() string {
+	return fmt.Sprintf("No file %v in the artifacts of test case %v", a.path, a.testCase)
+}
+
+type ArtifactFileTooLargeError struct {
+	path    string
+	size    int64
+	maxSize int64
+}
+
+func (a ArtifactFileTooLargeError) Error() string {
+	return fmt.Sprintf("File %v is %v bytes, more than the %v bytes that can be served on its own, download the artifacts of the test case instead", a.path, a.size, a.maxSize)
+}
+
+type UnknownTestbedError struct {
+	testbed string
+}
+
+func (u UnknownTestbedError) Error() string {
+	return fmt.Sprintf("Testbed %v is neither a url nor a known alias, see /testbeds for the aliases", u.testbed)
+}
@@ -54,6 +54,14 @@ func TestPlanFileNonexistentError(t *testing.T) {
 	}
 }
 
+func TestInvalidReportingUrlError(t *testing.T) {
+	urlErr := InvalidReportingUrlError{reporter: "test_observer", url: "tests-api"}
+	desiredErrString := `Reporter test_observer needs a reporting_url to report to, "tests-api" isn't a valid url`
+	if urlErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, urlErr.Error())
+	}
+}
+
 func TestInvalidArtifactTypeError(t *testing.T) {
 	artifactErr := InvalidArtifactTypeError{url: "https://central-bureaucracy.gov/hello.rpm"}
 	desiredErrString := "url https://central-bureaucracy.gov/hello.rpm contains an invalid artifact type"
@@ -61,3 +69,75 @@ func TestInvalidArtifactTypeError(t *testing.T) {
 		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, artifactErr.Error())
 	}
 }
+
+func TestJobNotOwnedError(t *testing.T) {
+	ownerErr := JobNotOwnedError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", username: "zoidberg"}
+	desiredErrString := "Job 4ce9189f-561a-4886-aeef-1836f28b073b wasn't requested by zoidberg"
+	if ownerErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, ownerErr.Error())
+	}
+}
+
+func TestJobAlreadyFinishedError(t *testing.T) {
+	finishedErr := JobAlreadyFinishedError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", status: "pass"}
+	desiredErrString := "Job 4ce9189f-561a-4886-aeef-1836f28b073b has already finished with status pass"
+	if finishedErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, finishedErr.Error())
+	}
+}
+
+func TestInvalidQueryParameterError(t *testing.T) {
+	paramErr := InvalidQueryParameterError{param: "status", value: "exploded"}
+	desiredErrString := "Invalid value exploded for query parameter status"
+	if paramErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, paramErr.Error())
+	}
+}
+
+func TestTestCaseNotFoundError(t *testing.T) {
+	testCaseErr := TestCaseNotFoundError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", testCase: "Slurm-Basic"}
+	desiredErrString := "No test case Slurm-Basic found for job 4ce9189f-561a-4886-aeef-1836f28b073b"
+	if testCaseErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, testCaseErr.Error())
+	}
+}
+
+func TestTestNotViewableError(t *testing.T) {
+	viewErr := TestNotViewableError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", testCase: "Firefox-Example-Basic", state: "requested"}
+	desiredErrString := "Test case Firefox-Example-Basic of job 4ce9189f-561a-4886-aeef-1836f28b073b has no running VM to view, its state is requested"
+	if viewErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, viewErr.Error())
+	}
+}
+
+func TestArtifactsNotFoundError(t *testing.T) {
+	artifactsErr := ArtifactsNotFoundError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", testCase: "Firefox-Example-Basic"}
+	desiredErrString := "Test case Firefox-Example-Basic of job 4ce9189f-561a-4886-aeef-1836f28b073b has no artifacts yet"
+	if artifactsErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, artifactsErr.Error())
+	}
+}
+
+func TestArtifactFileNotFoundError(t *testing.T) {
+	fileErr := ArtifactFileNotFoundError{testCase: "Firefox-Example-Basic", path: "screenshots/slurm.png"}
+	desiredErrString := "No file screenshots/slurm.png in the artifacts of test case Firefox-Example-Basic"
+	if fileErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, fileErr.Error())
+	}
+}
+
+func TestArtifactFileTooLargeError(t *testing.T) {
+	fileErr := ArtifactFileTooLargeError{path: "screenshots/1.png", size: 5000000, maxSize: 4000000}
+	desiredErrString := "File screenshots/1.png is 5000000 bytes, more than the 4000000 bytes that can be served on its own, download the artifacts of the test case instead"
+	if fileErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, fileErr.Error())
+	}
+}
+
+func TestUnknownTestbedError(t *testing.T) {
+	testbedErr := UnknownTestbedError{testbed: "slurm-desktop"}
+	desiredErrString := "Testbed slurm-desktop is neither a url nor a known alias, see /testbeds for the aliases"
+	if testbedErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, testbedErr.Error())
+	}
+}
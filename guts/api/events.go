@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"guts.ubuntu.com/v2/database"
+	"slices"
+	"time"
+)
+
+var (
+	// channel the schema triggers publish state changes on
+	JobEventsChannel   = "guts_events"
+	JobEventsKeepAlive = 30 * time.Second
+)
+
+// JobEvent is a state change of either a test or a job
+type JobEvent struct {
+	Type     string `json:"type"`
+	Uuid     string `json:"uuid"`
+	TestCase string `json:"test_case,omitempty"`
+	State    string `json:"state"`
+}
+
+func (j JobEvent) ToJson() string {
+	b, err := json.Marshal(j)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return string(b)
+}
+
+// IsFinal is true for the event of a job reaching its final status, after
+// which no more events will follow for the job
+func (j JobEvent) IsFinal() bool {
+	return j.Type == "job" && slices.Contains(FinishedJobStatuses, j.State)
+}
+
+func ParseJobEvent(payload string) (JobEvent, error) {
+	var event JobEvent
+	err := json.Unmarshal([]byte(payload), &event)
+	return event, err
+}
+
+// GetJobEventsSnapshot returns the current state of every test in the job,
+// followed by the job status
+func GetJobEventsSnapshot(uuidToFind string, driver database.DbDriver) ([]JobEvent, error) {
+	var events []JobEvent
+	job, err := FindJobByUuid(uuidToFind, driver)
+	if err != nil {
+		return events, err
+	}
+	testResults, err := CollateUuidTestResults(uuidToFind, driver)
+	if err != nil { // coverage-ignore
+		return events, err
+	}
+	var testCases []string
+	for testCase := range testResults {
+		testCases = append(testCases, testCase)
+	}
+	slices.Sort(testCases)
+	for _, testCase := range testCases {
+		events = append(events, JobEvent{Type: "test", Uuid: uuidToFind, TestCase: testCase, State: testResults[testCase]})
+	}
+	events = append(events, JobEvent{Type: "job", Uuid: uuidToFind, State: job.Status})
+	return events, nil
+}
+
+// StreamJobEvents sends the current state of the job, then every state change
+// published for it, until the job finishes or ctx is cancelled. The snapshot is
+// re-sent whenever the listener reconnects, as changes may have been missed.
+func StreamJobEvents(ctx context.Context, uuid string, notifications <-chan database.Notification, snapshot func() ([]JobEvent, error), send func(JobEvent), keepAlive func()) error {
+	sendSnapshot := func() (bool, error) {
+		events, err := snapshot()
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events {
+			send(event)
+			if event.IsFinal() {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	finished, err := sendSnapshot()
+	if finished || err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(JobEventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			keepAlive()
+		case notification, ok := <-notifications:
+			if !ok {
+				return nil
+			}
+			if notification.Payload == "" {
+				finished, err = sendSnapshot()
+				if finished || err != nil {
+					return err
+				}
+				continue
+			}
+			event, err := ParseJobEvent(notification.Payload)
+			if err != nil || event.Uuid != uuid {
+				continue
+			}
+			send(event)
+			if event.IsFinal() {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"reflect"
+	"testing"
+)
+
+func TestJobEventIsFinal(t *testing.T) {
+	finalEvents := []JobEvent{
+		{Type: "job", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", State: "pass"},
+		{Type: "job", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", State: "cancelled"},
+	}
+	for _, event := range finalEvents {
+		if !event.IsFinal() {
+			t.Errorf("event %v should be final", event)
+		}
+	}
+	nonFinalEvents := []JobEvent{
+		{Type: "job", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", State: "running"},
+		{Type: "test", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", TestCase: "Firefox-Example-Basic", State: "pass"},
+	}
+	for _, event := range nonFinalEvents {
+		if event.IsFinal() {
+			t.Errorf("event %v shouldn't be final", event)
+		}
+	}
+}
+
+func TestParseJobEvent(t *testing.T) {
+	payload := `{"type" : "test", "uuid" : "4ce9189f-561a-4886-aeef-1836f28b073b", "test_case" : "Firefox-Example-Basic", "state" : "running"}`
+	event, err := ParseJobEvent(payload)
+	utils.CheckError(err)
+	expectedEvent := JobEvent{Type: "test", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", TestCase: "Firefox-Example-Basic", State: "running"}
+	if event != expectedEvent {
+		t.Errorf("unexpected event!\nexpected: %v\nactual: %v", expectedEvent, event)
+	}
+}
+
+func TestStreamJobEvents(t *testing.T) {
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	snapshotEvents := []JobEvent{
+		{Type: "test", Uuid: uuid, TestCase: "Firefox-Example-Basic", State: "running"},
+		{Type: "job", Uuid: uuid, State: "running"},
+	}
+	snapshot := func() ([]JobEvent, error) {
+		return snapshotEvents, nil
+	}
+	notifications := make(chan database.Notification, 4)
+	notifications <- database.Notification{Channel: JobEventsChannel, Payload: `{"type": "test", "uuid": "e5a8a037-66ab-48c0-a358-5126e4969e5e", "test_case": "Firefox-Example-Basic", "state": "fail"}`}
+	notifications <- database.Notification{Channel: JobEventsChannel, Payload: `{"type": "test", "uuid": "4ce9189f-561a-4886-aeef-1836f28b073b", "test_case": "Firefox-Example-Basic", "state": "pass"}`}
+	notifications <- database.Notification{Channel: JobEventsChannel, Payload: `{"type": "job", "uuid": "4ce9189f-561a-4886-aeef-1836f28b073b", "state": "pass"}`}
+	notifications <- database.Notification{Channel: JobEventsChannel, Payload: `{"type": "test", "uuid": "4ce9189f-561a-4886-aeef-1836f28b073b", "test_case": "Firefox-Example-Basic", "state": "requested"}`}
+
+	var sentEvents []JobEvent
+	send := func(event JobEvent) {
+		sentEvents = append(sentEvents, event)
+	}
+	err := StreamJobEvents(context.Background(), uuid, notifications, snapshot, send, func() {})
+	utils.CheckError(err)
+
+	expectedEvents := append(snapshotEvents,
+		JobEvent{Type: "test", Uuid: uuid, TestCase: "Firefox-Example-Basic", State: "pass"},
+		JobEvent{Type: "job", Uuid: uuid, State: "pass"},
+	)
+	if !reflect.DeepEqual(sentEvents, expectedEvents) {
+		t.Errorf("unexpected events!\nexpected: %v\nactual: %v", expectedEvents, sentEvents)
+	}
+}
+
+func TestStreamJobEventsFinishedJob(t *testing.T) {
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	snapshotEvents := []JobEvent{
+		{Type: "test", Uuid: uuid, TestCase: "Firefox-Example-Basic", State: "pass"},
+		{Type: "job", Uuid: uuid, State: "pass"},
+	}
+	snapshot := func() ([]JobEvent, error) {
+		return snapshotEvents, nil
+	}
+	// nothing is ever published, so this would block if the stream didn't
+	// stop after the snapshot
+	notifications := make(chan database.Notification)
+
+	var sentEvents []JobEvent
+	send := func(event JobEvent) {
+		sentEvents = append(sentEvents, event)
+	}
+	err := StreamJobEvents(context.Background(), uuid, notifications, snapshot, send, func() {})
+	utils.CheckError(err)
+
+	if !reflect.DeepEqual(sentEvents, snapshotEvents) {
+		t.Errorf("unexpected events!\nexpected: %v\nactual: %v", snapshotEvents, sentEvents)
+	}
+}
+
+func TestStreamJobEventsReconnect(t *testing.T) {
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	snapshots := [][]JobEvent{
+		{{Type: "job", Uuid: uuid, State: "running"}},
+		{{Type: "job", Uuid: uuid, State: "fail"}},
+	}
+	snapshot := func() ([]JobEvent, error) {
+		events := snapshots[0]
+		snapshots = snapshots[1:]
+		return events, nil
+	}
+	notifications := make(chan database.Notification, 1)
+	notifications <- database.Notification{Channel: JobEventsChannel}
+
+	var sentEvents []JobEvent
+	send := func(event JobEvent) {
+		sentEvents = append(sentEvents, event)
+	}
+	err := StreamJobEvents(context.Background(), uuid, notifications, snapshot, send, func() {})
+	utils.CheckError(err)
+
+	expectedEvents := []JobEvent{
+		{Type: "job", Uuid: uuid, State: "running"},
+		{Type: "job", Uuid: uuid, State: "fail"},
+	}
+	if !reflect.DeepEqual(sentEvents, expectedEvents) {
+		t.Errorf("unexpected events!\nexpected: %v\nactual: %v", expectedEvents, sentEvents)
+	}
+}
+
+func TestStreamJobEventsCancelledContext(t *testing.T) {
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	snapshot := func() ([]JobEvent, error) {
+		return []JobEvent{{Type: "job", Uuid: uuid, State: "running"}}, nil
+	}
+	notifications := make(chan database.Notification)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := StreamJobEvents(ctx, uuid, notifications, snapshot, func(JobEvent) {}, func() {})
+	if err != nil {
+		t.Errorf("stream shouldn't have failed, but got %v", err)
+	}
+}
+
+func TestGetJobEventsSnapshot(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	events, err := GetJobEventsSnapshot(uuid, Driver)
+	utils.CheckError(err)
+
+	expectedEvents := []JobEvent{
+		{Type: "test", Uuid: uuid, TestCase: "Firefox-Example-Basic", State: "requested"},
+		{Type: "test", Uuid: uuid, TestCase: "Firefox-Example-New-Tab", State: "spawning"},
+		{Type: "job", Uuid: uuid, State: "running"},
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("unexpected events!\nexpected: %v\nactual: %v", expectedEvents, events)
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 var (
-	AllJobColumns = []string{"uuid", "artifact_url", "tests_repo", "tests_repo_branch", "tests_plans", "image_url", "reporter", "status", "submitted_at", "requester", "debug", "priority"}
+	AllJobColumns = []string{"uuid", "artifact_url", "tests_repo", "tests_repo_branch", "tests_plans", "image_url", "testbed_alias", "reporter", "status", "submitted_at", "requester", "debug", "priority", "retries"}
 )
 
 type JobEntry struct {
@@ -20,17 +20,62 @@ type JobEntry struct {
 	TestsRepoBranch string    `json:"tests_repo_branch"`
 	TestsPlans      []string  `json:"tests_plans"`
 	ImageUrl        string    `json:"image_url"`
+	TestbedAlias    string    `json:"testbed_alias"`
 	Reporter        string    `json:"reporter"`
 	Status          string    `json:"status"`
 	SubmittedAt     time.Time `json:"submitted_at"`
 	Requester       string    `json:"requester"`
 	Debug           bool      `json:"debug"`
 	Priority        int       `json:"priority"`
+	Retries         int       `json:"retries"`
 }
 
 type JobWithTestsDetails struct {
-	Job     JobEntry
-	Results map[string]string `json:"results"`
+	Job      JobEntry
+	Results  map[string]string        `json:"results"`
+	Attempts map[string][]TestAttempt `json:"attempts"`
+	Failures map[string][]TestResult  `json:"failures"`
+}
+
+// TestResult is a suite or test from the Robot Framework results of a test
+// case, with screenshots relative to the root of its artifacts
+type TestResult struct {
+	Kind        string     `json:"kind"`
+	Suite       string     `json:"suite"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Message     string     `json:"message"`
+	StartedAt   *time.Time `json:"started_at"`
+	DurationMs  int        `json:"duration_ms"`
+	Screenshots []string   `json:"screenshots"`
+}
+
+// TestAttempt holds one spawn of a test, from the spawner picking it up to
+// the test finishing, being retried or getting lost along the way
+type TestAttempt struct {
+	Attempt     int        `json:"attempt"`
+	State       string     `json:"state"`
+	SpawnerHost string     `json:"spawner_host"`
+	VncAddress  string     `json:"vnc_address"`
+	StartedAt   *time.Time `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	ExitCode    *int       `json:"exit_code"`
+	CommitHash  string     `json:"commit_hash"`
+	ResultsUrl  string     `json:"results_url"`
+}
+
+type TestCaseAttempts struct {
+	Uuid     string        `json:"uuid"`
+	TestCase string        `json:"test_case"`
+	Attempts []TestAttempt `json:"attempts"`
+}
+
+func (t TestCaseAttempts) ToJson() string {
+	b, err := json.Marshal(t)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return string(b)
 }
 
 type ReturnableJson interface {
@@ -65,8 +110,20 @@ func GetCompleteResultsForUuid(uuidToFind string, driver database.DbDriver) (Job
 		return completeJob, err
 	}
 
+	testAttempts, err := CollateUuidTestAttempts(uuidToFind, driver) // coverage-ignore
+	if err != nil {                                                  // coverage-ignore
+		return completeJob, err
+	}
+
+	testFailures, err := CollateUuidTestFailures(uuidToFind, driver) // coverage-ignore
+	if err != nil {                                                  // coverage-ignore
+		return completeJob, err
+	}
+
 	completeJob.Job = job
 	completeJob.Results = testResults
+	completeJob.Attempts = testAttempts
+	completeJob.Failures = testFailures
 
 	return completeJob, nil
 }
@@ -93,27 +150,193 @@ func CollateUuidTestResults(uuidToFind string, driver database.DbDriver) (map[st
 	return testResults, nil
 }
 
-func FindJobByUuid(uuidToFind string, driver database.DbDriver) (JobEntry, error) {
-	var job JobEntry
+var (
+	testAttemptColumns = []string{"test_case", "attempt", "state", "spawner_host", "vnc_address", "started_at", "finished_at", "exit_code", "commit_hash", "results_url"}
+)
 
-	row, err := driver.QueryRow("jobs", "uuid", uuidToFind, AllJobColumns)
+func CollateUuidTestAttempts(uuidToFind string, driver database.DbDriver) (map[string][]TestAttempt, error) {
+	testAttempts := make(map[string][]TestAttempt)
+
+	rows, err := driver.GetRows(database.Select("test_attempts", testAttemptColumns...).Where("uuid=?", uuidToFind).OrderBy("id"))
 	if err != nil { // coverage-ignore
-		return job, err
+		return testAttempts, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		testCase, attempt, err := ScanTestAttempt(rows)
+		if err != nil { // coverage-ignore
+			return testAttempts, err
+		}
+		testAttempts[testCase] = append(testAttempts[testCase], attempt)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return testAttempts, err
+	}
+	return testAttempts, nil
+}
+
+// CollateUuidTestFailures gathers the failed suites and tests, with why they
+// failed, from the attempt each test case is currently on. Suites that only
+// failed because a test in them did have no message of their own, so they're
+// left out
+func CollateUuidTestFailures(uuidToFind string, driver database.DbDriver) (map[string][]TestResult, error) {
+	testFailures := make(map[string][]TestResult)
+
+	failuresQuery := database.Select("test_results", "test_results.test_case", "kind", "suite", "name", "status", "message", "started_at", "duration_ms", "screenshots").
+		Join("JOIN tests ON tests.id=test_results.test_id AND tests.attempt=test_results.attempt").
+		Where("test_results.uuid=?", uuidToFind).
+		Where("status=?", "FAIL").
+		Where("message!=?", "").
+		OrderBy("test_results.id")
+	rows, err := driver.GetRows(failuresQuery)
+	if err != nil { // coverage-ignore
+		return testFailures, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		var testCase string
+		var result TestResult
+		var startedAt sql.NullTime
+		err := rows.Scan(
+			&testCase,
+			&result.Kind,
+			&result.Suite,
+			&result.Name,
+			&result.Status,
+			&result.Message,
+			&startedAt,
+			&result.DurationMs,
+			pq.Array(&result.Screenshots),
+		)
+		if err != nil { // coverage-ignore
+			return testFailures, err
+		}
+		if startedAt.Valid {
+			result.StartedAt = &startedAt.Time
+		}
+		testFailures[testCase] = append(testFailures[testCase], result)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return testFailures, err
+	}
+	return testFailures, nil
+}
+
+// GetTestCaseAttempts lists every attempt at a test case of a job, oldest first
+func GetTestCaseAttempts(uuidToFind, testCase string, driver database.DbDriver) (TestCaseAttempts, error) {
+	testCaseAttempts := TestCaseAttempts{Uuid: uuidToFind, TestCase: testCase, Attempts: []TestAttempt{}}
+	if _, err := FindJobByUuid(uuidToFind, driver); err != nil {
+		return testCaseAttempts, err
+	}
+
+	row, err := driver.GetRow(database.Select("tests", "COUNT(*)").Where("uuid=?", uuidToFind).Where("test_case=?", testCase))
+	if err != nil { // coverage-ignore
+		return testCaseAttempts, err
+	}
+	var testCount int
+	if err = row.Scan(&testCount); err != nil { // coverage-ignore
+		return testCaseAttempts, err
+	}
+	if testCount == 0 {
+		return testCaseAttempts, TestCaseNotFoundError{uuid: uuidToFind, testCase: testCase}
 	}
-	err = row.Scan(
+
+	rows, err := driver.GetRows(database.Select("test_attempts", testAttemptColumns...).Where("uuid=?", uuidToFind).Where("test_case=?", testCase).OrderBy("id"))
+	if err != nil { // coverage-ignore
+		return testCaseAttempts, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		_, attempt, err := ScanTestAttempt(rows)
+		if err != nil { // coverage-ignore
+			return testCaseAttempts, err
+		}
+		testCaseAttempts.Attempts = append(testCaseAttempts.Attempts, attempt)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return testCaseAttempts, err
+	}
+	return testCaseAttempts, nil
+}
+
+// ScanTestAttempt reads a row selected with testAttemptColumns, attempts still
+// in progress have no state, end or exit code yet
+func ScanTestAttempt(row JobScanner) (string, TestAttempt, error) {
+	var testCase string
+	var attempt TestAttempt
+	var state, spawnerHost, vncAddress, commitHash, resultsUrl sql.NullString
+	var startedAt, finishedAt sql.NullTime
+	var exitCode sql.NullInt64
+	err := row.Scan(
+		&testCase,
+		&attempt.Attempt,
+		&state,
+		&spawnerHost,
+		&vncAddress,
+		&startedAt,
+		&finishedAt,
+		&exitCode,
+		&commitHash,
+		&resultsUrl,
+	)
+	if err != nil { // coverage-ignore
+		return testCase, attempt, err
+	}
+	attempt.State = state.String
+	attempt.SpawnerHost = spawnerHost.String
+	attempt.VncAddress = vncAddress.String
+	attempt.CommitHash = commitHash.String
+	attempt.ResultsUrl = resultsUrl.String
+	if startedAt.Valid {
+		attempt.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		attempt.FinishedAt = &finishedAt.Time
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		attempt.ExitCode = &code
+	}
+	return testCase, attempt, nil
+}
+
+// JobScanner is satisfied by both *sql.Row and *sql.Rows
+type JobScanner interface {
+	Scan(dest ...any) error
+}
+
+func ScanJobEntry(scanner JobScanner) (JobEntry, error) {
+	var job JobEntry
+	err := scanner.Scan(
 		&job.Uuid,
 		&job.ArtifactUrl,
 		&job.TestsRepo,
 		&job.TestsRepoBranch,
 		pq.Array(&job.TestsPlans),
 		&job.ImageUrl,
+		&job.TestbedAlias,
 		&job.Reporter,
 		&job.Status,
 		&job.SubmittedAt,
 		&job.Requester,
 		&job.Debug,
 		&job.Priority,
+		&job.Retries,
 	)
+	return job, err
+}
+
+func FindJobByUuid(uuidToFind string, driver database.DbDriver) (JobEntry, error) {
+	var job JobEntry
+
+	row, err := driver.QueryRow("jobs", "uuid", uuidToFind, AllJobColumns)
+	if err != nil { // coverage-ignore
+		return job, err
+	}
+	job, err = ScanJobEntry(row)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -5,13 +5,14 @@ import (
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestGetCompleteResultsForUuidFailure(t *testing.T) {
 	Uuid := "21a57878-3307-449c-9f71-9f3f5d11f41c"
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -29,7 +30,7 @@ func TestGetCompleteResultsForUuidFailure(t *testing.T) {
 
 func TestGetCompleteResultsForUuidSuccess(t *testing.T) {
 	Uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -65,6 +66,8 @@ func TestGetCompleteResultsForUuidSuccess(t *testing.T) {
 	// expectedJob.Results["Firefox-Example-Basic"] = "running"
 	expectedJob.Results["Firefox-Example-Basic"] = "requested"
 	expectedJob.Results["Firefox-Example-New-Tab"] = "spawning"
+	expectedJob.Attempts = make(map[string][]TestAttempt)
+	expectedJob.Failures = make(map[string][]TestResult)
 	if !reflect.DeepEqual(job, expectedJob) {
 		t.Errorf("expected job not the same as actual\nexpected: %v\nactual: %v", expectedJob, job)
 	}
@@ -72,7 +75,7 @@ func TestGetCompleteResultsForUuidSuccess(t *testing.T) {
 
 func TestFindJobByUuid(t *testing.T) {
 	Uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -119,7 +122,7 @@ func TestJobToJson(t *testing.T) {
 	TestJob.Requester = "andersson123"
 	TestJob.Debug = false
 	TestJob.Priority = 8
-	ExpectedJson := `{"uuid":"4ce9189f-561a-4886-aeef-1836f28b073b","artifact_url":null,"tests_repo":"https://github.com/canonical/ubuntu-gui-testing.git","tests_repo_branch":"main","tests_plans":["tests/firefox-example/plans/extended.yaml","tests/firefox-example/plans/regular.yaml"],"image_url":"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso","reporter":"test_observer","status":"running","submitted_at":"2025-07-23T14:17:14.632177Z","requester":"andersson123","debug":false,"priority":8}`
+	ExpectedJson := `{"uuid":"4ce9189f-561a-4886-aeef-1836f28b073b","artifact_url":null,"tests_repo":"https://github.com/canonical/ubuntu-gui-testing.git","tests_repo_branch":"main","tests_plans":["tests/firefox-example/plans/extended.yaml","tests/firefox-example/plans/regular.yaml"],"image_url":"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso","testbed_alias":"","reporter":"test_observer","status":"running","submitted_at":"2025-07-23T14:17:14.632177Z","requester":"andersson123","debug":false,"priority":8,"retries":0}`
 	ConvertedJson := TestJob.ToJson()
 	if !reflect.DeepEqual(ExpectedJson, ConvertedJson) {
 		t.Errorf("json conversion not as expected!\nExpected: %v\nActual: %v", ExpectedJson, ConvertedJson)
@@ -146,9 +149,123 @@ func TestJobWithTestsDetailsToJson(t *testing.T) {
 	TestJob.Debug = false
 	TestJob.Priority = 8
 	jobwDetails.Job = TestJob
-	expectedJson := `{"Job":{"uuid":"4ce9189f-561a-4886-aeef-1836f28b073b","artifact_url":null,"tests_repo":"https://github.com/canonical/ubuntu-gui-testing.git","tests_repo_branch":"main","tests_plans":["tests/firefox-example/plans/extended.yaml","tests/firefox-example/plans/regular.yaml"],"image_url":"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso","reporter":"test_observer","status":"running","submitted_at":"2025-07-23T14:17:14.632177Z","requester":"andersson123","debug":false,"priority":8},"results":null}`
+	expectedJson := `{"Job":{"uuid":"4ce9189f-561a-4886-aeef-1836f28b073b","artifact_url":null,"tests_repo":"https://github.com/canonical/ubuntu-gui-testing.git","tests_repo_branch":"main","tests_plans":["tests/firefox-example/plans/extended.yaml","tests/firefox-example/plans/regular.yaml"],"image_url":"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso","testbed_alias":"","reporter":"test_observer","status":"running","submitted_at":"2025-07-23T14:17:14.632177Z","requester":"andersson123","debug":false,"priority":8,"retries":0},"results":null,"attempts":null,"failures":null}`
 	convertedJson := jobwDetails.ToJson()
 	if !reflect.DeepEqual(expectedJson, convertedJson) {
 		t.Errorf("expected json not same as actual\nexpected: %v\nactual: %v", expectedJson, convertedJson)
 	}
 }
+
+func TestGetTestCaseAttempts(t *testing.T) {
+	Uuid := "4bfebbd7-1c5d-4f63-a773-7c766bec7b2e"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	testCaseAttempts, err := GetTestCaseAttempts(Uuid, "Multipass-Basic", Driver)
+	utils.CheckError(err)
+
+	var states []string
+	var exitCodes []string
+	for _, attempt := range testCaseAttempts.Attempts {
+		states = append(states, attempt.State)
+		if attempt.ExitCode == nil {
+			exitCodes = append(exitCodes, "none")
+		} else {
+			exitCodes = append(exitCodes, fmt.Sprintf("%v", *attempt.ExitCode))
+		}
+	}
+	expectedStates := []string{"vm_died", "tempfail", "pass"}
+	if !reflect.DeepEqual(states, expectedStates) {
+		t.Errorf("unexpected attempt states!\nexpected: %v\nactual: %v", expectedStates, states)
+	}
+	expectedExitCodes := []string{"none", "999", "0"}
+	if !reflect.DeepEqual(exitCodes, expectedExitCodes) {
+		t.Errorf("unexpected attempt exit codes!\nexpected: %v\nactual: %v", expectedExitCodes, exitCodes)
+	}
+	expectedSpawnerHost := "spawner-1"
+	if testCaseAttempts.Attempts[0].SpawnerHost != expectedSpawnerHost {
+		t.Errorf("unexpected spawner host!\nexpected: %v\nactual: %v", expectedSpawnerHost, testCaseAttempts.Attempts[0].SpawnerHost)
+	}
+}
+
+func TestGetTestCaseAttemptsUnknownTestCase(t *testing.T) {
+	Uuid := "4bfebbd7-1c5d-4f63-a773-7c766bec7b2e"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	_, err = GetTestCaseAttempts(Uuid, "Firefox-Example-Basic", Driver)
+	expectedErr := TestCaseNotFoundError{uuid: Uuid, testCase: "Firefox-Example-Basic"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
+
+func TestTestCaseAttemptsToJson(t *testing.T) {
+	exitCode := 999
+	startedAt := time.Date(2025, 7, 23, 14, 6, 0, 0, time.UTC)
+	var testCaseAttempts TestCaseAttempts
+	testCaseAttempts.Uuid = "4bfebbd7-1c5d-4f63-a773-7c766bec7b2e"
+	testCaseAttempts.TestCase = "Multipass-Basic"
+	testCaseAttempts.Attempts = []TestAttempt{
+		{Attempt: 1, State: "tempfail", SpawnerHost: "spawner-2", VncAddress: "127.0.0.1:5931", StartedAt: &startedAt, ExitCode: &exitCode},
+	}
+	expectedJson := `{"uuid":"4bfebbd7-1c5d-4f63-a773-7c766bec7b2e","test_case":"Multipass-Basic","attempts":[{"attempt":1,"state":"tempfail","spawner_host":"spawner-2","vnc_address":"127.0.0.1:5931","started_at":"2025-07-23T14:06:00Z","finished_at":null,"exit_code":999,"commit_hash":"","results_url":""}]}`
+	if testCaseAttempts.ToJson() != expectedJson {
+		t.Errorf("unexpected json!\nexpected: %v\nactual: %v", expectedJson, testCaseAttempts.ToJson())
+	}
+}
+
+func TestCollateUuidTestFailures(t *testing.T) {
+	Uuid := "eccd3988-490d-4414-be97-605d1ac81073"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	testFailures, err := CollateUuidTestFailures(Uuid, Driver)
+	utils.CheckError(err)
+
+	startedAt := time.Date(2025, 7, 23, 14, 15, 2, 0, time.UTC)
+	expectedFailures := map[string][]TestResult{
+		"Firefox-Example-Basic": {
+			{Kind: "suite", Name: "Firefox-Example-Basic", Status: "FAIL", Message: "Suite setup failed:\nCouldn't connect to VNC server", StartedAt: &startedAt, DurationMs: 30012, Screenshots: []string{}},
+		},
+		"Firefox-Example-New-Tab": {
+			{Kind: "test", Suite: "Firefox-Example-New-Tab", Name: "Open A New Tab", Status: "FAIL", Message: "Couldn't find template new-tab.png on screen", StartedAt: &startedAt, DurationMs: 12503, Screenshots: []string{"screenshot-1.png"}},
+		},
+	}
+	for testCase, failures := range testFailures {
+		for i := range failures {
+			// compare the instant, not the location postgres hands back
+			utc := failures[i].StartedAt.UTC()
+			failures[i].StartedAt = &utc
+		}
+		testFailures[testCase] = failures
+	}
+	if !reflect.DeepEqual(testFailures, expectedFailures) {
+		t.Errorf("unexpected failures!\nexpected: %v\nactual: %v", expectedFailures, testFailures)
+	}
+}
+
+func TestTestResultToJson(t *testing.T) {
+	var jobwDetails JobWithTestsDetails
+	jobwDetails.Failures = map[string][]TestResult{
+		"Firefox-Example-New-Tab": {
+			{Kind: "test", Suite: "Firefox-Example-New-Tab", Name: "Open A New Tab", Status: "FAIL", Message: "Couldn't find template new-tab.png on screen", DurationMs: 12503, Screenshots: []string{"screenshot-1.png"}},
+		},
+	}
+	expectedJson := `"failures":{"Firefox-Example-New-Tab":[{"kind":"test","suite":"Firefox-Example-New-Tab","name":"Open A New Tab","status":"FAIL","message":"Couldn't find template new-tab.png on screen","started_at":null,"duration_ms":12503,"screenshots":["screenshot-1.png"]}]}`
+	if !strings.HasSuffix(jobwDetails.ToJson(), expectedJson+"}") {
+		t.Errorf("unexpected json!\nexpected suffix: %v\nactual: %v", expectedJson, jobwDetails.ToJson())
+	}
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	JobStatuses        = []string{"pending", "running", "pass", "fail", "cancelled", "flaky"}
+	JobsSortableFields = []string{"submitted_at", "priority"}
+	JobsDefaultLimit   = 50
+	JobsMaxLimit       = 200
+)
+
+type JobsFilter struct {
+	Requester       string
+	Status          string
+	ImageUrl        string
+	TestsRepo       string
+	TestsRepoBranch string
+	SubmittedAfter  *time.Time
+	SubmittedBefore *time.Time
+	SortBy          string
+	Order           string
+	Limit           int
+	Cursor          *JobsCursor
+}
+
+// JobsCursor points at the last job of a page, so the next page can carry
+// on from there regardless of jobs being added in the meantime.
+type JobsCursor struct {
+	SortBy    string `json:"sort_by"`
+	Order     string `json:"order"`
+	SortValue string `json:"sort_value"`
+	Uuid      string `json:"uuid"`
+}
+
+type JobsPage struct {
+	Jobs       []JobEntry `json:"jobs"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+func (j JobsPage) ToJson() string {
+	b, err := json.Marshal(j)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return string(b)
+}
+
+func (c JobsCursor) Encode() string {
+	b, err := json.Marshal(c)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// SortArg is the sort value as the type of the column it's compared with,
+// as not every database converts a string to it
+func (c JobsCursor) SortArg() (any, error) {
+	switch c.SortBy {
+	case "priority":
+		return strconv.Atoi(c.SortValue)
+	default:
+		return time.Parse(time.RFC3339Nano, c.SortValue)
+	}
+}
+
+func DecodeJobsCursor(encoded string) (JobsCursor, error) {
+	var cursor JobsCursor
+	b, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, InvalidQueryParameterError{param: "cursor", value: encoded}
+	}
+	if err = json.Unmarshal(b, &cursor); err != nil {
+		return cursor, InvalidQueryParameterError{param: "cursor", value: encoded}
+	}
+	return cursor, nil
+}
+
+func ParseJobsFilter(query url.Values) (JobsFilter, error) {
+	var filter JobsFilter
+	filter.Requester = query.Get("requester")
+	filter.Status = query.Get("status")
+	filter.ImageUrl = query.Get("image_url")
+	filter.TestsRepo = query.Get("tests_repo")
+	filter.TestsRepoBranch = query.Get("tests_repo_branch")
+	filter.SortBy = query.Get("sort")
+	filter.Order = query.Get("order")
+	filter.Limit = JobsDefaultLimit
+
+	if filter.Status != "" && !slices.Contains(JobStatuses, filter.Status) {
+		return filter, InvalidQueryParameterError{param: "status", value: filter.Status}
+	}
+
+	submittedAfter, err := ParseTimeQueryParameter(query, "submitted_after")
+	if err != nil {
+		return filter, err
+	}
+	filter.SubmittedAfter = submittedAfter
+
+	submittedBefore, err := ParseTimeQueryParameter(query, "submitted_before")
+	if err != nil {
+		return filter, err
+	}
+	filter.SubmittedBefore = submittedBefore
+
+	if filter.SortBy == "" {
+		filter.SortBy = "submitted_at"
+	}
+	if !slices.Contains(JobsSortableFields, filter.SortBy) {
+		return filter, InvalidQueryParameterError{param: "sort", value: filter.SortBy}
+	}
+
+	if filter.Order == "" {
+		filter.Order = "desc"
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		return filter, InvalidQueryParameterError{param: "order", value: filter.Order}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 || parsedLimit > JobsMaxLimit {
+			return filter, InvalidQueryParameterError{param: "limit", value: limit}
+		}
+		filter.Limit = parsedLimit
+	}
+
+	if encodedCursor := query.Get("cursor"); encodedCursor != "" {
+		cursor, err := DecodeJobsCursor(encodedCursor)
+		if err != nil {
+			return filter, err
+		}
+		// a cursor only makes sense for the ordering it was created with
+		if cursor.SortBy != filter.SortBy || cursor.Order != filter.Order {
+			return filter, InvalidQueryParameterError{param: "cursor", value: encodedCursor}
+		}
+		if _, err = cursor.SortArg(); err != nil {
+			return filter, InvalidQueryParameterError{param: "cursor", value: encodedCursor}
+		}
+		filter.Cursor = &cursor
+	}
+
+	return filter, nil
+}
+
+func ParseTimeQueryParameter(query url.Values, param string) (*time.Time, error) {
+	value := query.Get(param)
+	if value == "" {
+		return nil, nil
+	}
+	ts, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, InvalidQueryParameterError{param: param, value: value}
+	}
+	return &ts, nil
+}
+
+func BuildJobsQuery(filter JobsFilter) *database.Query {
+	query := database.Select("jobs", AllJobColumns...)
+
+	if filter.Requester != "" {
+		query.Where("requester=?", filter.Requester)
+	}
+	if filter.Status != "" {
+		query.Where("status=?", filter.Status)
+	}
+	if filter.ImageUrl != "" {
+		query.Where("image_url=?", filter.ImageUrl)
+	}
+	if filter.TestsRepo != "" {
+		query.Where("tests_repo=?", filter.TestsRepo)
+	}
+	if filter.TestsRepoBranch != "" {
+		query.Where("tests_repo_branch=?", filter.TestsRepoBranch)
+	}
+	if filter.SubmittedAfter != nil {
+		query.Where("submitted_at>=?", *filter.SubmittedAfter)
+	}
+	if filter.SubmittedBefore != nil {
+		query.Where("submitted_at<=?", *filter.SubmittedBefore)
+	}
+
+	comparison := "<"
+	if filter.Order == "asc" {
+		comparison = ">"
+	}
+	if filter.Cursor != nil {
+		// uuid breaks ties between jobs with the same sort value. The sort
+		// value was checked by ParseJobsFilter
+		sortArg, _ := filter.Cursor.SortArg()
+		query.Where(fmt.Sprintf("(%v, uuid) %v (?, ?)", filter.SortBy, comparison), sortArg, filter.Cursor.Uuid)
+	}
+
+	order := strings.ToUpper(filter.Order)
+	// fetch one more than the limit to find out whether there's another page
+	return query.OrderBy(fmt.Sprintf("%v %v", filter.SortBy, order), fmt.Sprintf("uuid %v", order)).Limit(filter.Limit + 1)
+}
+
+func GetCursorForJob(job JobEntry, filter JobsFilter) JobsCursor {
+	var cursor JobsCursor
+	cursor.SortBy = filter.SortBy
+	cursor.Order = filter.Order
+	cursor.Uuid = job.Uuid
+	switch filter.SortBy {
+	case "priority":
+		cursor.SortValue = strconv.Itoa(job.Priority)
+	default:
+		cursor.SortValue = job.SubmittedAt.Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+func ListJobs(filter JobsFilter, driver database.DbDriver) (JobsPage, error) {
+	var page JobsPage
+	page.Jobs = []JobEntry{}
+
+	rows, err := driver.GetRows(BuildJobsQuery(filter))
+	if err != nil { // coverage-ignore
+		return page, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		job, err := ScanJobEntry(rows)
+		if err != nil { // coverage-ignore
+			return page, err
+		}
+		page.Jobs = append(page.Jobs, job)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return page, err
+	}
+
+	if len(page.Jobs) > filter.Limit {
+		page.Jobs = page.Jobs[:filter.Limit]
+		page.NextCursor = GetCursorForJob(page.Jobs[filter.Limit-1], filter).Encode()
+	}
+
+	return page, nil
+}
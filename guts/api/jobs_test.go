@@ -0,0 +1,210 @@
+package api
+
+import (
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJobsFilterDefaults(t *testing.T) {
+	filter, err := ParseJobsFilter(url.Values{})
+	utils.CheckError(err)
+
+	var expectedFilter JobsFilter
+	expectedFilter.SortBy = "submitted_at"
+	expectedFilter.Order = "desc"
+	expectedFilter.Limit = JobsDefaultLimit
+
+	if !reflect.DeepEqual(filter, expectedFilter) {
+		t.Errorf("unexpected filter!\nexpected: %v\nactual: %v", expectedFilter, filter)
+	}
+}
+
+func TestParseJobsFilter(t *testing.T) {
+	query := url.Values{}
+	query.Set("requester", "andersson123")
+	query.Set("status", "pass")
+	query.Set("image_url", "https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso")
+	query.Set("tests_repo", "https://github.com/canonical/ubuntu-gui-testing.git")
+	query.Set("tests_repo_branch", "main")
+	query.Set("submitted_after", "2025-07-23T14:17:14.632400Z")
+	query.Set("submitted_before", "2025-07-23T14:17:14.632500Z")
+	query.Set("sort", "priority")
+	query.Set("order", "asc")
+	query.Set("limit", "2")
+
+	filter, err := ParseJobsFilter(query)
+	utils.CheckError(err)
+
+	after, err := time.Parse(time.RFC3339Nano, "2025-07-23T14:17:14.632400Z")
+	utils.CheckError(err)
+	before, err := time.Parse(time.RFC3339Nano, "2025-07-23T14:17:14.632500Z")
+	utils.CheckError(err)
+
+	var expectedFilter JobsFilter
+	expectedFilter.Requester = "andersson123"
+	expectedFilter.Status = "pass"
+	expectedFilter.ImageUrl = "https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso"
+	expectedFilter.TestsRepo = "https://github.com/canonical/ubuntu-gui-testing.git"
+	expectedFilter.TestsRepoBranch = "main"
+	expectedFilter.SubmittedAfter = &after
+	expectedFilter.SubmittedBefore = &before
+	expectedFilter.SortBy = "priority"
+	expectedFilter.Order = "asc"
+	expectedFilter.Limit = 2
+
+	if !reflect.DeepEqual(filter, expectedFilter) {
+		t.Errorf("unexpected filter!\nexpected: %v\nactual: %v", expectedFilter, filter)
+	}
+}
+
+func TestParseJobsFilterInvalid(t *testing.T) {
+	badParams := map[string]string{
+		"status":           "exploded",
+		"submitted_after":  "yesterday",
+		"submitted_before": "tomorrow",
+		"sort":             "requester",
+		"order":            "sideways",
+		"limit":            "0",
+		"cursor":           "not-a-cursor",
+	}
+	for param, value := range badParams {
+		query := url.Values{}
+		query.Set(param, value)
+		_, err := ParseJobsFilter(query)
+		expectedErr := InvalidQueryParameterError{param: param, value: value}
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+		}
+	}
+}
+
+func TestParseJobsFilterMismatchedCursor(t *testing.T) {
+	var cursor JobsCursor
+	cursor.SortBy = "priority"
+	cursor.Order = "desc"
+	cursor.SortValue = "8"
+	cursor.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+
+	query := url.Values{}
+	query.Set("cursor", cursor.Encode())
+	_, err := ParseJobsFilter(query)
+	expectedErr := InvalidQueryParameterError{param: "cursor", value: cursor.Encode()}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
+
+func TestParseJobsFilterBadCursorSortValue(t *testing.T) {
+	var cursor JobsCursor
+	cursor.SortBy = "submitted_at"
+	cursor.Order = "desc"
+	cursor.SortValue = "yesterday"
+	cursor.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+
+	query := url.Values{}
+	query.Set("cursor", cursor.Encode())
+	_, err := ParseJobsFilter(query)
+	expectedErr := InvalidQueryParameterError{param: "cursor", value: cursor.Encode()}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
+
+func TestJobsCursorRoundTrip(t *testing.T) {
+	var cursor JobsCursor
+	cursor.SortBy = "submitted_at"
+	cursor.Order = "asc"
+	cursor.SortValue = "2025-07-23T14:17:14.632177Z"
+	cursor.Uuid = "4ce9189f-561a-4886-aeef-1836f28b073b"
+
+	decoded, err := DecodeJobsCursor(cursor.Encode())
+	utils.CheckError(err)
+	if !reflect.DeepEqual(cursor, decoded) {
+		t.Errorf("cursor didn't survive encoding!\nexpected: %v\nactual: %v", cursor, decoded)
+	}
+}
+
+func TestBuildJobsQuery(t *testing.T) {
+	var filter JobsFilter
+	filter.Requester = "andersson123"
+	filter.Status = "pass"
+	filter.SortBy = "priority"
+	filter.Order = "asc"
+	filter.Limit = 10
+	filter.Cursor = &JobsCursor{SortBy: "priority", Order: "asc", SortValue: "8", Uuid: "4ce9189f-561a-4886-aeef-1836f28b073b"}
+
+	query, args, err := BuildJobsQuery(filter).Build()
+	utils.CheckError(err)
+
+	expectedQuery := "SELECT uuid, artifact_url, tests_repo, tests_repo_branch, tests_plans, image_url, testbed_alias, reporter, status, submitted_at, requester, debug, priority, retries FROM jobs WHERE (requester=$1) AND (status=$2) AND ((priority, uuid) > ($3, $4)) ORDER BY priority ASC, uuid ASC LIMIT $5"
+	expectedArgs := []any{"andersson123", "pass", 8, "4ce9189f-561a-4886-aeef-1836f28b073b", 11}
+
+	if query != expectedQuery {
+		t.Errorf("unexpected query!\nexpected: %v\nactual: %v", expectedQuery, query)
+	}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("unexpected args!\nexpected: %v\nactual: %v", expectedArgs, args)
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	query := url.Values{}
+	query.Set("requester", "andersson123")
+	query.Set("submitted_after", "2025-07-23T14:17:14.632400Z")
+	query.Set("submitted_before", "2025-07-23T14:17:14.632500Z")
+	query.Set("order", "asc")
+	query.Set("limit", "2")
+
+	filter, err := ParseJobsFilter(query)
+	utils.CheckError(err)
+
+	page, err := ListJobs(filter, Driver)
+	utils.CheckError(err)
+
+	var actualUuids []string
+	for _, job := range page.Jobs {
+		actualUuids = append(actualUuids, job.Uuid)
+	}
+	expectedUuids := []string{
+		"08b22844-2f6c-4fa9-b5cc-d937aeea6134",
+		"74ae401e-b14f-45b9-857d-056384df3ced",
+	}
+	if !reflect.DeepEqual(actualUuids, expectedUuids) {
+		t.Errorf("unexpected first page!\nexpected: %v\nactual: %v", expectedUuids, actualUuids)
+	}
+	if page.NextCursor == "" {
+		t.Errorf("first page should have a cursor to the next page")
+	}
+
+	query.Set("cursor", page.NextCursor)
+	filter, err = ParseJobsFilter(query)
+	utils.CheckError(err)
+
+	page, err = ListJobs(filter, Driver)
+	utils.CheckError(err)
+
+	actualUuids = []string{}
+	for _, job := range page.Jobs {
+		actualUuids = append(actualUuids, job.Uuid)
+	}
+	expectedUuids = []string{
+		"e5a8a037-66ab-48c0-a358-5126e4969e5e",
+	}
+	if !reflect.DeepEqual(actualUuids, expectedUuids) {
+		t.Errorf("unexpected second page!\nexpected: %v\nactual: %v", expectedUuids, actualUuids)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("last page shouldn't have a cursor, but has %v", page.NextCursor)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"strings"
+)
+
+// JunitTestSuites is a job rendered as JUnit XML, with a testsuite per plan
+// and a testcase per test case in it
+type JunitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []JunitTestSuite `xml:"testsuite"`
+}
+
+type JunitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []JunitTestCase `xml:"testcase"`
+}
+
+type JunitTestCase struct {
+	Name       string           `xml:"name,attr"`
+	ClassName  string           `xml:"classname,attr"`
+	Properties *JunitProperties `xml:"properties,omitempty"`
+	Failure    *JunitMessage    `xml:"failure,omitempty"`
+	Skipped    *JunitMessage    `xml:"skipped,omitempty"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+type JunitProperties struct {
+	Properties []JunitProperty `xml:"property"`
+}
+
+type JunitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type JunitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// JobTest is a single row of the tests table of a job
+type JobTest struct {
+	Plan       string
+	TestCase   string
+	State      string
+	ResultsUrl string
+}
+
+func (j JunitTestSuites) ToXml() ([]byte, error) {
+	b, err := xml.MarshalIndent(j, "", "  ")
+	if err != nil { // coverage-ignore
+		return b, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// CollateUuidTests lists the tests of a job in the order they were written
+func CollateUuidTests(uuidToFind string, driver database.DbDriver) ([]JobTest, error) {
+	var tests []JobTest
+
+	rows, err := driver.GetRows(database.Select("tests", "COALESCE(plan, '')", "test_case", "state", "COALESCE(results_url, '')").Where("uuid=?", uuidToFind).OrderBy("id"))
+	if err != nil { // coverage-ignore
+		return tests, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		var test JobTest
+		err := rows.Scan(&test.Plan, &test.TestCase, &test.State, &test.ResultsUrl)
+		if err != nil { // coverage-ignore
+			return tests, err
+		}
+		tests = append(tests, test)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return tests, err
+	}
+	return tests, nil
+}
+
+// GetJobJunit renders a job and its tests as JUnit XML
+func GetJobJunit(uuidToFind string, driver database.DbDriver) (JunitTestSuites, error) {
+	var junit JunitTestSuites
+	job, err := GetCompleteResultsForUuid(uuidToFind, driver)
+	if err != nil {
+		return junit, err
+	}
+
+	tests, err := CollateUuidTests(uuidToFind, driver)
+	if err != nil { // coverage-ignore
+		return junit, err
+	}
+	return JobToJunit(job, tests), nil
+}
+
+// JobToJunit groups the tests of a job into a testsuite per plan, keeping the
+// order the plans and tests were written in. Tests that haven't finished or
+// were cancelled are skipped, and failed tests carry the failure messages
+// from their Robot Framework results
+func JobToJunit(job JobWithTestsDetails, tests []JobTest) JunitTestSuites {
+	junit := JunitTestSuites{Name: job.Job.Uuid}
+	suiteIndexes := make(map[string]int)
+
+	for _, test := range tests {
+		suiteIndex, ok := suiteIndexes[test.Plan]
+		if !ok {
+			suiteIndex = len(junit.Suites)
+			suiteIndexes[test.Plan] = suiteIndex
+			junit.Suites = append(junit.Suites, JunitTestSuite{Name: test.Plan})
+		}
+		suite := &junit.Suites[suiteIndex]
+
+		testCase := JunitTestCase{Name: test.TestCase, ClassName: test.Plan}
+		if test.ResultsUrl != "" {
+			testCase.Properties = &JunitProperties{Properties: []JunitProperty{{Name: "results_url", Value: test.ResultsUrl}}}
+			testCase.SystemOut = fmt.Sprintf("Artifacts: %v", test.ResultsUrl)
+		}
+
+		switch test.State {
+		case "pass":
+		case "fail":
+			testCase.Failure = JunitFailure(job.Failures[test.TestCase])
+			suite.Failures++
+			junit.Failures++
+		case "cancelled":
+			testCase.Skipped = &JunitMessage{Message: "Test case was cancelled"}
+			suite.Skipped++
+			junit.Skipped++
+		default:
+			testCase.Skipped = &JunitMessage{Message: fmt.Sprintf("Test case hasn't finished, it's %v", test.State)}
+			suite.Skipped++
+			junit.Skipped++
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+		junit.Tests++
+	}
+	return junit
+}
+
+// JunitFailure summarises the failed suites and tests of a test case, the
+// message is the first failure and the text lists all of them
+func JunitFailure(failures []TestResult) *JunitMessage {
+	if len(failures) == 0 {
+		return &JunitMessage{Message: "Test case failed"}
+	}
+	var lines []string
+	for _, failure := range failures {
+		name := failure.Name
+		if failure.Suite != "" {
+			name = fmt.Sprintf("%v.%v", failure.Suite, failure.Name)
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v", name, failure.Message))
+	}
+	return &JunitMessage{Message: failures[0].Message, Text: strings.Join(lines, "\n")}
+}
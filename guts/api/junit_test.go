@@ -0,0 +1,169 @@
+package api
+
+import (
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"reflect"
+	"testing"
+)
+
+func TestJobToJunit(t *testing.T) {
+	var job JobWithTestsDetails
+	job.Job.Uuid = "eccd3988-490d-4414-be97-605d1ac81073"
+	job.Failures = map[string][]TestResult{
+		"Firefox-Example-New-Tab": {
+			{Kind: "test", Suite: "Firefox-Example-New-Tab", Name: "Open A New Tab", Status: "FAIL", Message: "Couldn't find template new-tab.png on screen"},
+		},
+	}
+	tests := []JobTest{
+		{Plan: "tests/firefox-example/plans/extended.yaml", TestCase: "Firefox-Example-Basic", State: "pass", ResultsUrl: "http://localhost:9999/res-1.tar.gz"},
+		{Plan: "tests/firefox-example/plans/extended.yaml", TestCase: "Firefox-Example-New-Tab", State: "fail", ResultsUrl: "http://localhost:9999/res-2.tar.gz"},
+		{Plan: "tests/firefox-example/plans/regular.yaml", TestCase: "Firefox-Example-Basic", State: "cancelled"},
+		{Plan: "tests/firefox-example/plans/extended.yaml", TestCase: "Firefox-Example-Private", State: "fail", ResultsUrl: "http://localhost:9999/res-3.tar.gz"},
+		{Plan: "tests/firefox-example/plans/regular.yaml", TestCase: "Firefox-Example-New-Tab", State: "spawning"},
+	}
+
+	expectedJunit := JunitTestSuites{
+		Name:     "eccd3988-490d-4414-be97-605d1ac81073",
+		Tests:    5,
+		Failures: 2,
+		Skipped:  2,
+		Suites: []JunitTestSuite{
+			{
+				Name:     "tests/firefox-example/plans/extended.yaml",
+				Tests:    3,
+				Failures: 2,
+				Cases: []JunitTestCase{
+					{
+						Name:       "Firefox-Example-Basic",
+						ClassName:  "tests/firefox-example/plans/extended.yaml",
+						Properties: &JunitProperties{Properties: []JunitProperty{{Name: "results_url", Value: "http://localhost:9999/res-1.tar.gz"}}},
+						SystemOut:  "Artifacts: http://localhost:9999/res-1.tar.gz",
+					},
+					{
+						Name:       "Firefox-Example-New-Tab",
+						ClassName:  "tests/firefox-example/plans/extended.yaml",
+						Properties: &JunitProperties{Properties: []JunitProperty{{Name: "results_url", Value: "http://localhost:9999/res-2.tar.gz"}}},
+						Failure:    &JunitMessage{Message: "Couldn't find template new-tab.png on screen", Text: "Firefox-Example-New-Tab.Open A New Tab: Couldn't find template new-tab.png on screen"},
+						SystemOut:  "Artifacts: http://localhost:9999/res-2.tar.gz",
+					},
+					{
+						Name:       "Firefox-Example-Private",
+						ClassName:  "tests/firefox-example/plans/extended.yaml",
+						Properties: &JunitProperties{Properties: []JunitProperty{{Name: "results_url", Value: "http://localhost:9999/res-3.tar.gz"}}},
+						Failure:    &JunitMessage{Message: "Test case failed"},
+						SystemOut:  "Artifacts: http://localhost:9999/res-3.tar.gz",
+					},
+				},
+			},
+			{
+				Name:    "tests/firefox-example/plans/regular.yaml",
+				Tests:   2,
+				Skipped: 2,
+				Cases: []JunitTestCase{
+					{
+						Name:      "Firefox-Example-Basic",
+						ClassName: "tests/firefox-example/plans/regular.yaml",
+						Skipped:   &JunitMessage{Message: "Test case was cancelled"},
+					},
+					{
+						Name:      "Firefox-Example-New-Tab",
+						ClassName: "tests/firefox-example/plans/regular.yaml",
+						Skipped:   &JunitMessage{Message: "Test case hasn't finished, it's spawning"},
+					},
+				},
+			},
+		},
+	}
+	junit := JobToJunit(job, tests)
+	if !reflect.DeepEqual(junit, expectedJunit) {
+		t.Errorf("unexpected junit!\nexpected: %v\nactual: %v", expectedJunit, junit)
+	}
+}
+
+func TestJunitFailure(t *testing.T) {
+	failures := []TestResult{
+		{Kind: "suite", Name: "Firefox-Example-Basic", Status: "FAIL", Message: "Suite setup failed"},
+		{Kind: "test", Suite: "Firefox-Example-Basic", Name: "Open Firefox", Status: "FAIL", Message: "Parent suite setup failed"},
+	}
+	expectedFailure := &JunitMessage{
+		Message: "Suite setup failed",
+		Text:    "Firefox-Example-Basic: Suite setup failed\nFirefox-Example-Basic.Open Firefox: Parent suite setup failed",
+	}
+	failure := JunitFailure(failures)
+	if !reflect.DeepEqual(failure, expectedFailure) {
+		t.Errorf("unexpected failure!\nexpected: %v\nactual: %v", expectedFailure, failure)
+	}
+}
+
+func TestJunitToXml(t *testing.T) {
+	junit := JunitTestSuites{
+		Name:     "eccd3988-490d-4414-be97-605d1ac81073",
+		Tests:    2,
+		Failures: 1,
+		Suites: []JunitTestSuite{
+			{
+				Name:     "tests/firefox-example/plans/extended.yaml",
+				Tests:    2,
+				Failures: 1,
+				Cases: []JunitTestCase{
+					{Name: "Firefox-Example-Basic", ClassName: "tests/firefox-example/plans/extended.yaml"},
+					{
+						Name:       "Firefox-Example-New-Tab",
+						ClassName:  "tests/firefox-example/plans/extended.yaml",
+						Properties: &JunitProperties{Properties: []JunitProperty{{Name: "results_url", Value: "http://localhost:9999/res-2.tar.gz"}}},
+						Failure:    &JunitMessage{Message: "Couldn't find <new-tab.png>", Text: "Open A New Tab: Couldn't find <new-tab.png>"},
+						SystemOut:  "Artifacts: http://localhost:9999/res-2.tar.gz",
+					},
+				},
+			},
+		},
+	}
+	expectedXml := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="eccd3988-490d-4414-be97-605d1ac81073" tests="2" failures="1" skipped="0">
+  <testsuite name="tests/firefox-example/plans/extended.yaml" tests="2" failures="1" skipped="0">
+    <testcase name="Firefox-Example-Basic" classname="tests/firefox-example/plans/extended.yaml"></testcase>
+    <testcase name="Firefox-Example-New-Tab" classname="tests/firefox-example/plans/extended.yaml">
+      <properties>
+        <property name="results_url" value="http://localhost:9999/res-2.tar.gz"></property>
+      </properties>
+      <failure message="Couldn&#39;t find &lt;new-tab.png&gt;">Open A New Tab: Couldn&#39;t find &lt;new-tab.png&gt;</failure>
+      <system-out>Artifacts: http://localhost:9999/res-2.tar.gz</system-out>
+    </testcase>
+  </testsuite>
+</testsuites>`
+	junitXml, err := junit.ToXml()
+	utils.CheckError(err)
+	if string(junitXml) != expectedXml {
+		t.Errorf("unexpected xml!\nexpected: %v\nactual: %v", expectedXml, string(junitXml))
+	}
+}
+
+func TestGetJobJunit(t *testing.T) {
+	Uuid := "eccd3988-490d-4414-be97-605d1ac81073"
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	junit, err := GetJobJunit(Uuid, Driver)
+	utils.CheckError(err)
+	if junit.Tests != 3 || junit.Failures != 3 || len(junit.Suites) != 1 {
+		t.Errorf("unexpected junit totals!\nexpected: %v tests, %v failures in %v suite\nactual: %v tests, %v failures in %v suites", 3, 3, 1, junit.Tests, junit.Failures, len(junit.Suites))
+	}
+	expectedFailure := &JunitMessage{
+		Message: "Couldn't find template new-tab.png on screen",
+		Text:    "Firefox-Example-New-Tab.Open A New Tab: Couldn't find template new-tab.png on screen",
+	}
+	if len(junit.Suites) == 1 && !reflect.DeepEqual(junit.Suites[0].Cases[1].Failure, expectedFailure) {
+		t.Errorf("unexpected failure!\nexpected: %v\nactual: %v", expectedFailure, junit.Suites[0].Cases[1].Failure)
+	}
+
+	_, err = GetJobJunit("21a57878-3307-449c-9f71-9f3f5d11f41c", Driver)
+	expectedErr := UuidNotFoundError{uuid: "21a57878-3307-449c-9f71-9f3f5d11f41c"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
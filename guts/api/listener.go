@@ -3,8 +3,11 @@ package api
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
 	"guts.ubuntu.com/v2/utils"
+	"log"
 	"net/http"
+	"strings"
 )
 
 // ignore coverage here - it's not smart enough for gin contexts
@@ -30,18 +33,29 @@ func RequestEndpoint(c *gin.Context) { // coverage-ignore
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		case InvalidArtifactTypeError:
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case UnknownTestbedError:
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		case NonWhitelistedDomainError:
 			c.IndentedJSON(http.StatusForbidden, gin.H{"message": err.Error()})
 		case utils.GenericGitError:
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		case PlanFileNonexistentError:
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case InvalidReportingUrlError:
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		}
 		return
 	}
 	c.IndentedJSON(http.StatusOK, retJson)
 }
 
+// ignore coverage here - it's not smart enough for gin contexts
+func TestbedsEndpoint(c *gin.Context) { // coverage-ignore
+	gutsCfg, _, _, err := Setup()
+	utils.CheckError(err)
+	c.IndentedJSON(http.StatusOK, TestbedAliases(gutsCfg.Testbeds).ToJson())
+}
+
 // ignore coverage here - it's not smart enough for gin contexts
 func JobEndpoint(c *gin.Context) { // coverage-ignore
 	_, Driver, _, err := Setup()
@@ -63,6 +77,158 @@ func JobEndpoint(c *gin.Context) { // coverage-ignore
 	c.IndentedJSON(http.StatusOK, job.ToJson())
 }
 
+// ignore coverage here - it's not smart enough for gin contexts
+func JobJunitEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	junit, err := GetJobJunit(uuid, Driver)
+	if err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case UuidNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	junitXml, err := junit.ToXml()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", junitXml)
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func JobEventsEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if _, err = FindJobByUuid(uuid, Driver); err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case UuidNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	// start listening before taking the snapshot, so no change falls in between
+	listener, err := Driver.Listen(JobEventsChannel)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error:\n%v", err.Error())})
+		return
+	}
+	defer utils.DeferredErrCheck(listener.Close)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	err = StreamJobEvents(
+		c.Request.Context(),
+		uuid,
+		listener.Notifications(),
+		func() ([]JobEvent, error) {
+			return GetJobEventsSnapshot(uuid, Driver)
+		},
+		func(event JobEvent) {
+			c.SSEvent(event.Type, event.ToJson())
+			c.Writer.Flush()
+		},
+		func() {
+			_, _ = c.Writer.WriteString(": keepalive\n\n")
+			c.Writer.Flush()
+		},
+	)
+	if err != nil {
+		log.Printf("event stream for %v stopped: %v\n", uuid, err)
+	}
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func TestAttemptsEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	attempts, err := GetTestCaseAttempts(uuid, c.Param("test_case"), Driver)
+	if err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case UuidNotFoundError, TestCaseNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	c.IndentedJSON(http.StatusOK, attempts.ToJson())
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func JobsEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	filter, err := ParseJobsFilter(c.Request.URL.Query())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	page, err := ListJobs(filter, Driver)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error:\n%v", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page.ToJson())
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func CancelJobEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	bareKey := c.GetHeader("X-Api-Key")
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	retJson, err := CancelJob(bareKey, uuid, Driver)
+	if err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case EmptyApiKeyError:
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case ApiKeyNotAcceptedError:
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case UuidNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		case JobNotOwnedError:
+			c.IndentedJSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		case JobAlreadyFinishedError:
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	c.IndentedJSON(http.StatusOK, retJson)
+}
+
 // ignore coverage here - it's not smart enough for gin contexts
 func ArtifactsEndpoint(c *gin.Context) { // coverage-ignore
 	GutsCfg, Driver, _, err := Setup()
@@ -71,9 +237,19 @@ func ArtifactsEndpoint(c *gin.Context) { // coverage-ignore
 	err = utils.ValidateUuid(uuid)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
 	}
-	artifactsTarGz, err := CollateArtifacts(uuid, Driver, GutsCfg)
+	c.Header("Content-Type", "application/x-gzip")
+	err = CollateArtifacts(uuid, Driver, GutsCfg, c.Writer)
 	if err != nil {
+		if c.Writer.Written() {
+			// the status is already sent, all that's left is to cut the
+			// tarball short so the client can tell it's broken
+			log.Printf("streaming artifacts for %v failed: %v\n", uuid, err)
+			c.Abort()
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
 		switch t := err.(type) {
 		default: // coverage-ignore
 			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
@@ -81,5 +257,125 @@ func ArtifactsEndpoint(c *gin.Context) { // coverage-ignore
 			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
 		}
 	}
-	c.Data(http.StatusOK, "application/x-tar", artifactsTarGz)
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func TestCaseArtifactsEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	testCase, isTarball := strings.CutSuffix(c.Param("test_case"), ".tar.gz")
+	if !isTarball {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("%v isn't a test case tarball", c.Param("test_case"))})
+		return
+	}
+	c.Header("Content-Type", "application/x-gzip")
+	err = StreamTestCaseArtifacts(uuid, testCase, Driver, c.Writer)
+	if err != nil {
+		if c.Writer.Written() {
+			log.Printf("streaming artifacts of %v for %v failed: %v\n", testCase, uuid, err)
+			c.Abort()
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case UuidNotFoundError, TestCaseNotFoundError, ArtifactsNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		}
+	}
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func TestCaseArtifactFileEndpoint(c *gin.Context) { // coverage-ignore
+	GutsCfg, Driver, _, err := Setup()
+	utils.CheckError(err)
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	testCase := c.Param("test_case")
+	filePath := c.Param("path")
+	// a bare trailing slash lists the files, anything else fetches one
+	if filePath == "/" {
+		tree, err := ListTestCaseArtifacts(uuid, testCase, Driver, GutsCfg)
+		if err != nil {
+			switch t := err.(type) {
+			default: // coverage-ignore
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+			case UuidNotFoundError, TestCaseNotFoundError, ArtifactsNotFoundError:
+				c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			}
+			return
+		}
+		c.IndentedJSON(http.StatusOK, tree.ToJson())
+		return
+	}
+	data, contentType, err := GetTestCaseArtifactFile(uuid, testCase, filePath, Driver, GutsCfg)
+	if err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case UuidNotFoundError, TestCaseNotFoundError, ArtifactsNotFoundError, ArtifactFileNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		case ArtifactFileTooLargeError:
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// ignore coverage here - it's not smart enough for gin contexts
+func VncEndpoint(c *gin.Context) { // coverage-ignore
+	_, Driver, _, err := Setup()
+	utils.CheckError(err)
+	// browsers can't set headers on websocket requests, so also accept the
+	// key as a query parameter for noVNC
+	bareKey := c.GetHeader("X-Api-Key")
+	if bareKey == "" {
+		bareKey = c.Query("api_key")
+	}
+	uuid := c.Param("uuid")
+	err = utils.ValidateUuid(uuid)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	vncAddress, err := GetVncAddressForViewer(bareKey, uuid, c.Param("test_case"), Driver)
+	if err != nil {
+		switch t := err.(type) {
+		default: // coverage-ignore
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Internal server error of type %v:\n%v", t, err.Error())})
+		case EmptyApiKeyError:
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case ApiKeyNotAcceptedError:
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case TestCaseNotFoundError:
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		case TestNotViewableError:
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			SelectVncSubprotocol(config)
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			if err := ProxyVnc(ws, vncAddress); err != nil {
+				log.Printf("vnc proxy for %v %v stopped: %v\n", uuid, c.Param("test_case"), err)
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
 }
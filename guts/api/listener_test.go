@@ -25,7 +25,7 @@ func SetUpRouter() *gin.Engine {
 func TestJobEndpoint(t *testing.T) {
 	r := SetUpRouter()
 	r.GET("/job/:uuid", JobEndpoint)
-	ExpectedResponse := `"{\"Job\":{\"uuid\":\"4ce9189f-561a-4886-aeef-1836f28b073b\",\"artifact_url\":null,\"tests_repo\":\"https://github.com/canonical/ubuntu-gui-testing.git\",\"tests_repo_branch\":\"main\",\"tests_plans\":[\"tests/firefox-example/plans/extended.yaml\",\"tests/firefox-example/plans/regular.yaml\"],\"image_url\":\"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso\",\"reporter\":\"test_observer\",\"status\":\"running\",\"submitted_at\":\"2025-07-23T14:17:14.632177Z\",\"requester\":\"andersson123\",\"debug\":false,\"priority\":11},\"results\":{\"Firefox-Example-Basic\":\"requested\",\"Firefox-Example-New-Tab\":\"spawning\"}}"`
+	ExpectedResponse := `"{\"Job\":{\"uuid\":\"4ce9189f-561a-4886-aeef-1836f28b073b\",\"artifact_url\":null,\"tests_repo\":\"https://github.com/canonical/ubuntu-gui-testing.git\",\"tests_repo_branch\":\"main\",\"tests_plans\":[\"tests/firefox-example/plans/extended.yaml\",\"tests/firefox-example/plans/regular.yaml\"],\"image_url\":\"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso\",\"testbed_alias\":\"\",\"reporter\":\"test_observer\",\"status\":\"running\",\"submitted_at\":\"2025-07-23T14:17:14.632177Z\",\"requester\":\"andersson123\",\"debug\":false,\"priority\":11,\"retries\":0},\"results\":{\"Firefox-Example-Basic\":\"requested\",\"Firefox-Example-New-Tab\":\"spawning\"},\"attempts\":{},\"failures\":{}}"`
 	Uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
 	reqFound, _ := http.NewRequest("GET", "/job/"+Uuid, nil)
 	w := httptest.NewRecorder()
@@ -68,6 +68,94 @@ func TestJobEndpointInvalidUuid(t *testing.T) {
 	}
 }
 
+func TestJobsEndpoint(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/jobs", JobsEndpoint)
+
+	reqFound, _ := http.NewRequest("GET", "/jobs?requester=andersson123&limit=1", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	expectedCode := 200
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
+func TestTestbedsEndpoint(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/testbeds", TestbedsEndpoint)
+
+	req, _ := http.NewRequest("GET", "/testbeds", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	expectedCode := 200
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "noble-desktop") {
+		t.Errorf("Testbed aliases not listed!\nActual: %v", w.Body.String())
+	}
+}
+
+func TestJobsEndpointInvalidQuery(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/jobs", JobsEndpoint)
+
+	reqFound, _ := http.NewRequest("GET", "/jobs?status=exploded", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	expectedCode := 400
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
+func TestJobJunitEndpoint(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/junit.xml", JobJunitEndpoint)
+
+	expectedCodes := map[string]int{
+		"/job/eccd3988-490d-4414-be97-605d1ac81073/junit.xml": 200,
+		"/job/21a57878-3307-449c-9f71-9f3f5d11f41c/junit.xml": 404,
+		"/job/asdf/junit.xml": 400,
+	}
+	for path, expectedCode := range expectedCodes {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if !reflect.DeepEqual(w.Code, expectedCode) {
+			t.Errorf("Unexpected exit code for %v!\nExpected: %v\nActual: %v", path, expectedCode, w.Code)
+		}
+	}
+}
+
+func TestTestAttemptsEndpoint(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/tests/:test_case/attempts", TestAttemptsEndpoint)
+	Uuid := "4bfebbd7-1c5d-4f63-a773-7c766bec7b2e"
+
+	reqFound, _ := http.NewRequest("GET", "/job/"+Uuid+"/tests/Multipass-Basic/attempts", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+	expectedCode := 200
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+
+	reqNotFound, _ := http.NewRequest("GET", "/job/"+Uuid+"/tests/Firefox-Example-Basic/attempts", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, reqNotFound)
+	expectedCode = 404
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
 func TestArtifactsEndpoint(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
@@ -85,6 +173,34 @@ func TestArtifactsEndpoint(t *testing.T) {
 	}
 }
 
+func TestTestCaseArtifactsEndpoints(t *testing.T) {
+	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
+	defer utils.DeferredErrCheck(servingProcess.Kill)
+
+	r := SetUpRouter()
+	r.GET("/artifacts/:uuid/:test_case", TestCaseArtifactsEndpoint)
+	r.GET("/artifacts/:uuid/:test_case/*path", TestCaseArtifactFileEndpoint)
+	Uuid := "27549483-e8f5-497f-a05d-e6d8e67a8e8a"
+
+	expectedCodes := map[string]int{
+		"/artifacts/" + Uuid + "/Farnsworth-Basic-1.tar.gz":     200,
+		"/artifacts/" + Uuid + "/Farnsworth-Basic-1/":           200,
+		"/artifacts/" + Uuid + "/Farnsworth-Basic-1/output.xml": 200,
+		"/artifacts/" + Uuid + "/Farnsworth-Basic-1/slurm.png":  404,
+		"/artifacts/" + Uuid + "/Slurm-Basic.tar.gz":            404,
+		"/artifacts/" + Uuid + "/Farnsworth-Basic-1":            404,
+		"/artifacts/asdf/Farnsworth-Basic-1/output.xml":         400,
+	}
+	for path, expectedCode := range expectedCodes {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if !reflect.DeepEqual(w.Code, expectedCode) {
+			t.Errorf("Unexpected exit code for %v!\nExpected: %v\nActual: %v", path, expectedCode, w.Code)
+		}
+	}
+}
+
 func TestArtifactsEndpointUnknownUuid(t *testing.T) {
 	r := SetUpRouter()
 	r.GET("/artifacts/:uuid/results.tar.gz", ArtifactsEndpoint)
@@ -318,3 +434,155 @@ func TestRequestEndpointBadPlanFile(t *testing.T) {
 		t.Errorf("wtf! code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, w.Code, w.Body.String())
 	}
 }
+
+func TestCancelJobEndpointSuccess(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	utils.CheckError(err)
+
+	andersson123KeyPreSha := "4c126f75-c7d8-4a89-9370-f065e7ff4208"
+	timData, err := GetAuthDataForKey(utils.Sha256sumOfString(andersson123KeyPreSha), Driver)
+	utils.CheckError(err)
+
+	jobEntry := CreateJobEntry(MakeDummyJobReq(), timData)
+	err = WriteJobEntryToDb(jobEntry, "", Driver)
+	utils.CheckError(err)
+
+	r := SetUpRouter()
+	r.DELETE("/job/:uuid", CancelJobEndpoint)
+
+	reqFound, _ := http.NewRequest("DELETE", "/job/"+jobEntry.Uuid, nil)
+	reqFound.Header.Add("X-Api-Key", andersson123KeyPreSha)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	// cancelling a second time should be rejected
+	reqAgain, _ := http.NewRequest("DELETE", "/job/"+jobEntry.Uuid, nil)
+	reqAgain.Header.Add("X-Api-Key", andersson123KeyPreSha)
+	wAgain := httptest.NewRecorder()
+	r.ServeHTTP(wAgain, reqAgain)
+
+	schedulerDriver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
+	utils.CheckError(err)
+	err = schedulerDriver.NukeUuid(jobEntry.Uuid)
+	utils.CheckError(err)
+
+	expectedCode := 200
+	if w.Code != expectedCode {
+		t.Errorf("code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, w.Code, w.Body.String())
+	}
+	expectedCode = 409
+	if wAgain.Code != expectedCode {
+		t.Errorf("code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, wAgain.Code, wAgain.Body.String())
+	}
+}
+
+func TestCancelJobEndpointNotOwned(t *testing.T) {
+	r := SetUpRouter()
+	r.DELETE("/job/:uuid", CancelJobEndpoint)
+
+	// requested by dloose
+	Uuid := "bc0b65b1-97d2-4be8-a472-d68d2a24f006"
+	reqFound, _ := http.NewRequest("DELETE", "/job/"+Uuid, nil)
+	reqFound.Header.Add("X-Api-Key", "4c126f75-c7d8-4a89-9370-f065e7ff4208")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	expectedCode := 403
+	if w.Code != expectedCode {
+		t.Errorf("code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, w.Code, w.Body.String())
+	}
+}
+
+func TestCancelJobEndpointEmptyApiKey(t *testing.T) {
+	r := SetUpRouter()
+	r.DELETE("/job/:uuid", CancelJobEndpoint)
+
+	Uuid := "bc0b65b1-97d2-4be8-a472-d68d2a24f006"
+	reqFound, _ := http.NewRequest("DELETE", "/job/"+Uuid, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	expectedCode := 401
+	if w.Code != expectedCode {
+		t.Errorf("code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, w.Code, w.Body.String())
+	}
+}
+
+func TestCancelJobEndpointUnknownUuid(t *testing.T) {
+	r := SetUpRouter()
+	r.DELETE("/job/:uuid", CancelJobEndpoint)
+
+	Uuid := "3676ead0-6d93-422d-91cc-0da81d6f594a"
+	reqFound, _ := http.NewRequest("DELETE", "/job/"+Uuid, nil)
+	reqFound.Header.Add("X-Api-Key", "4c126f75-c7d8-4a89-9370-f065e7ff4208")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, reqFound)
+
+	expectedCode := 404
+	if w.Code != expectedCode {
+		t.Errorf("code is expected to be %v but is actually %v, and response string is:\n%v", expectedCode, w.Code, w.Body.String())
+	}
+}
+
+func TestVncEndpointEmptyApiKey(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/tests/:test_case/vnc", VncEndpoint)
+
+	Uuid := "bc0b65b1-97d2-4be8-a472-d68d2a24f006"
+	req, _ := http.NewRequest("GET", "/job/"+Uuid+"/tests/Firmware-Updater-Tpm-Fde/vnc", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	expectedCode := 401
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
+func TestVncEndpointUnknownTestCase(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/tests/:test_case/vnc", VncEndpoint)
+
+	Uuid := "bc0b65b1-97d2-4be8-a472-d68d2a24f006"
+	req, _ := http.NewRequest("GET", "/job/"+Uuid+"/tests/Slurm-Basic/vnc?api_key=4c126f75-c7d8-4a89-9370-f065e7ff4208", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	expectedCode := 404
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
+func TestJobEventsEndpointUnknownUuid(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/events", JobEventsEndpoint)
+
+	Uuid := "3676ead0-6d93-422d-91cc-0da81d6f594a"
+	req, _ := http.NewRequest("GET", "/job/"+Uuid+"/events", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	expectedCode := 404
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
+
+func TestJobEventsEndpointInvalidUuid(t *testing.T) {
+	r := SetUpRouter()
+	r.GET("/job/:uuid/events", JobEventsEndpoint)
+
+	req, _ := http.NewRequest("GET", "/job/asdf/events", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	expectedCode := 400
+
+	if !reflect.DeepEqual(w.Code, expectedCode) {
+		t.Errorf("Unexpected exit code!\nExpected: %v\nActual: %v", expectedCode, w.Code)
+	}
+}
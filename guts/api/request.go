@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -16,6 +17,9 @@ import (
 	"time"
 )
 
+// base_reporting_url is a VARCHAR(300)
+const maxReportingUrlLength = 300
+
 type JobRequest struct {
 	ArtifactUrl     *string  `json:"artifact_url"` // has to be a pointer because it can be empty
 	TestsRepo       string   `json:"tests_repo"`
@@ -25,6 +29,8 @@ type JobRequest struct {
 	Debug           bool     `json:"debug"`
 	Priority        int      `json:"priority"`
 	Reporter        string   `json:"reporter"`
+	ReportingUrl    string   `json:"reporting_url"` // where the reporter reports the results to
+	Retries         int      `json:"retries"`
 }
 
 func (j JobRequest) ToJson() string {
@@ -39,6 +45,7 @@ type UserData struct {
 	Username    string
 	Key         string
 	MaxPriority int
+	MaxRetries  int
 }
 
 func ParseJobFromJson(jsonData []byte) (JobRequest, error) {
@@ -60,14 +67,23 @@ func ProcessJobRequest(cfgPath, apiKey string, jobReq JobRequest, driver databas
 	if err = ValidateArtifactUrl(*jobReq.ArtifactUrl, cfgPath); err != nil {
 		return "", err
 	}
+	imageUrl, testbedAlias, err := ResolveTestbedAlias(jobReq.TestBed, cfgPath)
+	if err != nil {
+		return "", err
+	}
+	jobReq.TestBed = imageUrl
 	if err = ValidateTestbedUrl(jobReq.TestBed, cfgPath); err != nil {
 		return "", err
 	}
 	if err = ValidateTestData(jobReq.TestsRepoBranch, jobReq.TestsRepo, jobReq.TestsPlans); err != nil {
 		return "", err
 	}
+	if err = ValidateReportingUrl(jobReq.Reporter, jobReq.ReportingUrl); err != nil {
+		return "", err
+	}
 	jobRow := CreateJobEntry(jobReq, userData)
-	if err = WriteJobEntryToDb(jobRow, driver); err != nil { // coverage-ignore
+	jobRow.TestbedAlias = testbedAlias
+	if err = WriteJobEntryToDb(jobRow, jobReq.ReportingUrl, driver); err != nil { // coverage-ignore
 		return "", err
 	}
 	returnJson := fmt.Sprintf(`{"uuid": "%v", "status_url": "%v"}`, jobRow.Uuid, GetStatusUrlForUuid(jobRow.Uuid, cfgPath))
@@ -76,7 +92,7 @@ func ProcessJobRequest(cfgPath, apiKey string, jobReq JobRequest, driver databas
 
 func GetAuthDataForKey(key string, driver database.DbDriver) (UserData, error) {
 	var user UserData
-	var params = []string{"username", "key", "maximum_priority"}
+	var params = []string{"username", "key", "maximum_priority", "maximum_retries"}
 	row, err := driver.QueryRow("users", "key", key, params)
 	if err != nil { // coverage-ignore
 		return user, err
@@ -85,6 +101,7 @@ func GetAuthDataForKey(key string, driver database.DbDriver) (UserData, error) {
 		&user.Username,
 		&user.Key,
 		&user.MaxPriority,
+		&user.MaxRetries,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -102,6 +119,13 @@ func AuthorizeUserAndAssignPriority(shadKey string, jobReq JobRequest, driver da
 	if jobReq.Priority > userData.MaxPriority {
 		jobReq.Priority = userData.MaxPriority
 	}
+	// retries are capped the same way as the priority
+	if jobReq.Retries > userData.MaxRetries {
+		jobReq.Retries = userData.MaxRetries
+	}
+	if jobReq.Retries < 0 {
+		jobReq.Retries = 0
+	}
 	return userData, jobReq, nil
 }
 
@@ -229,6 +253,18 @@ func ValidateTestData(testsRepoBranch, testsRepo string, testPlans []string) err
 	return nil
 }
 
+// ValidateReportingUrl checks a job with a reporter has a url to report to, as
+// the reporter has nowhere to send its results otherwise
+func ValidateReportingUrl(reporter, reportingUrl string) error {
+	if reporter == "" {
+		return nil
+	}
+	if !utils.IsValidUrl(reportingUrl) || len(reportingUrl) > maxReportingUrlLength {
+		return InvalidReportingUrlError{reporter: reporter, url: reportingUrl}
+	}
+	return nil
+}
+
 func CreateJobEntry(job JobRequest, uData UserData) JobEntry { // coverage-ignore
 	var thisJob JobEntry
 	thisJob.Uuid = uuid.New().String()
@@ -243,12 +279,23 @@ func CreateJobEntry(job JobRequest, uData UserData) JobEntry { // coverage-ignor
 	thisJob.Requester = uData.Username
 	thisJob.Debug = job.Debug
 	thisJob.Priority = job.Priority
+	thisJob.Retries = job.Retries
 	return thisJob
 }
 
-func WriteJobEntryToDb(job JobEntry, driver database.DbDriver) error {
-	err := InsertJobsRow(job, driver)
-	return err
+// WriteJobEntryToDb writes a job, along with where its results are reported
+// to when it has a reporter, all at once or not at all
+func WriteJobEntryToDb(job JobEntry, reportingUrl string, driver database.DbDriver) error {
+	return driver.WithTx(context.Background(), func(tx database.DbDriver) error {
+		err := InsertJobsRow(job, tx)
+		if err != nil {
+			return err
+		}
+		if job.Reporter == "" {
+			return nil
+		}
+		return InsertReporterRow(job.Uuid, reportingUrl, tx)
+	})
 }
 
 // We don't test this function because it's only used for unit tests
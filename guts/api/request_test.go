@@ -5,6 +5,7 @@ import (
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -27,7 +28,7 @@ func TestParseJobFromJsonFails(t *testing.T) {
 }
 
 func TestGetAuthDataForKeySuccess(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -39,6 +40,7 @@ func TestGetAuthDataForKeySuccess(t *testing.T) {
 	expectedTimData.Username = "andersson123"
 	expectedTimData.Key = "ba580bf88cfbc949f4894c85f65e65932872073105cb79d44caafa416452fbf2"
 	expectedTimData.MaxPriority = 10
+	expectedTimData.MaxRetries = 3
 	timData, err := GetAuthDataForKey(andersson123Key, Driver)
 	utils.CheckError(err)
 	if !reflect.DeepEqual(expectedTimData, timData) {
@@ -47,7 +49,7 @@ func TestGetAuthDataForKeySuccess(t *testing.T) {
 }
 
 func TestGetAuthDataForKeyUnknownUser(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -63,7 +65,7 @@ func TestGetAuthDataForKeyUnknownUser(t *testing.T) {
 }
 
 func TestAuthorizeUserAndAssignPriorityReqUnderMaxPrio(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -83,7 +85,7 @@ func TestAuthorizeUserAndAssignPriorityReqUnderMaxPrio(t *testing.T) {
 }
 
 func TestAuthorizeUserAndAssignPriorityBadKey(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -106,7 +108,7 @@ func TestAuthorizeUserAndAssignPriorityBadKey(t *testing.T) {
 }
 
 func TestAuthorizeUserAndAssignPriorityReqMaxPrio(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -127,7 +129,7 @@ func TestAuthorizeUserAndAssignPriorityReqMaxPrio(t *testing.T) {
 }
 
 func TestAuthorizeUserAndAssignPriorityReqOverMaxPrio(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
@@ -147,6 +149,34 @@ func TestAuthorizeUserAndAssignPriorityReqOverMaxPrio(t *testing.T) {
 	}
 }
 
+func TestAuthorizeUserAndAssignPriorityReqOverMaxRetries(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	andersson123KeyPreSha := "4c126f75-c7d8-4a89-9370-f065e7ff4208"
+	andersson123Key := utils.Sha256sumOfString(andersson123KeyPreSha)
+
+	dummyJobReq := MakeDummyJobReq()
+	dummyJobReq.Retries = 100
+
+	timData, alteredJobReq, err := AuthorizeUserAndAssignPriority(andersson123Key, dummyJobReq, Driver)
+	utils.CheckError(err)
+	if alteredJobReq.Retries != timData.MaxRetries {
+		t.Errorf("Request retries are %v and should have been reduced to %v", alteredJobReq.Retries, timData.MaxRetries)
+	}
+
+	dummyJobReq.Retries = -1
+	_, alteredJobReq, err = AuthorizeUserAndAssignPriority(andersson123Key, dummyJobReq, Driver)
+	utils.CheckError(err)
+	if alteredJobReq.Retries != 0 {
+		t.Errorf("Request retries are %v and should have been raised to 0", alteredJobReq.Retries)
+	}
+}
+
 func TestValidateArtifactUrlDeb(t *testing.T) {
 	_, _, args, err := Setup()
 	utils.CheckError(err)
@@ -302,7 +332,7 @@ func TestValidateTestDataBadPlans(t *testing.T) {
 }
 
 func TestWriteJobEntryToDbSucceeds(t *testing.T) {
-	_, Driver, _, err := Setup()
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
 	utils.CheckError(err)
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
@@ -316,21 +346,46 @@ func TestWriteJobEntryToDbSucceeds(t *testing.T) {
 	utils.CheckError(err)
 
 	dummyJobReq := MakeDummyJobReq()
+	dummyJobReq.Reporter = "test_observer"
+	dummyJobReq.ReportingUrl = "https://tests-api.ubuntu.com/v1/test-executions/423"
 	jobEntry := CreateJobEntry(dummyJobReq, timData)
 
-	err = WriteJobEntryToDb(jobEntry, Driver)
+	err = WriteJobEntryToDb(jobEntry, dummyJobReq.ReportingUrl, Driver)
 	utils.CheckError(err)
 
 	Driver, err = database.TestDbDriver("guts_scheduler", "guts_scheduler")
 	utils.CheckError(err)
 
+	// the job is written along with where it's reported to
+	row, err := Driver.GetRow(database.Select("reporter", "base_reporting_url").Where("uuid=?", jobEntry.Uuid))
+	utils.CheckError(err)
+	var baseReportingUrl string
+	utils.CheckError(row.Scan(&baseReportingUrl))
+	if baseReportingUrl != dummyJobReq.ReportingUrl {
+		t.Errorf("unexpected reporting url!\nexpected: %v\nactual: %v", dummyJobReq.ReportingUrl, baseReportingUrl)
+	}
+
 	err = Driver.NukeUuid(jobEntry.Uuid)
 	utils.CheckError(err)
 }
 
+func TestValidateReportingUrl(t *testing.T) {
+	utils.CheckError(ValidateReportingUrl("", ""))
+	utils.CheckError(ValidateReportingUrl("test_observer", "https://tests-api.ubuntu.com/v1/test-executions/423"))
+
+	badUrls := []string{"", "tests-api", "https://tests-api.ubuntu.com/" + strings.Repeat("a", maxReportingUrlLength)}
+	for _, badUrl := range badUrls {
+		err := ValidateReportingUrl("test_observer", badUrl)
+		expectedErr := InvalidReportingUrlError{reporter: "test_observer", url: badUrl}
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+		}
+	}
+}
+
 func TestJobRequestToJson(t *testing.T) {
 	jobReq := MakeDummyJobReq()
-	expectedJson := `{"artifact_url":"myurl","tests_repo":"myrepo","tests_repo_branch":"main","tests_plans":["plan1","plan2"],"testbed":"mytestbedurl","debug":false,"priority":1,"reporter":""}`
+	expectedJson := `{"artifact_url":"myurl","tests_repo":"myrepo","tests_repo_branch":"main","tests_plans":["plan1","plan2"],"testbed":"mytestbedurl","debug":false,"priority":1,"reporter":"","reporting_url":"","retries":0}`
 	jobJson := jobReq.ToJson()
 	if expectedJson != jobJson {
 		t.Errorf("expected json not same as actual\nexpected: %v\nactual: %v", expectedJson, jobJson)
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"regexp"
+	"strings"
+)
+
+var (
+	testbedPlaceholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+	// placeholders can't hold dashes, so {release}-desktop-daily splits cleanly
+	testbedPlaceholderValue = `[a-z0-9.]+`
+)
+
+// TestbedAlias maps a shorthand for a testbed to the url of its image. The
+// name may hold placeholders in braces, e.g. {release}-desktop-daily, which
+// are filled into the same placeholders in the url
+type TestbedAlias struct {
+	Name        string `yaml:"name" json:"name"`
+	Url         string `yaml:"url" json:"url"`
+	Description string `yaml:"description" json:"description"`
+}
+
+type TestbedAliases []TestbedAlias
+
+func (t TestbedAliases) ToJson() string {
+	b, err := json.Marshal(t)
+	if err != nil { // coverage-ignore
+		return ""
+	}
+	return string(b)
+}
+
+// Match checks whether a requested testbed is this alias, and if so returns
+// the url it expands to
+func (t TestbedAlias) Match(testbed string) (string, bool) {
+	var pattern strings.Builder
+	var placeholders []string
+	last := 0
+	for _, loc := range testbedPlaceholderPattern.FindAllStringSubmatchIndex(t.Name, -1) {
+		pattern.WriteString(regexp.QuoteMeta(t.Name[last:loc[0]]))
+		pattern.WriteString(fmt.Sprintf("(%v)", testbedPlaceholderValue))
+		placeholders = append(placeholders, t.Name[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(t.Name[last:]))
+
+	match := regexp.MustCompile(fmt.Sprintf("^%v$", pattern.String())).FindStringSubmatch(testbed)
+	if match == nil {
+		return "", false
+	}
+	imageUrl := t.Url
+	for i, placeholder := range placeholders {
+		imageUrl = strings.ReplaceAll(imageUrl, fmt.Sprintf("{%v}", placeholder), match[i+1])
+	}
+	return imageUrl, true
+}
+
+// ResolveTestbed expands a testbed alias into the url of its image, taking
+// the first alias that matches. Testbeds that are already urls are left as
+// they are, with no alias
+func ResolveTestbed(testbed string, aliases []TestbedAlias) (string, string, error) {
+	if strings.Contains(testbed, "://") {
+		return testbed, "", nil
+	}
+	for _, alias := range aliases {
+		if imageUrl, ok := alias.Match(testbed); ok {
+			return imageUrl, testbed, nil
+		}
+	}
+	return "", "", UnknownTestbedError{testbed: testbed}
+}
+
+func ResolveTestbedAlias(testbed, cfgPath string) (string, string, error) {
+	gutsCfg, err := ParseConfig(cfgPath)
+	utils.CheckError(err)
+	return ResolveTestbed(testbed, gutsCfg.Testbeds)
+}
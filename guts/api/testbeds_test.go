@@ -0,0 +1,59 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveTestbed(t *testing.T) {
+	aliases := []TestbedAlias{
+		{Name: "{release}-desktop-daily", Url: "https://cdimage.ubuntu.com/{release}/daily-live/current/{release}-desktop-amd64.iso"},
+		{Name: "{release}-{flavour}-daily", Url: "https://cdimage.ubuntu.com/{flavour}/{release}/daily-live/current/{release}-desktop-amd64.iso"},
+		{Name: "noble-desktop", Url: "https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso"},
+	}
+	expectedUrls := map[string]string{
+		"questing-desktop-daily": "https://cdimage.ubuntu.com/questing/daily-live/current/questing-desktop-amd64.iso",
+		"noble-kubuntu-daily":    "https://cdimage.ubuntu.com/kubuntu/noble/daily-live/current/noble-desktop-amd64.iso",
+		"noble-desktop":          "https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso",
+	}
+	for testbed, expectedUrl := range expectedUrls {
+		imageUrl, alias, err := ResolveTestbed(testbed, aliases)
+		if err != nil {
+			t.Errorf("Unexpected error resolving %v: %v", testbed, err)
+		}
+		if imageUrl != expectedUrl || alias != testbed {
+			t.Errorf("Unexpected resolution of %v!\nExpected: %v %v\nActual: %v %v", testbed, expectedUrl, testbed, imageUrl, alias)
+		}
+	}
+
+	// urls aren't aliases
+	testbedUrl := "http://localhost:9999/questing-desktop-amd64.iso"
+	imageUrl, alias, err := ResolveTestbed(testbedUrl, aliases)
+	if err != nil || imageUrl != testbedUrl || alias != "" {
+		t.Errorf("Url %v shouldn't have been resolved, got %v %v %v", testbedUrl, imageUrl, alias, err)
+	}
+}
+
+func TestResolveTestbedUnknown(t *testing.T) {
+	aliases := []TestbedAlias{
+		{Name: "{release}-desktop-daily", Url: "https://cdimage.ubuntu.com/{release}/daily-live/current/{release}-desktop-amd64.iso"},
+		{Name: "noble-desktop", Url: "https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso"},
+	}
+	for _, testbed := range []string{"slurm-desktop", "questing-desktop-daily-daily", "-desktop-daily", "noble-desktop.iso"} {
+		_, _, err := ResolveTestbed(testbed, aliases)
+		expectedErr := UnknownTestbedError{testbed: testbed}
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("Unexpected error for %v!\nExpected: %v\nActual: %v", testbed, expectedErr, err)
+		}
+	}
+}
+
+func TestTestbedAliasesToJson(t *testing.T) {
+	aliases := TestbedAliases{
+		{Name: "noble-desktop", Url: "https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso", Description: "Ubuntu Desktop 24.04.3 LTS"},
+	}
+	expectedJson := `[{"name":"noble-desktop","url":"https://releases.ubuntu.com/noble/ubuntu-24.04.3-desktop-amd64.iso","description":"Ubuntu Desktop 24.04.3 LTS"}]`
+	if aliases.ToJson() != expectedJson {
+		t.Errorf("Unexpected json!\nExpected: %v\nActual: %v", expectedJson, aliases.ToJson())
+	}
+}
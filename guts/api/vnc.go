@@ -0,0 +1,106 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// states in which the test has a VM with a vnc server attached
+	VncViewableStates = []string{"spawned", "running"}
+	VncDialTimeout    = 10 * time.Second
+	// qemu's -vnc :N listens on tcp port VncBasePort+N
+	VncBasePort = 5900
+)
+
+// Don't need to test this directly, it's tested by listener_test.go
+func GetVncAddressForViewer(apiKey, uuidToView, testCase string, driver database.DbDriver) (string, error) { // coverage-ignore
+	if apiKey == "" {
+		return "", EmptyApiKeyError{}
+	}
+	shakey := utils.Sha256sumOfString(apiKey)
+	_, err := GetAuthDataForKey(shakey, driver)
+	if err != nil {
+		return "", ApiKeyNotAcceptedError{}
+	}
+	return FindVncAddress(uuidToView, testCase, driver)
+}
+
+func FindVncAddress(uuidToView, testCase string, driver database.DbDriver) (string, error) {
+	var vncAddress sql.NullString
+	var state string
+	row, err := driver.GetRow(database.Select("tests", "vnc_address", "state").Where("uuid=?", uuidToView).Where("test_case=?", testCase))
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	err = row.Scan(&vncAddress, &state)
+	if err == sql.ErrNoRows {
+		return "", TestCaseNotFoundError{uuid: uuidToView, testCase: testCase}
+	}
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	if !slices.Contains(VncViewableStates, state) || vncAddress.String == "" {
+		return "", TestNotViewableError{uuid: uuidToView, testCase: testCase, state: state}
+	}
+	return VncTcpAddress(vncAddress.String)
+}
+
+// VncTcpAddress converts the host:display address the spawner advertises
+// into the host:port address the vnc server actually listens on
+func VncTcpAddress(vncAddress string) (string, error) {
+	host, display, found := strings.Cut(vncAddress, ":")
+	if !found {
+		return "", fmt.Errorf("vnc address %v doesn't conform to expected syntax", vncAddress)
+	}
+	displayNumber, err := strconv.Atoi(display)
+	if err != nil {
+		return "", fmt.Errorf("vnc address %v doesn't conform to expected syntax", vncAddress)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(VncBasePort+displayNumber)), nil
+}
+
+// SelectVncSubprotocol picks the "binary" subprotocol if the client offers it,
+// as older noVNC versions refuse to connect otherwise
+func SelectVncSubprotocol(config *websocket.Config) {
+	if slices.Contains(config.Protocol, "binary") {
+		config.Protocol = []string{"binary"}
+	} else {
+		config.Protocol = nil
+	}
+}
+
+// ProxyVnc shuffles the RFB stream between the websocket and the vnc server
+// until either side hangs up
+func ProxyVnc(ws *websocket.Conn, vncAddress string) error {
+	vncConn, err := net.DialTimeout("tcp", vncAddress, VncDialTimeout)
+	if err != nil {
+		return err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(vncConn, ws)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(ws, vncConn)
+		done <- err
+	}()
+	err = <-done
+	// closing both ends unblocks whichever copy is still running
+	_ = ws.Close()
+	_ = vncConn.Close()
+	<-done
+	return err
+}
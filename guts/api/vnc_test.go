@@ -0,0 +1,167 @@
+package api
+
+import (
+	"golang.org/x/net/websocket"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVncTcpAddress(t *testing.T) {
+	address, err := VncTcpAddress("127.0.0.1:3")
+	utils.CheckError(err)
+	expectedAddress := "127.0.0.1:5903"
+	if address != expectedAddress {
+		t.Errorf("unexpected address!\nexpected: %v\nactual: %v", expectedAddress, address)
+	}
+}
+
+func TestVncTcpAddressInvalid(t *testing.T) {
+	for _, vncAddress := range []string{"127.0.0.1", "127.0.0.1:three"} {
+		_, err := VncTcpAddress(vncAddress)
+		if err == nil {
+			t.Errorf("vnc address %v should have been rejected", vncAddress)
+		}
+	}
+}
+
+func TestSelectVncSubprotocol(t *testing.T) {
+	var config websocket.Config
+	config.Protocol = []string{"base64", "binary"}
+	SelectVncSubprotocol(&config)
+	expectedProtocol := []string{"binary"}
+	if !reflect.DeepEqual(config.Protocol, expectedProtocol) {
+		t.Errorf("unexpected protocol!\nexpected: %v\nactual: %v", expectedProtocol, config.Protocol)
+	}
+
+	config.Protocol = []string{"base64"}
+	SelectVncSubprotocol(&config)
+	if config.Protocol != nil {
+		t.Errorf("no protocol should have been selected, but got %v", config.Protocol)
+	}
+}
+
+func TestProxyVnc(t *testing.T) {
+	// stand in for a vnc server by sending a greeting and echoing the reply
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(listener.Close)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("RFB 003.008\n"))
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	server := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			SelectVncSubprotocol(config)
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			_ = ProxyVnc(ws, listener.Addr().String())
+		},
+	})
+	defer server.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+	config, err := websocket.NewConfig(wsUrl, server.URL)
+	utils.CheckError(err)
+	config.Protocol = []string{"binary"}
+	ws, err := websocket.DialConfig(config)
+	utils.CheckError(err)
+	defer ws.Close()
+
+	greeting := make([]byte, 12)
+	_, err = io.ReadFull(ws, greeting)
+	utils.CheckError(err)
+	if string(greeting) != "RFB 003.008\n" {
+		t.Errorf("unexpected greeting!\nexpected: %v\nactual: %v", "RFB 003.008\n", string(greeting))
+	}
+
+	_, err = ws.Write([]byte("hello"))
+	utils.CheckError(err)
+	echo := make([]byte, 5)
+	_, err = io.ReadFull(ws, echo)
+	utils.CheckError(err)
+	if string(echo) != "hello" {
+		t.Errorf("unexpected echo!\nexpected: %v\nactual: %v", "hello", string(echo))
+	}
+}
+
+func TestProxyVncUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.CheckError(err)
+	address := listener.Addr().String()
+	utils.CheckError(listener.Close())
+
+	proxyErr := make(chan error, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		proxyErr <- ProxyVnc(ws, address)
+	}))
+	defer server.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, err := websocket.Dial(wsUrl, "", server.URL)
+	utils.CheckError(err)
+	defer ws.Close()
+
+	if err := <-proxyErr; err == nil {
+		t.Errorf("proxying to a closed port should have failed")
+	}
+}
+
+func TestFindVncAddress(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	address, err := FindVncAddress("bc0b65b1-97d2-4be8-a472-d68d2a24f006", "Firmware-Updater-Tpm-Fde", Driver)
+	utils.CheckError(err)
+	expectedAddress := "127.0.0.1:11889"
+	if address != expectedAddress {
+		t.Errorf("unexpected address!\nexpected: %v\nactual: %v", expectedAddress, address)
+	}
+}
+
+func TestFindVncAddressNotViewable(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	_, err = FindVncAddress("4ce9189f-561a-4886-aeef-1836f28b073b", "Firefox-Example-Basic", Driver)
+	expectedErr := TestNotViewableError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", testCase: "Firefox-Example-Basic", state: "requested"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
+
+func TestFindVncAddressUnknownTestCase(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	_, err = FindVncAddress("4ce9189f-561a-4886-aeef-1836f28b073b", "Slurm-Basic", Driver)
+	expectedErr := TestCaseNotFoundError{uuid: "4ce9189f-561a-4886-aeef-1836f28b073b", testCase: "Slurm-Basic"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+}
@@ -4,17 +4,31 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"guts.ubuntu.com/v2/api"
+	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
 )
 
 func main() { // coverage-ignore
 	router := gin.Default()
 	router.GET("/job/:uuid", api.JobEndpoint)
+	router.GET("/job/:uuid/events", api.JobEventsEndpoint)
+	router.GET("/job/:uuid/junit.xml", api.JobJunitEndpoint)
+	router.GET("/jobs", api.JobsEndpoint)
+	router.GET("/testbeds", api.TestbedsEndpoint)
+	router.DELETE("/job/:uuid", api.CancelJobEndpoint)
+	router.GET("/job/:uuid/tests/:test_case/vnc", api.VncEndpoint)
+	router.GET("/job/:uuid/tests/:test_case/attempts", api.TestAttemptsEndpoint)
 	router.GET("/artifacts/:uuid/results.tar.gz", api.ArtifactsEndpoint)
+	router.GET("/artifacts/:uuid/:test_case", api.TestCaseArtifactsEndpoint)
+	router.GET("/artifacts/:uuid/:test_case/*path", api.TestCaseArtifactFileEndpoint)
 	router.POST("/request/", api.RequestEndpoint)
 	args := api.ParseArgs()
 	GutsCfg, err := api.ParseConfig(args.ConfigFilePath)
 	utils.CheckError(err)
+	// refuse to serve from a schema this binary wasn't built for
+	Driver, err := database.NewDbDriver(GutsCfg.Database.Driver, GutsCfg.Database.ConnectionString)
+	utils.CheckError(err)
+	utils.CheckError(Driver.CheckSchemaVersion())
 	router_address := fmt.Sprintf("%v:%v", GutsCfg.Api.Hostname, GutsCfg.Api.Port)
 	err = router.Run(router_address)
 	utils.CheckError(err)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"log"
+	"os"
+)
+
+// guts-migrate brings the schema of the database up to the version it was
+// built for. It connects as the owner of the database, as the apps' own
+// users can't change the schema
+func main() { // coverage-ignore
+	var driver, connectionString string
+	var baseline int
+	var check bool
+	flag.StringVar(&driver, "driver", "postgres", "Database driver")
+	flag.StringVar(&connectionString, "connection-string", os.Getenv("GUTS_MIGRATE_CONNECTION_STRING"), "Connection string of the database, as its owner")
+	flag.IntVar(&baseline, "baseline", 0, "Record the migrations up to this version as applied without running them, for databases set up before migrations were tracked")
+	flag.BoolVar(&check, "check", false, "Only check the database is at the version of the schema guts-migrate was built for")
+	flag.Parse()
+
+	Driver, err := database.NewDbDriver(driver, connectionString)
+	utils.CheckError(err)
+
+	if check {
+		utils.CheckError(Driver.CheckSchemaVersion())
+		log.Println("database schema is up to date")
+		return
+	}
+
+	if baseline > 0 {
+		utils.CheckError(Driver.BaselineMigrations(context.Background(), baseline))
+		log.Printf("recorded migrations up to version %v as applied\n", baseline)
+	}
+
+	applied, err := Driver.Migrate(context.Background())
+	utils.CheckError(err)
+	for _, migration := range applied {
+		log.Printf("applied migration %v\n", migration.Name)
+	}
+	version, err := database.SchemaVersion()
+	utils.CheckError(err)
+	log.Printf("database schema is at version %v\n", version)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/reporter"
+	"guts.ubuntu.com/v2/utils"
+	"math/rand/v2"
+	"time"
+)
+
+func main() { // coverage-ignore
+	cfgPath := reporter.ParseArgs()
+
+	reporterCfg, err := reporter.ParseConfig(cfgPath)
+	utils.CheckError(err)
+
+	Driver, err := database.NewDbDriver(reporterCfg.Database.Driver, reporterCfg.Database.ConnectionString)
+	utils.CheckError(err)
+	// refuse to run against a schema this binary wasn't built for
+	utils.CheckError(Driver.CheckSchemaVersion())
+
+	for {
+		err = reporter.ReporterLoop(Driver, reporterCfg)
+		utils.CheckError(err)
+		// wait somewhere between 15 and 45 seconds before checking for finished jobs again
+		pollSleepDuration := time.Second * time.Duration(rand.IntN(30)+15)
+		time.Sleep(pollSleepDuration)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/runner"
 	"guts.ubuntu.com/v2/utils"
+	"log"
 	"math/rand/v2"
 	"time"
 )
@@ -19,11 +22,18 @@ func main() { // coverage-ignore
 	// Initialise the database driver
 	Driver, err := database.NewDbDriver(RunnerCfg.Database.Driver, RunnerCfg.Database.ConnectionString)
 	utils.CheckError(err)
+	// refuse to run against a schema this binary wasn't built for
+	utils.CheckError(Driver.CheckSchemaVersion())
 
 	for {
 		// perform the regular loop
-		err = runner.RunnerLoop(Driver, RunnerCfg)
-		utils.CheckError(err)
+		err = runner.RunnerLoop(context.Background(), Driver, RunnerCfg)
+		// a runner whose claim on its test was released moves on to the next
+		if errors.As(err, &database.ClaimLostError{}) {
+			log.Printf("Stopped running a test: %v", err)
+		} else {
+			utils.CheckError(err)
+		}
 		// wait somewhere between 30 and 90 seconds before checking for new jobs
 		pollSleepDuration := time.Second * time.Duration(rand.IntN(60)+30)
 		time.Sleep(pollSleepDuration)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/scheduler"
 	"guts.ubuntu.com/v2/utils"
@@ -16,10 +17,12 @@ func main() { // coverage-ignore
 
 	Driver, err := database.NewDbDriver(schedulerCfg.Database.Driver, schedulerCfg.Database.ConnectionString)
 	utils.CheckError(err)
+	// refuse to run against a schema this binary wasn't built for
+	utils.CheckError(Driver.CheckSchemaVersion())
 
 	for {
 		// perform the regular loop
-		err = scheduler.SchedulerLoop(Driver, schedulerCfg)
+		err = scheduler.SchedulerLoop(context.Background(), Driver, schedulerCfg)
 		utils.CheckError(err)
 		// wait somewhere between 15 and 45 seconds before starting the main scheduler loop again
 		pollSleepDuration := time.Second * time.Duration(rand.IntN(30)+15)
@@ -4,8 +4,6 @@ import (
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/spawner"
 	"guts.ubuntu.com/v2/utils"
-	"math/rand/v2"
-	"time"
 )
 
 func main() { // coverage-ignore
@@ -14,15 +12,17 @@ func main() { // coverage-ignore
 	utils.CheckError(err)
 	err = spawner.CreateCacheIfNotExists(SpawnerCfg)
 	utils.CheckError(err)
+	// remove the disks of VMs left behind when the spawner last died
+	err = spawner.CleanupOrphanedDisks(SpawnerCfg)
+	utils.CheckError(err)
 	Driver, err := database.NewDbDriver(SpawnerCfg.Database.Driver, SpawnerCfg.Database.ConnectionString)
 	utils.CheckError(err)
+	// refuse to run against a schema this binary wasn't built for
+	utils.CheckError(Driver.CheckSchemaVersion())
 
-	for {
-		// perform the regular loop
-		err = spawner.SpawnerLoop(Driver, SpawnerCfg)
-		utils.CheckError(err)
-		// wait somewhere between 30 and 90 seconds before checking for new jobs
-		pollSleepDuration := time.Second * time.Duration(rand.IntN(60)+30)
-		time.Sleep(pollSleepDuration)
-	}
+	VmPool, err := spawner.NewVmPool(SpawnerCfg)
+	utils.CheckError(err)
+	// spawn VMs for requested tests while there's room for them
+	err = VmPool.Run(Driver, SpawnerCfg)
+	utils.CheckError(err)
 }
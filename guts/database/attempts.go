@@ -0,0 +1,33 @@
+package database
+
+import (
+	"time"
+)
+
+// StartTestAttempt opens a new attempt for a test when a spawner picks it up,
+// recording where the test is being spawned
+func StartTestAttempt(id int, spawnerHost string, Driver DbDriver) error {
+	_, err := Driver.Exec(Insert("test_attempts", "test_id", "uuid", "test_case", "attempt", "spawner_host", "vnc_address", "started_at").
+		Rows(Select("tests", "id", "uuid", "test_case", "attempt").
+			Column("?", spawnerHost).
+			Column("vnc_address").
+			Column("?", time.Now()).
+			Where("id=?", id)))
+	return err
+}
+
+// FinishTestAttempt closes the open attempt of a test with the given outcome,
+// taking the commit hash and results url the test row holds at that point.
+// exitCode is nil when the test never got as far as yarf exiting. Finishing a
+// test with no open attempt does nothing, so it's safe to call more than once
+func FinishTestAttempt(id int, outcome string, exitCode *int, Driver DbDriver) error {
+	_, err := Driver.Exec(Update("test_attempts").
+		Set("state", outcome).
+		Set("exit_code", exitCode).
+		Set("finished_at", time.Now()).
+		SetExpr("commit_hash=(?)", Select("tests", "commit_hash").Where("tests.id=test_attempts.test_id")).
+		SetExpr("results_url=(?)", Select("tests", "results_url").Where("tests.id=test_attempts.test_id")).
+		Where("test_id=?", id).
+		Where("finished_at IS NULL"))
+	return err
+}
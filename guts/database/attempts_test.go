@@ -0,0 +1,43 @@
+package database
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"testing"
+)
+
+func TestStartAndFinishTestAttempt(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 13
+	err = StartTestAttempt(rowId, "spawner-1", Driver)
+	utils.CheckError(err)
+
+	exitCode := 999
+	err = FinishTestAttempt(rowId, "tempfail", &exitCode, Driver)
+	utils.CheckError(err)
+	// there's no open attempt left, so this shouldn't touch the finished one
+	err = FinishTestAttempt(rowId, "vm_died", nil, Driver)
+	utils.CheckError(err)
+
+	var state, spawnerHost, commitHash string
+	var recordedExitCode int
+	row, err := Driver.RunQueryRow(`SELECT state, spawner_host, exit_code, commit_hash FROM test_attempts WHERE test_id=13 ORDER BY id DESC LIMIT 1`)
+	utils.CheckError(err)
+	err = row.Scan(&state, &spawnerHost, &recordedExitCode, &commitHash)
+	utils.CheckError(err)
+
+	if state != "tempfail" || recordedExitCode != exitCode {
+		t.Errorf("Unexpected attempt outcome!\nExpected: %v %v\nActual: %v %v", "tempfail", exitCode, state, recordedExitCode)
+	}
+	if spawnerHost != "spawner-1" {
+		t.Errorf("Unexpected spawner host!\nExpected: %v\nActual: %v", "spawner-1", spawnerHost)
+	}
+	expectedCommitHash := "7c829b15bea308c05ed47ac0fdd2dd5425b96f21"
+	if commitHash != expectedCommitHash {
+		t.Errorf("Unexpected commit hash!\nExpected: %v\nActual: %v", expectedCommitHash, commitHash)
+	}
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ClaimLostError is returned when a worker writes to a test it no longer
+// holds the claim on, as the test was reset and possibly claimed by another
+// worker in the meantime
+type ClaimLostError struct {
+	id     int
+	worker string
+}
+
+func (c ClaimLostError) Error() string {
+	return fmt.Sprintf("Test %v is no longer claimed by %v", c.id, c.worker)
+}
+
+// WorkerName names a worker claiming tests, unique across hosts as long as
+// slot is unique on the host
+func WorkerName(slot string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	return fmt.Sprintf("%v:%v", hostname, slot), nil
+}
+
+// ClaimTest atomically claims the first test selected by candidate, a query
+// selecting tests.id, moving it to state and recording worker as its
+// claimant. Tests being claimed by other workers at the same time are skipped
+// rather than waited on, so no two workers can claim the same test. The id is
+// 0 and the uuid empty when there's no test to claim
+func (d DbDriver) ClaimTest(candidate *Query, state, worker string) (int, string, error) {
+	return d.Interface.InterfaceClaimTest(candidate, state, worker)
+}
+
+// UpdateClaimedTest runs update, an update of the tests table, on a test for
+// a worker holding the claim on it, failing with a ClaimLostError if it
+// doesn't anymore
+func (d DbDriver) UpdateClaimedTest(id int, worker string, update *Query) error {
+	updated, err := d.Exec(update.Where("id=?", id).Where("claimed_by=?", worker))
+	if err != nil { // coverage-ignore
+		return err
+	}
+	if updated == 0 {
+		return ClaimLostError{id: id, worker: worker}
+	}
+	return nil
+}
+
+// ReleaseClaimedTest hands a test a worker claimed but can't run back to be
+// claimed again, by this worker or another
+func (d DbDriver) ReleaseClaimedTest(id int, worker string) error {
+	return d.UpdateClaimedTest(id, worker, Update("tests").Set("state", "requested").Set("claimed_by", ""))
+}
+
+// SetClaimedTestStateTo is SetTestStateTo for a worker holding the claim on
+// a test
+func (d DbDriver) SetClaimedTestStateTo(id int, state, worker string) error {
+	return d.UpdateClaimedTest(id, worker, Update("tests").Set("state", state))
+}
+
+// HeartbeatClaimedTest updates the heartbeat of a test for a worker holding
+// the claim on it. A ClaimLostError tells the worker another worker may own
+// the test now, and it should stop working on it
+func (d DbDriver) HeartbeatClaimedTest(id int, worker string) error {
+	return d.UpdateClaimedTest(id, worker, Update("tests").Set("updated_at", time.Now()))
+}
+
+func (p PgOperationInterface) InterfaceClaimTest(candidate *Query, state, worker string) (int, string, error) {
+	var id int
+	var uuid string
+	// the candidate is locked by FOR UPDATE until the claim commits, and
+	// other claims skip over it instead of claiming it once it's unlocked
+	claimQuery, args, err := Update("tests").
+		Set("state", state).
+		Set("claimed_by", worker).
+		Where("id=(?)", candidate.ForUpdateSkipLocked("tests")).
+		Returning("id", "uuid").
+		Build()
+	if err != nil { // coverage-ignore
+		return id, uuid, err
+	}
+	err = p.conn().QueryRowContext(p.Driver.context(), claimQuery, args...).Scan(
+		&id,
+		&uuid,
+	)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	return id, uuid, err
+}
+
+func (s SqliteOperationInterface) InterfaceClaimTest(candidate *Query, state, worker string) (int, string, error) {
+	var id int
+	var uuid string
+	// sqlite runs one write at a time, so no other claim can take the
+	// candidate between it being selected and claimed
+	claimQuery, args, err := Update("tests").
+		Set("state", state).
+		Set("claimed_by", worker).
+		Where("id=(?)", candidate).
+		Returning("id", "uuid").
+		BuildFor(Sqlite)
+	if err != nil { // coverage-ignore
+		return id, uuid, err
+	}
+	err = s.conn().QueryRowContext(s.Driver.context(), claimQuery, args...).Scan(
+		&id,
+		&uuid,
+	)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	return id, uuid, err
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClaimTestConcurrently(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 54
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=54`))
+	}()
+
+	workers := []string{"spawner-1:spawner-1", "spawner-1:spawner-2", "spawner-2:spawner-1", "spawner-2:spawner-2"}
+	claimedIds := make([]int, len(workers))
+	var wg sync.WaitGroup
+	for i, worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			claimedIds[i], _, err = Driver.ClaimTest(Select("tests", "id").Where("id=?", rowId).Where("state=?", "requested"), "spawning", worker)
+			utils.CheckError(err)
+		}()
+	}
+	wg.Wait()
+
+	winner := ""
+	for i, id := range claimedIds {
+		if id == 0 {
+			continue
+		}
+		if winner != "" {
+			t.Errorf("test %v was claimed by both %v and %v", rowId, winner, workers[i])
+		}
+		winner = workers[i]
+	}
+	if winner == "" {
+		t.Fatalf("test %v should have been claimed by one of %v", rowId, workers)
+	}
+
+	// late writes from the workers that lost are rejected
+	for _, worker := range workers {
+		err = Driver.SetClaimedTestStateTo(rowId, "spawned", worker)
+		if worker == winner {
+			utils.CheckError(err)
+		} else if _, ok := err.(ClaimLostError); !ok {
+			t.Errorf("%v doesn't hold the claim on test %v, but its write got %v", worker, rowId, err)
+		}
+	}
+	state, err := Driver.GetTestState(rowId)
+	utils.CheckError(err)
+	if state != "spawned" {
+		t.Errorf("unexpected state of test %v!\nexpected: spawned\nactual: %v", rowId, state)
+	}
+}
+
+func TestHeartbeatClaimedTest(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 54
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=54`))
+	}()
+	id, _, err := Driver.ClaimTest(Select("tests", "id").Where("id=?", rowId).Where("state=?", "requested"), "spawning", "spawner-1:spawner-1")
+	utils.CheckError(err)
+	if id != rowId {
+		t.Fatalf("test %v should have been claimed, but claimed %v", rowId, id)
+	}
+
+	var before, after time.Time
+	row, err := Driver.GetRow(Select("tests", "updated_at").Where("id=?", rowId))
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&before))
+	utils.CheckError(Driver.HeartbeatClaimedTest(rowId, "spawner-1:spawner-1"))
+	row, err = Driver.GetRow(Select("tests", "updated_at").Where("id=?", rowId))
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&after))
+	if !after.After(before) {
+		t.Errorf("the heartbeat of test %v should have moved on from %v, but is %v", rowId, before, after)
+	}
+
+	// a worker that lost its claim can't keep the test looking alive
+	err = Driver.HeartbeatClaimedTest(rowId, "spawner-1:spawner-2")
+	if _, ok := err.(ClaimLostError); !ok {
+		t.Errorf("spawner-1:spawner-2 doesn't hold the claim on test %v, but its heartbeat got %v", rowId, err)
+	}
+}
+
+func TestReleaseClaimedTest(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 54
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=54`))
+	}()
+	candidate := Select("tests", "id").Where("id=?", rowId).Where("state=?", "requested")
+	_, _, err = Driver.ClaimTest(candidate, "spawning", "spawner-1:spawner-1")
+	utils.CheckError(err)
+
+	// only the worker holding the claim can release it
+	err = Driver.ReleaseClaimedTest(rowId, "spawner-1:spawner-2")
+	if _, ok := err.(ClaimLostError); !ok {
+		t.Errorf("spawner-1:spawner-2 doesn't hold the claim on test %v, but releasing it got %v", rowId, err)
+	}
+	utils.CheckError(Driver.ReleaseClaimedTest(rowId, "spawner-1:spawner-1"))
+
+	// which leaves the test to be claimed again
+	id, _, err := Driver.ClaimTest(candidate, "spawning", "spawner-1:spawner-2")
+	utils.CheckError(err)
+	if id != rowId {
+		t.Errorf("released test %v should have been claimed again, but claimed %v", rowId, id)
+	}
+}
+
+func TestClaimTestNothingToClaim(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	id, uuid, err := Driver.ClaimTest(Select("tests", "id").Where("id=?", 1007).Where("state=?", "requested"), "spawning", "spawner-1:spawner-1")
+	utils.CheckError(err)
+	if id != 0 || uuid != "" {
+		t.Errorf("there's no test 1007 to claim, but claimed %v of %v", id, uuid)
+	}
+}
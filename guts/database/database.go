@@ -1,11 +1,13 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/lib/pq"
 	"guts.ubuntu.com/v2/utils"
 	"log"
+	"os"
 	"os/exec"
 	"reflect"
 	"slices"
@@ -34,11 +36,18 @@ type DbDriver struct {
 	ConnectionString string
 	SupportedDrivers []string
 	Interface        DbOperationInterface
+	// the context of the transaction the driver runs statements in, see
+	// BeginTx. It's nil outside of transactions
+	ctx context.Context
 }
 
 func (d DbDriver) DbConnect() (*sql.DB, error) {
 	var db *sql.DB
-	db, err := sql.Open(d.Driver, d.ConnectionString)
+	driverName, connectionString := d.Driver, d.ConnectionString
+	if d.Driver == "sqlite" {
+		driverName, connectionString = sqliteDriverName, sqliteDataSource(connectionString)
+	}
+	db, err := sql.Open(driverName, connectionString)
 	if err != nil {
 		return db, err
 	}
@@ -57,6 +66,17 @@ func NewOperationInterface(driver DbDriver) (DbDriver, error) {
 		driver.Interface = thisInterface
 		return driver, nil
 	}
+	if driver.Driver == "sqlite" {
+		var thisInterface SqliteOperationInterface
+		thisInterface.Driver = driver
+		db, err := driver.DbConnect()
+		if err != nil { // coverage-ignore
+			return driver, err
+		}
+		thisInterface.Db = db
+		driver.Interface = thisInterface
+		return driver, nil
+	}
 	return driver, fmt.Errorf("%v is an invalid driver", driver.Driver)
 }
 
@@ -79,48 +99,134 @@ func (d DbDriver) PrepareQuery(query string) (*sql.Stmt, error) { // coverage-ig
 	return stmt, err
 }
 
-func (d DbDriver) RunQueryRow(query string) (*sql.Row, error) {
-	row, err := d.Interface.InterfaceRunQueryRow(query)
+// RunQueryRow runs a query returning at most one row, with args bound to its
+// $n placeholders
+func (d DbDriver) RunQueryRow(query string, args ...any) (*sql.Row, error) {
+	return d.RunQueryRowContext(d.context(), query, args...)
+}
+
+func (d DbDriver) RunQueryRowContext(ctx context.Context, query string, args ...any) (*sql.Row, error) {
+	row, err := d.Interface.InterfaceRunQueryRow(ctx, query, args...)
 	return row, err
 }
 
-func (d DbDriver) UpdateRow(query string) error {
-	err := d.Interface.InterfaceRunRowUpdate(query)
+// UpdateRow runs a statement that doesn't return rows, with args bound to its
+// $n placeholders
+func (d DbDriver) UpdateRow(query string, args ...any) error {
+	return d.UpdateRowContext(d.context(), query, args...)
+}
+
+func (d DbDriver) UpdateRowContext(ctx context.Context, query string, args ...any) error {
+	_, err := d.Interface.InterfaceExec(ctx, query, args...)
 	return err
 }
 
+// GetRow runs a built query returning at most one row
+func (d DbDriver) GetRow(q *Query) (*sql.Row, error) {
+	return d.GetRowContext(d.context(), q)
+}
+
+func (d DbDriver) GetRowContext(ctx context.Context, q *Query) (*sql.Row, error) {
+	query, args, err := q.BuildFor(d.Interface.Dialect())
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	return d.Interface.InterfaceRunQueryRow(ctx, query, args...)
+}
+
+// GetRows runs a built query returning any number of rows
+func (d DbDriver) GetRows(q *Query) (*sql.Rows, error) {
+	return d.GetRowsContext(d.context(), q)
+}
+
+func (d DbDriver) GetRowsContext(ctx context.Context, q *Query) (*sql.Rows, error) {
+	query, args, err := q.BuildFor(d.Interface.Dialect())
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	return d.Interface.InterfaceRunQuery(ctx, query, args...)
+}
+
+// Exec runs a built statement that doesn't return rows, returning how many
+// rows it affected
+func (d DbDriver) Exec(q *Query) (int64, error) {
+	return d.ExecContext(d.context(), q)
+}
+
+func (d DbDriver) ExecContext(ctx context.Context, q *Query) (int64, error) {
+	query, args, err := q.BuildFor(d.Interface.Dialect())
+	if err != nil { // coverage-ignore
+		return 0, err
+	}
+	return d.Interface.InterfaceExec(ctx, query, args...)
+}
+
 func (d DbDriver) TestsUpdateUpdatedAt(id int) error {
 	err := d.Interface.UpdateUpdatedAt(id)
 	return err
 }
 
 func (d DbDriver) SetTestStateTo(id int, state string) error {
-	stateUpdateQuery := fmt.Sprintf(`UPDATE tests SET state='%v' WHERE id=%v`, state, id)
-	err := d.UpdateRow(stateUpdateQuery)
+	_, err := d.Exec(Update("tests").Set("state", state).Where("id=?", id))
 	return err
 }
 
+func (d DbDriver) GetTestState(id int) (string, error) {
+	var state string
+	row, err := d.QueryRow("tests", "id", fmt.Sprintf("%v", id), []string{"state"})
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	err = row.Scan(
+		&state,
+	)
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	return state, nil
+}
+
+// NukeUuid removes a job and everything about its tests from the database,
+// all at once or not at all
 func (d DbDriver) NukeUuid(uuid string) error {
-	return d.Interface.RemoveUuidFromAllTables(uuid)
+	return d.NukeUuidContext(d.context(), uuid)
+}
+
+func (d DbDriver) NukeUuidContext(ctx context.Context, uuid string) error {
+	return d.WithTx(ctx, func(tx DbDriver) error {
+		return tx.Interface.RemoveUuidFromAllTables(uuid)
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // section with interfaces and functionality for different engines
 
 type DbOperationInterface interface {
+	Dialect() Dialect
 	DbAvailable() error
 	InterfaceQueryRow(table, queryField, queryValue string, fields []string) (*sql.Row, error)
 	InterfaceQuery(table, queryField, queryValue string, fields []string) (*sql.Rows, error)
 	InterfacePrepareQuery(queryString string) (*sql.Stmt, error)
-	InterfaceRunQueryRow(queryString string) (*sql.Row, error)
-	InterfaceRunRowUpdate(query string) error
+	InterfaceRunQueryRow(ctx context.Context, queryString string, args ...any) (*sql.Row, error)
+	InterfaceRunQuery(ctx context.Context, queryString string, args ...any) (*sql.Rows, error)
+	InterfaceExec(ctx context.Context, queryString string, args ...any) (int64, error)
 	UpdateUpdatedAt(id int) error
 	RemoveUuidFromAllTables(uuid string) error
+	InterfaceListen(channel string) (DbListener, error)
+	InterfaceClaimTest(candidate *Query, state, worker string) (int, string, error)
+	InterfaceBeginTx(ctx context.Context) (DbOperationInterface, *sql.Tx, error)
+	InterfaceLockSchema() error
 }
 
 type PgOperationInterface struct {
 	Driver DbDriver
 	Db     *sql.DB
+	// set when the interface runs statements in a transaction on Db
+	tx *sql.Tx
+}
+
+func (p PgOperationInterface) Dialect() Dialect {
+	return Postgres
 }
 
 func (p PgOperationInterface) DbAvailable() error {
@@ -138,12 +244,12 @@ func (p PgOperationInterface) DbAvailable() error {
 func (p PgOperationInterface) InterfaceQueryRow(table, queryField, queryValue string, fields []string) (*sql.Row, error) { // coverage-ignore
 	var row *sql.Row
 	queryString := fmt.Sprintf("SELECT %v FROM %v WHERE %v=$1", strings.Join(fields, ", "), table, queryField)
-	stmt, err := p.Db.Prepare(queryString)
+	stmt, err := p.conn().PrepareContext(p.Driver.context(), queryString)
 	if err != nil { // coverage-ignore
 		return row, err
 	}
 	defer utils.DeferredErrCheck(stmt.Close)
-	row = stmt.QueryRow(queryValue)
+	row = stmt.QueryRowContext(p.Driver.context(), queryValue)
 	return row, nil
 }
 
@@ -151,12 +257,12 @@ func (p PgOperationInterface) InterfaceQuery(table, queryField, queryValue strin
 	var rows *sql.Rows
 	queryString := fmt.Sprintf("SELECT %v FROM %v WHERE %v=$1", strings.Join(fields, ", "), table, queryField)
 	log.Printf("running query %v with query parameter %v\n", queryString, queryValue)
-	stmt, err := p.Db.Prepare(queryString)
+	stmt, err := p.conn().PrepareContext(p.Driver.context(), queryString)
 	if err != nil { // coverage-ignore
 		return rows, err
 	}
 	defer utils.DeferredErrCheck(stmt.Close)
-	rows, err = stmt.Query(queryValue)
+	rows, err = stmt.QueryContext(p.Driver.context(), queryValue)
 	if err != nil { // coverage-ignore
 		return rows, err
 	}
@@ -164,51 +270,39 @@ func (p PgOperationInterface) InterfaceQuery(table, queryField, queryValue strin
 }
 
 func (p PgOperationInterface) InterfacePrepareQuery(queryString string) (*sql.Stmt, error) { // coverage-ignore
-	stmt, err := p.Db.Prepare(queryString)
+	stmt, err := p.conn().PrepareContext(p.Driver.context(), queryString)
 	return stmt, err
 }
 
-func (p PgOperationInterface) InterfaceRunQueryRow(queryString string) (*sql.Row, error) {
-	var row *sql.Row
-	stmt, err := p.Db.Prepare(queryString)
-	if err != nil { // coverage-ignore
-		return row, err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-	row = stmt.QueryRow()
-	return row, nil
+func (p PgOperationInterface) InterfaceRunQueryRow(ctx context.Context, queryString string, args ...any) (*sql.Row, error) {
+	return p.conn().QueryRowContext(ctx, queryString, args...), nil
+}
+
+func (p PgOperationInterface) InterfaceRunQuery(ctx context.Context, queryString string, args ...any) (*sql.Rows, error) {
+	return p.conn().QueryContext(ctx, queryString, args...)
 }
 
-func (p PgOperationInterface) InterfaceRunRowUpdate(query string) error {
-	stmt, err := p.Db.Prepare(query)
+func (p PgOperationInterface) InterfaceExec(ctx context.Context, queryString string, args ...any) (int64, error) {
+	result, err := p.conn().ExecContext(ctx, queryString, args...)
 	if err != nil { // coverage-ignore
-		return err
+		return 0, err
 	}
-	defer utils.DeferredErrCheck(stmt.Close)
-	_, err = stmt.Query()
-	return err
+	return result.RowsAffected()
 }
 
 func (p PgOperationInterface) UpdateUpdatedAt(id int) error {
 	ts := time.Now()
 	updateCmd := `UPDATE tests SET updated_at=$1 WHERE id=$2`
-	stmt, err := p.Db.Prepare(updateCmd)
-	if err != nil { // coverage-ignore
-		return err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-	_, err = stmt.Exec(ts, id)
+	_, err := p.InterfaceExec(p.Driver.context(), updateCmd, ts, id)
 	return err
 }
 
 func (p PgOperationInterface) DeleteUuidFromTable(uuid, table string) error {
-	removeQuery := fmt.Sprintf(`DELETE FROM %v WHERE uuid='%v'`, table, uuid)
-	stmt, err := p.Db.Prepare(removeQuery)
+	removeQuery, args, err := Delete(table).Where("uuid=?", uuid).Build()
 	if err != nil { // coverage-ignore
 		return err
 	}
-	defer utils.DeferredErrCheck(stmt.Close)
-	_, err = stmt.Exec()
+	_, err = p.InterfaceExec(p.Driver.context(), removeQuery, args...)
 	return err
 }
 
@@ -219,6 +313,16 @@ func (p PgOperationInterface) RemoveUuidFromAllTables(uuid string) error {
 		return err
 	}
 
+	err = p.DeleteUuidFromTable(uuid, "test_attempts")
+	if err != nil { // coverage-ignore
+		return err
+	}
+
+	err = p.DeleteUuidFromTable(uuid, "test_results")
+	if err != nil { // coverage-ignore
+		return err
+	}
+
 	err = p.DeleteUuidFromTable(uuid, "tests")
 	if err != nil { // coverage-ignore
 		return err
@@ -246,7 +350,13 @@ func SkipTestIfPostgresInactive(PgError error) bool { // coverage-ignore
 	return false
 }
 
+// TestDbDriver connects to the test database as username. With
+// GUTS_TEST_DRIVER=sqlite it's a sqlite database of the test data instead,
+// made for each test binary, so the tests don't need postgres
 func TestDbDriver(username, password string) (DbDriver, error) { // coverage-ignore
+	if os.Getenv(TestDriverEnv) == "sqlite" {
+		return testSqliteDbDriver()
+	}
 	var driver DbDriver
 	driver.Driver = "postgres"
 	driver.ConnectionString = fmt.Sprintf("host=localhost port=5432 user=%v password=%v dbname=guts sslmode=disable", username, password)
@@ -259,7 +369,7 @@ func NewDbDriver(desiredDriver, desiredConnectionString string) (DbDriver, error
 	var driver DbDriver
 	driver.Driver = desiredDriver
 	driver.ConnectionString = desiredConnectionString
-	driver.SupportedDrivers = []string{"postgres"}
+	driver.SupportedDrivers = []string{"postgres", "sqlite"}
 	if !slices.Contains(driver.SupportedDrivers, driver.Driver) {
 		return driver, fmt.Errorf("database couldn't be initialised - %v is an unsupported driver", driver.Driver)
 	}
@@ -179,3 +179,19 @@ func TestNukeUuid(t *testing.T) {
 	err = Driver.NukeUuid(uuid)
 	utils.CheckError(err)
 }
+
+func TestGetTestState(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 5
+	state, err := Driver.GetTestState(rowId)
+	utils.CheckError(err)
+	expectedState := "pass"
+	if state != expectedState {
+		t.Errorf("Unexpected test state!\nExpected: %v\nActual: %v", expectedState, state)
+	}
+}
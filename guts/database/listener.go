@@ -0,0 +1,125 @@
+package database
+
+import (
+	"github.com/lib/pq"
+	"log"
+	"time"
+)
+
+var (
+	ListenerMinReconnectInterval = 10 * time.Second
+	ListenerMaxReconnectInterval = time.Minute
+	ListenerPollInterval         = 5 * time.Second
+)
+
+// Notification is a single message published on a channel. An empty payload
+// means the connection was re-established, and notifications sent in the
+// meantime may have been missed.
+type Notification struct {
+	Channel string
+	Payload string
+}
+
+type DbListener interface {
+	Notifications() <-chan Notification
+	Close() error
+}
+
+type PgListener struct {
+	listener      *pq.Listener
+	notifications chan Notification
+	closed        chan struct{}
+}
+
+func (d DbDriver) Listen(channel string) (DbListener, error) {
+	listener, err := d.Interface.InterfaceListen(channel)
+	return listener, err
+}
+
+func (p PgOperationInterface) InterfaceListen(channel string) (DbListener, error) {
+	pgListener := &PgListener{}
+	reportProblem := func(event pq.ListenerEventType, err error) {
+		if err != nil { // coverage-ignore
+			log.Printf("listener on channel %v: %v\n", channel, err)
+		}
+	}
+	pgListener.listener = pq.NewListener(p.Driver.ConnectionString, ListenerMinReconnectInterval, ListenerMaxReconnectInterval, reportProblem)
+	if err := pgListener.listener.Listen(channel); err != nil { // coverage-ignore
+		_ = pgListener.listener.Close()
+		return nil, err
+	}
+	pgListener.notifications = make(chan Notification)
+	pgListener.closed = make(chan struct{})
+	go pgListener.forward(channel)
+	return pgListener, nil
+}
+
+func (p *PgListener) forward(channel string) {
+	defer close(p.notifications)
+	for n := range p.listener.Notify {
+		notification := Notification{Channel: channel}
+		// pq sends nil after reconnecting
+		if n != nil {
+			notification.Payload = n.Extra
+		}
+		select {
+		case p.notifications <- notification:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *PgListener) Notifications() <-chan Notification {
+	return p.notifications
+}
+
+func (p *PgListener) Close() error {
+	close(p.closed)
+	return p.listener.Close()
+}
+
+// PollingListener stands in for a listener on databases that can't publish
+// notifications. It sends an empty notification every ListenerPollInterval,
+// so whoever is listening re-reads what it's interested in
+type PollingListener struct {
+	notifications chan Notification
+	closed        chan struct{}
+}
+
+// InterfaceListen polls, as sqlite has no LISTEN/NOTIFY
+func (s SqliteOperationInterface) InterfaceListen(channel string) (DbListener, error) {
+	listener := &PollingListener{
+		notifications: make(chan Notification),
+		closed:        make(chan struct{}),
+	}
+	go listener.poll(channel)
+	return listener, nil
+}
+
+func (p *PollingListener) poll(channel string) {
+	defer close(p.notifications)
+	ticker := time.NewTicker(ListenerPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closed:
+			return
+		}
+		select {
+		case p.notifications <- Notification{Channel: channel}:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *PollingListener) Notifications() <-chan Notification {
+	return p.notifications
+}
+
+func (p *PollingListener) Close() error {
+	close(p.closed)
+	return nil
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	Driver, err := TestDbDriver("guts_api", "guts_api")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	if Driver.Interface.Dialect() != Postgres {
+		t.Skip("Skipping test as only postgres publishes notifications")
+	}
+
+	channel := "guts_listener_test"
+	listener, err := Driver.Listen(channel)
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(listener.Close)
+
+	stmt, err := Driver.PrepareQuery(`SELECT pg_notify($1, $2)`)
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(stmt.Close)
+	_, err = stmt.Exec(channel, "good news everyone")
+	utils.CheckError(err)
+
+	expectedNotification := Notification{Channel: channel, Payload: "good news everyone"}
+	select {
+	case notification := <-listener.Notifications():
+		if notification != expectedNotification {
+			t.Errorf("Unexpected notification!\nExpected: %v\nActual: %v", expectedNotification, notification)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Didn't receive a notification on channel %v", channel)
+	}
+}
@@ -0,0 +1,287 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// the schema patches, numbered from 0001 in the order they're applied. The
+// sqlite ones start from the schema postgres was at when sqlite was supported,
+// and carry on with the same numbers
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+const migrationsDir = "migrations"
+
+// migrationsDirs holds the migrations of each dialect
+var migrationsDirs = map[Dialect]string{
+	Postgres: migrationsDir,
+	Sqlite:   path.Join(migrationsDir, "sqlite"),
+}
+
+var migrationFilePattern = regexp.MustCompile(`^([0-9]{4})-[a-z0-9-]+\.sql$`)
+
+// the key of the advisory lock migrations hold while they run, so only one
+// guts-migrate at a time applies them
+const schemaLockKey = 0x67757473
+
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name VARCHAR(300) NOT NULL, applied_at TIMESTAMP WITH TIME ZONE NOT NULL)`
+
+type InvalidMigrationError struct {
+	name   string
+	reason string
+}
+
+func (i InvalidMigrationError) Error() string {
+	return fmt.Sprintf("Invalid migration %v: %v", i.name, i.reason)
+}
+
+type MigrationFailedError struct {
+	name string
+	err  error
+}
+
+func (m MigrationFailedError) Error() string {
+	return fmt.Sprintf("Migration %v failed: %v", m.name, m.err)
+}
+
+func (m MigrationFailedError) Unwrap() error {
+	return m.err
+}
+
+type SchemaVersionMismatchError struct {
+	database int
+	binary   int
+}
+
+func (s SchemaVersionMismatchError) Error() string {
+	if s.database > s.binary {
+		return fmt.Sprintf("Database schema is at version %v, newer than the version %v this binary was built for, upgrade the binary", s.database, s.binary)
+	}
+	return fmt.Sprintf("Database schema is at version %v, older than the version %v this binary was built for, run guts-migrate", s.database, s.binary)
+}
+
+type AlreadyMigratedError struct {
+	version int
+}
+
+func (a AlreadyMigratedError) Error() string {
+	return fmt.Sprintf("Database already has migrations up to version %v recorded, it can't be baselined", a.version)
+}
+
+// Migration is a schema patch, its version is the number it's named with
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+// Migrations lists the migrations of dialect embedded in the binary in the
+// order they're applied
+func Migrations(dialect Dialect) ([]Migration, error) {
+	var migrations []Migration
+	dir := migrationsDirs[dialect]
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil { // coverage-ignore
+		return migrations, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		migration, err := readMigration(dir, entry.Name())
+		if err != nil { // coverage-ignore
+			return migrations, err
+		}
+		// a gap means a patch went missing, so the schema wouldn't be the one
+		// the version says it is
+		expectedVersion := 1
+		if len(migrations) > 0 {
+			expectedVersion = migrations[len(migrations)-1].Version + 1
+		} else if dialect == Sqlite {
+			expectedVersion = migration.Version
+		}
+		if migration.Version != expectedVersion { // coverage-ignore
+			return migrations, InvalidMigrationError{name: entry.Name(), reason: fmt.Sprintf("expected version %v", expectedVersion)}
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+func readMigration(dir, name string) (Migration, error) {
+	var migration Migration
+	match := migrationFilePattern.FindStringSubmatch(name)
+	if match == nil {
+		return migration, InvalidMigrationError{name: name, reason: "name doesn't match NNNN-description.sql"}
+	}
+	version, err := strconv.Atoi(match[1])
+	if err != nil { // coverage-ignore
+		return migration, err
+	}
+	sql, err := migrationFiles.ReadFile(path.Join(dir, name))
+	if err != nil { // coverage-ignore
+		return migration, err
+	}
+	migration.Version = version
+	migration.Name = name
+	migration.Sql = string(sql)
+	return migration, nil
+}
+
+// SchemaVersion is the version of the schema the binary was built for, that
+// of its last migration, which is the same for every dialect
+func SchemaVersion() (int, error) {
+	migrations, err := Migrations(Postgres)
+	if err != nil { // coverage-ignore
+		return 0, err
+	}
+	return lastVersion(migrations), nil
+}
+
+func lastVersion(migrations []Migration) int {
+	if len(migrations) == 0 { // coverage-ignore
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// AppliedSchemaVersion is the version of the last migration applied to the
+// database, 0 if there are none
+func (d DbDriver) AppliedSchemaVersion() (int, error) {
+	var version int
+	row, err := d.GetRow(Select("schema_migrations", "COALESCE(MAX(version), 0)"))
+	if err != nil { // coverage-ignore
+		return version, err
+	}
+	err = row.Scan(&version)
+	return version, err
+}
+
+// CheckSchemaVersion fails with a SchemaVersionMismatchError unless the
+// database is at the version of the schema the binary was built for
+func (d DbDriver) CheckSchemaVersion() error {
+	binaryVersion, err := SchemaVersion()
+	if err != nil { // coverage-ignore
+		return err
+	}
+	databaseVersion, err := d.AppliedSchemaVersion()
+	if err != nil { // coverage-ignore
+		return err
+	}
+	// the tests run against a database at the version they're built for
+	if databaseVersion != binaryVersion { // coverage-ignore
+		return SchemaVersionMismatchError{database: databaseVersion, binary: binaryVersion}
+	}
+	return nil
+}
+
+// Migrate applies the migrations the database doesn't have yet, all in one
+// transaction, returning the ones it applied. Migrations running at the same
+// time wait for each other, so each is applied once. It's run by guts-migrate
+// as the owner of the database, which the tests don't connect as
+func (d DbDriver) Migrate(ctx context.Context) ([]Migration, error) { // coverage-ignore
+	var applied []Migration
+	migrations, err := Migrations(d.Interface.Dialect())
+	if err != nil {
+		return applied, err
+	}
+	err = d.WithTx(ctx, func(tx DbDriver) error {
+		currentVersion, err := tx.lockSchemaMigrations()
+		if err != nil {
+			return err
+		}
+		if currentVersion > lastVersion(migrations) {
+			return SchemaVersionMismatchError{database: currentVersion, binary: lastVersion(migrations)}
+		}
+		for _, migration := range migrations {
+			if migration.Version <= currentVersion {
+				continue
+			}
+			err = tx.UpdateRow(migration.Sql)
+			if err != nil {
+				return MigrationFailedError{name: migration.Name, err: err}
+			}
+			err = tx.recordMigration(migration)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// BaselineMigrations records the migrations up to version as applied without
+// running them, for databases whose schema was set up before migrations were
+// tracked
+func (d DbDriver) BaselineMigrations(ctx context.Context, version int) error { // coverage-ignore
+	migrations, err := Migrations(d.Interface.Dialect())
+	if err != nil {
+		return err
+	}
+	if version < migrations[0].Version || version > lastVersion(migrations) {
+		return SchemaVersionMismatchError{database: version, binary: lastVersion(migrations)}
+	}
+	return d.WithTx(ctx, func(tx DbDriver) error {
+		currentVersion, err := tx.lockSchemaMigrations()
+		if err != nil {
+			return err
+		}
+		if currentVersion != 0 {
+			return AlreadyMigratedError{version: currentVersion}
+		}
+		for _, migration := range migrations {
+			if migration.Version > version {
+				break
+			}
+			err = tx.recordMigration(migration)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// lockSchemaMigrations takes the migrations lock for the rest of the
+// transaction, creating schema_migrations if this is the first migration,
+// and returns the version the database is at
+func (d DbDriver) lockSchemaMigrations() (int, error) { // coverage-ignore
+	err := d.Interface.InterfaceLockSchema()
+	if err != nil {
+		return 0, err
+	}
+	err = d.UpdateRow(schemaMigrationsTable)
+	if err != nil {
+		return 0, err
+	}
+	return d.AppliedSchemaVersion()
+}
+
+func (d DbDriver) recordMigration(migration Migration) error { // coverage-ignore
+	return d.UpdateRow(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, migration.Version, migration.Name, time.Now())
+}
+
+// InterfaceLockSchema takes an advisory lock held until the end of the
+// transaction the interface runs in
+func (p PgOperationInterface) InterfaceLockSchema() error { // coverage-ignore
+	_, err := p.InterfaceExec(p.Driver.context(), `SELECT pg_advisory_xact_lock($1)`, schemaLockKey)
+	return err
+}
+
+// InterfaceLockSchema does nothing, as transactions on sqlite already hold
+// the lock on the whole database
+func (s SqliteOperationInterface) InterfaceLockSchema() error {
+	return nil
+}
@@ -1,9 +1,3 @@
--- create db
-
-CREATE DATABASE guts;
-
-\c guts;
-
 DROP TABLE IF EXISTS currtztable;
 
 SELECT current_setting('TIMEZONE') INTO currtztable;
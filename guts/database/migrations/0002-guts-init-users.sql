@@ -1,5 +1,3 @@
-\c guts
-
 CREATE OR REPLACE FUNCTION add_user_if_not_exists(username NAME, pw TEXT)
 RETURNS INTEGER
 AS $$
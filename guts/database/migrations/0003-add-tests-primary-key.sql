@@ -1,5 +1,3 @@
-\c guts;
-
 ALTER TABLE tests
 ADD COLUMN id INTEGER PRIMARY KEY
 GENERATED BY DEFAULT AS IDENTITY;
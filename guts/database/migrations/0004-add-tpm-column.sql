@@ -1,3 +1 @@
-\c guts;
-
 ALTER TABLE tests ADD COLUMN tpm BOOLEAN NOT NULL DEFAULT false; -- \n
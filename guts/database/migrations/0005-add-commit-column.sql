@@ -1,3 +1 @@
-\c guts;
-
 ALTER TABLE tests ADD COLUMN commit_hash VARCHAR(300);
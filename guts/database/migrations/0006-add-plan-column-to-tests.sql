@@ -1,3 +1 @@
-\c guts;
-
 ALTER TABLE tests ADD COLUMN plan VARCHAR(500);
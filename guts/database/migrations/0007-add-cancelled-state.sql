@@ -0,0 +1,22 @@
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS constrain_status;
+ALTER TABLE jobs ADD CONSTRAINT constrain_status CHECK (status IN (
+    'pending',
+    'running', 'pass', 'fail', 'cancelled'
+));
+
+ALTER TABLE tests DROP CONSTRAINT IF EXISTS constrain_state;
+ALTER TABLE tests ADD CONSTRAINT constrain_state CHECK (
+    state IN (
+        'requested',
+        'spawning',
+        'spawned',
+        'running',
+        'pass',
+        'fail',
+        'cancelled'
+    )
+);
+
+-- the api needs to be able to cancel jobs and their tests
+GRANT UPDATE ON jobs TO guts_api;
+GRANT UPDATE ON tests TO guts_api;
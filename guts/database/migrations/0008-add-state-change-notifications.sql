@@ -0,0 +1,39 @@
+-- publish every test state and job status change on the guts_events channel,
+-- so the api can stream them to clients without polling
+
+CREATE OR REPLACE FUNCTION notify_test_state_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('guts_events', json_build_object(
+        'type', 'test',
+        'uuid', NEW.uuid,
+        'test_case', NEW.test_case,
+        'state', NEW.state
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_job_status_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('guts_events', json_build_object(
+        'type', 'job',
+        'uuid', NEW.uuid,
+        'state', NEW.status
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tests_state_insert ON tests;
+CREATE TRIGGER tests_state_insert AFTER INSERT ON tests
+FOR EACH ROW EXECUTE FUNCTION notify_test_state_change();
+
+DROP TRIGGER IF EXISTS tests_state_change ON tests;
+CREATE TRIGGER tests_state_change AFTER UPDATE OF state ON tests
+FOR EACH ROW WHEN (OLD.state IS DISTINCT FROM NEW.state)
+EXECUTE FUNCTION notify_test_state_change();
+
+DROP TRIGGER IF EXISTS jobs_status_change ON jobs;
+CREATE TRIGGER jobs_status_change AFTER UPDATE OF status ON jobs
+FOR EACH ROW WHEN (OLD.status IS DISTINCT FROM NEW.status)
+EXECUTE FUNCTION notify_job_status_change();
@@ -0,0 +1,14 @@
+-- track delivery of results to the reporting service, so results are
+-- reported once, and failed deliveries are retried with a backoff
+ALTER TABLE reporter ADD COLUMN IF NOT EXISTS reported_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE reporter ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE reporter ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE reporter ADD COLUMN IF NOT EXISTS last_error VARCHAR(500);
+
+-- the reporter reads the results of finished jobs
+GRANT SELECT ON jobs TO guts_reporter;
+GRANT SELECT ON tests TO guts_reporter;
+
+-- the api records where the results of a job are reported to along with the
+-- job, so the reporter finds every job with a reporter
+GRANT INSERT ON reporter TO guts_api;
@@ -0,0 +1,34 @@
+-- how many times each failed test of a job is retried
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS retries INTEGER NOT NULL DEFAULT 0;
+-- retries are capped per user, like priority
+ALTER TABLE users ADD COLUMN IF NOT EXISTS maximum_retries INTEGER NOT NULL DEFAULT 3;
+-- the attempt at the test a row currently holds, starting at 1
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS attempt INTEGER NOT NULL DEFAULT 1;
+
+-- a job is flaky when all of its tests passed, but some only on a retry
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS constrain_status;
+ALTER TABLE jobs ADD CONSTRAINT constrain_status CHECK (status IN (
+    'pending',
+    'running', 'pass', 'fail', 'cancelled', 'flaky'
+));
+
+-- the results of every finished attempt at a test, as the tests row is
+-- reused for the next attempt
+CREATE TABLE IF NOT EXISTS test_attempts (
+    id INTEGER PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    test_id INTEGER NOT NULL,
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    test_case VARCHAR(100),
+    attempt INTEGER NOT NULL,
+    state VARCHAR(50) NOT NULL,
+    results_url VARCHAR(300),
+    commit_hash VARCHAR(300),
+    finished_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    CONSTRAINT test_id_key FOREIGN KEY (test_id) REFERENCES tests (id),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+GRANT SELECT, INSERT ON test_attempts TO guts_runner;
+GRANT SELECT ON test_attempts TO guts_api;
+GRANT SELECT ON test_attempts TO guts_reporter;
+GRANT SELECT, DELETE ON test_attempts TO guts_scheduler;
@@ -0,0 +1,16 @@
+-- test_attempts gets a row for every spawn of a test, opened by the spawner
+-- and closed by whichever of the spawner, runner or scheduler saw it end, so
+-- tempfails, dead VMs and stale tests leave a trace too
+ALTER TABLE test_attempts ADD COLUMN IF NOT EXISTS spawner_host VARCHAR(255);
+ALTER TABLE test_attempts ADD COLUMN IF NOT EXISTS vnc_address VARCHAR(100);
+ALTER TABLE test_attempts ADD COLUMN IF NOT EXISTS started_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE test_attempts ADD COLUMN IF NOT EXISTS exit_code INTEGER;
+-- an attempt has neither an outcome nor an end while it is still going
+ALTER TABLE test_attempts ALTER COLUMN state DROP NOT NULL;
+ALTER TABLE test_attempts ALTER COLUMN finished_at DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS test_attempts_test_id ON test_attempts (test_id);
+
+GRANT SELECT, INSERT, UPDATE ON test_attempts TO guts_spawner;
+GRANT SELECT, INSERT, UPDATE ON test_attempts TO guts_runner;
+GRANT SELECT, UPDATE, DELETE ON test_attempts TO guts_scheduler;
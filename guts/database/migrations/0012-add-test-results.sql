@@ -0,0 +1,27 @@
+-- the suites and tests in the Robot Framework output.xml of each attempt at
+-- a test, so failures can be read without downloading any artifacts
+CREATE TABLE IF NOT EXISTS test_results (
+    id INTEGER PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    test_id INTEGER NOT NULL,
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    test_case VARCHAR(100),
+    attempt INTEGER NOT NULL,
+    kind VARCHAR(10) NOT NULL,
+    suite TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    screenshots TEXT [] NOT NULL DEFAULT '{}',
+    CONSTRAINT constrain_kind CHECK (kind IN ('suite', 'test')),
+    CONSTRAINT test_id_key FOREIGN KEY (test_id) REFERENCES tests (id),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+CREATE INDEX IF NOT EXISTS test_results_uuid ON test_results (uuid);
+
+GRANT SELECT, INSERT ON test_results TO guts_runner;
+GRANT SELECT ON test_results TO guts_api;
+GRANT SELECT ON test_results TO guts_reporter;
+GRANT SELECT, DELETE ON test_results TO guts_scheduler;
@@ -0,0 +1,3 @@
+-- the shorthand a job requested its testbed with, e.g. questing-desktop-daily,
+-- image_url holds what it was expanded to. Empty when a url was requested
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS testbed_alias VARCHAR(100) NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- what a test needs of its VM, as requested in its plan. The zero values
+-- leave it to the spawner's defaults
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS memory INT NOT NULL DEFAULT 0; -- in MB
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS cores INT NOT NULL DEFAULT 0;
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS disk_gb INT NOT NULL DEFAULT 0;
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS uefi BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS secure_boot BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS display_resolution VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS gpu VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+-- what each spawner's host can give the VMs of tests, registered by the
+-- spawner so it only claims the tests it can run. updated_at is refreshed
+-- while the spawner is polling for tests
+CREATE TABLE IF NOT EXISTS spawners (
+    hostname VARCHAR(255) PRIMARY KEY,
+    architecture VARCHAR(20) NOT NULL,
+    kvm BOOLEAN NOT NULL DEFAULT false,
+    tpm BOOLEAN NOT NULL DEFAULT false,
+    uefi BOOLEAN NOT NULL DEFAULT false,
+    secure_boot BOOLEAN NOT NULL DEFAULT false,
+    max_memory INT NOT NULL DEFAULT 0, -- in MB
+    max_cores INT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+GRANT SELECT, INSERT, UPDATE ON spawners TO guts_spawner;
+GRANT SELECT ON spawners TO guts_api;
@@ -0,0 +1,5 @@
+-- the spawner or runner currently working on a test. A spawner claims a
+-- requested test, the runner takes the claim over once the VM is up, and the
+-- scheduler releases it when it requests the test again. Workers only write
+-- the state of tests they hold the claim on
+ALTER TABLE tests ADD COLUMN IF NOT EXISTS claimed_by VARCHAR(300) NOT NULL DEFAULT '';
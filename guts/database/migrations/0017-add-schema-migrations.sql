@@ -0,0 +1,8 @@
+-- schema_migrations is created by the migrations themselves, to record the
+-- versions applied. Every app checks it on startup, and refuses to start if
+-- the database isn't at the version it was built for
+GRANT SELECT ON schema_migrations TO guts_api;
+GRANT SELECT ON schema_migrations TO guts_spawner;
+GRANT SELECT ON schema_migrations TO guts_scheduler;
+GRANT SELECT ON schema_migrations TO guts_runner;
+GRANT SELECT ON schema_migrations TO guts_reporter;
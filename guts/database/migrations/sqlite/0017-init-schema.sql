@@ -0,0 +1,128 @@
+-- the schema of the postgres migrations up to 0017, which sqlite starts from.
+-- sqlite has no roles, so there are no grants, and no LISTEN/NOTIFY, so there
+-- are no notification triggers. Arrays are stored as postgres array literals
+
+CREATE TABLE IF NOT EXISTS jobs (
+    uuid VARCHAR(36) PRIMARY KEY NOT NULL,  -- noqa: RF04
+    artifact_url VARCHAR(300),
+    tests_repo VARCHAR(300) NOT NULL,
+    tests_repo_branch VARCHAR(200) NOT NULL,
+    tests_plans TEXT,
+    image_url VARCHAR(300) NOT NULL,
+    reporter VARCHAR(50) NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    submitted_at TIMESTAMP NOT NULL,
+    requester VARCHAR(50) NOT NULL,
+    debug BOOLEAN NOT NULL,
+    priority INTEGER NOT NULL,
+    retries INTEGER NOT NULL DEFAULT 0,
+    testbed_alias VARCHAR(100) NOT NULL DEFAULT '',
+    CONSTRAINT constrain_status CHECK (status IN (
+        'pending',
+        'running', 'pass', 'fail', 'cancelled', 'flaky'
+    ))
+);
+
+CREATE TABLE IF NOT EXISTS tests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    test_case VARCHAR(100),
+    vnc_address VARCHAR(50),
+    state VARCHAR(50),
+    results_url VARCHAR(300),
+    updated_at TIMESTAMP NOT NULL,
+    tpm BOOLEAN NOT NULL DEFAULT false,
+    commit_hash VARCHAR(300),
+    plan VARCHAR(500),
+    attempt INTEGER NOT NULL DEFAULT 1,
+    memory INT NOT NULL DEFAULT 0, -- in MB
+    cores INT NOT NULL DEFAULT 0,
+    disk_gb INT NOT NULL DEFAULT 0,
+    uefi BOOLEAN NOT NULL DEFAULT false,
+    secure_boot BOOLEAN NOT NULL DEFAULT false,
+    display_resolution VARCHAR(20) NOT NULL DEFAULT '',
+    gpu VARCHAR(20) NOT NULL DEFAULT '',
+    claimed_by VARCHAR(300) NOT NULL DEFAULT '',
+    CONSTRAINT constrain_state CHECK (
+        state IN (
+            'requested',
+            'spawning',
+            'spawned',
+            'running',
+            'pass',
+            'fail',
+            'cancelled'
+        )
+    ),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    username VARCHAR(50),
+    key VARCHAR(200),  -- stored as sha256 sum  -- noqa: RF04
+    maximum_priority INTEGER NOT NULL,
+    maximum_retries INTEGER NOT NULL DEFAULT 3
+);
+
+CREATE TABLE IF NOT EXISTS reporter (
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    base_reporting_url VARCHAR(300),
+    reported_at TIMESTAMP,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP,
+    last_error VARCHAR(500),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+CREATE TABLE IF NOT EXISTS test_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    test_id INTEGER NOT NULL,
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    test_case VARCHAR(100),
+    attempt INTEGER NOT NULL,
+    state VARCHAR(50),
+    results_url VARCHAR(300),
+    commit_hash VARCHAR(300),
+    finished_at TIMESTAMP,
+    spawner_host VARCHAR(255),
+    vnc_address VARCHAR(100),
+    started_at TIMESTAMP,
+    exit_code INTEGER,
+    CONSTRAINT test_id_key FOREIGN KEY (test_id) REFERENCES tests (id),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+CREATE INDEX IF NOT EXISTS test_attempts_test_id ON test_attempts (test_id);
+
+CREATE TABLE IF NOT EXISTS test_results (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    test_id INTEGER NOT NULL,
+    uuid VARCHAR(36) NOT NULL,  -- noqa: RF04
+    test_case VARCHAR(100),
+    attempt INTEGER NOT NULL,
+    kind VARCHAR(10) NOT NULL,
+    suite TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    screenshots TEXT NOT NULL DEFAULT '{}',
+    CONSTRAINT constrain_kind CHECK (kind IN ('suite', 'test')),
+    CONSTRAINT test_id_key FOREIGN KEY (test_id) REFERENCES tests (id),
+    CONSTRAINT uuid_key FOREIGN KEY (uuid) REFERENCES jobs (uuid)
+);
+
+CREATE INDEX IF NOT EXISTS test_results_uuid ON test_results (uuid);
+
+CREATE TABLE IF NOT EXISTS spawners (
+    hostname VARCHAR(255) PRIMARY KEY,
+    architecture VARCHAR(20) NOT NULL,
+    kvm BOOLEAN NOT NULL DEFAULT false,
+    tpm BOOLEAN NOT NULL DEFAULT false,
+    uefi BOOLEAN NOT NULL DEFAULT false,
+    secure_boot BOOLEAN NOT NULL DEFAULT false,
+    max_memory INT NOT NULL DEFAULT 0, -- in MB
+    max_cores INT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL
+);
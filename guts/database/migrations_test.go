@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations(Postgres)
+	utils.CheckError(err)
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("Unexpected version for %v!\nExpected: %v\nActual: %v", migration.Name, i+1, migration.Version)
+		}
+		if !strings.HasPrefix(migration.Name, fmt.Sprintf("%04d-", migration.Version)) {
+			t.Errorf("Migration %v isn't named after its version %v", migration.Name, migration.Version)
+		}
+		// migrations run in a transaction on the guts database, not in psql
+		for _, line := range strings.Split(migration.Sql, "\n") {
+			if strings.HasPrefix(line, `\`) || strings.Contains(line, "CREATE DATABASE") {
+				t.Errorf("Migration %v has a line that can't run in a transaction: %v", migration.Name, line)
+			}
+		}
+	}
+	version, err := SchemaVersion()
+	utils.CheckError(err)
+	if version != len(migrations) {
+		t.Errorf("Unexpected schema version!\nExpected: %v\nActual: %v", len(migrations), version)
+	}
+}
+
+func TestSqliteMigrations(t *testing.T) {
+	migrations, err := Migrations(Sqlite)
+	utils.CheckError(err)
+	if len(migrations) == 0 {
+		t.Fatalf("Expected sqlite migrations")
+	}
+	for i, migration := range migrations {
+		if migration.Version != migrations[0].Version+i {
+			t.Errorf("Unexpected version for %v!\nExpected: %v\nActual: %v", migration.Name, migrations[0].Version+i, migration.Version)
+		}
+	}
+	// both dialects are at the same version, so the binaries check either
+	version, err := SchemaVersion()
+	utils.CheckError(err)
+	if lastVersion(migrations) != version {
+		t.Errorf("Unexpected sqlite schema version!\nExpected: %v\nActual: %v", version, lastVersion(migrations))
+	}
+}
+
+func TestReadMigrationBadName(t *testing.T) {
+	_, err := readMigration(migrationsDir, "add-spawners.sql")
+	if !errors.As(err, &InvalidMigrationError{}) {
+		t.Errorf("Unexpected error!\nExpected: InvalidMigrationError\nActual: %v", err)
+	}
+	if !strings.Contains(err.Error(), "add-spawners.sql") {
+		t.Errorf("Expected the error to name the migration, got: %v", err)
+	}
+}
+
+func TestMigrationErrors(t *testing.T) {
+	cause := errors.New(`column "tpm" of relation "tests" already exists`)
+	var err error = MigrationFailedError{name: "0004-add-tpm-column.sql", err: cause}
+	if !errors.Is(err, cause) || !strings.Contains(err.Error(), "0004-add-tpm-column.sql") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err = AlreadyMigratedError{version: 16}
+	if !strings.Contains(err.Error(), "16") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSchemaVersionMismatchError(t *testing.T) {
+	behind := SchemaVersionMismatchError{database: 16, binary: 17}.Error()
+	if !strings.Contains(behind, "run guts-migrate") {
+		t.Errorf("Expected a database behind the binary to be migrated, got: %v", behind)
+	}
+	ahead := SchemaVersionMismatchError{database: 18, binary: 17}.Error()
+	if !strings.Contains(ahead, "upgrade the binary") {
+		t.Errorf("Expected a binary behind the database to be upgraded, got: %v", ahead)
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	Driver, err := TestDbDriver("guts_api", "guts_api")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	err = Driver.CheckSchemaVersion()
+	utils.CheckError(err)
+}
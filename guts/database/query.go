@@ -0,0 +1,408 @@
+package database
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect is the flavour of SQL a database engine speaks
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	Sqlite
+)
+
+// Expression is an arg the dialects write differently. Like a subquery, its
+// SQL replaces the placeholder and its args are bound in its place
+type Expression interface {
+	clause(dialect Dialect) (clause, error)
+}
+
+// clause is a piece of SQL with a ? placeholder for each of its args. An arg
+// can be a *Query or an Expression, in which case its SQL replaces the
+// placeholder and its args are bound in its place
+type clause struct {
+	sql  string
+	args []any
+}
+
+// Query builds a statement whose values are bound as arguments instead of
+// being written into the SQL, so they can't change what the statement does.
+// Only table and column names, which come from the code, are written as is
+type Query struct {
+	statement  string
+	columns    []clause
+	from       string
+	rows       *clause
+	joins      []clause
+	onConflict string
+	sets       []clause
+	wheres     []clause
+	orderBy    []string
+	limit      *clause
+	forUpdate  string
+	returning  []string
+}
+
+// Select starts a query selecting columns from table
+func Select(table string, columns ...string) *Query {
+	q := &Query{from: table}
+	for _, column := range columns {
+		q.Column(column)
+	}
+	return q
+}
+
+// Column adds a column to a select that isn't just a name, e.g. a value
+// copied into every row an insert adds
+func (q *Query) Column(column string, args ...any) *Query {
+	q.columns = append(q.columns, clause{sql: column, args: args})
+	return q
+}
+
+// Insert starts a query inserting rows into columns of table, the rows come
+// from Values or Rows
+func Insert(table string, columns ...string) *Query {
+	return &Query{statement: fmt.Sprintf("INSERT INTO %v (%v)", table, strings.Join(columns, ", "))}
+}
+
+// Values adds a row of values to an insert, one for each of its columns
+func (q *Query) Values(values ...any) *Query {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	q.rows = &clause{sql: fmt.Sprintf("VALUES (%v)", placeholders), args: values}
+	return q
+}
+
+// Rows inserts the rows a select finds, its columns in the order of the
+// insert's
+func (q *Query) Rows(rows *Query) *Query {
+	q.rows = &clause{sql: "?", args: []any{rows}}
+	return q
+}
+
+// OnConflictUpdate turns an insert into an upsert. When the row clashes with
+// an existing one on columns, the existing row is updated with Set and
+// SetExpr instead, where EXCLUDED is the row that was to be inserted
+func (q *Query) OnConflictUpdate(columns ...string) *Query {
+	q.onConflict = fmt.Sprintf("ON CONFLICT (%v) DO UPDATE", strings.Join(columns, ", "))
+	return q
+}
+
+// Update starts a query updating the rows of table, columns are set with Set
+// and SetExpr
+func Update(table string) *Query {
+	return &Query{statement: fmt.Sprintf("UPDATE %v", table)}
+}
+
+// Delete starts a query deleting rows from table
+func Delete(table string) *Query {
+	return &Query{statement: fmt.Sprintf("DELETE FROM %v", table)}
+}
+
+// Join adds a join, e.g. "JOIN jobs ON jobs.uuid=tests.uuid"
+func (q *Query) Join(join string, args ...any) *Query {
+	q.joins = append(q.joins, clause{sql: join, args: args})
+	return q
+}
+
+// Set sets column to value in an update
+func (q *Query) Set(column string, value any) *Query {
+	return q.SetExpr(fmt.Sprintf("%v=?", column), value)
+}
+
+// SetExpr adds an assignment to an update that isn't just a value, e.g.
+// "attempt=attempt+1"
+func (q *Query) SetExpr(assignment string, args ...any) *Query {
+	q.sets = append(q.sets, clause{sql: assignment, args: args})
+	return q
+}
+
+// Where adds a condition all the rows must meet, ANDed with any others
+func (q *Query) Where(condition string, args ...any) *Query {
+	q.wheres = append(q.wheres, clause{sql: condition, args: args})
+	return q
+}
+
+// WhereIn adds a condition that column is one of values, which must be a
+// slice. No rows meet it when values is empty
+func (q *Query) WhereIn(column string, values any) *Query {
+	if reflect.ValueOf(values).Len() == 0 {
+		return q.Where("false")
+	}
+	return q.Where("?", in{column: column, values: values})
+}
+
+// in is the condition of WhereIn
+type in struct {
+	column string
+	values any
+}
+
+func (i in) clause(dialect Dialect) (clause, error) {
+	if dialect == Postgres {
+		return clause{sql: fmt.Sprintf("%v = ANY(?)", i.column), args: []any{pq.Array(i.values)}}, nil
+	}
+	// sqlite has no arrays, so each value gets a placeholder
+	values := reflect.ValueOf(i.values)
+	placeholders := make([]string, values.Len())
+	args := make([]any, values.Len())
+	for n := range values.Len() {
+		placeholders[n] = "?"
+		args[n] = values.Index(n).Interface()
+	}
+	return clause{sql: fmt.Sprintf("%v IN (%v)", i.column, strings.Join(placeholders, ", ")), args: args}, nil
+}
+
+type ago struct {
+	interval string
+}
+
+// Ago is the time interval, e.g. '2 minutes', before now
+func Ago(interval string) Expression {
+	return ago{interval: interval}
+}
+
+func (a ago) clause(dialect Dialect) (clause, error) {
+	if dialect == Postgres {
+		return clause{sql: "(now() - ?::interval)", args: []any{a.interval}}, nil
+	}
+	// sqlite has no intervals, so the time is worked out here
+	duration, err := ParseInterval(a.interval)
+	if err != nil {
+		return clause{}, err
+	}
+	return clause{sql: "?", args: []any{time.Now().UTC().Add(-duration)}}, nil
+}
+
+// the units of postgres intervals that always span the same time
+var intervalUnits = map[string]time.Duration{
+	"microsecond": time.Microsecond,
+	"millisecond": time.Millisecond,
+	"second":      time.Second,
+	"minute":      time.Minute,
+	"hour":        time.Hour,
+	"day":         24 * time.Hour,
+	"week":        7 * 24 * time.Hour,
+}
+
+type InvalidIntervalError struct {
+	interval string
+}
+
+func (i InvalidIntervalError) Error() string {
+	return fmt.Sprintf("Invalid interval %q, expected amounts of microseconds, milliseconds, seconds, minutes, hours, days or weeks like '2 minutes'", i.interval)
+}
+
+// ParseInterval parses a postgres interval like '1 hour 30 minutes'. Months
+// and years aren't supported, as how long they are depends on when they are
+func ParseInterval(interval string) (time.Duration, error) {
+	var duration time.Duration
+	fields := strings.Fields(interval)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return 0, InvalidIntervalError{interval: interval}
+	}
+	for i := 0; i < len(fields); i += 2 {
+		amount, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return 0, InvalidIntervalError{interval: interval}
+		}
+		unit, ok := intervalUnits[strings.TrimSuffix(strings.ToLower(fields[i+1]), "s")]
+		if !ok {
+			return 0, InvalidIntervalError{interval: interval}
+		}
+		duration += time.Duration(amount) * unit
+	}
+	return duration, nil
+}
+
+type matches struct {
+	subject string
+	pattern string
+	args    []any
+}
+
+// Matches is a condition that subject matches the regular expression
+// pattern, both of them SQL with ? placeholders for args
+func Matches(subject, pattern string, args ...any) Expression {
+	return matches{subject: subject, pattern: pattern, args: args}
+}
+
+func (m matches) clause(dialect Dialect) (clause, error) {
+	operator := "~"
+	if dialect == Sqlite {
+		operator = "REGEXP"
+	}
+	return clause{sql: fmt.Sprintf("(%v %v %v)", m.subject, operator, m.pattern), args: m.args}, nil
+}
+
+func (q *Query) OrderBy(orders ...string) *Query {
+	q.orderBy = append(q.orderBy, orders...)
+	return q
+}
+
+func (q *Query) Limit(limit int) *Query {
+	q.limit = &clause{sql: "LIMIT ?", args: []any{limit}}
+	return q
+}
+
+// ForUpdateSkipLocked locks the rows of table the query selects until the
+// transaction ends, skipping rows already locked by another transaction
+func (q *Query) ForUpdateSkipLocked(table string) *Query {
+	q.forUpdate = table
+	return q
+}
+
+func (q *Query) Returning(columns ...string) *Query {
+	q.returning = append(q.returning, columns...)
+	return q
+}
+
+// clauses lists the clauses of the query in the order they're written in
+func (q *Query) clauses(dialect Dialect) []clause {
+	var clauses []clause
+	if q.from != "" {
+		clauses = append(clauses, joinClauses("SELECT ", q.columns, ", "), clause{sql: "FROM " + q.from})
+	} else {
+		clauses = append(clauses, clause{sql: q.statement})
+	}
+	if q.rows != nil {
+		clauses = append(clauses, *q.rows)
+	}
+	clauses = append(clauses, q.joins...)
+	if q.onConflict != "" {
+		clauses = append(clauses, clause{sql: q.onConflict})
+	}
+	if len(q.sets) > 0 {
+		clauses = append(clauses, joinClauses("SET ", q.sets, ", "))
+	}
+	if len(q.wheres) > 0 {
+		clauses = append(clauses, joinClauses("WHERE ", q.wheres, " AND "))
+	}
+	if len(q.orderBy) > 0 {
+		clauses = append(clauses, clause{sql: "ORDER BY " + strings.Join(q.orderBy, ", ")})
+	}
+	if q.limit != nil {
+		clauses = append(clauses, *q.limit)
+	}
+	// sqlite has no row locks, a write locks the whole database
+	if q.forUpdate != "" && dialect == Postgres {
+		clauses = append(clauses, clause{sql: fmt.Sprintf("FOR UPDATE OF %v SKIP LOCKED", q.forUpdate)})
+	}
+	if len(q.returning) > 0 {
+		clauses = append(clauses, clause{sql: "RETURNING " + strings.Join(q.returning, ", ")})
+	}
+	return clauses
+}
+
+func joinClauses(prefix string, clauses []clause, separator string) clause {
+	var joined clause
+	parts := make([]string, 0, len(clauses))
+	for _, c := range clauses {
+		// conditions are parenthesised so an OR in one doesn't swallow the rest
+		if separator == " AND " && len(clauses) > 1 {
+			parts = append(parts, fmt.Sprintf("(%v)", c.sql))
+		} else {
+			parts = append(parts, c.sql)
+		}
+		joined.args = append(joined.args, c.args...)
+	}
+	joined.sql = prefix + strings.Join(parts, separator)
+	return joined
+}
+
+// flatten writes the query with ? placeholders, inlining subqueries and
+// expressions
+func (q *Query) flatten(dialect Dialect) (string, []any, error) {
+	var sqlParts []string
+	var args []any
+	for _, c := range q.clauses(dialect) {
+		sql, clauseArgs, err := c.flatten(dialect)
+		if err != nil {
+			return "", nil, err
+		}
+		sqlParts = append(sqlParts, sql)
+		args = append(args, clauseArgs...)
+	}
+	return strings.Join(sqlParts, " "), args, nil
+}
+
+func (c clause) flatten(dialect Dialect) (string, []any, error) {
+	var builder strings.Builder
+	var args []any
+	argIndex := 0
+	inLiteral := false
+	for _, char := range c.sql {
+		if char == '\'' {
+			inLiteral = !inLiteral
+		}
+		if char != '?' || inLiteral {
+			builder.WriteRune(char)
+			continue
+		}
+		if argIndex >= len(c.args) {
+			return "", nil, fmt.Errorf("clause %q has more placeholders than its %v args", c.sql, len(c.args))
+		}
+		arg := c.args[argIndex]
+		argIndex++
+		var subSql string
+		var subArgs []any
+		var err error
+		switch sub := arg.(type) {
+		case *Query:
+			subSql, subArgs, err = sub.flatten(dialect)
+		case Expression:
+			var subClause clause
+			subClause, err = sub.clause(dialect)
+			if err == nil {
+				subSql, subArgs, err = subClause.flatten(dialect)
+			}
+		default:
+			builder.WriteRune('?')
+			args = append(args, arg)
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		builder.WriteString(subSql)
+		args = append(args, subArgs...)
+	}
+	if argIndex != len(c.args) {
+		return "", nil, fmt.Errorf("clause %q has fewer placeholders than its %v args", c.sql, len(c.args))
+	}
+	return builder.String(), args, nil
+}
+
+// Build writes the query for postgres with numbered $n placeholders and
+// returns the args to bind to them
+func (q *Query) Build() (string, []any, error) {
+	return q.BuildFor(Postgres)
+}
+
+// BuildFor is Build for the dialect of another database
+func (q *Query) BuildFor(dialect Dialect) (string, []any, error) {
+	flatSql, args, err := q.flatten(dialect)
+	if err != nil {
+		return "", nil, err
+	}
+	var builder strings.Builder
+	argNumber := 0
+	inLiteral := false
+	for _, char := range flatSql {
+		if char == '\'' {
+			inLiteral = !inLiteral
+		}
+		if char == '?' && !inLiteral {
+			argNumber++
+			fmt.Fprintf(&builder, "$%v", argNumber)
+			continue
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String(), args, nil
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryBuild(t *testing.T) {
+	type testCase struct {
+		name          string
+		query         *Query
+		expectedQuery string
+		expectedArgs  []any
+	}
+	testCases := []testCase{
+		{
+			name:          "select",
+			query:         Select("tests", "plan", "test_case").Where("id=?", 4),
+			expectedQuery: "SELECT plan, test_case FROM tests WHERE id=$1",
+			expectedArgs:  []any{4},
+		},
+		{
+			name: "select with join, order and limit",
+			query: Select("tests", "tests.id").
+				Join("JOIN jobs ON jobs.uuid=tests.uuid").
+				Where("state=?", "spawned").
+				Where("vnc_address!=? OR priority>?", "", 3).
+				OrderBy("priority DESC").
+				Limit(1),
+			expectedQuery: "SELECT tests.id FROM tests JOIN jobs ON jobs.uuid=tests.uuid WHERE (state=$1) AND (vnc_address!=$2 OR priority>$3) ORDER BY priority DESC LIMIT $4",
+			expectedArgs:  []any{"spawned", "", 3, 1},
+		},
+		{
+			name:          "update",
+			query:         Update("tests").Set("state", "requested").SetExpr("attempt=attempt+1").Where("id=?", 7),
+			expectedQuery: "UPDATE tests SET state=$1, attempt=attempt+1 WHERE id=$2",
+			expectedArgs:  []any{"requested", 7},
+		},
+		{
+			name:          "values aren't written into the query",
+			query:         Update("jobs").Set("status", "pass'; DROP TABLE jobs; --").Where("uuid=?", "x' OR '1'='1"),
+			expectedQuery: "UPDATE jobs SET status=$1 WHERE uuid=$2",
+			expectedArgs:  []any{"pass'; DROP TABLE jobs; --", "x' OR '1'='1"},
+		},
+		{
+			name:          "placeholders in literals are left alone",
+			query:         Select("tests", "id").Where("test_case!='why?'").Where("uuid=?", "abc"),
+			expectedQuery: "SELECT id FROM tests WHERE (test_case!='why?') AND (uuid=$1)",
+			expectedArgs:  []any{"abc"},
+		},
+		{
+			name:          "where in",
+			query:         Update("tests").Set("claimed_by", "").WhereIn("id", []string{"1", "2"}),
+			expectedQuery: "UPDATE tests SET claimed_by=$1 WHERE id = ANY($2)",
+			expectedArgs:  []any{"", pq.Array([]string{"1", "2"})},
+		},
+		{
+			name:          "where in nothing",
+			query:         Update("tests").Set("claimed_by", "").WhereIn("id", []string{}),
+			expectedQuery: "UPDATE tests SET claimed_by=$1 WHERE false",
+			expectedArgs:  []any{""},
+		},
+		{
+			name:          "delete",
+			query:         Delete("reporter").Where("uuid=?", "abc"),
+			expectedQuery: "DELETE FROM reporter WHERE uuid=$1",
+			expectedArgs:  []any{"abc"},
+		},
+		{
+			name:          "insert",
+			query:         Insert("reporter", "uuid", "base_reporting_url").Values("abc", "https://example.com"),
+			expectedQuery: "INSERT INTO reporter (uuid, base_reporting_url) VALUES ($1, $2)",
+			expectedArgs:  []any{"abc", "https://example.com"},
+		},
+		{
+			name: "insert from select",
+			query: Insert("test_attempts", "test_id", "spawner_host", "vnc_address").
+				Rows(Select("tests", "id").Column("?", "host").Column("vnc_address").Where("id=?", 4)),
+			expectedQuery: "INSERT INTO test_attempts (test_id, spawner_host, vnc_address) SELECT id, $1, vnc_address FROM tests WHERE id=$2",
+			expectedArgs:  []any{"host", 4},
+		},
+		{
+			name: "upsert",
+			query: Insert("spawners", "hostname", "kvm").
+				Values("host", true).
+				OnConflictUpdate("hostname").
+				SetExpr("kvm=EXCLUDED.kvm"),
+			expectedQuery: "INSERT INTO spawners (hostname, kvm) VALUES ($1, $2) ON CONFLICT (hostname) DO UPDATE SET kvm=EXCLUDED.kvm",
+			expectedArgs:  []any{"host", true},
+		},
+		{
+			name: "subquery",
+			query: Update("tests").
+				Set("state", "running").
+				Where("id=(?)", Select("tests", "id").Where("state=?", "spawned").Limit(1).ForUpdateSkipLocked("tests")).
+				Returning("id", "uuid"),
+			expectedQuery: "UPDATE tests SET state=$1 WHERE id=(SELECT id FROM tests WHERE state=$2 LIMIT $3 FOR UPDATE OF tests SKIP LOCKED) RETURNING id, uuid",
+			expectedArgs:  []any{"running", "spawned", 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, args, err := tc.query.Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if query != tc.expectedQuery {
+				t.Errorf("unexpected query!\nexpected: %v\nactual: %v", tc.expectedQuery, query)
+			}
+			if !reflect.DeepEqual(args, tc.expectedArgs) {
+				t.Errorf("unexpected args!\nexpected: %v\nactual: %v", tc.expectedArgs, args)
+			}
+		})
+	}
+}
+
+func TestQueryBuildFor(t *testing.T) {
+	type testCase struct {
+		name          string
+		dialect       Dialect
+		query         *Query
+		expectedQuery string
+		expectedArgs  []any
+	}
+	claim := func() *Query {
+		return Update("tests").
+			Set("state", "running").
+			Where("id=(?)", Select("tests", "id").Where("state=?", "spawned").Limit(1).ForUpdateSkipLocked("tests")).
+			Returning("id", "uuid")
+	}
+	architectures := func() *Query {
+		return Select("jobs", "uuid").Where("NOT ? OR ?", Matches("image_url", "?", "-(amd64|arm64)[.+]"), Matches("image_url", "('-' || ? || '[.+]')", "amd64"))
+	}
+	testCases := []testCase{
+		{
+			name:          "postgres where in",
+			dialect:       Postgres,
+			query:         Select("tests", "id").WhereIn("id", []int{1, 2}),
+			expectedQuery: "SELECT id FROM tests WHERE id = ANY($1)",
+			expectedArgs:  []any{pq.Array([]int{1, 2})},
+		},
+		{
+			name:          "sqlite where in",
+			dialect:       Sqlite,
+			query:         Select("tests", "id").WhereIn("id", []int{1, 2}).Where("state=?", "spawned"),
+			expectedQuery: "SELECT id FROM tests WHERE (id IN ($1, $2)) AND (state=$3)",
+			expectedArgs:  []any{1, 2, "spawned"},
+		},
+		{
+			name:          "postgres locks",
+			dialect:       Postgres,
+			query:         claim(),
+			expectedQuery: "UPDATE tests SET state=$1 WHERE id=(SELECT id FROM tests WHERE state=$2 LIMIT $3 FOR UPDATE OF tests SKIP LOCKED) RETURNING id, uuid",
+			expectedArgs:  []any{"running", "spawned", 1},
+		},
+		{
+			name:          "sqlite doesn't lock rows",
+			dialect:       Sqlite,
+			query:         claim(),
+			expectedQuery: "UPDATE tests SET state=$1 WHERE id=(SELECT id FROM tests WHERE state=$2 LIMIT $3) RETURNING id, uuid",
+			expectedArgs:  []any{"running", "spawned", 1},
+		},
+		{
+			name:          "postgres matches",
+			dialect:       Postgres,
+			query:         architectures(),
+			expectedQuery: "SELECT uuid FROM jobs WHERE NOT (image_url ~ $1) OR (image_url ~ ('-' || $2 || '[.+]'))",
+			expectedArgs:  []any{"-(amd64|arm64)[.+]", "amd64"},
+		},
+		{
+			name:          "sqlite matches",
+			dialect:       Sqlite,
+			query:         architectures(),
+			expectedQuery: "SELECT uuid FROM jobs WHERE NOT (image_url REGEXP $1) OR (image_url REGEXP ('-' || $2 || '[.+]'))",
+			expectedArgs:  []any{"-(amd64|arm64)[.+]", "amd64"},
+		},
+		{
+			name:          "postgres ago",
+			dialect:       Postgres,
+			query:         Select("tests", "id").Where("updated_at < ?", Ago("2 minutes")),
+			expectedQuery: "SELECT id FROM tests WHERE updated_at < (now() - $1::interval)",
+			expectedArgs:  []any{"2 minutes"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, args, err := tc.query.BuildFor(tc.dialect)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if query != tc.expectedQuery {
+				t.Errorf("unexpected query!\nexpected: %v\nactual: %v", tc.expectedQuery, query)
+			}
+			if !reflect.DeepEqual(args, tc.expectedArgs) {
+				t.Errorf("unexpected args!\nexpected: %v\nactual: %v", tc.expectedArgs, args)
+			}
+		})
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	testCases := map[string]time.Duration{
+		"2 minutes":         2 * time.Minute,
+		"1 hour 30 minutes": 90 * time.Minute,
+		"1 Day":             24 * time.Hour,
+		"2 weeks 500 ms":    -1,
+		"500 milliseconds":  500 * time.Millisecond,
+		"1 month":           -1,
+		"minutes":           -1,
+		"two minutes":       -1,
+		"":                  -1,
+	}
+	for interval, expected := range testCases {
+		duration, err := ParseInterval(interval)
+		if expected == -1 {
+			if !errors.As(err, &InvalidIntervalError{}) || !strings.Contains(err.Error(), interval) {
+				t.Errorf("Unexpected error for %q!\nExpected: InvalidIntervalError\nActual: %v", interval, err)
+			}
+			continue
+		}
+		if err != nil || duration != expected {
+			t.Errorf("Unexpected duration for %q!\nExpected: %v\nActual: %v %v", interval, expected, duration, err)
+		}
+	}
+}
+
+func TestQueryBuildMismatchedArgs(t *testing.T) {
+	for _, query := range []*Query{
+		Select("tests", "id").Where("id=? AND state=?", 4),
+		Select("tests", "id").Where("id=?", 4, "requested"),
+		Update("tests").Set("state", "running").Where("id=(?)", Select("tests", "id").Where("state=?")),
+	} {
+		if _, _, err := query.Build(); err == nil {
+			t.Errorf("expected an error building a query with mismatched args")
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"log"
+	"modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestDriverEnv names the environment variable choosing the database driver
+// of TestDbDriver
+const TestDriverEnv = "GUTS_TEST_DRIVER"
+
+// the format times are written to sqlite in, which sorts the same as the times
+// as they're all in UTC, and which sqlite reads back as UTC
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999"
+
+// what each connection to a sqlite database is opened with. Transactions take
+// the write lock as they begin, rather than failing if another transaction
+// writes first, and wait for it for up to 10 seconds
+const sqliteConnectionParams = "_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)"
+
+// the name sqliteDriver is registered under
+const sqliteDriverName = "guts-sqlite"
+
+func init() {
+	// the postgres functions the queries use that sqlite doesn't have
+	sqlite.MustRegisterScalarFunction("now", 0, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return time.Now().UTC().Format(sqliteTimeFormat), nil
+	})
+	// sqlite runs "subject REGEXP pattern" as regexp(pattern, subject)
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		return regexp.MatchString(fmt.Sprint(args[0]), fmt.Sprint(args[1]))
+	})
+	// the functions are registered on the driver registered as sqlite, which
+	// opening a database hands over without connecting to it
+	db, err := sql.Open("sqlite", "")
+	if err != nil { // coverage-ignore
+		panic(err)
+	}
+	sql.Register(sqliteDriverName, sqliteDriver{Driver: db.Driver()})
+}
+
+// sqliteDriver is the sqlite driver, with times written in sqliteTimeFormat
+// rather than in the zone they're in
+type sqliteDriver struct {
+	driver.Driver
+}
+
+// sqliteConn is what the connections of the sqlite driver can do
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type utcConn struct {
+	sqliteConn
+}
+
+func (s sqliteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := s.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return utcConn{sqliteConn: conn.(sqliteConn)}, nil
+}
+
+// CheckNamedValue converts args like database/sql does, then writes times in
+// sqliteTimeFormat
+func (u utcConn) CheckNamedValue(arg *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(arg.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC().Format(sqliteTimeFormat)
+	}
+	arg.Value = value
+	return nil
+}
+
+// sqliteDataSource is the connection string of a sqlite database, the path of
+// its file, with the params each connection is opened with
+func sqliteDataSource(connectionString string) string {
+	if strings.Contains(connectionString, "?") {
+		return connectionString + "&" + sqliteConnectionParams
+	}
+	return connectionString + "?" + sqliteConnectionParams
+}
+
+type SqliteOperationInterface struct {
+	Driver DbDriver
+	Db     *sql.DB
+	// set when the interface runs statements in a transaction on Db
+	tx *sql.Tx
+}
+
+func (s SqliteOperationInterface) Dialect() Dialect {
+	return Sqlite
+}
+
+func (s SqliteOperationInterface) DbAvailable() error {
+	return s.Db.PingContext(s.Driver.context())
+}
+
+func (s SqliteOperationInterface) InterfaceQueryRow(table, queryField, queryValue string, fields []string) (*sql.Row, error) { // coverage-ignore
+	queryString := fmt.Sprintf("SELECT %v FROM %v WHERE %v=$1", strings.Join(fields, ", "), table, queryField)
+	return s.InterfaceRunQueryRow(s.Driver.context(), queryString, queryValue)
+}
+
+func (s SqliteOperationInterface) InterfaceQuery(table, queryField, queryValue string, fields []string) (*sql.Rows, error) { // coverage-ignore
+	queryString := fmt.Sprintf("SELECT %v FROM %v WHERE %v=$1", strings.Join(fields, ", "), table, queryField)
+	log.Printf("running query %v with query parameter %v\n", queryString, queryValue)
+	return s.InterfaceRunQuery(s.Driver.context(), queryString, queryValue)
+}
+
+func (s SqliteOperationInterface) InterfacePrepareQuery(queryString string) (*sql.Stmt, error) { // coverage-ignore
+	return s.conn().PrepareContext(s.Driver.context(), queryString)
+}
+
+func (s SqliteOperationInterface) InterfaceRunQueryRow(ctx context.Context, queryString string, args ...any) (*sql.Row, error) {
+	return s.conn().QueryRowContext(ctx, queryString, args...), nil
+}
+
+func (s SqliteOperationInterface) InterfaceRunQuery(ctx context.Context, queryString string, args ...any) (*sql.Rows, error) {
+	return s.conn().QueryContext(ctx, queryString, args...)
+}
+
+func (s SqliteOperationInterface) InterfaceExec(ctx context.Context, queryString string, args ...any) (int64, error) {
+	result, err := s.conn().ExecContext(ctx, queryString, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s SqliteOperationInterface) UpdateUpdatedAt(id int) error {
+	_, err := s.InterfaceExec(s.Driver.context(), `UPDATE tests SET updated_at=$1 WHERE id=$2`, time.Now(), id)
+	return err
+}
+
+func (s SqliteOperationInterface) RemoveUuidFromAllTables(uuid string) error {
+	// order must be preserved as uuid is a primary key in jobs
+	for _, table := range []string{"reporter", "test_attempts", "test_results", "tests", "jobs"} {
+		removeQuery, args, err := Delete(table).Where("uuid=?", uuid).BuildFor(Sqlite)
+		if err != nil { // coverage-ignore
+			return err
+		}
+		_, err = s.InterfaceExec(s.Driver.context(), removeQuery, args...)
+		if err != nil { // coverage-ignore
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// test database, just used for testing, so we don't test
+
+var testSqliteDb struct {
+	once   sync.Once
+	driver DbDriver
+	err    error
+}
+
+// the COPY statements loading the test data into postgres
+var testDataCopyPattern = regexp.MustCompile(`COPY (\w+) \(([^)]*)\) FROM '[^']*/([\w.-]+\.csv)'`)
+
+// testSqliteDbDriver makes a sqlite database in a temporary directory, with
+// the schema and the test data postgres is bootstrapped with. It's made once
+// for each test binary, and left behind for looking into failed tests
+func testSqliteDbDriver() (DbDriver, error) { // coverage-ignore
+	testSqliteDb.once.Do(func() {
+		dir, err := os.MkdirTemp("", "guts-test-")
+		if err != nil {
+			testSqliteDb.err = err
+			return
+		}
+		driver, err := NewDbDriver("sqlite", filepath.Join(dir, "guts.db"))
+		if err != nil {
+			testSqliteDb.err = err
+			return
+		}
+		if _, err = driver.Migrate(context.Background()); err != nil {
+			testSqliteDb.err = err
+			return
+		}
+		testSqliteDb.driver = driver
+		testSqliteDb.err = driver.WithTx(context.Background(), func(tx DbDriver) error {
+			return tx.loadTestData()
+		})
+	})
+	return testSqliteDb.driver, testSqliteDb.err
+}
+
+// testDataDir finds the test data of the repository the tests run in
+func testDataDir() (string, error) { // coverage-ignore
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		testData := filepath.Join(dir, "postgres", "test-data")
+		if _, err := os.Stat(filepath.Join(testData, "test-data.sql")); err == nil {
+			return testData, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no postgres/test-data above %v", dir)
+		}
+		dir = parent
+	}
+}
+
+// loadTestData runs the COPY statements of the postgres test data as inserts
+func (d DbDriver) loadTestData() error { // coverage-ignore
+	testData, err := testDataDir()
+	if err != nil {
+		return err
+	}
+	script, err := os.ReadFile(filepath.Join(testData, "test-data.sql"))
+	if err != nil {
+		return err
+	}
+	for _, copyStatement := range testDataCopyPattern.FindAllStringSubmatch(string(script), -1) {
+		var columns []string
+		for _, column := range strings.Split(copyStatement[2], ",") {
+			columns = append(columns, strings.TrimSpace(column))
+		}
+		err = d.loadTestDataCsv(copyStatement[1], columns, filepath.Join(testData, copyStatement[3]))
+		if err != nil {
+			return fmt.Errorf("loading %v: %w", copyStatement[3], err)
+		}
+	}
+	return nil
+}
+
+type testDataColumn struct {
+	kind    string
+	notNull bool
+}
+
+func (d DbDriver) loadTestDataCsv(table string, columns []string, path string) error { // coverage-ignore
+	tableColumns := map[string]testDataColumn{}
+	rows, err := d.GetRows(Select(fmt.Sprintf("pragma_table_info('%v')", table), "name", "type", "\"notnull\""))
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+	for rows.Next() {
+		var name string
+		var column testDataColumn
+		if err = rows.Scan(&name, &column.kind, &column.notNull); err != nil {
+			return err
+		}
+		tableColumns[name] = column
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(file.Close)
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%v", i+1)
+	}
+	insert := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	// the first record is the header
+	for _, record := range records[1:] {
+		values := make([]any, len(columns))
+		for i, field := range record {
+			values[i], err = testDataValue(tableColumns[columns[i]], field)
+			if err != nil {
+				return err
+			}
+		}
+		if err = d.UpdateRow(insert, values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testDataValue converts a field of a postgres CSV to what's stored in column
+func testDataValue(column testDataColumn, field string) (any, error) { // coverage-ignore
+	// postgres reads empty fields as NULL, unless they're quoted, which only
+	// the columns that can't be NULL have
+	if field == "" && !column.notNull {
+		return nil, nil
+	}
+	switch column.kind {
+	case "BOOLEAN":
+		return strconv.ParseBool(field)
+	case "TIMESTAMP":
+		return time.Parse("2006-01-02T15:04:05.999999999-07", field)
+	}
+	return field, nil
+}
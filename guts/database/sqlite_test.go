@@ -0,0 +1,245 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"guts.ubuntu.com/v2/utils"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSqliteDbDriver makes an empty sqlite database at the schema version of
+// the binary
+func newSqliteDbDriver(t *testing.T) DbDriver {
+	Driver, err := NewDbDriver("sqlite", filepath.Join(t.TempDir(), "guts.db"))
+	utils.CheckError(err)
+	t.Cleanup(func() {
+		utils.CheckError(Driver.Interface.(SqliteOperationInterface).Db.Close())
+	})
+	_, err = Driver.Migrate(context.Background())
+	utils.CheckError(err)
+	return Driver
+}
+
+// addSqliteJob adds a job with a test in each of states
+func addSqliteJob(Driver DbDriver, uuid, imageUrl string, states ...string) {
+	utils.CheckError(Driver.UpdateRow(`INSERT INTO jobs (uuid, tests_repo, tests_repo_branch, tests_plans, image_url, reporter, status, submitted_at, requester, debug, priority) VALUES ($1, 'repo', 'main', '{plan.yaml}', $2, 'test_observer', 'running', $3, 'andersson123', false, 1)`, uuid, imageUrl, time.Now()))
+	for i, state := range states {
+		utils.CheckError(Driver.UpdateRow(`INSERT INTO tests (uuid, test_case, state, updated_at) VALUES ($1, $2, $3, $4)`, uuid, i, state, time.Now()))
+	}
+}
+
+func TestSqliteDbDriver(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	if Driver.Interface.Dialect() != Sqlite {
+		t.Errorf("Unexpected dialect!\nExpected: %v\nActual: %v", Sqlite, Driver.Interface.Dialect())
+	}
+	utils.CheckError(Driver.Interface.DbAvailable())
+	utils.CheckError(Driver.CheckSchemaVersion())
+	// migrating again has nothing left to apply
+	applied, err := Driver.Migrate(context.Background())
+	utils.CheckError(err)
+	if len(applied) != 0 {
+		t.Errorf("Expected no migrations to be applied again, got %v", applied)
+	}
+	utils.CheckError(Driver.Interface.InterfaceLockSchema())
+}
+
+func TestSqliteUnavailable(t *testing.T) {
+	Driver, err := NewDbDriver("sqlite", filepath.Join(t.TempDir(), "missing", "guts.db"))
+	utils.CheckError(err)
+	if err = Driver.Interface.DbAvailable(); err == nil {
+		t.Errorf("Expected a database in a directory that doesn't exist to be unavailable")
+	}
+}
+
+func TestSqliteDataSource(t *testing.T) {
+	testCases := map[string]string{
+		"/var/lib/guts/guts.db":                  "/var/lib/guts/guts.db?" + sqliteConnectionParams,
+		"/var/lib/guts/guts.db?_pragma=cache(1)": "/var/lib/guts/guts.db?_pragma=cache(1)&" + sqliteConnectionParams,
+	}
+	for connectionString, expected := range testCases {
+		if actual := sqliteDataSource(connectionString); actual != expected {
+			t.Errorf("Unexpected data source!\nExpected: %v\nActual: %v", expected, actual)
+		}
+	}
+}
+
+func TestSqliteClaimTest(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	uuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	addSqliteJob(Driver, uuid, "https://cdimage.ubuntu.com/questing-desktop-amd64.iso", "requested", "running", "requested")
+	candidate := func() *Query {
+		return Select("tests", "id").Where("state=?", "requested").OrderBy("id").Limit(1)
+	}
+
+	for _, expectedId := range []int{1, 3} {
+		id, claimedUuid, err := Driver.ClaimTest(candidate(), "spawning", "spawner:1")
+		utils.CheckError(err)
+		if id != expectedId || claimedUuid != uuid {
+			t.Errorf("Unexpected claim!\nExpected: %v %v\nActual: %v %v", expectedId, uuid, id, claimedUuid)
+		}
+	}
+	id, claimedUuid, err := Driver.ClaimTest(candidate(), "spawning", "spawner:1")
+	utils.CheckError(err)
+	if id != 0 || claimedUuid != "" {
+		t.Errorf("Expected nothing left to claim, claimed %v %v", id, claimedUuid)
+	}
+	utils.CheckError(Driver.SetClaimedTestStateTo(1, "spawned", "spawner:1"))
+	err = Driver.SetClaimedTestStateTo(1, "spawned", "spawner:2")
+	if !errors.As(err, &ClaimLostError{}) {
+		t.Errorf("Unexpected error!\nExpected: ClaimLostError\nActual: %v", err)
+	}
+}
+
+func TestSqliteTimes(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	uuid := "2afd5896-9203-4c87-8790-a40091557d8d"
+	addSqliteJob(Driver, uuid, "https://cdimage.ubuntu.com/questing-desktop-amd64.iso", "running", "running")
+	// times are written in UTC whichever zone they're in, so they compare as
+	// the times they are
+	longAgo := time.Date(2025, 7, 23, 16, 17, 14, 632177000, time.FixedZone("CEST", 2*60*60))
+	utils.CheckError(Driver.UpdateRow(`UPDATE tests SET updated_at=$1 WHERE id=1`, longAgo))
+	utils.CheckError(Driver.TestsUpdateUpdatedAt(2))
+
+	var updatedAt time.Time
+	row, err := Driver.GetRow(Select("tests", "updated_at").Where("id=?", 1))
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&updatedAt))
+	if !reflect.DeepEqual(updatedAt, longAgo.UTC()) {
+		t.Errorf("Unexpected time!\nExpected: %v\nActual: %v", longAgo.UTC(), updatedAt)
+	}
+
+	rows, err := Driver.GetRows(Select("tests", "id").Where("updated_at < ?", Ago("2 minutes")))
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(rows.Close)
+	var ids []int
+	for rows.Next() {
+		var id int
+		utils.CheckError(rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	utils.CheckError(rows.Err())
+	if !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("Unexpected tests updated over 2 minutes ago!\nExpected: %v\nActual: %v", []int{1}, ids)
+	}
+
+	var inThePast bool
+	row, err = Driver.RunQueryRow(`SELECT updated_at <= now() FROM tests WHERE id=2`)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&inThePast))
+	if !inThePast {
+		t.Errorf("Expected the test to have been updated before now()")
+	}
+
+	_, err = Driver.Exec(Update("tests").Set("state", "running").Where("updated_at < ?", Ago("a while")))
+	if !errors.As(err, &InvalidIntervalError{}) {
+		t.Errorf("Unexpected error!\nExpected: InvalidIntervalError\nActual: %v", err)
+	}
+}
+
+func TestSqliteMatches(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	addSqliteJob(Driver, "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e001", "https://cdimage.ubuntu.com/questing-desktop-amd64.iso", "requested")
+	addSqliteJob(Driver, "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e002", "https://cdimage.ubuntu.com/questing-desktop-arm64.iso", "requested")
+	addSqliteJob(Driver, "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e003", "https://cdimage.ubuntu.com/questing-desktop.iso", "requested")
+
+	rows, err := Driver.GetRows(Select("jobs", "uuid").
+		Where("NOT ? OR ?", Matches("image_url", "?", `-(amd64|arm64)[.+]`), Matches("image_url", "('-' || ? || '[.+]')", "amd64")).
+		WhereIn("uuid", []string{"5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e001", "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e002", "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e003"}).
+		OrderBy("uuid"))
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(rows.Close)
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		utils.CheckError(rows.Scan(&uuid))
+		uuids = append(uuids, uuid)
+	}
+	utils.CheckError(rows.Err())
+	expectedUuids := []string{"5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e001", "5b0e4a1b-5e87-4b1b-a8b8-f4e1a5a3e003"}
+	if !reflect.DeepEqual(uuids, expectedUuids) {
+		t.Errorf("Unexpected jobs for amd64!\nExpected: %v\nActual: %v", expectedUuids, uuids)
+	}
+
+	// like ~, REGEXP is NULL when either side is
+	var matched *bool
+	row, err := Driver.RunQueryRow(`SELECT NULL REGEXP 'amd64'`)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&matched))
+	if matched != nil {
+		t.Errorf("Expected NULL to match nothing, got %v", *matched)
+	}
+}
+
+func TestSqliteNukeUuid(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	uuid := "eccd3988-490d-4414-be97-605d1ac81073"
+	addSqliteJob(Driver, uuid, "https://cdimage.ubuntu.com/questing-desktop-amd64.iso", "pass", "fail")
+	utils.CheckError(Driver.UpdateRow(`INSERT INTO reporter (uuid, base_reporting_url) VALUES ($1, 'https://tests-api.ubuntu.com')`, uuid))
+	utils.CheckError(StartTestAttempt(1, "spawner", Driver))
+
+	utils.CheckError(Driver.NukeUuid(uuid))
+	for _, table := range []string{"reporter", "test_attempts", "test_results", "tests", "jobs"} {
+		var count int
+		row, err := Driver.GetRow(Select(table, "COUNT(*)").Where("uuid=?", uuid))
+		utils.CheckError(err)
+		utils.CheckError(row.Scan(&count))
+		if count != 0 {
+			t.Errorf("Expected %v to have no rows of %v, it has %v", table, uuid, count)
+		}
+	}
+}
+
+func TestSqliteErrors(t *testing.T) {
+	Driver := newSqliteDbDriver(t)
+	_, err := Driver.Exec(Update("no_such_table").Set("state", "pass"))
+	if err == nil {
+		t.Errorf("Expected updating a table that doesn't exist to fail")
+	}
+	// args database/sql can't convert fail before reaching sqlite
+	err = Driver.UpdateRow(`UPDATE tests SET state=$1`, struct{}{})
+	if err == nil {
+		t.Errorf("Expected an arg that can't be converted to fail")
+	}
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Driver.BeginTx(cancelledCtx)
+	if err == nil {
+		t.Errorf("Expected beginning a cancelled transaction to fail")
+	}
+}
+
+func TestPollingListener(t *testing.T) {
+	defer func(interval time.Duration) { ListenerPollInterval = interval }(ListenerPollInterval)
+	ListenerPollInterval = 10 * time.Millisecond
+	Driver := newSqliteDbDriver(t)
+
+	channel := "guts_listener_test"
+	listener, err := Driver.Listen(channel)
+	utils.CheckError(err)
+	// polls are empty notifications, so listeners re-read what changed
+	expectedNotification := Notification{Channel: channel}
+	select {
+	case notification := <-listener.Notifications():
+		if notification != expectedNotification {
+			t.Errorf("Unexpected notification!\nExpected: %v\nActual: %v", expectedNotification, notification)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Didn't receive a notification on channel %v", channel)
+	}
+	// a poll waiting to be received is dropped on closing
+	time.Sleep(2 * ListenerPollInterval)
+	utils.CheckError(listener.Close())
+	time.Sleep(2 * ListenerPollInterval)
+	for range listener.Notifications() {
+	}
+
+	listener, err = Driver.Listen(channel)
+	utils.CheckError(err)
+	utils.CheckError(listener.Close())
+	for range listener.Notifications() {
+	}
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+type NestedTxError struct{}
+
+func (n NestedTxError) Error() string {
+	return "Can't begin a transaction in another transaction, use WithTx to join it instead"
+}
+
+// queryer runs statements, on the database or in a transaction on it
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// Tx is a transaction on the database. Its DbDriver runs every statement,
+// including those of functions it's passed to, in the transaction
+type Tx struct {
+	DbDriver
+	tx *sql.Tx
+}
+
+func (t Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback undoes the transaction, doing nothing if it's already been
+// committed or rolled back
+func (t Tx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) { // coverage-ignore
+		return nil
+	}
+	return err
+}
+
+// context is what the statements of the driver run under when they aren't
+// given a context of their own
+func (d DbDriver) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// InTx checks whether the driver runs its statements in a transaction
+func (d DbDriver) InTx() bool {
+	return d.ctx != nil
+}
+
+// BeginTx starts a transaction, which is rolled back if ctx is cancelled or
+// times out before it's committed
+func (d DbDriver) BeginTx(ctx context.Context) (Tx, error) {
+	if d.InTx() {
+		return Tx{}, NestedTxError{}
+	}
+	txInterface, tx, err := d.Interface.InterfaceBeginTx(ctx)
+	if err != nil {
+		return Tx{}, err
+	}
+	txDriver := d
+	txDriver.Interface = txInterface
+	txDriver.ctx = ctx
+	return Tx{DbDriver: txDriver, tx: tx}, nil
+}
+
+// WithTx runs fn in a transaction, committing it if fn succeeds and rolling
+// it back if fn fails or panics. Calling WithTx on the driver of a transaction
+// runs fn as part of that transaction
+func (d DbDriver) WithTx(ctx context.Context, fn func(tx DbDriver) error) (err error) {
+	if d.InTx() {
+		return fn(d)
+	}
+	tx, err := d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.Rollback()
+			panic(r)
+		}
+		if err != nil {
+			// the error of fn is the one worth reporting
+			_ = tx.Rollback()
+		}
+	}()
+	if err = fn(tx.DbDriver); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// conn is what the interface runs statements on
+func (p PgOperationInterface) conn() queryer {
+	if p.tx != nil {
+		return p.tx
+	}
+	return p.Db
+}
+
+func (p PgOperationInterface) InterfaceBeginTx(ctx context.Context) (DbOperationInterface, *sql.Tx, error) {
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, nil, err
+	}
+	txInterface := p
+	txInterface.tx = tx
+	txInterface.Driver.ctx = ctx
+	return txInterface, tx, nil
+}
+
+// conn is what the interface runs statements on
+func (s SqliteOperationInterface) conn() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.Db
+}
+
+func (s SqliteOperationInterface) InterfaceBeginTx(ctx context.Context) (DbOperationInterface, *sql.Tx, error) {
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return s, nil, err
+	}
+	txInterface := s
+	txInterface.tx = tx
+	txInterface.Driver.ctx = ctx
+	return txInterface, tx, nil
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"guts.ubuntu.com/v2/utils"
+	"testing"
+)
+
+func TestWithTx(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 4
+	originalState, err := Driver.GetTestState(rowId)
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.SetTestStateTo(rowId, originalState))
+	}()
+
+	failure := errors.New("failed halfway through")
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	type testCase struct {
+		name          string
+		ctx           context.Context
+		fnErr         error
+		expectedState string
+	}
+	testCases := []testCase{
+		{name: "fn fails", ctx: context.Background(), fnErr: failure, expectedState: originalState},
+		{name: "context cancelled", ctx: cancelledCtx, expectedState: originalState},
+		{name: "fn succeeds", ctx: context.Background(), expectedState: "spawning"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Driver.WithTx(tc.ctx, func(tx DbDriver) error {
+				if !tx.InTx() {
+					t.Errorf("driver of the transaction isn't in it")
+				}
+				err := tx.SetTestStateTo(rowId, "spawning")
+				if err != nil {
+					return err
+				}
+				// joins the transaction rather than starting another
+				err = tx.WithTx(tc.ctx, func(nestedTx DbDriver) error {
+					return nestedTx.UpdateRow(`UPDATE tests SET updated_at=now() WHERE id=$1`, rowId)
+				})
+				if err != nil {
+					return err
+				}
+				return tc.fnErr
+			})
+			if tc.ctx.Err() == nil && !errors.Is(err, tc.fnErr) {
+				t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", tc.fnErr, err)
+			}
+			if tc.ctx.Err() != nil && err == nil {
+				t.Errorf("Expected a cancelled transaction to fail")
+			}
+			state, err := Driver.GetTestState(rowId)
+			utils.CheckError(err)
+			if state != tc.expectedState {
+				t.Errorf("Unexpected test state!\nExpected: %v\nActual: %v", tc.expectedState, state)
+			}
+		})
+	}
+}
+
+func TestWithTxPanics(t *testing.T) {
+	Driver, err := TestDbDriver("guts_spawner", "guts_spawner")
+	if SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	rowId := 4
+	originalState, err := Driver.GetTestState(rowId)
+	utils.CheckError(err)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected WithTx to panic with fn")
+			}
+		}()
+		_ = Driver.WithTx(context.Background(), func(tx DbDriver) error {
+			utils.CheckError(tx.SetTestStateTo(rowId, "spawning"))
+			panic("failed halfway through")
+		})
+	}()
+
+	state, err := Driver.GetTestState(rowId)
+	utils.CheckError(err)
+	if state != originalState {
+		t.Errorf("Unexpected test state!\nExpected: %v\nActual: %v", originalState, state)
+	}
+}
+
+func TestBeginTxInTx(t *testing.T) {
+	var Driver DbDriver
+	Driver.ctx = context.Background()
+	_, err := Driver.BeginTx(context.Background())
+	if !errors.As(err, &NestedTxError{}) {
+		t.Errorf("Unexpected error!\nExpected: %v\nActual: %v", NestedTxError{}, err)
+	}
+}
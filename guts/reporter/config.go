@@ -0,0 +1,38 @@
+package reporter
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type GutsReporterConfig struct {
+	Database struct {
+		Driver           string `yaml:"driver"`
+		ConnectionString string `yaml:"connection_string"`
+	}
+	ApiUrl         string `yaml:"api_url"`          // used to link to the artifacts of a job
+	MaxAttempts    int    `yaml:"max_attempts"`     // give up reporting a job after this many failures
+	RetryBaseDelay string `yaml:"retry_base_delay"` // like '30s', doubled after every failure
+	// settings for each reporting service, keyed by the reporter of a job
+	Reporters map[string]map[string]string `yaml:"reporters"`
+}
+
+func ParseConfig(cfgPath string) (GutsReporterConfig, error) {
+	var ReporterConfig GutsReporterConfig
+	filename, err := filepath.Abs(cfgPath)
+	if err != nil { // coverage-ignore
+		return ReporterConfig, err
+	}
+	yamlFile, err := os.ReadFile(filename)
+	if err != nil { // coverage-ignore
+		return ReporterConfig, err
+	}
+	err = yaml.Unmarshal(yamlFile, &ReporterConfig)
+	if err != nil { // coverage-ignore
+		return ReporterConfig, err
+	}
+	_, err = time.ParseDuration(ReporterConfig.RetryBaseDelay)
+	return ReporterConfig, err
+}
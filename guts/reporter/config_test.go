@@ -0,0 +1,27 @@
+package reporter
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfgPath := "./guts-reporter.yaml"
+	reporterCfg, err := ParseConfig(cfgPath)
+	utils.CheckError(err)
+
+	var expectedCfg GutsReporterConfig
+	expectedCfg.Database.Driver = "postgres"
+	expectedCfg.Database.ConnectionString = "host=localhost port=5432 user=guts_reporter password=guts_reporter dbname=guts sslmode=disable"
+	expectedCfg.ApiUrl = "http://localhost:8080"
+	expectedCfg.MaxAttempts = 8
+	expectedCfg.RetryBaseDelay = "30s"
+	expectedCfg.Reporters = map[string]map[string]string{
+		"test_observer": {"api_token": ""},
+	}
+
+	if !reflect.DeepEqual(expectedCfg, reporterCfg) {
+		t.Errorf("unexpected parsed config!\nexpected: %v\nactual: %v", expectedCfg, reporterCfg)
+	}
+}
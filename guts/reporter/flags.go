@@ -0,0 +1,23 @@
+package reporter
+
+import (
+	"flag"
+	"os"
+)
+
+func ParseArgs() string { // coverage-ignore
+	var configFilePath string
+	// Config file path
+	cfgPathFromEnv := os.Getenv("GUTS_REPORTER_CFG_PATH")
+	if cfgPathFromEnv == "" {
+		cfgPathFromEnv = "./guts-reporter.yaml"
+	}
+	if flag.Lookup("cfg-path") == nil {
+		flag.StringVar(&configFilePath, "cfg-path", cfgPathFromEnv, "Path to config file for the guts reporter")
+	}
+
+	// Parse
+	flag.Parse()
+
+	return configFilePath
+}
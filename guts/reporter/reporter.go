@@ -0,0 +1,207 @@
+package reporter
+
+import (
+	"database/sql"
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"log"
+	"time"
+)
+
+var (
+	// upper bound for the delay between two attempts at reporting a job
+	MaxRetryDelay = 6 * time.Hour
+	// last_error is a VARCHAR(500)
+	maxErrorLength = 500
+)
+
+type TestReport struct {
+	TestCase   string
+	State      string
+	ResultsUrl string
+}
+
+// JobReport is everything a reporting service gets told about a finished job
+type JobReport struct {
+	Uuid             string
+	Reporter         string
+	BaseReportingUrl string
+	Status           string
+	ArtifactsUrl     string
+	Attempts         int
+	Tests            []TestReport
+}
+
+type ReporterBackend interface {
+	Connect(rprtCfg *map[string]string) (ReporterBackend, error)
+	// Report must be safe to call again for a report that previously failed
+	// part way through, without duplicating what was already delivered
+	Report(report JobReport) error
+}
+
+type UnsupportedReporterError struct {
+	reporter string
+}
+
+func (u UnsupportedReporterError) Error() string {
+	return fmt.Sprintf("%v isn't a supported reporter", u.reporter)
+}
+
+type ReportDeliveryError struct {
+	url  string
+	code int
+}
+
+func (r ReportDeliveryError) Error() string {
+	return fmt.Sprintf("Reporting to %v returned %v", r.url, r.code)
+}
+
+func GetReporterBackend(reporter string, rprtCfg map[string]string) (ReporterBackend, error) {
+	if reporter == "test_observer" {
+		var testObserver TestObserverBackend
+		return testObserver.Connect(&rprtCfg)
+	}
+	return nil, UnsupportedReporterError{reporter: reporter}
+}
+
+// RetryDelay doubles the base delay for every failed attempt
+func RetryDelay(baseDelay time.Duration, attempts int) time.Duration {
+	delay := baseDelay
+	for i := 0; i < attempts; i++ {
+		delay *= 2
+		if delay >= MaxRetryDelay {
+			return MaxRetryDelay
+		}
+	}
+	return delay
+}
+
+func GetArtifactsUrl(apiUrl, uuid string) string {
+	return fmt.Sprintf("%v/artifacts/%v/results.tar.gz", apiUrl, uuid)
+}
+
+// GetPendingReports finds finished jobs which haven't been reported yet and
+// are due another attempt
+func GetPendingReports(Driver database.DbDriver, maxAttempts int) ([]JobReport, error) {
+	var reports []JobReport
+	pendingQuery := database.Select("reporter", "reporter.uuid", "reporter.base_reporting_url", "jobs.reporter", "jobs.status", "reporter.attempts").
+		Join("JOIN jobs ON jobs.uuid=reporter.uuid").
+		WhereIn("jobs.status", []string{"pass", "fail", "flaky"}).
+		Where("reporter.reported_at IS NULL").
+		Where("reporter.attempts<?", maxAttempts).
+		Where("reporter.next_attempt_at IS NULL OR reporter.next_attempt_at<=?", time.Now())
+	rows, err := Driver.GetRows(pendingQuery)
+	if err != nil { // coverage-ignore
+		return reports, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		var report JobReport
+		var baseReportingUrl sql.NullString
+		err = rows.Scan(
+			&report.Uuid,
+			&baseReportingUrl,
+			&report.Reporter,
+			&report.Status,
+			&report.Attempts,
+		)
+		if err != nil { // coverage-ignore
+			return reports, err
+		}
+		report.BaseReportingUrl = baseReportingUrl.String
+		reports = append(reports, report)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return reports, err
+	}
+	return reports, nil
+}
+
+func CollateTestReports(Driver database.DbDriver, uuid string) ([]TestReport, error) {
+	var tests []TestReport
+	rows, err := Driver.GetRows(database.Select("tests", "test_case", "state", "results_url").Where("uuid=?", uuid).OrderBy("id"))
+	if err != nil { // coverage-ignore
+		return tests, err
+	}
+	defer utils.DeferredErrCheck(rows.Close)
+
+	for rows.Next() {
+		var test TestReport
+		var resultsUrl sql.NullString
+		err = rows.Scan(
+			&test.TestCase,
+			&test.State,
+			&resultsUrl,
+		)
+		if err != nil { // coverage-ignore
+			return tests, err
+		}
+		test.ResultsUrl = resultsUrl.String
+		tests = append(tests, test)
+	}
+	if err = rows.Err(); err != nil { // coverage-ignore
+		return tests, err
+	}
+	return tests, nil
+}
+
+func MarkReported(Driver database.DbDriver, uuid string) error {
+	_, err := Driver.Exec(database.Update("reporter").Set("reported_at", time.Now()).Set("last_error", nil).Where("uuid=?", uuid))
+	return err
+}
+
+func MarkReportFailed(Driver database.DbDriver, report JobReport, reportErr error, baseDelay time.Duration) error {
+	errString := reportErr.Error()
+	if len(errString) > maxErrorLength {
+		errString = errString[:maxErrorLength]
+	}
+	nextAttempt := time.Now().Add(RetryDelay(baseDelay, report.Attempts))
+	_, err := Driver.Exec(database.Update("reporter").
+		SetExpr("attempts=attempts+1").
+		Set("next_attempt_at", nextAttempt).
+		Set("last_error", errString).
+		Where("uuid=?", report.Uuid))
+	return err
+}
+
+func DeliverReport(Driver database.DbDriver, ReporterCfg GutsReporterConfig, report JobReport) error {
+	backend, err := GetReporterBackend(report.Reporter, ReporterCfg.Reporters[report.Reporter])
+	if err != nil {
+		return err
+	}
+	report.Tests, err = CollateTestReports(Driver, report.Uuid)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	report.ArtifactsUrl = GetArtifactsUrl(ReporterCfg.ApiUrl, report.Uuid)
+	return backend.Report(report)
+}
+
+// don't bother testing the main loop, that's for integration testing
+func ReporterLoop(Driver database.DbDriver, ReporterCfg GutsReporterConfig) error { // coverage-ignore
+	baseDelay, err := time.ParseDuration(ReporterCfg.RetryBaseDelay)
+	if err != nil {
+		return err
+	}
+	reports, err := GetPendingReports(Driver, ReporterCfg.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		log.Printf("reporting results of job %v to %v\n", report.Uuid, report.BaseReportingUrl)
+		if reportErr := DeliverReport(Driver, ReporterCfg, report); reportErr != nil {
+			// a failing reporting service shouldn't stop other jobs from being reported
+			log.Printf("reporting job %v failed (attempt %v): %v\n", report.Uuid, report.Attempts+1, reportErr)
+			if err = MarkReportFailed(Driver, report, reportErr, baseDelay); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = MarkReported(Driver, report.Uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package reporter
+
+import (
+	"fmt"
+	"guts.ubuntu.com/v2/api"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	expectedDelays := map[int]time.Duration{
+		0:  30 * time.Second,
+		1:  time.Minute,
+		3:  4 * time.Minute,
+		20: MaxRetryDelay,
+	}
+	for attempts, expectedDelay := range expectedDelays {
+		delay := RetryDelay(30*time.Second, attempts)
+		if delay != expectedDelay {
+			t.Errorf("unexpected delay after %v attempts!\nexpected: %v\nactual: %v", attempts, expectedDelay, delay)
+		}
+	}
+}
+
+func TestGetArtifactsUrl(t *testing.T) {
+	artifactsUrl := GetArtifactsUrl("https://guts.ubuntu.com", "eccd3988-490d-4414-be97-605d1ac81073")
+	expectedUrl := "https://guts.ubuntu.com/artifacts/eccd3988-490d-4414-be97-605d1ac81073/results.tar.gz"
+	if artifactsUrl != expectedUrl {
+		t.Errorf("unexpected artifacts url!\nexpected: %v\nactual: %v", expectedUrl, artifactsUrl)
+	}
+}
+
+func TestUnsupportedReporterError(t *testing.T) {
+	reporterErr := UnsupportedReporterError{reporter: "carrier_pigeon"}
+	desiredErrString := "carrier_pigeon isn't a supported reporter"
+	if reporterErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, reporterErr.Error())
+	}
+}
+
+func TestReportDeliveryError(t *testing.T) {
+	deliveryErr := ReportDeliveryError{url: "https://tests-api.ubuntu.com/v1/test-executions/423", code: 503}
+	desiredErrString := "Reporting to https://tests-api.ubuntu.com/v1/test-executions/423 returned 503"
+	if deliveryErr.Error() != desiredErrString {
+		t.Errorf("Unexpected error string!\nExpected: %v\nActual: %v", desiredErrString, deliveryErr.Error())
+	}
+}
+
+func TestGetPendingReports(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	reports, err := GetPendingReports(Driver, 8)
+	utils.CheckError(err)
+
+	var uuids []string
+	for _, report := range reports {
+		uuids = append(uuids, report.Uuid)
+	}
+	// finished jobs get reported, running ones don't
+	if !slices.Contains(uuids, "eccd3988-490d-4414-be97-605d1ac81073") {
+		t.Errorf("finished job eccd3988-490d-4414-be97-605d1ac81073 should be pending a report")
+	}
+	if slices.Contains(uuids, "4ce9189f-561a-4886-aeef-1836f28b073b") {
+		t.Errorf("running job 4ce9189f-561a-4886-aeef-1836f28b073b shouldn't be pending a report")
+	}
+}
+
+func TestGetPendingReportsFromJobRequest(t *testing.T) {
+	ApiDriver, err := database.TestDbDriver("guts_api", "guts_api")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	utils.CheckError(err)
+
+	// a job requested with a reporter, as the api writes it
+	jobReq := api.MakeDummyJobReq()
+	jobReq.Reporter = "test_observer"
+	jobReq.ReportingUrl = "https://tests-api.ubuntu.com/v1/test-executions/423"
+	userData, err := api.GetAuthDataForKey(utils.Sha256sumOfString("4c126f75-c7d8-4a89-9370-f065e7ff4208"), ApiDriver)
+	utils.CheckError(err)
+	jobEntry := api.CreateJobEntry(jobReq, userData)
+	utils.CheckError(api.WriteJobEntryToDb(jobEntry, jobReq.ReportingUrl, ApiDriver))
+	// leave the job reported, so it isn't pending for other tests
+	defer func() {
+		utils.CheckError(MarkReported(Driver, jobEntry.Uuid))
+	}()
+
+	pendingReport := func() *JobReport {
+		reports, err := GetPendingReports(Driver, 8)
+		utils.CheckError(err)
+		for _, report := range reports {
+			if report.Uuid == jobEntry.Uuid {
+				return &report
+			}
+		}
+		return nil
+	}
+	if report := pendingReport(); report != nil {
+		t.Errorf("pending job %v shouldn't be pending a report", jobEntry.Uuid)
+	}
+
+	_, err = ApiDriver.Exec(database.Update("jobs").Set("status", "pass").Where("uuid=?", jobEntry.Uuid))
+	utils.CheckError(err)
+	expectedReport := JobReport{
+		Uuid:             jobEntry.Uuid,
+		Reporter:         "test_observer",
+		BaseReportingUrl: "https://tests-api.ubuntu.com/v1/test-executions/423",
+		Status:           "pass",
+	}
+	report := pendingReport()
+	if report == nil {
+		t.Fatalf("finished job %v should be pending a report", jobEntry.Uuid)
+	}
+	if !reflect.DeepEqual(*report, expectedReport) {
+		t.Errorf("unexpected report!\nexpected: %v\nactual: %v", expectedReport, *report)
+	}
+}
+
+func TestCollateTestReports(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	uuid := "eccd3988-490d-4414-be97-605d1ac81073"
+	tests, err := CollateTestReports(Driver, uuid)
+	utils.CheckError(err)
+
+	resultsUrl := fmt.Sprintf("https://guts.ubuntu.com/artifacts/%v/", uuid)
+	expectedTests := []TestReport{
+		{TestCase: "Firefox-Example-Basic", State: "fail", ResultsUrl: resultsUrl},
+		{TestCase: "Firefox-Example-New-Tab", State: "fail", ResultsUrl: resultsUrl},
+		{TestCase: "Firefox-Example-Basic", State: "fail", ResultsUrl: resultsUrl},
+	}
+	if !reflect.DeepEqual(tests, expectedTests) {
+		t.Errorf("unexpected test reports!\nexpected: %v\nactual: %v", expectedTests, tests)
+	}
+}
+
+func TestMarkReported(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	uuid := "08b22844-2f6c-4fa9-b5cc-d937aeea6134"
+	err = MarkReported(Driver, uuid)
+	utils.CheckError(err)
+
+	reports, err := GetPendingReports(Driver, 8)
+	utils.CheckError(err)
+	for _, report := range reports {
+		if report.Uuid == uuid {
+			t.Errorf("job %v was reported, so shouldn't be pending any more", uuid)
+		}
+	}
+}
+
+func TestMarkReportFailed(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	var report JobReport
+	report.Uuid = "74ae401e-b14f-45b9-857d-056384df3ced"
+	err = MarkReportFailed(Driver, report, ReportDeliveryError{url: "https://tests-api.ubuntu.com/v1/test-executions/213", code: 503}, time.Hour)
+	utils.CheckError(err)
+
+	// the next attempt is an hour away, so it isn't due yet
+	reports, err := GetPendingReports(Driver, 8)
+	utils.CheckError(err)
+	for _, pending := range reports {
+		if pending.Uuid == report.Uuid {
+			t.Errorf("job %v shouldn't be retried before its backoff is over", report.Uuid)
+		}
+	}
+}
+
+func TestDeliverReport(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_reporter", "guts_reporter")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	fake := &FakeTestObserver{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	var reporterCfg GutsReporterConfig
+	reporterCfg.ApiUrl = "https://guts.ubuntu.com"
+	reporterCfg.Reporters = map[string]map[string]string{"test_observer": {}}
+
+	var report JobReport
+	report.Uuid = "eccd3988-490d-4414-be97-605d1ac81073"
+	report.Reporter = "test_observer"
+	report.BaseReportingUrl = server.URL + "/v1/test-executions/423"
+	report.Status = "fail"
+	err = DeliverReport(Driver, reporterCfg, report)
+	utils.CheckError(err)
+
+	// the duplicate test case is only reported once
+	if len(fake.Results) != 2 {
+		t.Errorf("unexpected number of results reported: %v", fake.Results)
+	}
+	expectedPatches := []TestObserverExecutionPatch{
+		{Status: "FAILED", CiLink: "https://guts.ubuntu.com/artifacts/eccd3988-490d-4414-be97-605d1ac81073/results.tar.gz"},
+	}
+	if !reflect.DeepEqual(fake.Patches, expectedPatches) {
+		t.Errorf("unexpected patches!\nexpected: %v\nactual: %v", expectedPatches, fake.Patches)
+	}
+}
@@ -0,0 +1,134 @@
+package reporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	TestObserverTimeout = 30 * time.Second
+)
+
+// TestObserverBackend reports to a test execution in Test Observer, which
+// base_reporting_url points at, e.g.
+// https://tests-api.ubuntu.com/v1/test-executions/423
+type TestObserverBackend struct {
+	Cfg    TestObserverConfig
+	Client *http.Client
+}
+
+type TestObserverConfig struct {
+	ApiToken string `json:"api_token"`
+}
+
+type TestObserverResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Comment string `json:"comment"`
+}
+
+type TestObserverExecutionPatch struct {
+	Status string `json:"status"`
+	CiLink string `json:"ci_link"`
+}
+
+func (t TestObserverBackend) Connect(rprtCfg *map[string]string) (ReporterBackend, error) {
+	if rprtCfg != nil {
+		jsonBody, err := json.Marshal(*rprtCfg)
+		if err != nil { // coverage-ignore
+			return t, err
+		}
+		cfg := TestObserverConfig{}
+		if err = json.Unmarshal(jsonBody, &cfg); err != nil { // coverage-ignore
+			return t, err
+		}
+		t.Cfg = cfg
+	}
+	t.Client = &http.Client{Timeout: TestObserverTimeout}
+	return t, nil
+}
+
+func TestObserverStatus(state string) string {
+	switch state {
+	// a flaky job passed in the end, its retries are in the artifacts
+	case "pass", "flaky":
+		return "PASSED"
+	case "fail":
+		return "FAILED"
+	default:
+		return "SKIPPED"
+	}
+}
+
+func (t TestObserverBackend) Report(report JobReport) error {
+	resultsUrl := fmt.Sprintf("%v/test-results", strings.TrimSuffix(report.BaseReportingUrl, "/"))
+
+	// results already there come from a previous attempt, don't send them twice
+	var existingResults []TestObserverResult
+	if err := t.do(http.MethodGet, resultsUrl, nil, &existingResults); err != nil {
+		return err
+	}
+	alreadyReported := make(map[string]bool)
+	for _, result := range existingResults {
+		alreadyReported[result.Name] = true
+	}
+
+	newResults := []TestObserverResult{}
+	for _, test := range report.Tests {
+		if alreadyReported[test.TestCase] {
+			continue
+		}
+		var result TestObserverResult
+		result.Name = test.TestCase
+		result.Status = TestObserverStatus(test.State)
+		if test.ResultsUrl != "" {
+			result.Comment = fmt.Sprintf("Artifacts: %v", test.ResultsUrl)
+		}
+		newResults = append(newResults, result)
+		alreadyReported[test.TestCase] = true
+	}
+	if len(newResults) > 0 {
+		if err := t.do(http.MethodPost, resultsUrl, newResults, nil); err != nil {
+			return err
+		}
+	}
+
+	var patch TestObserverExecutionPatch
+	patch.Status = TestObserverStatus(report.Status)
+	patch.CiLink = report.ArtifactsUrl
+	return t.do(http.MethodPatch, report.BaseReportingUrl, patch, nil)
+}
+
+func (t TestObserverBackend) do(method, url string, body any, response any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil { // coverage-ignore
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.Cfg.ApiToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", t.Cfg.ApiToken))
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(resp.Body.Close)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ReportDeliveryError{url: url, code: resp.StatusCode}
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
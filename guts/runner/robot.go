@@ -0,0 +1,205 @@
+package runner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/lib/pq"
+	"guts.ubuntu.com/v2/database"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// the name of the file Robot Framework writes its results to in yarf's outdir
+	RobotOutputFile = "output.xml"
+	// Robot Framework 7 timestamps
+	robotTimeFormat = "2006-01-02T15:04:05.999999"
+	// Robot Framework 6 and older timestamps
+	robotLegacyTimeFormat = "20060102 15:04:05.999"
+	screenshotPattern     = regexp.MustCompile(`<img[^>]*\ssrc="([^"]+)"`)
+)
+
+// RobotResult is the outcome of a single suite or test in a Robot Framework
+// output.xml
+type RobotResult struct {
+	Kind        string
+	Suite       string
+	Name        string
+	Status      string
+	Message     string
+	StartedAt   *time.Time
+	DurationMs  int
+	Screenshots []string
+}
+
+// robotNode is any element of an output.xml, the layout of keywords changes
+// between Robot Framework versions so the tree is walked by element name
+type robotNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr  `xml:",any,attr"`
+	Text     string      `xml:",chardata"`
+	Children []robotNode `xml:",any"`
+}
+
+func (n robotNode) Attr(name string) string {
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first direct child with the given element name
+func (n robotNode) Child(name string) (robotNode, bool) {
+	for _, child := range n.Children {
+		if child.XMLName.Local == name {
+			return child, true
+		}
+	}
+	return robotNode{}, false
+}
+
+// ParseRobotOutput reads the suites and tests out of a Robot Framework
+// output.xml, every suite comes before the suites and tests it contains
+func ParseRobotOutput(outputPath string) ([]RobotResult, error) {
+	var results []RobotResult
+	dat, err := os.ReadFile(outputPath)
+	if err != nil {
+		return results, err
+	}
+
+	var root robotNode
+	err = xml.Unmarshal(dat, &root)
+	if err != nil {
+		return results, err
+	}
+	if root.XMLName.Local != "robot" {
+		return results, fmt.Errorf("%v isn't a Robot Framework output file", outputPath)
+	}
+
+	for _, child := range root.Children {
+		if child.XMLName.Local == "suite" {
+			results, err = appendRobotSuite(results, child, "")
+			if err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+func appendRobotSuite(results []RobotResult, suite robotNode, parent string) ([]RobotResult, error) {
+	suiteResult := RobotResult{Kind: "suite", Suite: parent, Name: suite.Attr("name")}
+	err := setRobotStatus(&suiteResult, suite)
+	if err != nil {
+		return results, err
+	}
+	results = append(results, suiteResult)
+
+	fullName := suiteResult.Name
+	if parent != "" {
+		fullName = fmt.Sprintf("%v.%v", parent, suiteResult.Name)
+	}
+	for _, child := range suite.Children {
+		switch child.XMLName.Local {
+		case "suite":
+			results, err = appendRobotSuite(results, child, fullName)
+			if err != nil {
+				return results, err
+			}
+		case "test":
+			testResult := RobotResult{Kind: "test", Suite: fullName, Name: child.Attr("name")}
+			err = setRobotStatus(&testResult, child)
+			if err != nil {
+				return results, err
+			}
+			testResult.Screenshots = RobotScreenshots(child)
+			results = append(results, testResult)
+		}
+	}
+	return results, nil
+}
+
+// setRobotStatus fills in the status, message and timing of a suite or test
+// from its own status element, which both old and new output.xml files have
+func setRobotStatus(result *RobotResult, node robotNode) error {
+	status, ok := node.Child("status")
+	if !ok {
+		return fmt.Errorf("%v %v has no status", result.Kind, result.Name)
+	}
+	result.Status = status.Attr("status")
+	result.Message = strings.TrimSpace(status.Text)
+
+	if start := status.Attr("start"); start != "" {
+		startedAt, err := time.ParseInLocation(robotTimeFormat, start, time.Local)
+		if err != nil {
+			return err
+		}
+		result.StartedAt = &startedAt
+		// elapsed is left out when nothing ran, e.g. a test that was skipped
+		if elapsed := status.Attr("elapsed"); elapsed != "" {
+			seconds, err := strconv.ParseFloat(elapsed, 64)
+			if err != nil {
+				return err
+			}
+			result.DurationMs = int(seconds * 1000)
+		}
+	} else if start := status.Attr("starttime"); start != "" && start != "N/A" {
+		startedAt, err := time.ParseInLocation(robotLegacyTimeFormat, start, time.Local)
+		if err != nil {
+			return err
+		}
+		result.StartedAt = &startedAt
+		endedAt, err := time.ParseInLocation(robotLegacyTimeFormat, status.Attr("endtime"), time.Local)
+		if err != nil {
+			return err
+		}
+		result.DurationMs = int(endedAt.Sub(startedAt).Milliseconds())
+	}
+	return nil
+}
+
+// RobotScreenshots finds the images embedded in the html log messages
+// anywhere under a test, in the order they were logged
+func RobotScreenshots(node robotNode) []string {
+	screenshots := []string{}
+	for _, child := range node.Children {
+		if child.XMLName.Local == "msg" && child.Attr("html") == "true" {
+			for _, match := range screenshotPattern.FindAllStringSubmatch(child.Text, -1) {
+				screenshots = append(screenshots, match[1])
+			}
+		}
+		screenshots = append(screenshots, RobotScreenshots(child)...)
+	}
+	return screenshots
+}
+
+// StoreTestResults records the parsed results against the attempt the tests
+// row currently holds
+func StoreTestResults(id int, results []RobotResult, Driver database.DbDriver) error {
+	for _, result := range results {
+		screenshots := result.Screenshots
+		if screenshots == nil {
+			screenshots = []string{}
+		}
+		_, err := Driver.Exec(database.Insert("test_results", "test_id", "uuid", "test_case", "attempt", "kind", "suite", "name", "status", "message", "started_at", "duration_ms", "screenshots").
+			Rows(database.Select("tests", "id", "uuid", "test_case", "attempt").
+				Column("?", result.Kind).
+				Column("?", result.Suite).
+				Column("?", result.Name).
+				Column("?", result.Status).
+				Column("?", result.Message).
+				Column("?", result.StartedAt).
+				Column("?", result.DurationMs).
+				Column("?", pq.Array(screenshots)).
+				Where("id=?", id)))
+		if err != nil { // coverage-ignore
+			return err
+		}
+	}
+	return nil
+}
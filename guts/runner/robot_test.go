@@ -0,0 +1,151 @@
+package runner
+
+import (
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	robotOutput = `<?xml version="1.0" encoding="UTF-8"?>
+<robot generator="Robot 7.0.1 (Python 3.12.3 on linux)" generated="2025-07-23T14:15:01.000000" rpa="false" schemaversion="5">
+<suite id="s1" name="Firefox-Example-New-Tab" source="/tmp/gitrepo/tests/firefox-example">
+<test id="s1-t1" name="Open Firefox" line="5">
+<kw name="Click LEFT Button On" owner="Hid">
+<arg>firefox.png</arg>
+<status status="PASS" start="2025-07-23T14:15:02.000000" elapsed="4.120"/>
+</kw>
+<status status="PASS" start="2025-07-23T14:15:02.000000" elapsed="4.120"/>
+</test>
+<test id="s1-t2" name="Open A New Tab" line="12">
+<kw name="Match" owner="Hid">
+<msg time="2025-07-23T14:15:14.000000" level="INFO" html="true">&lt;img src="screenshot-1.png" width="800px"&gt;</msg>
+<msg time="2025-07-23T14:15:14.000000" level="FAIL">Couldn't find template new-tab.png on screen</msg>
+<status status="FAIL" start="2025-07-23T14:15:02.000000" elapsed="12.503"/>
+</kw>
+<status status="FAIL" start="2025-07-23T14:15:02.000000" elapsed="12.503">Couldn't find template new-tab.png on screen</status>
+</test>
+<status status="FAIL" start="2025-07-23T14:15:02.000000" elapsed="16.623"/>
+</suite>
+</robot>
+`
+	legacyRobotOutput = `<?xml version="1.0" encoding="UTF-8"?>
+<robot generator="Robot 6.1.1 (Python 3.12.3 on linux)" generated="20250723 14:15:01.000" rpa="false" schemaversion="4">
+<suite id="s1" name="Firefox-Example-Basic" source="/tmp/gitrepo/tests/firefox-example">
+<suite id="s1-s1" name="Basic" source="/tmp/gitrepo/tests/firefox-example/basic.robot">
+<status status="FAIL" starttime="20250723 14:15:02.000" endtime="20250723 14:15:32.012">Suite setup failed:
+Couldn't connect to VNC server</status>
+</suite>
+<status status="FAIL" starttime="20250723 14:15:02.000" endtime="20250723 14:15:32.012"/>
+</suite>
+</robot>
+`
+)
+
+func WriteRobotOutput(t *testing.T, output string) string {
+	outputPath := fmt.Sprintf("%v/%v", t.TempDir(), RobotOutputFile)
+	utils.CheckError(os.WriteFile(outputPath, []byte(output), 0644))
+	return outputPath
+}
+
+func TestParseRobotOutput(t *testing.T) {
+	results, err := ParseRobotOutput(WriteRobotOutput(t, robotOutput))
+	utils.CheckError(err)
+
+	startedAt := time.Date(2025, 7, 23, 14, 15, 2, 0, time.Local)
+	expectedResults := []RobotResult{
+		{Kind: "suite", Name: "Firefox-Example-New-Tab", Status: "FAIL", StartedAt: &startedAt, DurationMs: 16623},
+		{Kind: "test", Suite: "Firefox-Example-New-Tab", Name: "Open Firefox", Status: "PASS", StartedAt: &startedAt, DurationMs: 4120, Screenshots: []string{}},
+		{Kind: "test", Suite: "Firefox-Example-New-Tab", Name: "Open A New Tab", Status: "FAIL", Message: "Couldn't find template new-tab.png on screen", StartedAt: &startedAt, DurationMs: 12503, Screenshots: []string{"screenshot-1.png"}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("unexpected results!\nexpected: %v\nactual: %v", expectedResults, results)
+	}
+}
+
+func TestParseLegacyRobotOutput(t *testing.T) {
+	results, err := ParseRobotOutput(WriteRobotOutput(t, legacyRobotOutput))
+	utils.CheckError(err)
+
+	startedAt := time.Date(2025, 7, 23, 14, 15, 2, 0, time.Local)
+	expectedResults := []RobotResult{
+		{Kind: "suite", Name: "Firefox-Example-Basic", Status: "FAIL", StartedAt: &startedAt, DurationMs: 30012},
+		{Kind: "suite", Suite: "Firefox-Example-Basic", Name: "Basic", Status: "FAIL", Message: "Suite setup failed:\nCouldn't connect to VNC server", StartedAt: &startedAt, DurationMs: 30012},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("unexpected results!\nexpected: %v\nactual: %v", expectedResults, results)
+	}
+}
+
+func TestParseRobotOutputNoElapsed(t *testing.T) {
+	results, err := ParseRobotOutput(WriteRobotOutput(t, `<?xml version="1.0" encoding="UTF-8"?>
+<robot generator="Robot 7.0.1 (Python 3.12.3 on linux)" generated="2025-07-23T14:15:01.000000" rpa="false" schemaversion="5">
+<suite id="s1" name="Firefox-Example-Skipped" source="/tmp/gitrepo/tests/firefox-example">
+<test id="s1-t1" name="Open Firefox" line="5">
+<status status="SKIP" start="2025-07-23T14:15:02.000000"/>
+</test>
+<status status="SKIP" start="2025-07-23T14:15:02.000000" elapsed="0.001"/>
+</suite>
+</robot>
+`))
+	utils.CheckError(err)
+
+	startedAt := time.Date(2025, 7, 23, 14, 15, 2, 0, time.Local)
+	expectedResults := []RobotResult{
+		{Kind: "suite", Name: "Firefox-Example-Skipped", Status: "SKIP", StartedAt: &startedAt, DurationMs: 1},
+		{Kind: "test", Suite: "Firefox-Example-Skipped", Name: "Open Firefox", Status: "SKIP", StartedAt: &startedAt, DurationMs: 0, Screenshots: []string{}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("unexpected results!\nexpected: %v\nactual: %v", expectedResults, results)
+	}
+}
+
+func TestParseRobotOutputFailure(t *testing.T) {
+	_, err := ParseRobotOutput(WriteRobotOutput(t, `<?xml version="1.0" encoding="UTF-8"?><testsuites/>`))
+	if err == nil {
+		t.Errorf("a junit file shouldn't parse as Robot Framework output")
+	}
+
+	_, err = ParseRobotOutput(WriteRobotOutput(t, `<robot><suite name="Truncated">`))
+	if err == nil {
+		t.Errorf("a truncated output file shouldn't parse")
+	}
+
+	_, err = ParseRobotOutput(WriteRobotOutput(t, `<robot><suite name="Bad"><status status="PASS" start="2025-07-23T14:15:02.000000" elapsed="soon"/></suite></robot>`))
+	if err == nil {
+		t.Errorf("an output file with a malformed elapsed time shouldn't parse")
+	}
+
+	_, err = ParseRobotOutput(fmt.Sprintf("%v/%v", t.TempDir(), RobotOutputFile))
+	if err == nil {
+		t.Errorf("a missing output file shouldn't parse")
+	}
+}
+
+func TestStoreTestResults(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_runner", "guts_runner")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	rowId := 30
+	results, err := ParseRobotOutput(WriteRobotOutput(t, robotOutput))
+	utils.CheckError(err)
+	err = StoreTestResults(rowId, results, Driver)
+	utils.CheckError(err)
+
+	var count int
+	row, err := Driver.RunQueryRow(`SELECT COUNT(*) FROM test_results WHERE test_id=$1 AND status='FAIL'`, rowId)
+	utils.CheckError(err)
+	err = row.Scan(&count)
+	utils.CheckError(err)
+	if count != 2 {
+		t.Errorf("unexpected number of failed results!\nexpected: %v\nactual: %v", 2, count)
+	}
+}
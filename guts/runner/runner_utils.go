@@ -1,17 +1,23 @@
 package runner
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/storage"
 	"guts.ubuntu.com/v2/utils"
+	"log"
 	"os"
 	"os/exec"
 	"strings"
 	"time"
 )
 
+// how long the runner gets to write the outcome of a test to the database
+var StateUpdateTimeout = 30 * time.Second
+
 type TestGitData struct {
 	TestCase        string
 	CommitHash      string
@@ -23,8 +29,10 @@ type TestGitData struct {
 func GetPartialGitData(rowId int, Driver database.DbDriver) (TestGitData, error) {
 	var testGitData TestGitData
 
-	testQuery := fmt.Sprintf(`SELECT tests.test_case, jobs.tests_repo, jobs.tests_repo_branch FROM tests JOIN jobs ON jobs.uuid=tests.uuid WHERE tests.id=%v`, rowId)
-	row, err := Driver.RunQueryRow(testQuery)
+	testQuery := database.Select("tests", "tests.test_case", "jobs.tests_repo", "jobs.tests_repo_branch").
+		Join("JOIN jobs ON jobs.uuid=tests.uuid").
+		Where("tests.id=?", rowId)
+	row, err := Driver.GetRow(testQuery)
 
 	if err != nil { // coverage-ignore
 		return testGitData, err
@@ -82,49 +90,50 @@ func CloneTestsData(rowId int, Driver database.DbDriver) (TestGitData, error) {
 	return testData, nil
 }
 
-func FindJobForRunner(Driver database.DbDriver) (int, string, error) {
-	var id int
-	var Uuid string
-
-	testQuery := `SELECT tests.id, tests.uuid FROM tests JOIN jobs ON jobs.uuid=tests.uuid WHERE state='spawned' AND vnc_address!='' ORDER BY priority DESC LIMIT 1`
-	row, err := Driver.RunQueryRow(testQuery)
-	if err != nil { // coverage-ignore
-		return id, Uuid, err
-	}
-	err = row.Scan(
-		&id,
-		&Uuid,
-	)
-
-	if err != nil { // coverage-ignore
-		if err == sql.ErrNoRows {
-			return id, Uuid, nil
-		} else {
-			return id, Uuid, err
-		}
-	}
-
-	return id, Uuid, nil
+// ClaimTestForRunner claims the spawned test with the highest priority for
+// worker, marking it as running. The id is 0 if there are no tests waiting
+func ClaimTestForRunner(worker string, Driver database.DbDriver) (int, string, error) {
+	candidate := database.Select("tests", "tests.id").
+		Join("JOIN jobs ON jobs.uuid=tests.uuid").
+		Where("state=?", "spawned").
+		Where("vnc_address!=?", "").
+		OrderBy("priority DESC").
+		Limit(1)
+	return Driver.ClaimTest(candidate, "running", worker)
 }
 
-func SetCommitHashForTest(id int, hash string, Driver database.DbDriver) error {
-	updateQuery := fmt.Sprintf(`UPDATE tests SET commit_hash='%v' WHERE id=%v`, hash, id)
-	err := Driver.UpdateRow(updateQuery)
-	return err
+// SetCommitHashForTest records the commit of the tests repo a worker holding
+// the claim on a test runs it from
+func SetCommitHashForTest(id int, hash, worker string, Driver database.DbDriver) error {
+	return Driver.UpdateClaimedTest(id, worker, database.Update("tests").Set("commit_hash", hash))
 }
 
 func SetResultsUrlForTest(id int, resultsUrl string, Driver database.DbDriver) error {
-	updateQuery := fmt.Sprintf(`UPDATE tests SET results_url='%v' WHERE id=%v`, resultsUrl, id)
-	err := Driver.UpdateRow(updateQuery)
+	_, err := Driver.Exec(database.Update("tests").Set("results_url", resultsUrl).Where("id=?", id))
 	return err
 }
 
+// UploadTestArtifacts uploads the gzipped artifacts of the attempt a test is on
+// to backend, each attempt under its own name so a retry doesn't overwrite the
+// artifacts of the attempts before it, returning where they were uploaded to
+func UploadTestArtifacts(id int, Uuid string, gzippedTarBytes []byte, backend storage.StorageBackend, Driver database.DbDriver) (string, error) {
+	var attempt int
+	row, err := Driver.GetRow(database.Select("tests", "attempt").Where("id=?", id))
+	if err != nil { // coverage-ignore
+		return "", err
+	}
+	err = row.Scan(&attempt)
+	if err != nil {
+		return "", err
+	}
+	return backend.Upload(Uuid, fmt.Sprintf("%v-%v-attempt%v.tar.gz", Uuid, id, attempt), gzippedTarBytes)
+}
+
 func GetPlanAndTestCase(rowId int, Driver database.DbDriver) (string, string, error) {
 	plan := ""
 	testCase := ""
 
-	testQuery := fmt.Sprintf(`SELECT plan, test_case FROM tests WHERE id=%v`, rowId)
-	row, err := Driver.RunQueryRow(testQuery)
+	row, err := Driver.GetRow(database.Select("tests", "plan", "test_case").Where("id=?", rowId))
 	if err != nil { // coverage-ignore
 		return plan, testCase, err
 	}
@@ -181,8 +190,7 @@ func GetYarfCommandLine(TestData TestGitData, rowId int, artifactsDir string, Dr
 }
 
 func RemoveVncAddress(id int, Driver database.DbDriver) error {
-	updateQuery := fmt.Sprintf(`UPDATE tests SET vnc_address='' WHERE id='%v'`, id)
-	err := Driver.UpdateRow(updateQuery)
+	_, err := Driver.Exec(database.Update("tests").Set("vnc_address", "").Where("id=?", id))
 	return err
 }
 
@@ -211,25 +219,61 @@ func GetHostAndPort(id int, Driver database.DbDriver) (string, string, error) {
 	return splitAddr[0], splitAddr[1], nil
 }
 
+// ShouldRetryTest checks whether a failed test has any of its job's
+// retries left
+func ShouldRetryTest(id int, Driver database.DbDriver) (bool, error) {
+	var attempt, retries int
+	retryQuery := database.Select("tests", "tests.attempt", "jobs.retries").
+		Join("JOIN jobs ON jobs.uuid=tests.uuid").
+		Where("tests.id=?", id)
+	row, err := Driver.GetRow(retryQuery)
+	if err != nil { // coverage-ignore
+		return false, err
+	}
+	err = row.Scan(
+		&attempt,
+		&retries,
+	)
+	if err != nil { // coverage-ignore
+		return false, err
+	}
+	// the first attempt isn't a retry
+	return attempt <= retries, nil
+}
+
+// RequeueTestForRetry sends a test the worker has claimed back to the spawner
+// for its next attempt
+func RequeueTestForRetry(id int, worker string, Driver database.DbDriver) error {
+	requeue := database.Update("tests").
+		Set("state", "requested").
+		Set("vnc_address", "").
+		Set("results_url", "").
+		SetExpr("attempt=attempt+1").
+		Set("updated_at", time.Now())
+	return Driver.UpdateClaimedTest(id, worker, requeue)
+}
+
 // don't bother testing the main loop, that's for integration testing
-func RunnerLoop(Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { // coverage-ignore
+func RunnerLoop(ctx context.Context, Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { // coverage-ignore
 	// ensure we have a functional storage backend
 	backend, err := storage.GetStorageBackend(RunnerCfg.Storage)
 	if err != nil {
 		return err
 	}
 
-	//.get row id and uuid
-	rowId, Uuid, err := FindJobForRunner(Driver)
+	// - claim a spawned test, setting its state to `running`
+	worker, err := database.WorkerName(fmt.Sprintf("runner-%v", os.Getpid()))
 	if err != nil {
 		return err
 	}
-
-	// - set state to `running`
-	err = Driver.SetTestStateTo(rowId, "running")
+	rowId, Uuid, err := ClaimTestForRunner(worker, Driver)
 	if err != nil {
 		return err
 	}
+	// there are no tests waiting for a runner
+	if rowId == 0 {
+		return nil
+	}
 
 	// - clone the tests repo
 	GitData, err := CloneTestsData(rowId, Driver)
@@ -238,16 +282,19 @@ func RunnerLoop(Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { //
 	}
 
 	// - update the `commit_hash` column
-	err = SetCommitHashForTest(rowId, GitData.CommitHash, Driver)
+	err = SetCommitHashForTest(rowId, GitData.CommitHash, worker, Driver)
 	if err != nil {
 		return err
 	}
 
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, GitData.RepoDir)
+
 	// create temp dir for artifacts
 	artifactDirName, err := os.MkdirTemp("", "artifacts")
 	if err != nil {
 		return err
 	}
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, artifactDirName)
 
 	// create yarf command line
 	yarfCmdLine, err := GetYarfCommandLine(GitData, rowId, artifactDirName, Driver)
@@ -272,29 +319,69 @@ func RunnerLoop(Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { //
 	yarfTempFailCode := 999
 	heartbeatDuration := time.Second * 5
 
-	for !yarfProcess.ProcessState.Exited() {
-		err = database.UpdateUpdatedAt(rowId, Driver)
+	// wait on the yarf process in the background so we can keep an eye
+	// on the test state while it runs
+	yarfExited := utils.WaitInBackground(yarfProcess)
+
+	for !utils.ProcessHasExited(yarfExited) {
+		// stop running the test if its job has been cancelled
+		state, err := Driver.GetTestState(rowId)
+		if err != nil {
+			return err
+		}
+		if state == "cancelled" {
+			err = yarfProcess.Process.Kill()
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
+				return err
+			}
+			<-yarfExited
+			return database.FinishTestAttempt(rowId, "cancelled", nil, Driver)
+		}
+		// stop running the test once the scheduler has released the claim on
+		// it, as it may be running on another runner by now
+		err = Driver.HeartbeatClaimedTest(rowId, worker)
+		if errors.As(err, &database.ClaimLostError{}) {
+			err = errors.Join(err, yarfProcess.Process.Kill())
+			<-yarfExited
+			return err
+		}
 		if err != nil {
 			return err
 		}
 		time.Sleep(heartbeatDuration)
 	}
 
+	// the outcome of the test is written in one transaction, so a failure
+	// halfway through can't leave the test finished in one table but not in
+	// another
+	updateCtx, cancel := context.WithTimeout(ctx, StateUpdateTimeout)
+	defer cancel()
+
 	// Test must have now completed.
 	exitCode := yarfProcess.ProcessState.ExitCode()
 	if exitCode == yarfTempFailCode {
 		// this means that the test run was a tempfail
 		// here, unset the vnc_address and set the state back to requested
 		// doing this means the test will be retried
-		err = RemoveVncAddress(rowId, Driver)
-		if err != nil {
-			return err
-		}
-		err = Driver.SetTestStateTo(rowId, "requested")
-		if err != nil {
-			return err
-		}
-		return nil
+		return Driver.WithTx(updateCtx, func(tx database.DbDriver) error {
+			err := database.FinishTestAttempt(rowId, "tempfail", &exitCode, tx)
+			if err != nil {
+				return err
+			}
+			err = RemoveVncAddress(rowId, tx)
+			if err != nil {
+				return err
+			}
+			return tx.SetClaimedTestStateTo(rowId, "requested", worker)
+		})
+	}
+
+	// keep the suite and test results of this attempt, a missing or broken
+	// output.xml shouldn't lose the rest of the artifacts though
+	robotResults, err := ParseRobotOutput(fmt.Sprintf("%v/%v", artifactDirName, RobotOutputFile))
+	if err != nil {
+		log.Printf("couldn't parse the results of test %v: %v\n", rowId, err)
+		robotResults = nil
 	}
 
 	// Bundle up test artifacts and result - which is artifactDirName
@@ -310,13 +397,7 @@ func RunnerLoop(Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { //
 	}
 
 	// upload the test artifacts to the storage backend
-	storageUrl, err := backend.Upload(Uuid, fmt.Sprintf("%v-%v.tar.gz", Uuid, rowId), gzippedTarBytes)
-	if err != nil {
-		return err
-	}
-
-	// write artifact_url to tests table
-	err = SetResultsUrlForTest(rowId, storageUrl, Driver)
+	storageUrl, err := UploadTestArtifacts(rowId, Uuid, gzippedTarBytes, backend, Driver)
 	if err != nil {
 		return err
 	}
@@ -327,11 +408,35 @@ func RunnerLoop(Driver database.DbDriver, RunnerCfg GutsRunnerConfig) error { //
 		finalState = "fail"
 	}
 
-	// update test state
-	err = Driver.SetTestStateTo(rowId, finalState)
-	if err != nil {
-		return err
-	}
+	return Driver.WithTx(updateCtx, func(tx database.DbDriver) error {
+		err := StoreTestResults(rowId, robotResults, tx)
+		if err != nil {
+			return err
+		}
+
+		// write artifact_url to tests table
+		err = SetResultsUrlForTest(rowId, storageUrl, tx)
+		if err != nil {
+			return err
+		}
+
+		// keep the results of this attempt around before the row gets reused
+		err = database.FinishTestAttempt(rowId, finalState, &exitCode, tx)
+		if err != nil {
+			return err
+		}
+
+		if finalState == "fail" {
+			retry, err := ShouldRetryTest(rowId, tx)
+			if err != nil {
+				return err
+			}
+			if retry {
+				return RequeueTestForRetry(rowId, worker, tx)
+			}
+		}
 
-	return nil
+		// update test state
+		return tx.SetClaimedTestStateTo(rowId, finalState, worker)
+	})
 }
@@ -3,6 +3,7 @@ package runner
 import (
 	"fmt"
 	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/storage"
 	"guts.ubuntu.com/v2/utils"
 	"os"
 	"reflect"
@@ -105,15 +106,19 @@ func TestCloneTestsDataBadGitUrl(t *testing.T) {
 	}
 }
 
-func TestFindJobForRunner(t *testing.T) {
+func TestClaimTestForRunner(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_runner", "guts_runner")
 	utils.CheckError(err)
 
 	expectedRow := 65
 	expectedUuid := "724254b8-5d51-42f5-8394-99976f87e520"
 
-	accRow, accUuid, err := FindJobForRunner(Driver)
+	accRow, accUuid, err := ClaimTestForRunner("runner-1:runner-1", Driver)
 	utils.CheckError(err)
+	// hand the test back, so other tests can still claim it
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='spawned', claimed_by='' WHERE id=$1`, accRow))
+	}()
 
 	if expectedRow != accRow {
 		t.Errorf("unexpected row response!\nexpected: %v\nactual: %v", expectedRow, accRow)
@@ -130,11 +135,31 @@ func TestSetCommitHashForTest(t *testing.T) {
 	rowId := 23
 	commitHash := "1665bf0f817a795ffbc0a9f6d000def16ace544c"
 
-	err = SetCommitHashForTest(rowId, commitHash, Driver)
+	// only the runner holding the claim on a test can write to it
+	err = SetCommitHashForTest(rowId, commitHash, "runner-1:runner-1", Driver)
+	if _, ok := err.(database.ClaimLostError); !ok {
+		t.Errorf("setting the commit hash of an unclaimed test should fail with a ClaimLostError, got %v", err)
+	}
+	// keep the row as it was, so other tests can still use it
+	var originalCommitHash string
+	row, err := Driver.RunQueryRow(`SELECT commit_hash FROM tests WHERE id=$1`, rowId)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&originalCommitHash))
+	utils.CheckError(Driver.UpdateRow(`UPDATE tests SET claimed_by='runner-1:runner-1' WHERE id=$1`, rowId))
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET commit_hash=$1, claimed_by='' WHERE id=$2`, originalCommitHash, rowId))
+	}()
+
+	err = SetCommitHashForTest(rowId, commitHash, "runner-1:runner-1", Driver)
 	utils.CheckError(err)
 
-	err = SetCommitHashForTest(rowId, "", Driver)
+	var actualCommitHash string
+	row, err = Driver.RunQueryRow(`SELECT commit_hash FROM tests WHERE id=$1`, rowId)
 	utils.CheckError(err)
+	utils.CheckError(row.Scan(&actualCommitHash))
+	if actualCommitHash != commitHash {
+		t.Errorf("unexpected commit hash!\nexpected: %v\nactual: %v", commitHash, actualCommitHash)
+	}
 }
 
 func TestSetResultsUrlForTest(t *testing.T) {
@@ -275,7 +300,7 @@ tests:
 		t.Errorf("getting yarf command line didn't fail when it should have!")
 	}
 
-	expectedErrString := "couldn't parse test entrypoint for test Firefox-Example-Basic and plan {[{asdf1 {tests/firefox-example {false}}} {asdf2 {tests/firefox-example {false}}}]}"
+	expectedErrString := "couldn't parse test entrypoint for test Firefox-Example-Basic and plan {[{asdf1 {tests/firefox-example {false 0 0 0 false false  }}} {asdf2 {tests/firefox-example {false 0 0 0 false false  }}}]}"
 
 	if err.Error() != expectedErrString {
 		t.Errorf("unexpected error string!\nexpected: %v\nactual: %v", expectedErrString, err.Error())
@@ -305,8 +330,7 @@ func TestRemoveVncAddress(t *testing.T) {
 	err = RemoveVncAddress(rowId, Driver)
 	utils.CheckError(err)
 
-	updateAddrQuery := fmt.Sprintf(`UPDATE tests SET vnc_address='%v' WHERE id='%v'`, existingVncAddress, rowId)
-	err = Driver.UpdateRow(updateAddrQuery)
+	err = Driver.UpdateRow(`UPDATE tests SET vnc_address=$1 WHERE id=$2`, existingVncAddress, rowId)
 	utils.CheckError(err)
 }
 
@@ -329,3 +353,109 @@ func TestGetHostAndPort(t *testing.T) {
 		t.Errorf("unexpected port!\nexpected: %v\nactual: %v", expectedPort, port)
 	}
 }
+
+func TestShouldRetryTest(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_runner", "guts_runner")
+	utils.CheckError(err)
+
+	// the test data jobs don't ask for any retries
+	rowId := 23
+	retry, err := ShouldRetryTest(rowId, Driver)
+	utils.CheckError(err)
+	if retry {
+		t.Errorf("test %v shouldn't be retried when its job has no retries", rowId)
+	}
+}
+
+func TestRequeueTestForRetry(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_runner", "guts_runner")
+	utils.CheckError(err)
+
+	// keep the row as it was, so other tests can still use it
+	rowId := 23
+	var state, vncAddress, resultsUrl string
+	row, err := Driver.RunQueryRow(`SELECT state, vnc_address, results_url FROM tests WHERE id=$1`, rowId)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&state, &vncAddress, &resultsUrl))
+
+	// only the runner holding the claim on a test can requeue it
+	err = RequeueTestForRetry(rowId, "runner-1:runner-1", Driver)
+	if _, ok := err.(database.ClaimLostError); !ok {
+		t.Errorf("requeueing an unclaimed test should fail with a ClaimLostError, got %v", err)
+	}
+	utils.CheckError(Driver.UpdateRow(`UPDATE tests SET claimed_by='runner-1:runner-1' WHERE id=$1`, rowId))
+	err = RequeueTestForRetry(rowId, "runner-1:runner-1", Driver)
+	utils.CheckError(err)
+
+	var attempt int
+	var newState string
+	row, err = Driver.RunQueryRow(`SELECT attempt, state FROM tests WHERE id=$1`, rowId)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&attempt, &newState))
+
+	resetQuery := `UPDATE tests SET state=$1, vnc_address=$2, results_url=$3, attempt=1, claimed_by='' WHERE id=$4`
+	utils.CheckError(Driver.UpdateRow(resetQuery, state, vncAddress, resultsUrl, rowId))
+
+	if attempt != 2 || newState != "requested" {
+		t.Errorf("unexpected requeued test!\nexpected: %v %v\nactual: %v %v", 2, "requested", attempt, newState)
+	}
+}
+
+func TestUploadTestArtifacts(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_runner", "guts_runner")
+	utils.CheckError(err)
+	backend, err := storage.GetStorageBackend(map[string]string{
+		"provider":    "local",
+		"object_path": t.TempDir(),
+		"object_port": "9999",
+		"object_host": "http://localhost",
+	})
+	utils.CheckError(err)
+
+	// keep the row as it was, so other tests can still use it
+	rowId := 23
+	uuid := "b1416679-aec8-41a0-9202-d6198d3d303b"
+	var resultsUrl string
+	var attempt int
+	row, err := Driver.RunQueryRow(`SELECT results_url, attempt FROM tests WHERE id=$1`, rowId)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&resultsUrl, &attempt))
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET results_url=$1, attempt=$2 WHERE id=$3`, resultsUrl, attempt, rowId))
+	}()
+
+	// run two attempts at the test, each uploading its own artifacts
+	for i, outcome := range []string{"fail", "pass"} {
+		if i > 0 {
+			utils.CheckError(Driver.UpdateRow(`UPDATE tests SET attempt=attempt+1 WHERE id=$1`, rowId))
+		}
+		utils.CheckError(database.StartTestAttempt(rowId, "spawner-1", Driver))
+		storageUrl, err := UploadTestArtifacts(rowId, uuid, []byte(outcome), backend, Driver)
+		utils.CheckError(err)
+		utils.CheckError(SetResultsUrlForTest(rowId, storageUrl, Driver))
+		utils.CheckError(database.FinishTestAttempt(rowId, outcome, nil, Driver))
+	}
+
+	var resultsUrls []string
+	rows, err := Driver.GetRows(database.Select("test_attempts", "results_url").Where("test_id=?", rowId).OrderBy("id DESC").Limit(2))
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(rows.Close)
+	for rows.Next() {
+		var attemptResultsUrl string
+		utils.CheckError(rows.Scan(&attemptResultsUrl))
+		resultsUrls = append(resultsUrls, attemptResultsUrl)
+	}
+	utils.CheckError(rows.Err())
+	expectedResultsUrls := []string{
+		fmt.Sprintf("http://localhost:9999/%v/%v-%v-attempt%v.tar.gz", uuid, uuid, rowId, attempt+1),
+		fmt.Sprintf("http://localhost:9999/%v/%v-%v-attempt%v.tar.gz", uuid, uuid, rowId, attempt),
+	}
+	if !reflect.DeepEqual(resultsUrls, expectedResultsUrls) {
+		t.Errorf("unexpected attempt results urls!\nexpected: %v\nactual: %v", expectedResultsUrls, resultsUrls)
+	}
+
+	_, err = UploadTestArtifacts(0, uuid, []byte("pass"), backend, Driver)
+	if err == nil {
+		t.Errorf("uploading the artifacts of a test that doesn't exist should fail")
+	}
+}
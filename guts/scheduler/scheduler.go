@@ -1,39 +1,41 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/storage"
 	"guts.ubuntu.com/v2/utils"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// how long the tests of a job get to be written once its plans are parsed,
+// before the job is left for the next pass of the scheduler
+var JobExpansionTimeout = time.Minute
+
 type TestsEntry struct {
-	Uuid       string
-	TestCase   string
-	VncAddress string
-	State      string
-	ResultsUrl string
-	UpdatedAt  time.Time
-	Tpm        bool
-	CommitHash string
-	Plan       string
+	Uuid         string
+	TestCase     string
+	VncAddress   string
+	State        string
+	ResultsUrl   string
+	UpdatedAt    time.Time
+	Requirements utils.TestCaseRequirements
+	CommitHash   string
+	Plan         string
 }
 
 func GetNewJobsUuids(Driver database.DbDriver) ([]string, error) {
 	var uuids []string
 
-	uuidQuery := `SELECT uuid FROM jobs EXCEPT SELECT uuid FROM tests`
-	stmt, err := Driver.PrepareQuery(uuidQuery)
-	if err != nil { // coverage-ignore
-		return uuids, err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-
-	rows, err := stmt.Query()
+	uuidQuery := database.Select("jobs", "uuid").
+		Where("status!=?", "cancelled").
+		Where("uuid NOT IN (?)", database.Select("tests", "uuid"))
+	rows, err := Driver.GetRows(uuidQuery)
 	if err != nil { // coverage-ignore
 		return uuids, err
 	}
@@ -88,7 +90,9 @@ func GetTestData(Driver database.DbDriver, Uuid string) (string, string, []strin
 ///////////////////////////////////////////////////////////////////////////
 // tested up to here
 
-func WriteTestsForJob(Driver database.DbDriver, Uuid string) error {
+// WriteTestsForJob expands a job into a test for each test case of its plans,
+// writing either all of them or, if anything fails, none
+func WriteTestsForJob(ctx context.Context, Driver database.DbDriver, Uuid string) error {
 	cloneDirName, err := os.MkdirTemp("", "gitrepo")
 	if err != nil { // coverage-ignore
 		return err
@@ -106,6 +110,7 @@ func WriteTestsForJob(Driver database.DbDriver, Uuid string) error {
 		return err
 	}
 
+	var tEntries []TestsEntry
 	for _, planPath := range testPlanPaths {
 		// create full plan path
 		fullPlanPath := fmt.Sprintf("%v/%v", cloneDirName, planPath)
@@ -124,52 +129,54 @@ func WriteTestsForJob(Driver database.DbDriver, Uuid string) error {
 			tEntry.State = "requested"
 			tEntry.ResultsUrl = ""
 			tEntry.UpdatedAt = time.Now()
-			tEntry.Tpm = testCase.Data.Requirements.Tpm
+			tEntry.Requirements = testCase.Data.Requirements
 			tEntry.CommitHash = ""
 			tEntry.Plan = planPath
+			tEntries = append(tEntries, tEntry)
+		}
+	}
 
-			// write test entry to database
-			err = WriteTestToDb(Driver, tEntry)
+	// a job with some of its tests written would never get the rest, as the
+	// scheduler only expands jobs that have no tests
+	return Driver.WithTx(ctx, func(tx database.DbDriver) error {
+		for _, tEntry := range tEntries {
+			err := WriteTestToDb(tx, tEntry)
 			if err != nil { // coverage-ignore
 				return err
 			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 func WriteTestToDb(Driver database.DbDriver, test TestsEntry) error {
-	columns := []string{"uuid", "test_case", "vnc_address", "state", "results_url", "updated_at", "tpm", "commit_hash", "plan"}
-	queryString := fmt.Sprintf(
-		`INSERT INTO tests (%v) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		strings.Join(columns, ", "),
-	)
-
-	stmt, err := Driver.PrepareQuery(queryString)
-	if err != nil { // coverage-ignore
-		return err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-
-	_, err = stmt.Exec(
+	columns := []string{"uuid", "test_case", "vnc_address", "state", "results_url", "updated_at", "tpm", "commit_hash", "plan", "memory", "cores", "disk_gb", "uefi", "secure_boot", "display_resolution", "gpu"}
+	_, err := Driver.Exec(database.Insert("tests", columns...).Values(
 		test.Uuid,
 		test.TestCase,
 		test.VncAddress,
 		test.State,
 		test.ResultsUrl,
 		test.UpdatedAt,
-		test.Tpm,
+		test.Requirements.Tpm,
 		test.CommitHash,
 		test.Plan,
-	)
-
+		int(test.Requirements.Memory),
+		test.Requirements.Cores,
+		test.Requirements.DiskGb,
+		test.Requirements.Uefi,
+		test.Requirements.SecureBoot,
+		test.Requirements.DisplayResolution,
+		test.Requirements.Gpu,
+	))
 	return err
 }
 
 func GetUpdatedJobState(Driver database.DbDriver, Uuid string) (string, error) {
 	newState := ""
+	passedOnRetry := false
 
-	rows, err := Driver.Query("tests", "uuid", Uuid, []string{"state"})
+	rows, err := Driver.Query("tests", "uuid", Uuid, []string{"state", "attempt"})
 	if err != nil { // coverage-ignore
 		return "", err
 	}
@@ -178,17 +185,21 @@ func GetUpdatedJobState(Driver database.DbDriver, Uuid string) (string, error) {
 
 	for rows.Next() {
 		var thisState string
+		var attempt int
 
-		err = rows.Scan(&thisState)
+		err = rows.Scan(&thisState, &attempt)
 		if err != nil { // coverage-ignore
 			return newState, err
 		}
 
-		log.Printf("state=%v\n", thisState)
+		log.Printf("state=%v attempt=%v\n", thisState, attempt)
 
 		if thisState != "pass" && thisState != "fail" {
 			return "running", nil
 		}
+		if thisState == "pass" && attempt > 1 {
+			passedOnRetry = true
+		}
 		if thisState != newState {
 			if newState != "fail" {
 				newState = thisState
@@ -200,10 +211,15 @@ func GetUpdatedJobState(Driver database.DbDriver, Uuid string) (string, error) {
 		return "", err
 	}
 
+	// every test passed in the end, but not all of them first time round
+	if newState == "pass" && passedOnRetry {
+		return "flaky", nil
+	}
+
 	return newState, nil
 }
 
-func HandleNewJobRequests(Driver database.DbDriver) error {
+func HandleNewJobRequests(ctx context.Context, Driver database.DbDriver) error {
 	currUuids, err := GetNewJobsUuids(Driver)
 	if err != nil { // coverage-ignore
 		return err
@@ -213,7 +229,9 @@ func HandleNewJobRequests(Driver database.DbDriver) error {
 
 	for _, thisUuid := range currUuids {
 		log.Printf("Writing tests to tests table for job %v\n", thisUuid)
-		err = WriteTestsForJob(Driver, thisUuid)
+		jobCtx, cancel := context.WithTimeout(ctx, JobExpansionTimeout)
+		err = WriteTestsForJob(jobCtx, Driver, thisUuid)
+		cancel()
 		// As per the dogma through the rest of this repo - WriteTestsForJob
 		// only returns non-nil in the event of standard library errors,
 		// so we ignore this block
@@ -248,10 +266,17 @@ func GetRunningJobs(Driver database.DbDriver) ([]string, error) {
 	return uuids, nil
 }
 
+// UpdateJobStatus sets the status of a job, unless the job was cancelled in
+// the meantime, as the cancellation is what the requester asked for last
 func UpdateJobStatus(Driver database.DbDriver, status, uuid string) error {
 	log.Printf("setting job %v status to %v", uuid, status)
-	updateQuery := fmt.Sprintf(`UPDATE jobs SET status='%v' WHERE uuid='%v'`, status, uuid)
-	err := Driver.UpdateRow(updateQuery)
+	updated, err := Driver.Exec(database.Update("jobs").
+		Set("status", status).
+		Where("uuid=?", uuid).
+		Where("status<>?", "cancelled"))
+	if err == nil && updated == 0 {
+		log.Printf("job %v was cancelled, leaving its status be", uuid)
+	}
 	return err
 }
 
@@ -284,20 +309,25 @@ func UpdateCompleteJobs(Driver database.DbDriver) error {
 	return nil
 }
 
+func CancelTestsForCancelledJobs(Driver database.DbDriver) error {
+	// The api cancels all unfinished tests when it cancels a job, but a
+	// spawner or runner may have written a new state to a test since then
+	cancelQuery := `UPDATE tests SET state='cancelled' WHERE uuid IN (SELECT uuid FROM jobs WHERE status='cancelled') AND state IN ('requested', 'spawning', 'spawned', 'running')`
+	err := Driver.UpdateRow(cancelQuery)
+	return err
+}
+
 func GetFailedRowIdsForState(Driver database.DbDriver, interval, state string) ([]string, error) {
 	var ids []string
 
-	idQuery := fmt.Sprintf(`SELECT id FROM tests WHERE state='%s' AND updated_at < (now() - interval '%s')`, state, interval)
-	stmt, err := Driver.PrepareQuery(idQuery)
-	if err != nil { // coverage-ignore
-		return ids, err
-	}
-	defer utils.DeferredErrCheck(stmt.Close)
-
-	rows, err := stmt.Query()
+	idQuery := database.Select("tests", "id").
+		Where("state=?", state).
+		Where("updated_at < ?", database.Ago(interval))
+	rows, err := Driver.GetRows(idQuery)
 	if err != nil { // coverage-ignore
 		return ids, err
 	}
+	defer utils.DeferredErrCheck(rows.Close)
 
 	for rows.Next() {
 		var thisId string
@@ -316,28 +346,68 @@ func GetFailedRowIdsForState(Driver database.DbDriver, interval, state string) (
 }
 
 func BatchUpdateTestsWithRowIds(Driver database.DbDriver, field, value string, ids []string) error {
-	query := fmt.Sprintf(`UPDATE tests SET %s='%s' WHERE id IN (%s)`, field, value, strings.Join(ids, ", "))
-	err := Driver.UpdateRow(query)
+	_, err := Driver.Exec(database.Update("tests").Set(field, value).WhereIn("id", ids))
 	return err
 }
 
-func FixFailedSpawns(Driver database.DbDriver, interval string) error {
-	ids, err := GetFailedRowIdsForState(Driver, interval, "spawning")
-	if err != nil { // coverage-ignore
-		return err
+// FinishStaleTestAttempts closes the attempts of tests whose spawner or
+// runner stopped sending heartbeats, before the tests are requested again
+func FinishStaleTestAttempts(Driver database.DbDriver, outcome string, ids []string) error {
+	for _, id := range ids {
+		rowId, err := strconv.Atoi(id)
+		if err != nil { // coverage-ignore
+			return err
+		}
+		err = database.FinishTestAttempt(rowId, outcome, nil, Driver)
+		if err != nil { // coverage-ignore
+			return err
+		}
 	}
-	return BatchUpdateTestsWithRowIds(Driver, "state", "requested", ids)
+	return nil
+}
+
+// ResetStaleTests requests the tests in state again whose spawner or runner
+// stopped sending heartbeats for interval, closing their attempts with
+// outcome. The stale spawner or runner loses its claim in the same update, so
+// it can't write to the test if it comes back. The update checks the tests are
+// still stale itself, so a test that got a heartbeat in the meantime is left be
+func ResetStaleTests(Driver database.DbDriver, interval, state, outcome string) error {
+	return Driver.WithTx(context.Background(), func(tx database.DbDriver) error {
+		rows, err := tx.GetRows(database.Update("tests").
+			Set("claimed_by", "").
+			Set("state", "requested").
+			Where("state=?", state).
+			Where("updated_at < ?", database.Ago(interval)).
+			Returning("id"))
+		if err != nil { // coverage-ignore
+			return err
+		}
+		defer utils.DeferredErrCheck(rows.Close)
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil { // coverage-ignore
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err = rows.Err(); err != nil { // coverage-ignore
+			return err
+		}
+		return FinishStaleTestAttempts(tx, outcome, ids)
+	})
+}
+
+func FixFailedSpawns(Driver database.DbDriver, interval string) error {
+	return ResetStaleTests(Driver, interval, "spawning", "spawn_timeout")
 }
 
 func FixFailedRuns(Driver database.DbDriver, interval string) error {
-	ids, err := GetFailedRowIdsForState(Driver, interval, "running")
-	if err != nil { // coverage-ignore
-		return err
-	}
-	return BatchUpdateTestsWithRowIds(Driver, "state", "requested", ids)
+	return ResetStaleTests(Driver, interval, "running", "run_timeout")
 }
 
-func DataRetentionPolicy(Driver database.DbDriver, backend storage.StorageBackend, duration time.Duration) error {
+func DataRetentionPolicy(ctx context.Context, Driver database.DbDriver, backend storage.StorageBackend, duration time.Duration) error {
 	// clear the object storage
 	uuids, err := backend.RemoveObjectsOlderThan(duration)
 	if err != nil { // coverage-ignore
@@ -346,7 +416,7 @@ func DataRetentionPolicy(Driver database.DbDriver, backend storage.StorageBacken
 
 	// iterate through uuids and nuke each of them in the db
 	for _, uuid := range uuids {
-		err = Driver.NukeUuid(uuid)
+		err = Driver.NukeUuidContext(ctx, uuid)
 		if err != nil { // coverage-ignore
 			return err
 		}
@@ -354,10 +424,10 @@ func DataRetentionPolicy(Driver database.DbDriver, backend storage.StorageBacken
 	return nil
 }
 
-func SchedulerLoop(Driver database.DbDriver, SchedulerCfg GutsSchedulerConfig) error { // coverage-ignore
+func SchedulerLoop(ctx context.Context, Driver database.DbDriver, SchedulerCfg GutsSchedulerConfig) error { // coverage-ignore
 
 	// Scheduler step 1: handle new job requests
-	err := HandleNewJobRequests(Driver)
+	err := HandleNewJobRequests(ctx, Driver)
 	if err != nil {
 		return err
 	}
@@ -368,13 +438,19 @@ func SchedulerLoop(Driver database.DbDriver, SchedulerCfg GutsSchedulerConfig) e
 		return err
 	}
 
-	// Scheduler step 3: Check for failed spawner processes
+	// Scheduler step 3: Ensure tests of cancelled jobs stay cancelled
+	err = CancelTestsForCancelledJobs(Driver)
+	if err != nil {
+		return err
+	}
+
+	// Scheduler step 4: Check for failed spawner processes
 	err = FixFailedSpawns(Driver, SchedulerCfg.TestInactiveResetTime)
 	if err != nil {
 		return err
 	}
 
-	// Scheduler step 4: Check for failed runner processes
+	// Scheduler step 5: Check for failed runner processes
 	err = FixFailedRuns(Driver, SchedulerCfg.TestInactiveResetTime)
 	if err != nil {
 		return err
@@ -386,11 +462,11 @@ func SchedulerLoop(Driver database.DbDriver, SchedulerCfg GutsSchedulerConfig) e
 		return err
 	}
 
-	// Scheduler step 5: Remove old objects and db entries
+	// Scheduler step 6: Remove old objects and db entries
 	retentionDuration, err := time.ParseDuration(fmt.Sprintf("%vd", SchedulerCfg.ArtifactRetentionDays))
 	if err != nil {
 		return err
 	}
-	err = DataRetentionPolicy(Driver, backend, retentionDuration)
+	err = DataRetentionPolicy(ctx, Driver, backend, retentionDuration)
 	return err
 }
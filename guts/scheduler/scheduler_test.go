@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	"guts.ubuntu.com/v2/api"
 	"guts.ubuntu.com/v2/database"
@@ -89,7 +90,7 @@ func TestWriteTestsForJob(t *testing.T) {
 	dummyJobReq.TestsPlans = []string{"tests/firefox-example/plans/regular.yaml", "tests/firefox-example/plans/extended.yaml"}
 	jobEntry := api.CreateJobEntry(dummyJobReq, timData)
 
-	err = api.WriteJobEntryToDb(jobEntry, Driver)
+	err = api.WriteJobEntryToDb(jobEntry, "", Driver)
 	utils.CheckError(err)
 
 	// init scheduler driver
@@ -97,7 +98,7 @@ func TestWriteTestsForJob(t *testing.T) {
 	utils.CheckError(err)
 
 	// test the WriteTestsForJob function
-	err = WriteTestsForJob(Driver, jobEntry.Uuid)
+	err = WriteTestsForJob(context.Background(), Driver, jobEntry.Uuid)
 	utils.CheckError(err)
 
 	// nuke the uuid
@@ -138,11 +139,35 @@ func TestGetUpdatedJobState(t *testing.T) {
 	}
 }
 
+func TestGetUpdatedJobStateFlaky(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+
+	// make one test of a pass/pass/pass job have passed on its second attempt
+	Uuid := "505af468-13b4-405f-a384-273a31c60e6a"
+	err = Driver.UpdateRow(`UPDATE tests SET attempt=2 WHERE id=(SELECT MIN(id) FROM tests WHERE uuid=$1)`, Uuid)
+	utils.CheckError(err)
+
+	state, err := GetUpdatedJobState(Driver, Uuid)
+
+	utils.CheckError(Driver.UpdateRow(`UPDATE tests SET attempt=1 WHERE uuid=$1`, Uuid))
+	utils.CheckError(err)
+
+	expectedState := "flaky"
+	if expectedState != state {
+		t.Errorf("unexpected state output!\nexpected: %v\nactual: %v", expectedState, state)
+	}
+}
+
 func TestHandleNewJobRequests(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
 	utils.CheckError(err)
 
-	err = HandleNewJobRequests(Driver)
+	err = HandleNewJobRequests(context.Background(), Driver)
 	utils.CheckError(err)
 }
 
@@ -190,6 +215,32 @@ func TestUpdateJobStatus(t *testing.T) {
 	utils.CheckError(err)
 }
 
+func TestUpdateJobStatusCancelled(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
+	utils.CheckError(err)
+
+	testUuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	defer func() {
+		_, err := Driver.Exec(database.Update("jobs").Set("status", "running").Where("uuid=?", testUuid))
+		utils.CheckError(err)
+	}()
+
+	// the job is cancelled after the scheduler found its tests finished, but
+	// before it wrote the job's status
+	_, err = Driver.Exec(database.Update("jobs").Set("status", "cancelled").Where("uuid=?", testUuid))
+	utils.CheckError(err)
+	err = UpdateJobStatus(Driver, "pass", testUuid)
+	utils.CheckError(err)
+
+	row, err := Driver.GetRow(database.Select("jobs", "status").Where("uuid=?", testUuid))
+	utils.CheckError(err)
+	var status string
+	utils.CheckError(row.Scan(&status))
+	if status != "cancelled" {
+		t.Errorf("the cancellation of job %v should have stuck, but its status is %v", testUuid, status)
+	}
+}
+
 func TestUpdateCompleteJobs(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
 	utils.CheckError(err)
@@ -198,6 +249,14 @@ func TestUpdateCompleteJobs(t *testing.T) {
 	utils.CheckError(err)
 }
 
+func TestCancelTestsForCancelledJobs(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
+	utils.CheckError(err)
+
+	err = CancelTestsForCancelledJobs(Driver)
+	utils.CheckError(err)
+}
+
 func TestGetFailedRowIdsForState(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_scheduler", "guts_scheduler")
 	utils.CheckError(err)
@@ -262,8 +321,24 @@ func TestFixFailedSpawns(t *testing.T) {
 		"67",
 	}
 
+	err = BatchUpdateTestsWithRowIds(Driver, "claimed_by", "spawner-1", spawningRowIds)
+	utils.CheckError(err)
+
 	err = FixFailedSpawns(Driver, "2 minutes")
 	utils.CheckError(err)
+
+	// the claim is released along with the state
+	row, err := Driver.GetRow(database.Select("tests", "COUNT(*)").
+		Where("state=?", "requested").
+		Where("claimed_by=?", "").
+		WhereIn("id", spawningRowIds))
+	utils.CheckError(err)
+	var requested int
+	utils.CheckError(row.Scan(&requested))
+	if requested != len(spawningRowIds) {
+		t.Errorf("expected %v released and requested tests, got %v", len(spawningRowIds), requested)
+	}
+
 	err = BatchUpdateTestsWithRowIds(Driver, "state", "spawning", spawningRowIds)
 	utils.CheckError(err)
 }
@@ -278,8 +353,38 @@ func TestFixFailedRuns(t *testing.T) {
 		"93",
 	}
 
+	// a runner that sends a heartbeat before the stale tests are reset
+	// keeps its claim
+	row, err := Driver.GetRow(database.Select("tests", "updated_at").Where("id=?", 93))
+	utils.CheckError(err)
+	var updatedAt time.Time
+	utils.CheckError(row.Scan(&updatedAt))
+	_, err = Driver.Exec(database.Update("tests").Set("claimed_by", "runner-1").Set("updated_at", time.Now()).Where("id=?", 93))
+	utils.CheckError(err)
+	defer func() {
+		_, err := Driver.Exec(database.Update("tests").Set("claimed_by", "").Set("updated_at", updatedAt).Where("id=?", 93))
+		utils.CheckError(err)
+	}()
+
 	err = FixFailedRuns(Driver, "2 minutes")
 	utils.CheckError(err)
+
+	state, err := Driver.GetTestState(93)
+	utils.CheckError(err)
+	if state != "running" {
+		t.Errorf("test 93 got a heartbeat and should still be running, but is %v", state)
+	}
+	row, err = Driver.GetRow(database.Select("tests", "COUNT(*)").
+		Where("state=?", "requested").
+		Where("claimed_by=?", "").
+		WhereIn("id", runningRowIds[:2]))
+	utils.CheckError(err)
+	var requested int
+	utils.CheckError(row.Scan(&requested))
+	if requested != 2 {
+		t.Errorf("expected 2 released and requested tests, got %v", requested)
+	}
+
 	err = BatchUpdateTestsWithRowIds(Driver, "state", "running", runningRowIds)
 	utils.CheckError(err)
 }
@@ -308,6 +413,6 @@ func TestDataRetentionPolicy(t *testing.T) {
 	utils.CheckError(err)
 	time.Sleep(time.Second * 4)
 
-	err = DataRetentionPolicy(Driver, backend, retentionDuration)
+	err = DataRetentionPolicy(context.Background(), Driver, backend, retentionDuration)
 	utils.CheckError(err)
 }
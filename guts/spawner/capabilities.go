@@ -0,0 +1,85 @@
+package spawner
+
+import (
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"os"
+	"runtime"
+	"time"
+)
+
+var (
+	// the architectures images are built for, as named in their file names
+	// like questing-desktop-amd64.iso. An image naming none of them runs on
+	// a spawner of any architecture
+	ImageArchitecturePattern = `-(amd64|arm64|armhf|ppc64el|riscv64|s390x)[.+]`
+	// Go's names for architectures that Ubuntu names differently
+	goArchToUbuntuArch = map[string]string{
+		"arm":     "armhf",
+		"ppc64le": "ppc64el",
+	}
+)
+
+// SpawnerCapabilities is what a spawner's host can give the VMs of tests,
+// kept in the spawners table so spawners only claim tests they can run
+type SpawnerCapabilities struct {
+	Hostname     string
+	Architecture string
+	Kvm          bool
+	Tpm          bool
+	Uefi         bool
+	SecureBoot   bool
+	MaxMemoryMb  int // the most memory a single VM can have
+	MaxCores     int // the most cores a single VM can have
+}
+
+// DetectCapabilities works out the capabilities of the host the spawner runs on
+func DetectCapabilities(SpawnerCfg GutsSpawnerConfig) (SpawnerCapabilities, error) {
+	var capabilities SpawnerCapabilities
+	hostname, err := os.Hostname()
+	if err != nil { // coverage-ignore
+		return capabilities, err
+	}
+	hostMemoryMb, err := HostMemoryMb()
+	if err != nil { // coverage-ignore
+		return capabilities, err
+	}
+	capabilities.Hostname = hostname
+	capabilities.Architecture = UbuntuArchitecture(runtime.GOARCH)
+	capabilities.Kvm = utils.FileOrDirExists("/dev/kvm") == nil
+	capabilities.Tpm = SwtpmAvailable() == nil
+	capabilities.Uefi = utils.AllFilesExist(UefiFirmwarePaths(TestRequirements{uefi: true}, SpawnerCfg))
+	capabilities.SecureBoot = utils.AllFilesExist(UefiFirmwarePaths(TestRequirements{uefi: true, secureBoot: true}, SpawnerCfg))
+	capabilities.MaxMemoryMb = hostMemoryMb
+	capabilities.MaxCores = runtime.NumCPU()
+	return capabilities, nil
+}
+
+func UbuntuArchitecture(goArch string) string {
+	if ubuntuArch, ok := goArchToUbuntuArch[goArch]; ok {
+		return ubuntuArch
+	}
+	return goArch
+}
+
+// RegisterSpawner records the capabilities of a spawner in the spawners
+// table, replacing what it registered before
+func RegisterSpawner(capabilities SpawnerCapabilities, Driver database.DbDriver) error {
+	registration := database.Insert("spawners", "hostname", "architecture", "kvm", "tpm", "uefi", "secure_boot", "max_memory", "max_cores", "updated_at").Values(
+		capabilities.Hostname,
+		capabilities.Architecture,
+		capabilities.Kvm,
+		capabilities.Tpm,
+		capabilities.Uefi,
+		capabilities.SecureBoot,
+		capabilities.MaxMemoryMb,
+		capabilities.MaxCores,
+		time.Now(),
+	).OnConflictUpdate("hostname")
+	for _, column := range []string{"architecture", "kvm", "tpm", "uefi", "secure_boot", "max_memory", "max_cores", "updated_at"} {
+		registration.SetExpr(fmt.Sprintf("%v=EXCLUDED.%v", column, column))
+	}
+	_, err := Driver.Exec(registration)
+	return err
+}
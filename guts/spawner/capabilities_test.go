@@ -0,0 +1,83 @@
+package spawner
+
+import (
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestUbuntuArchitecture(t *testing.T) {
+	for goArch, expectedArch := range map[string]string{"amd64": "amd64", "arm64": "arm64", "arm": "armhf", "ppc64le": "ppc64el"} {
+		if arch := UbuntuArchitecture(goArch); arch != expectedArch {
+			t.Errorf("unexpected architecture for %v!\nexpected: %v\nactual: %v", goArch, expectedArch, arch)
+		}
+	}
+}
+
+func TestImageArchitecturePattern(t *testing.T) {
+	pattern := regexp.MustCompile(ImageArchitecturePattern)
+	for imageUrl, hasArchitecture := range map[string]bool{
+		"https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso":                                            true,
+		"https://cdimage.ubuntu.com/ubuntu-server/daily-preinstalled/current/questing-preinstalled-server-arm64+raspi.img.xz": true,
+		"http://localhost:9999/questing-mini-iso-amd64-preinstalled.img":                                                      false,
+		"http://localhost:9999/delta.img": false,
+	} {
+		if pattern.MatchString(imageUrl) != hasArchitecture {
+			t.Errorf("%v should match %v: %v", imageUrl, ImageArchitecturePattern, hasArchitecture)
+		}
+	}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
+	firmwareDir := t.TempDir()
+	spawnerCfg.Virtualisation.UefiFirmware = filepath.Join(firmwareDir, "OVMF_CODE_4M.fd")
+	spawnerCfg.Virtualisation.UefiVars = filepath.Join(firmwareDir, "OVMF_VARS_4M.fd")
+	spawnerCfg.Virtualisation.SecureBootFirmware = filepath.Join(firmwareDir, "OVMF_CODE_4M.secboot.fd")
+	spawnerCfg.Virtualisation.SecureBootVars = filepath.Join(firmwareDir, "OVMF_VARS_4M.ms.fd")
+	for _, firmware := range []string{spawnerCfg.Virtualisation.UefiFirmware, spawnerCfg.Virtualisation.UefiVars} {
+		utils.CheckError(os.WriteFile(firmware, []byte{}, 0644))
+	}
+
+	capabilities, err := DetectCapabilities(spawnerCfg)
+	utils.CheckError(err)
+	hostname, err := os.Hostname()
+	utils.CheckError(err)
+	if capabilities.Hostname != hostname {
+		t.Errorf("unexpected hostname!\nexpected: %v\nactual: %v", hostname, capabilities.Hostname)
+	}
+	if !capabilities.Uefi || capabilities.SecureBoot {
+		t.Errorf("only the UEFI firmware is installed, but the capabilities are %+v", capabilities)
+	}
+	if capabilities.Tpm != (SwtpmAvailable() == nil) {
+		t.Errorf("the TPM capability should follow whether swtpm is installed: %+v", capabilities)
+	}
+	if capabilities.MaxMemoryMb <= 0 || capabilities.MaxCores <= 0 {
+		t.Errorf("a host should have some memory and cores: %+v", capabilities)
+	}
+}
+
+func TestRegisterSpawner(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
+	}
+	capabilities := SpawnerCapabilities{Hostname: "guts-spawner-registered", Architecture: "amd64", Kvm: true, MaxMemoryMb: 4096, MaxCores: 4}
+	utils.CheckError(RegisterSpawner(capabilities, Driver))
+	// registering again updates the spawner's row rather than failing
+	capabilities.Tpm = true
+	utils.CheckError(RegisterSpawner(capabilities, Driver))
+
+	var tpm bool
+	row, err := Driver.RunQueryRow(`SELECT tpm FROM spawners WHERE hostname='guts-spawner-registered'`)
+	utils.CheckError(err)
+	utils.CheckError(row.Scan(&tpm))
+	if !tpm {
+		t.Errorf("registering a spawner again should have updated its capabilities")
+	}
+}
@@ -12,12 +12,27 @@ type GutsSpawnerConfig struct {
 		ConnectionString string `yaml:"connection_string"`
 	}
 	Virtualisation struct {
-		Memory int `yaml:"memory"`
-		Cores  int `yaml:"cores"`
+		Memory int `yaml:"memory"` // per VM, in MB
+		Cores  int `yaml:"cores"`  // per VM
+		// each VM is given a VNC port from the range, so it also limits how
+		// many VMs run at once
+		VncPortRangeStart uint `yaml:"vnc_port_range_start"`
+		VncPortRangeEnd   uint `yaml:"vnc_port_range_end"`
+		MaxVms            int  `yaml:"max_vms"` // 0 to fit as many as the host can
+		// OVMF firmware for tests that need UEFI or a TPM, and the templates
+		// of the NVRAM vars each of those tests gets a copy of
+		UefiFirmware       string `yaml:"uefi_firmware"`
+		UefiVars           string `yaml:"uefi_vars"`
+		SecureBootFirmware string `yaml:"secure_boot_firmware"`
+		SecureBootVars     string `yaml:"secure_boot_vars"`
 	}
 	General struct {
-		ImageCachePath string `yaml:"image_cache_path"`
+		ImageCachePath               string `yaml:"image_cache_path"`
+		ImageCacheMaxSize            int    `yaml:"image_cache_max_size"`            // in bytes
+		ImageCacheReductionThreshold int    `yaml:"image_cache_reduction_threshold"` // in bytes
 	}
+	// how to tell whether a cached image is up to date, per image domain
+	Checksums []ChecksumProviderConfig `yaml:"checksums"`
 }
 
 func ParseConfig(filePath string) (GutsSpawnerConfig, error) {
@@ -14,7 +14,19 @@ func TestParseConfigSuccess(t *testing.T) {
 	testCfg.Database.ConnectionString = "host=localhost port=5432 user=guts_spawner password=guts_spawner dbname=guts sslmode=disable"
 	testCfg.Virtualisation.Memory = 4096
 	testCfg.Virtualisation.Cores = 8
+	testCfg.Virtualisation.VncPortRangeStart = 1
+	testCfg.Virtualisation.VncPortRangeEnd = 4
+	testCfg.Virtualisation.UefiFirmware = "/usr/share/OVMF/OVMF_CODE_4M.fd"
+	testCfg.Virtualisation.UefiVars = "/usr/share/OVMF/OVMF_VARS_4M.fd"
+	testCfg.Virtualisation.SecureBootFirmware = "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd"
+	testCfg.Virtualisation.SecureBootVars = "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"
 	testCfg.General.ImageCachePath = "/srv/guts/images/"
+	testCfg.General.ImageCacheMaxSize = 107374182400
+	testCfg.General.ImageCacheReductionThreshold = 85899345920
+	testCfg.Checksums = []ChecksumProviderConfig{
+		{Domain: "cdimage.ubuntu.com", Provider: "sha256sums"},
+		{Domain: "localhost", Provider: "sha256sums"},
+	}
 	if !reflect.DeepEqual(SpawnerCfg, testCfg) {
 		t.Errorf("parsed config not the same as expected!\nExpected: %v\nActual: %v", testCfg, SpawnerCfg)
 	}
@@ -18,7 +18,7 @@ func ParseArgs() { // coverage-ignore
 		flag.StringVar(&VncHost, "host", "", "Vnc host to advertise to the runner")
 	}
 	if flag.Lookup("port") == nil {
-		flag.UintVar(&VncPort, "port", 0, "Vnc port to advertise to the runner")
+		flag.UintVar(&VncPort, "port", 0, "Vnc port to advertise to the runner, for a spawner of a single VM without vnc_port_range_start in its config")
 	}
 
 	// Config file path
@@ -37,7 +37,4 @@ func ParseArgs() { // coverage-ignore
 	if VncHost == "" {
 		log.Fatal("-host arg must be set")
 	}
-	if VncPort == 0 {
-		log.Fatal("-port arg must be set")
-	}
 }
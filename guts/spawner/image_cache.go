@@ -0,0 +1,271 @@
+package spawner
+
+import (
+	"errors"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// files the cache keeps next to an image, which aren't images themselves
+	imageCacheSidecarSuffixes = []string{".lock", ".in_use", ".last_used", ".new", HttpValidatorSuffix, ".qcow2"}
+	// disks younger than this may not be locked by their spawner yet
+	OrphanedDiskAge = time.Minute
+)
+
+// FileLock is an flock(2) lock on a file, which is shared between all the
+// spawners on a host as well as the goroutines of one spawner
+type FileLock struct {
+	f *os.File
+}
+
+func openLockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+}
+
+// LockFile waits for a syscall.LOCK_SH or syscall.LOCK_EX lock on path,
+// creating it if it doesn't exist
+func LockFile(path string, how int) (*FileLock, error) {
+	f, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), how); err != nil { // coverage-ignore
+		_ = f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+// TryLockFile is LockFile without the waiting, the lock is nil if someone
+// else holds a conflicting lock on path
+func TryLockFile(path string, how int) (*FileLock, error) {
+	f, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, f.Close()
+	}
+	if err != nil { // coverage-ignore
+		_ = f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if err != nil { // coverage-ignore
+		_ = l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// ImageLockPath is locked exclusively while an image is checked or downloaded
+func ImageLockPath(imagePath string) string {
+	return fmt.Sprintf("%v.lock", imagePath)
+}
+
+// ImageInUsePath is locked shared while a VM uses an image
+func ImageInUsePath(imagePath string) string {
+	return fmt.Sprintf("%v.in_use", imagePath)
+}
+
+func ImageLastUsedPath(imagePath string) string {
+	return fmt.Sprintf("%v.last_used", imagePath)
+}
+
+// AcquireImage downloads an image into the cache, or reuses the cached copy.
+// Only one spawner on a host downloads an image at a time, and the others
+// wait for it and then use its download. The image isn't evicted until the
+// returned lock is unlocked, though it may be replaced by a newer download,
+// which doesn't disturb VMs that already have the image open
+func AcquireImage(imageUrl string, SpawnerCfg GutsSpawnerConfig) (string, *FileLock, error) {
+	imagePath := fmt.Sprintf("%v%v", SpawnerCfg.General.ImageCachePath, utils.GetFileNameFromUrl(imageUrl))
+	downloadLock, err := LockFile(ImageLockPath(imagePath), syscall.LOCK_EX)
+	if err != nil {
+		return "", nil, err
+	}
+
+	imagePath, err = DownloadImage(imageUrl, SpawnerCfg)
+	if err == nil {
+		err = RefreshLastUsedFile(imagePath)
+	}
+	var inUseLock *FileLock
+	if err == nil {
+		// taken before the download lock is let go, so there's no moment
+		// the image can be evicted in between
+		inUseLock, err = LockFile(ImageInUsePath(imagePath), syscall.LOCK_SH)
+	}
+	unlockErr := downloadLock.Unlock()
+	if err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		if inUseLock != nil {
+			_ = inUseLock.Unlock()
+		}
+		return "", nil, err
+	}
+
+	// disks of VMs that are gone take up room better used for images
+	err = CleanupOrphanedDisks(SpawnerCfg)
+	if err == nil {
+		err = ImageCacheRetentionPolicy(SpawnerCfg)
+	}
+	if err != nil { // coverage-ignore
+		_ = inUseLock.Unlock()
+		return "", nil, err
+	}
+	return imagePath, inUseLock, nil
+}
+
+func RefreshLastUsedFile(imagePath string) error {
+	lastUsed := []byte(strconv.FormatInt(time.Now().Unix(), 10))
+	return utils.AtomicWrite(lastUsed, ImageLastUsedPath(imagePath))
+}
+
+// CachedImages lists the images in the cache, from the least to the most
+// recently used
+func CachedImages(cacheDirectory string) ([]string, error) {
+	entries, err := os.ReadDir(cacheDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []string
+	lastUsed := make(map[string]int)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || IsImageCacheSidecar(e.Name()) {
+			continue
+		}
+		imagePath := filepath.Join(cacheDirectory, e.Name())
+		// images downloaded before their use was recorded are the oldest
+		dat, err := os.ReadFile(ImageLastUsedPath(imagePath))
+		if err == nil {
+			lastUsed[imagePath], _ = strconv.Atoi(string(dat))
+		}
+		images = append(images, imagePath)
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return lastUsed[images[i]] < lastUsed[images[j]]
+	})
+	return images, nil
+}
+
+func IsImageCacheSidecar(fileName string) bool {
+	for _, suffix := range imageCacheSidecarSuffixes {
+		if strings.HasSuffix(fileName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageCacheRetentionPolicy keeps the image cache below
+// image_cache_max_size, evicting the least recently used images until it's
+// below image_cache_reduction_threshold. Images that are in use are skipped
+func ImageCacheRetentionPolicy(SpawnerCfg GutsSpawnerConfig) error {
+	cacheDirectory := SpawnerCfg.General.ImageCachePath
+	maxSize := SpawnerCfg.General.ImageCacheMaxSize
+	reduceTo := SpawnerCfg.General.ImageCacheReductionThreshold
+	if maxSize <= 0 {
+		return nil
+	}
+	dirSize, err := utils.GetDirSize(cacheDirectory)
+	if err != nil {
+		return err
+	}
+	if dirSize < maxSize {
+		return nil
+	}
+
+	images, err := CachedImages(cacheDirectory)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	for _, imagePath := range images {
+		if dirSize < reduceTo {
+			return nil
+		}
+		evicted, err := EvictImage(imagePath)
+		if err != nil { // coverage-ignore
+			return err
+		}
+		if !evicted {
+			continue
+		}
+		dirSize, err = utils.GetDirSize(cacheDirectory)
+		if err != nil { // coverage-ignore
+			return err
+		}
+	}
+	return nil
+}
+
+// EvictImage removes an image from the cache, unless it's being downloaded
+// or used
+func EvictImage(imagePath string) (bool, error) {
+	downloadLock, err := TryLockFile(ImageLockPath(imagePath), syscall.LOCK_EX)
+	if err != nil || downloadLock == nil {
+		return false, err
+	}
+	defer utils.DeferredErrCheck(downloadLock.Unlock)
+	inUseLock, err := TryLockFile(ImageInUsePath(imagePath), syscall.LOCK_EX)
+	if err != nil || inUseLock == nil {
+		return false, err
+	}
+	defer utils.DeferredErrCheck(inUseLock.Unlock)
+
+	// the lock files stay, as other spawners may be waiting on them
+	for _, path := range []string{imagePath, ImageLastUsedPath(imagePath), fmt.Sprintf("%v%v", imagePath, HttpValidatorSuffix), fmt.Sprintf("%v.new", imagePath)} {
+		err = utils.RemoveIfExists(path)
+		if err != nil { // coverage-ignore
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// CleanupOrphanedDisks removes the qcow2 disks in the cache that no spawner
+// holds a lock on, which are left behind when a spawner dies or errors out
+// with a VM running
+func CleanupOrphanedDisks(SpawnerCfg GutsSpawnerConfig) error {
+	disks, err := filepath.Glob(filepath.Join(SpawnerCfg.General.ImageCachePath, "*.qcow2"))
+	if err != nil { // coverage-ignore
+		return err
+	}
+	for _, disk := range disks {
+		info, err := os.Stat(disk)
+		if err != nil || time.Since(info.ModTime()) < OrphanedDiskAge {
+			continue
+		}
+		diskLock, err := TryLockFile(disk, syscall.LOCK_EX)
+		if err != nil { // coverage-ignore
+			return err
+		}
+		if diskLock == nil {
+			continue
+		}
+		err = os.Remove(disk)
+		if err != nil { // coverage-ignore
+			_ = diskLock.Unlock()
+			return err
+		}
+		err = diskLock.Unlock()
+		if err != nil { // coverage-ignore
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package spawner
+
+import (
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TempImageCacheConfig(t *testing.T) GutsSpawnerConfig {
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.General.ImageCachePath = fmt.Sprintf("%v/", t.TempDir())
+	spawnerCfg.Checksums = []ChecksumProviderConfig{{Domain: "127.0.0.1", Provider: "sha256sums"}}
+	return spawnerCfg
+}
+
+// WriteCachedImage writes an image of size bytes to the cache, last used
+// at lastUsed
+func WriteCachedImage(spawnerCfg GutsSpawnerConfig, name string, size int, lastUsed int64) string {
+	imagePath := filepath.Join(spawnerCfg.General.ImageCachePath, name)
+	utils.CheckError(os.WriteFile(imagePath, make([]byte, size), 0644))
+	utils.CheckError(os.WriteFile(ImageLastUsedPath(imagePath), []byte(fmt.Sprint(lastUsed)), 0644))
+	return imagePath
+}
+
+func TestTryLockFile(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "delta.img.lock")
+	sharedLock, err := LockFile(lockPath, syscall.LOCK_SH)
+	utils.CheckError(err)
+
+	otherSharedLock, err := TryLockFile(lockPath, syscall.LOCK_SH)
+	utils.CheckError(err)
+	if otherSharedLock == nil {
+		t.Errorf("two shared locks on %v should be allowed", lockPath)
+	} else {
+		utils.CheckError(otherSharedLock.Unlock())
+	}
+	exclusiveLock, err := TryLockFile(lockPath, syscall.LOCK_EX)
+	utils.CheckError(err)
+	if exclusiveLock != nil {
+		t.Errorf("an exclusive lock on %v shouldn't be allowed while it's shared", lockPath)
+	}
+
+	utils.CheckError(sharedLock.Unlock())
+	exclusiveLock, err = TryLockFile(lockPath, syscall.LOCK_EX)
+	utils.CheckError(err)
+	if exclusiveLock == nil {
+		t.Errorf("an exclusive lock on %v should be allowed once it's unlocked", lockPath)
+	} else {
+		utils.CheckError(exclusiveLock.Unlock())
+	}
+}
+
+func TestAcquireImageConcurrently(t *testing.T) {
+	var imageRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "SHA256SUMS") {
+			_, err := fmt.Fprintf(w, "%v *delta.img\n", deltaBrainwaveSha256)
+			utils.CheckError(err)
+			return
+		}
+		imageRequests.Add(1)
+		// give the other spawners time to pile up behind this download
+		time.Sleep(50 * time.Millisecond)
+		_, err := w.Write([]byte("delta-brainwave"))
+		utils.CheckError(err)
+	}))
+	defer server.Close()
+
+	spawnerCfg := TempImageCacheConfig(t)
+	imageUrl := fmt.Sprintf("%v/delta.img", server.URL)
+	var wg sync.WaitGroup
+	imagePaths := make([]string, 4)
+	imageLocks := make([]*FileLock, 4)
+	for i := range imagePaths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			imagePaths[i], imageLocks[i], err = AcquireImage(imageUrl, spawnerCfg)
+			utils.CheckError(err)
+		}()
+	}
+	wg.Wait()
+
+	if imageRequests.Load() != 1 {
+		t.Errorf("concurrent spawners should share one download, but made %v", imageRequests.Load())
+	}
+	expectedImagePath := fmt.Sprintf("%vdelta.img", spawnerCfg.General.ImageCachePath)
+	for _, imagePath := range imagePaths {
+		if imagePath != expectedImagePath {
+			t.Errorf("unexpected image path!\nexpected: %v\nactual: %v", expectedImagePath, imagePath)
+		}
+	}
+	if utils.FileOrDirExists(ImageLastUsedPath(expectedImagePath)) != nil {
+		t.Errorf("the use of %v should have been recorded", expectedImagePath)
+	}
+
+	// the image can't be evicted while it's in use
+	evicted, err := EvictImage(expectedImagePath)
+	utils.CheckError(err)
+	if evicted {
+		t.Errorf("%v shouldn't be evicted while it's in use", expectedImagePath)
+	}
+	// but it can be checked for updates by other spawners meanwhile
+	_, imageLock, err := AcquireImage(imageUrl, spawnerCfg)
+	utils.CheckError(err)
+	for _, imageLock := range append(imageLocks, imageLock) {
+		utils.CheckError(imageLock.Unlock())
+	}
+	evicted, err = EvictImage(expectedImagePath)
+	utils.CheckError(err)
+	if !evicted {
+		t.Errorf("%v should be evicted once it's no longer used", expectedImagePath)
+	}
+}
+
+func TestCachedImages(t *testing.T) {
+	spawnerCfg := TempImageCacheConfig(t)
+	newest := WriteCachedImage(spawnerCfg, "newest.img", 10, 300)
+	oldest := WriteCachedImage(spawnerCfg, "oldest.iso", 10, 100)
+	middle := WriteCachedImage(spawnerCfg, "middle.img", 10, 200)
+	unrecorded := filepath.Join(spawnerCfg.General.ImageCachePath, "unrecorded.img")
+	utils.CheckError(os.WriteFile(unrecorded, []byte("delta-brainwave"), 0644))
+	for _, sidecar := range []string{"middle.img.lock", "middle.img.in_use", "middle.img.http-validator", "newest.img.new", "4ce9189f-561a-4886-aeef-1836f28b073b-e4c5c1b5.qcow2"} {
+		utils.CheckError(os.WriteFile(filepath.Join(spawnerCfg.General.ImageCachePath, sidecar), []byte{}, 0644))
+	}
+
+	images, err := CachedImages(spawnerCfg.General.ImageCachePath)
+	utils.CheckError(err)
+	expectedImages := []string{unrecorded, oldest, middle, newest}
+	if !reflect.DeepEqual(images, expectedImages) {
+		t.Errorf("unexpected images!\nexpected: %v\nactual: %v", expectedImages, images)
+	}
+}
+
+func TestImageCacheRetentionPolicy(t *testing.T) {
+	spawnerCfg := TempImageCacheConfig(t)
+	oldest := WriteCachedImage(spawnerCfg, "oldest.img", 1000, 100)
+	inUse := WriteCachedImage(spawnerCfg, "in-use.img", 1000, 200)
+	middle := WriteCachedImage(spawnerCfg, "middle.img", 1000, 300)
+	newest := WriteCachedImage(spawnerCfg, "newest.img", 1000, 400)
+	imageLock, err := LockFile(ImageInUsePath(inUse), syscall.LOCK_SH)
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(imageLock.Unlock)
+
+	// below the max size nothing is evicted
+	dirSize, err := utils.GetDirSize(spawnerCfg.General.ImageCachePath)
+	utils.CheckError(err)
+	spawnerCfg.General.ImageCacheMaxSize = dirSize + 1
+	spawnerCfg.General.ImageCacheReductionThreshold = dirSize - 1500
+	err = ImageCacheRetentionPolicy(spawnerCfg)
+	utils.CheckError(err)
+	if utils.FileOrDirExists(oldest) != nil {
+		t.Errorf("%v shouldn't be evicted from a cache below its max size", oldest)
+	}
+
+	// evicting the oldest image isn't enough, and the next one is in use
+	spawnerCfg.General.ImageCacheMaxSize = dirSize - 1
+	err = ImageCacheRetentionPolicy(spawnerCfg)
+	utils.CheckError(err)
+
+	for _, evicted := range []string{oldest, ImageLastUsedPath(oldest), middle} {
+		if utils.FileOrDirExists(evicted) == nil {
+			t.Errorf("%v should have been evicted", evicted)
+		}
+	}
+	for _, kept := range []string{inUse, newest} {
+		if utils.FileOrDirExists(kept) != nil {
+			t.Errorf("%v shouldn't have been evicted", kept)
+		}
+	}
+}
+
+func TestImageCacheRetentionPolicyNoLimit(t *testing.T) {
+	spawnerCfg := TempImageCacheConfig(t)
+	image := WriteCachedImage(spawnerCfg, "delta.img", 1000, 100)
+	err := ImageCacheRetentionPolicy(spawnerCfg)
+	utils.CheckError(err)
+	if utils.FileOrDirExists(image) != nil {
+		t.Errorf("%v shouldn't be evicted from a cache with no max size", image)
+	}
+}
+
+func TestCleanupOrphanedDisks(t *testing.T) {
+	spawnerCfg := TempImageCacheConfig(t)
+	longAgo := time.Now().Add(-time.Hour)
+	var disks []string
+	for _, name := range []string{"orphaned", "in-use", "just-created"} {
+		disk := filepath.Join(spawnerCfg.General.ImageCachePath, fmt.Sprintf("%v.qcow2", name))
+		utils.CheckError(os.WriteFile(disk, []byte{}, 0644))
+		disks = append(disks, disk)
+	}
+	utils.CheckError(os.Chtimes(disks[0], longAgo, longAgo))
+	utils.CheckError(os.Chtimes(disks[1], longAgo, longAgo))
+	diskLock, err := LockFile(disks[1], syscall.LOCK_EX)
+	utils.CheckError(err)
+	defer utils.DeferredErrCheck(diskLock.Unlock)
+
+	err = CleanupOrphanedDisks(spawnerCfg)
+	utils.CheckError(err)
+	if utils.FileOrDirExists(disks[0]) == nil {
+		t.Errorf("%v should have been cleaned up", disks[0])
+	}
+	for _, disk := range disks[1:] {
+		if utils.FileOrDirExists(disk) != nil {
+			t.Errorf("%v shouldn't have been cleaned up", disk)
+		}
+	}
+}
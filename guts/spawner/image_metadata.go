@@ -2,97 +2,324 @@ package spawner
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"guts.ubuntu.com/v2/utils"
-	"io/ioutil"
+	"hash"
+	"io"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
 
-func GetLocalShaSum(pathToFile string) (string, error) {
-	err := utils.FileOrDirExists(pathToFile)
-	if err != nil {
-		return "", err
-	}
-	dat, err := os.ReadFile(pathToFile)
-	if err != nil { // coverage-ignore
-		return "", err
+var (
+	// where the http validator of an image downloaded with the etag provider
+	// is kept, next to the image
+	HttpValidatorSuffix = ".http-validator"
+	// used when the spawner config doesn't list any checksum providers
+	DefaultChecksumProviders = []ChecksumProviderConfig{
+		{Domain: "cdimage.ubuntu.com", Provider: "sha256sums"},
+		{Domain: "localhost", Provider: "sha256sums"},
 	}
-	h := sha256.New()
-	h.Write(dat)
-	return hex.EncodeToString(h.Sum(nil)), nil
+)
+
+// ChecksumProvider tells whether a cached image is still the same as the one
+// at its url, so it doesn't need downloading again
+type ChecksumProvider interface {
+	// RemoteChecksum fetches what a copy of the image at imageUrl should match
+	RemoteChecksum(imageUrl string) (string, error)
+	// LocalChecksum works out the same for a copy of an image on disk
+	LocalChecksum(imagePath string) (string, error)
+	// Downloaded is called once an image has been downloaded to imagePath,
+	// with the remote checksum it was downloaded against
+	Downloaded(imagePath, remoteChecksum string) error
+}
+
+// HashingChecksumProvider is a ChecksumProvider whose checksums are hashes of
+// the image, so downloads of it can be verified
+type HashingChecksumProvider interface {
+	ChecksumProvider
+	Hash() hash.Hash
+}
+
+type ChecksumProviderConfig struct {
+	Domain   string `yaml:"domain"`
+	Provider string `yaml:"provider"`
+	Keyring  string `yaml:"keyring"` // only used by signed_sha256sums
+}
+
+type UnsupportedChecksumProviderError struct {
+	provider string
+}
+
+func (u UnsupportedChecksumProviderError) Error() string {
+	return fmt.Sprintf("%v isn't a supported checksum provider", u.provider)
+}
+
+type NoChecksumProviderError struct {
+	url string
+}
+
+func (n NoChecksumProviderError) Error() string {
+	return fmt.Sprintf("Couldn't acquire shasum of image at %v", n.url)
+}
+
+type ChecksumMismatchError struct {
+	url      string
+	expected string
+	actual   string
+}
+
+func (c ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("Image downloaded from %v has checksum %v instead of %v", c.url, c.actual, c.expected)
+}
+
+type BadChecksumSignatureError struct {
+	url    string
+	output string
 }
 
-func GetRemoteShaSum(imageUrl string) (string, error) {
-	// This is now looking okay to me.
-	domainsFunctions := DomainsAndInterfaces()
-	supportedDomains := make([]string, len(domainsFunctions))
-	ctr := 0
-	for idx, _ := range domainsFunctions {
-		supportedDomains[ctr] = idx
-		ctr = ctr + 1
-	}
-	for _, domain := range supportedDomains {
-		thisRegex := fmt.Sprintf(`(http|https):\/\/%v(.*)`, domain)
-		match := regexp.MustCompile(thisRegex).MatchString(imageUrl)
-		if match {
-			shasum, err := domainsFunctions[domain]["shasum"](imageUrl)
-			return shasum, err
+func (b BadChecksumSignatureError) Error() string {
+	return fmt.Sprintf("Signature of %v couldn't be verified:\n%v", b.url, b.output)
+}
+
+func GetChecksumProvider(providerCfg ChecksumProviderConfig) (ChecksumProvider, error) {
+	switch providerCfg.Provider {
+	case "sha256sums":
+		return ChecksumsFileProvider{FileName: "SHA256SUMS", NewHash: sha256.New}, nil
+	case "sha512sums":
+		return ChecksumsFileProvider{FileName: "SHA512SUMS", NewHash: sha512.New}, nil
+	case "signed_sha256sums":
+		if providerCfg.Keyring == "" {
+			return nil, fmt.Errorf("the signed_sha256sums provider for %v needs a keyring", providerCfg.Domain)
 		}
+		return ChecksumsFileProvider{FileName: "SHA256SUMS", NewHash: sha256.New, Keyring: providerCfg.Keyring}, nil
+	case "sha256_sidecar":
+		return SidecarChecksumProvider{Extension: ".sha256", NewHash: sha256.New}, nil
+	case "etag":
+		return HttpValidatorProvider{}, nil
 	}
-	return "", fmt.Errorf("Couldn't acquire shasum of image at %v", imageUrl)
+	return nil, UnsupportedChecksumProviderError{provider: providerCfg.Provider}
 }
 
-func DomainsAndInterfaces() map[string]map[string]func(string) (string, error) {
-	m := make(map[string]map[string]func(string) (string, error))
-	cdimageMap := map[string]func(string) (string, error){"shasum": CdImageGetShasumOfImage}
-	m["cdimage.ubuntu.com"] = cdimageMap
-	m["localhost"] = cdimageMap
-	return m
+// ChecksumProviderForUrl finds the first checksum provider configured for the
+// domain of an image url
+func ChecksumProviderForUrl(imageUrl string, SpawnerCfg GutsSpawnerConfig) (ChecksumProvider, error) {
+	providers := SpawnerCfg.Checksums
+	if len(providers) == 0 {
+		providers = DefaultChecksumProviders
+	}
+	for _, providerCfg := range providers {
+		thisRegex := fmt.Sprintf(`^(http|https):\/\/%v([:/].*)?$`, regexp.QuoteMeta(providerCfg.Domain))
+		if regexp.MustCompile(thisRegex).MatchString(imageUrl) {
+			return GetChecksumProvider(providerCfg)
+		}
+	}
+	return nil, NoChecksumProviderError{url: imageUrl}
 }
 
-func CdImageGetShasumOfImage(imageUrl string) (string, error) {
-	allShaSums, err := CdImageDownloadCheckSumFileForImage(imageUrl)
+func GetRemoteChecksum(imageUrl string, SpawnerCfg GutsSpawnerConfig) (string, error) {
+	provider, err := ChecksumProviderForUrl(imageUrl, SpawnerCfg)
 	if err != nil {
 		return "", err
 	}
-	imageName := utils.GetFileNameFromUrl(imageUrl)
-	thisShaSum, err := CdImageParseShasumForImage(allShaSums, imageName)
-	return thisShaSum, err
+	return provider.RemoteChecksum(imageUrl)
 }
 
-func CdImageDownloadCheckSumFileForImage(imageUrl string) (string, error) {
-	imageName := utils.GetFileNameFromUrl(imageUrl)
-	baseDirUrl := strings.Replace(imageUrl, imageName, "", -1)
-	shasumUrl := fmt.Sprintf("%v%v", baseDirUrl, "SHA256SUMS")
-	response, err := http.Get(shasumUrl)
+// HashFile hashes a file without reading all of it into memory
+func HashFile(pathToFile string, newHash func() hash.Hash) (string, error) {
+	err := utils.FileOrDirExists(pathToFile)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(pathToFile)
 	if err != nil { // coverage-ignore
 		return "", err
 	}
+	defer utils.DeferredErrCheck(f.Close)
+	h := newHash()
+	if _, err = io.Copy(h, f); err != nil { // coverage-ignore
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func GetLocalShaSum(pathToFile string) (string, error) {
+	return HashFile(pathToFile, sha256.New)
+}
+
+// DownloadChecksumFile fetches a small file, like SHA256SUMS, next to an image
+func DownloadChecksumFile(fileUrl string) (string, error) {
+	response, err := http.Get(fileUrl)
+	if err != nil {
+		return "", err
+	}
+	defer utils.DeferredErrCheck(response.Body.Close)
 	if response.StatusCode != 200 {
-		response.Body.Close()
-		return "", fmt.Errorf("%v returned %v instead of 200", shasumUrl, response.StatusCode)
+		return "", fmt.Errorf("%v returned %v instead of 200", fileUrl, response.StatusCode)
 	}
-	body, err := ioutil.ReadAll(response.Body)
-	response.Body.Close()
+	body, err := io.ReadAll(response.Body)
 	if err != nil { // coverage-ignore
 		return "", err
 	}
 	return string(body), nil
 }
 
-func CdImageParseShasumForImage(allShaSums, imageName string) (string, error) {
-	shasumRegex := fmt.Sprintf(`([a-zA-Z0-9]{64}) \*%v`, imageName)
-	r, err := regexp.Compile(shasumRegex)
+// ParseChecksumForImage finds the checksum of an image in a SHA256SUMS style
+// file, where images are listed in either binary or text mode
+func ParseChecksumForImage(allChecksums, imageName string, checksumLength int) (string, error) {
+	checksumRegex := fmt.Sprintf(`(?m)^([a-fA-F0-9]{%v}) [ *]%v$`, checksumLength, regexp.QuoteMeta(imageName))
+	r, err := regexp.Compile(checksumRegex)
 	if err != nil { // coverage-ignore
 		return "", err
 	}
-	imageChkSum := r.FindStringSubmatch(allShaSums)
+	imageChkSum := r.FindStringSubmatch(allChecksums)
 	if len(imageChkSum) < 2 || imageChkSum[1] == "" {
-		return "", fmt.Errorf("No matches for regex %v in:\n%v", shasumRegex, allShaSums)
+		return "", fmt.Errorf("No matches for regex %v in:\n%v", checksumRegex, allChecksums)
 	}
-	return imageChkSum[1], nil
+	return strings.ToLower(imageChkSum[1]), nil
+}
+
+// ChecksumsFileProvider reads checksums from a file listing every image in
+// the same directory, like cdimage's SHA256SUMS. With a keyring, the file
+// must come with a detached signature, like SHA256SUMS.gpg, made by a key in it
+type ChecksumsFileProvider struct {
+	FileName string
+	NewHash  func() hash.Hash
+	Keyring  string
+}
+
+func (c ChecksumsFileProvider) RemoteChecksum(imageUrl string) (string, error) {
+	imageName := utils.GetFileNameFromUrl(imageUrl)
+	checksumsUrl := fmt.Sprintf("%v%v", strings.TrimSuffix(imageUrl, imageName), c.FileName)
+	allChecksums, err := DownloadChecksumFile(checksumsUrl)
+	if err != nil {
+		return "", err
+	}
+	if c.Keyring != "" {
+		signatureUrl := fmt.Sprintf("%v.gpg", checksumsUrl)
+		signature, err := DownloadChecksumFile(signatureUrl)
+		if err != nil {
+			return "", err
+		}
+		err = VerifyChecksumsSignature(checksumsUrl, allChecksums, signature, c.Keyring)
+		if err != nil {
+			return "", err
+		}
+	}
+	return ParseChecksumForImage(allChecksums, imageName, c.NewHash().Size()*2)
+}
+
+func (c ChecksumsFileProvider) LocalChecksum(imagePath string) (string, error) {
+	return HashFile(imagePath, c.NewHash)
+}
+
+func (c ChecksumsFileProvider) Downloaded(imagePath, remoteChecksum string) error {
+	return nil
+}
+
+func (c ChecksumsFileProvider) Hash() hash.Hash {
+	return c.NewHash()
+}
+
+// VerifyChecksumsSignature checks a detached signature of a checksums file
+// against the keys in a keyring with gpgv
+func VerifyChecksumsSignature(checksumsUrl, allChecksums, signature, keyring string) error {
+	keyringPath, err := filepath.Abs(keyring)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	tempDir, err := os.MkdirTemp("", "checksums")
+	if err != nil { // coverage-ignore
+		return err
+	}
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, tempDir)
+
+	checksumsPath := filepath.Join(tempDir, "checksums")
+	signaturePath := filepath.Join(tempDir, "checksums.gpg")
+	if err = os.WriteFile(checksumsPath, []byte(allChecksums), 0644); err != nil { // coverage-ignore
+		return err
+	}
+	if err = os.WriteFile(signaturePath, []byte(signature), 0644); err != nil { // coverage-ignore
+		return err
+	}
+	gpgvCmd := exec.Command("gpgv", "--keyring", keyringPath, signaturePath, checksumsPath)
+	output, err := gpgvCmd.CombinedOutput()
+	if err != nil {
+		return BadChecksumSignatureError{url: checksumsUrl, output: string(output)}
+	}
+	return nil
+}
+
+// SidecarChecksumProvider reads the checksum of an image from a file next to
+// it named after the image, like image.iso.sha256
+type SidecarChecksumProvider struct {
+	Extension string
+	NewHash   func() hash.Hash
+}
+
+func (s SidecarChecksumProvider) RemoteChecksum(imageUrl string) (string, error) {
+	sidecarUrl := fmt.Sprintf("%v%v", imageUrl, s.Extension)
+	sidecar, err := DownloadChecksumFile(sidecarUrl)
+	if err != nil {
+		return "", err
+	}
+	// sidecars either hold just the checksum, or a line of a SHA256SUMS file
+	fields := strings.Fields(sidecar)
+	checksumLength := s.NewHash().Size() * 2
+	if len(fields) == 0 || !regexp.MustCompile(fmt.Sprintf(`^[a-fA-F0-9]{%v}$`, checksumLength)).MatchString(fields[0]) {
+		return "", fmt.Errorf("%v doesn't hold a checksum:\n%v", sidecarUrl, sidecar)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func (s SidecarChecksumProvider) LocalChecksum(imagePath string) (string, error) {
+	return HashFile(imagePath, s.NewHash)
+}
+
+func (s SidecarChecksumProvider) Downloaded(imagePath, remoteChecksum string) error {
+	return nil
+}
+
+func (s SidecarChecksumProvider) Hash() hash.Hash {
+	return s.NewHash()
+}
+
+// HttpValidatorProvider is for mirrors with no checksums, an image is
+// considered unchanged while its ETag, or failing that its Last-Modified
+// header, stays the same as when it was downloaded
+type HttpValidatorProvider struct{}
+
+func (h HttpValidatorProvider) RemoteChecksum(imageUrl string) (string, error) {
+	response, err := http.Head(imageUrl)
+	if err != nil {
+		return "", err
+	}
+	defer utils.DeferredErrCheck(response.Body.Close)
+	if response.StatusCode != 200 {
+		return "", fmt.Errorf("%v returned %v instead of 200", imageUrl, response.StatusCode)
+	}
+	if etag := response.Header.Get("ETag"); etag != "" {
+		return fmt.Sprintf("etag:%v", etag), nil
+	}
+	if lastModified := response.Header.Get("Last-Modified"); lastModified != "" {
+		return fmt.Sprintf("last-modified:%v", lastModified), nil
+	}
+	return "", fmt.Errorf("%v has neither an ETag nor a Last-Modified header", imageUrl)
+}
+
+func (h HttpValidatorProvider) LocalChecksum(imagePath string) (string, error) {
+	validator, err := os.ReadFile(fmt.Sprintf("%v%v", imagePath, HttpValidatorSuffix))
+	if err != nil {
+		return "", err
+	}
+	return string(validator), nil
+}
+
+func (h HttpValidatorProvider) Downloaded(imagePath, remoteChecksum string) error {
+	return os.WriteFile(fmt.Sprintf("%v%v", imagePath, HttpValidatorSuffix), []byte(remoteChecksum), 0644)
 }
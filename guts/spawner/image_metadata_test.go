@@ -1,18 +1,50 @@
 package spawner
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"guts.ubuntu.com/v2/utils"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
-func TestGetRemoteShaSum(t *testing.T) {
+var (
+	localChecksumProvider = ChecksumsFileProvider{FileName: "SHA256SUMS", NewHash: sha256.New}
+	// sha256 and sha512 of "delta-brainwave"
+	deltaBrainwaveSha256 = "efe716a6fedbbc1ace5186dd81b5308435360ce7113bc0dfba539a1c0bc79907"
+	deltaBrainwaveSha512 = "9e73b7c260f3cefc1e693ff430e5344be66264b87566e6d65e4c837c322d35deb67938c43199e761dd5ca52b7edca6f9f2d1c4ad663942a94e3e5238c571323a"
+)
+
+// ServeChecksumFiles serves each of files at its path, images are served
+// with an ETag
+func ServeChecksumFiles(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if filepath.Ext(r.URL.Path) == ".img" {
+			w.Header().Set("ETag", `"delta-brainwave"`)
+		}
+		_, err := w.Write([]byte(contents))
+		utils.CheckError(err)
+	}))
+}
+
+func TestGetRemoteChecksum(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
 
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
 	imageUrl := "http://localhost:9999/questing-mini-iso-amd64.iso"
-	shasum, err := GetRemoteShaSum(imageUrl)
+	shasum, err := GetRemoteChecksum(imageUrl, spawnerCfg)
 	utils.CheckError(err)
 	expectedShasum := "a52d5d22d71375efae79de6cf8a125228ac19356c84f4af17ef5955147be7ef5"
 	if shasum != expectedShasum {
@@ -20,34 +52,107 @@ func TestGetRemoteShaSum(t *testing.T) {
 	}
 }
 
-func TestGetRemoteShaSumFailure(t *testing.T) {
-	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
-	defer utils.DeferredErrCheck(servingProcess.Kill)
-
+func TestGetRemoteChecksumFailure(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
 	imageUrl := "http://planetexpress.com/questing-mini-iso-amd64.iso"
-	_, err := GetRemoteShaSum(imageUrl)
+	_, err := GetRemoteChecksum(imageUrl, spawnerCfg)
 	expectedErrString := fmt.Sprintf("Couldn't acquire shasum of image at %v", imageUrl)
 	if err.Error() != expectedErrString {
 		t.Errorf("unexpected err string!\nexpected: %v\nactual: %v", expectedErrString, err.Error())
 	}
 }
 
-func TestCdImageGetShasumOfImage(t *testing.T) {
-	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
-	defer utils.DeferredErrCheck(servingProcess.Kill)
+func TestGetChecksumProvider(t *testing.T) {
+	providers := map[string]ChecksumProvider{
+		"sha256_sidecar": SidecarChecksumProvider{Extension: ".sha256", NewHash: sha256.New},
+		"etag":           HttpValidatorProvider{},
+	}
+	for name, expectedProvider := range providers {
+		provider, err := GetChecksumProvider(ChecksumProviderConfig{Domain: "mirror.planetexpress.com", Provider: name})
+		utils.CheckError(err)
+		if reflect.TypeOf(provider) != reflect.TypeOf(expectedProvider) {
+			t.Errorf("unexpected provider for %v!\nexpected: %T\nactual: %T", name, expectedProvider, provider)
+		}
+	}
 
-	imageUrl := "http://localhost:9999/questing-mini-iso-amd64.iso"
-	shasum, err := CdImageGetShasumOfImage(imageUrl)
+	_, err := GetChecksumProvider(ChecksumProviderConfig{Domain: "mirror.planetexpress.com", Provider: "md5sums"})
+	expectedErr := UnsupportedChecksumProviderError{provider: "md5sums"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error!\nexpected: %v\nactual: %v", expectedErr, err)
+	}
+
+	_, err = GetChecksumProvider(ChecksumProviderConfig{Domain: "mirror.planetexpress.com", Provider: "signed_sha256sums"})
+	if err == nil {
+		t.Errorf("the signed_sha256sums provider shouldn't be usable without a keyring")
+	}
+}
+
+func TestChecksumProviderForUrl(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.Checksums = []ChecksumProviderConfig{
+		{Domain: "mirror.planetexpress.com", Provider: "etag"},
+		{Domain: "cdimage.ubuntu.com", Provider: "sha512sums"},
+	}
+	provider, err := ChecksumProviderForUrl("https://mirror.planetexpress.com/images/delta.img", spawnerCfg)
 	utils.CheckError(err)
-	expectedShasum := "a52d5d22d71375efae79de6cf8a125228ac19356c84f4af17ef5955147be7ef5"
-	if shasum != expectedShasum {
-		t.Errorf("Parsed shasum not same as expected!\nExpected: %v\nActual: %v", expectedShasum, shasum)
+	if _, ok := provider.(HttpValidatorProvider); !ok {
+		t.Errorf("unexpected provider for mirror.planetexpress.com: %T", provider)
+	}
+	provider, err = ChecksumProviderForUrl("https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso", spawnerCfg)
+	utils.CheckError(err)
+	if provider.(ChecksumsFileProvider).FileName != "SHA512SUMS" {
+		t.Errorf("unexpected provider for cdimage.ubuntu.com: %v", provider)
+	}
+
+	// domains are matched in full, not as a prefix
+	_, err = ChecksumProviderForUrl("https://mirror.planetexpress.com.evil.com/delta.img", spawnerCfg)
+	if err == nil {
+		t.Errorf("mirror.planetexpress.com.evil.com shouldn't match mirror.planetexpress.com")
+	}
+	_, err = ChecksumProviderForUrl("http://localhost:9999/questing-mini-iso-amd64.iso", spawnerCfg)
+	if err == nil {
+		t.Errorf("localhost shouldn't have a provider when the config doesn't list it")
+	}
+
+	// with no providers configured, the defaults are used
+	provider, err = ChecksumProviderForUrl("http://localhost:9999/questing-mini-iso-amd64.iso", GutsSpawnerConfig{})
+	utils.CheckError(err)
+	if provider.(ChecksumsFileProvider).FileName != "SHA256SUMS" {
+		t.Errorf("unexpected default provider for localhost: %v", provider)
+	}
+}
+
+func TestChecksumsFileProvider(t *testing.T) {
+	server := ServeChecksumFiles(map[string]string{
+		"/images/SHA256SUMS": fmt.Sprintf("%v  delta.img\n", deltaBrainwaveSha256),
+		"/images/SHA512SUMS": fmt.Sprintf("%v *delta.img\n", deltaBrainwaveSha512),
+	})
+	defer server.Close()
+
+	imageUrl := fmt.Sprintf("%v/images/delta.img", server.URL)
+	checksum, err := localChecksumProvider.RemoteChecksum(imageUrl)
+	utils.CheckError(err)
+	if checksum != deltaBrainwaveSha256 {
+		t.Errorf("unexpected sha256!\nexpected: %v\nactual: %v", deltaBrainwaveSha256, checksum)
+	}
+
+	provider, err := GetChecksumProvider(ChecksumProviderConfig{Provider: "sha512sums"})
+	utils.CheckError(err)
+	checksum, err = provider.RemoteChecksum(imageUrl)
+	utils.CheckError(err)
+	if checksum != deltaBrainwaveSha512 {
+		t.Errorf("unexpected sha512!\nexpected: %v\nactual: %v", deltaBrainwaveSha512, checksum)
+	}
+
+	_, err = localChecksumProvider.RemoteChecksum(fmt.Sprintf("%v/elsewhere/delta.img", server.URL))
+	if err == nil {
+		t.Errorf("acquiring a checksum with no SHA256SUMS file succeeded where it should have failed")
 	}
 }
 
-func TestCdImageGetShasumOfImageFailure(t *testing.T) {
+func TestChecksumsFileProviderFailure(t *testing.T) {
 	imageUrl := "http://planetexpress.com/questing-mini-iso-amd64.iso"
-	shasum, err := CdImageGetShasumOfImage(imageUrl)
+	shasum, err := localChecksumProvider.RemoteChecksum(imageUrl)
 	if err == nil {
 		t.Errorf("acquiring shasum file from %v succeeded where it should have failed", imageUrl)
 	}
@@ -56,23 +161,110 @@ func TestCdImageGetShasumOfImageFailure(t *testing.T) {
 	}
 }
 
-func TestCdImageDownloadCheckSumFileForImage(t *testing.T) {
-	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
-	defer utils.DeferredErrCheck(servingProcess.Kill)
+func TestSignedChecksumsFileProvider(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil { // coverage-ignore
+		t.Skip("Skipping test as gpg isn't installed")
+	}
+	gnupgHome := t.TempDir()
+	t.Setenv("GNUPGHOME", gnupgHome)
+	gpg := func(args ...string) []byte {
+		out, err := exec.Command("gpg", append([]string{"--batch", "--passphrase", ""}, args...)...).Output()
+		utils.CheckError(err)
+		return out
+	}
+	gpg("--quick-gen-key", "guts-test@planetexpress.com", "ed25519", "sign", "never")
+	keyringPath := filepath.Join(gnupgHome, "keyring.gpg")
+	utils.CheckError(os.WriteFile(keyringPath, gpg("--export"), 0644))
 
-	imageUrl := "http://localhost:9999/questing-mini-iso-amd64.iso"
-	shasums, err := CdImageDownloadCheckSumFileForImage(imageUrl)
+	checksums := fmt.Sprintf("%v *delta.img\n", deltaBrainwaveSha256)
+	checksumsPath := filepath.Join(gnupgHome, "SHA256SUMS")
+	utils.CheckError(os.WriteFile(checksumsPath, []byte(checksums), 0644))
+	signature := gpg("--detach-sign", "--output", "-", checksumsPath)
+
+	server := ServeChecksumFiles(map[string]string{
+		"/signed/SHA256SUMS":       checksums,
+		"/signed/SHA256SUMS.gpg":   string(signature),
+		"/tampered/SHA256SUMS":     fmt.Sprintf("%v *delta.img\n", deltaBrainwaveSha512[:64]),
+		"/tampered/SHA256SUMS.gpg": string(signature),
+		"/unsigned/SHA256SUMS":     checksums,
+	})
+	defer server.Close()
+
+	provider, err := GetChecksumProvider(ChecksumProviderConfig{Provider: "signed_sha256sums", Keyring: keyringPath})
 	utils.CheckError(err)
-	expectedShasumFile := "a52d5d22d71375efae79de6cf8a125228ac19356c84f4af17ef5955147be7ef5 *questing-mini-iso-amd64.iso\n"
-	if expectedShasumFile != shasums {
-		t.Errorf("Parsed shasum file not the same as expected!\nExpected: %v\nActual: %v", expectedShasumFile, shasums)
+	checksum, err := provider.RemoteChecksum(fmt.Sprintf("%v/signed/delta.img", server.URL))
+	utils.CheckError(err)
+	if checksum != deltaBrainwaveSha256 {
+		t.Errorf("unexpected sha256!\nexpected: %v\nactual: %v", deltaBrainwaveSha256, checksum)
+	}
+
+	_, err = provider.RemoteChecksum(fmt.Sprintf("%v/tampered/delta.img", server.URL))
+	if _, ok := err.(BadChecksumSignatureError); !ok {
+		t.Errorf("a tampered SHA256SUMS file should fail verification, got: %v", err)
+	}
+	_, err = provider.RemoteChecksum(fmt.Sprintf("%v/unsigned/delta.img", server.URL))
+	if err == nil {
+		t.Errorf("an unsigned SHA256SUMS file should fail verification")
 	}
 }
 
-func TestCdImageParseShasumForImage(t *testing.T) {
+func TestSidecarChecksumProvider(t *testing.T) {
+	server := ServeChecksumFiles(map[string]string{
+		"/images/delta.img.sha256":     fmt.Sprintf("%v\n", deltaBrainwaveSha256),
+		"/images/listed.img.sha256":    fmt.Sprintf("%v *listed.img\n", deltaBrainwaveSha256),
+		"/images/truncated.img.sha256": deltaBrainwaveSha256[:32],
+	})
+	defer server.Close()
+
+	provider, err := GetChecksumProvider(ChecksumProviderConfig{Provider: "sha256_sidecar"})
+	utils.CheckError(err)
+	for _, image := range []string{"delta.img", "listed.img"} {
+		checksum, err := provider.RemoteChecksum(fmt.Sprintf("%v/images/%v", server.URL, image))
+		utils.CheckError(err)
+		if checksum != deltaBrainwaveSha256 {
+			t.Errorf("unexpected sha256 for %v!\nexpected: %v\nactual: %v", image, deltaBrainwaveSha256, checksum)
+		}
+	}
+	for _, image := range []string{"truncated.img", "missing.img"} {
+		_, err := provider.RemoteChecksum(fmt.Sprintf("%v/images/%v", server.URL, image))
+		if err == nil {
+			t.Errorf("acquiring a checksum from the sidecar of %v succeeded where it should have failed", image)
+		}
+	}
+}
+
+func TestHttpValidatorProvider(t *testing.T) {
+	server := ServeChecksumFiles(map[string]string{"/images/delta.img": "delta-brainwave"})
+	defer server.Close()
+
+	provider := HttpValidatorProvider{}
+	imageUrl := fmt.Sprintf("%v/images/delta.img", server.URL)
+	imagePath := filepath.Join(t.TempDir(), "delta.img")
+	utils.CheckError(os.WriteFile(imagePath, []byte("delta-brainwave"), 0644))
+
+	remoteChecksum, err := provider.RemoteChecksum(imageUrl)
+	utils.CheckError(err)
+	if remoteChecksum != `etag:"delta-brainwave"` {
+		t.Errorf("unexpected validator: %v", remoteChecksum)
+	}
+	if IdenticalLocalAndRemoteChecksum(provider, imageUrl, imagePath) {
+		t.Errorf("an image that wasn't downloaded with its validator recorded shouldn't be identical")
+	}
+	utils.CheckError(provider.Downloaded(imagePath, remoteChecksum))
+	if !IdenticalLocalAndRemoteChecksum(provider, imageUrl, imagePath) {
+		t.Errorf("an image with an unchanged ETag should be identical")
+	}
+
+	_, err = provider.RemoteChecksum(fmt.Sprintf("%v/images/missing.img", server.URL))
+	if err == nil {
+		t.Errorf("acquiring a validator for a missing image succeeded where it should have failed")
+	}
+}
+
+func TestParseChecksumForImage(t *testing.T) {
 	shasumFile := "a4310d26648801af766733bf01845d7d2f4d26a96a02ea45ee532d74068999a0 *questing-desktop-amd64.iso\nf425a4872fdd163f38ec785eaa1bdab1f1bdae202b67247f57ed1aa96a3a20a4 *questing-desktop-arm64.iso\n"
 	desiredImage := "questing-desktop-amd64.iso"
-	parsedShasum, err := CdImageParseShasumForImage(shasumFile, desiredImage)
+	parsedShasum, err := ParseChecksumForImage(shasumFile, desiredImage, 64)
 	utils.CheckError(err)
 	expectedShasum := "a4310d26648801af766733bf01845d7d2f4d26a96a02ea45ee532d74068999a0"
 	if parsedShasum != expectedShasum {
@@ -80,16 +272,23 @@ func TestCdImageParseShasumForImage(t *testing.T) {
 	}
 }
 
-func TestCdImageParseShasumForImageFails(t *testing.T) {
+func TestParseChecksumForImageFails(t *testing.T) {
 	shasumFile := "asdf *questing-desktop-amd64.iso\nasdf *questing-desktop-arm64.iso\n"
 	desiredImage := "questing-desktop-amd64.iso"
-	parsedShasum, err := CdImageParseShasumForImage(shasumFile, desiredImage)
+	parsedShasum, err := ParseChecksumForImage(shasumFile, desiredImage, 64)
 	if err == nil {
 		t.Errorf("Parsing shasum for %v from %v succeeded where it should have failed", desiredImage, shasumFile)
 	}
 	if parsedShasum != "" {
 		t.Errorf("parsed shasum should be empty but is instead: %v", parsedShasum)
 	}
+
+	// an image whose name is the end of another's shouldn't match it
+	shasumFile = "a4310d26648801af766733bf01845d7d2f4d26a96a02ea45ee532d74068999a0 *noble-questing-desktop-amd64.iso\n"
+	_, err = ParseChecksumForImage(shasumFile, desiredImage, 64)
+	if err == nil {
+		t.Errorf("Parsing shasum for %v from %v succeeded where it should have failed", desiredImage, shasumFile)
+	}
 }
 
 func TestGetLocalShaSum(t *testing.T) {
@@ -99,11 +298,10 @@ func TestGetLocalShaSum(t *testing.T) {
 	defer utils.DeferredErrCheckStringArg(os.Remove, f.Name())
 	err = os.WriteFile(f.Name(), []byte(testString), 0644)
 	utils.CheckError(err)
-	expectedShasum := "efe716a6fedbbc1ace5186dd81b5308435360ce7113bc0dfba539a1c0bc79907"
 	actualShasum, err := GetLocalShaSum(f.Name())
 	utils.CheckError(err)
-	if actualShasum != expectedShasum {
-		t.Errorf("expected shasum not the same as actual\nexpected: %v\nactual: %v", expectedShasum, actualShasum)
+	if actualShasum != deltaBrainwaveSha256 {
+		t.Errorf("expected shasum not the same as actual\nexpected: %v\nactual: %v", deltaBrainwaveSha256, actualShasum)
 	}
 }
 
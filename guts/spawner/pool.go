@@ -0,0 +1,258 @@
+package spawner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"guts.ubuntu.com/v2/database"
+	"guts.ubuntu.com/v2/utils"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how long the pool waits before claiming tests again after failing to
+	MinErrorBackoff = 5 * time.Second
+	MaxErrorBackoff = 5 * time.Minute
+)
+
+// VmPool runs up to Capacity VMs at once, each in a slot of its own with its
+// own VNC port, as long as the host has the memory and cores left for them
+type VmPool struct {
+	Capacity  int
+	freePorts chan uint
+	mu        sync.Mutex
+	free      VmResources
+	running   int
+}
+
+// VncPorts lists the VNC ports the spawner may give its VMs, from the
+// vnc_port_range in the config, or the -port arg for a spawner of one VM
+func VncPorts(SpawnerCfg GutsSpawnerConfig) ([]uint, error) {
+	start := SpawnerCfg.Virtualisation.VncPortRangeStart
+	end := SpawnerCfg.Virtualisation.VncPortRangeEnd
+	if start == 0 {
+		if VncPort == 0 {
+			return nil, fmt.Errorf("either the -port arg or vnc_port_range_start in the config must be set")
+		}
+		return []uint{VncPort}, nil
+	}
+	if end == 0 {
+		end = start
+	}
+	if end < start {
+		return nil, fmt.Errorf("vnc_port_range_end %v is below vnc_port_range_start %v", end, start)
+	}
+	var ports []uint
+	for port := start; port <= end; port++ {
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// HostMemoryMb reads the total memory of the host from /proc/meminfo
+func HostMemoryMb() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil { // coverage-ignore
+		return 0, err
+	}
+	defer utils.DeferredErrCheck(f.Close)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			memoryKb, err := strconv.Atoi(fields[1])
+			return memoryKb / 1024, err
+		}
+	}
+	return 0, fmt.Errorf("couldn't find the total memory of the host in /proc/meminfo")
+}
+
+// VmCapacity works out how many VMs fit on a host at once, as limited by
+// the VNC ports, the host's cores and memory against the cores and memory
+// of each VM, and max_vms in the config
+func VmCapacity(SpawnerCfg GutsSpawnerConfig, ports, hostCores, hostMemoryMb int) int {
+	capacity := ports
+	if SpawnerCfg.Virtualisation.Cores > 0 {
+		capacity = min(capacity, hostCores/SpawnerCfg.Virtualisation.Cores)
+	}
+	if SpawnerCfg.Virtualisation.Memory > 0 {
+		capacity = min(capacity, hostMemoryMb/SpawnerCfg.Virtualisation.Memory)
+	}
+	if SpawnerCfg.Virtualisation.MaxVms > 0 {
+		capacity = min(capacity, SpawnerCfg.Virtualisation.MaxVms)
+	}
+	// a host too small for a single VM still runs one, overcommitted, as a
+	// spawner always has
+	return max(capacity, 1)
+}
+
+func NewVmPool(SpawnerCfg GutsSpawnerConfig) (*VmPool, error) {
+	ports, err := VncPorts(SpawnerCfg)
+	if err != nil {
+		return nil, err
+	}
+	hostMemoryMb, err := HostMemoryMb()
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	capacity := VmCapacity(SpawnerCfg, len(ports), runtime.NumCPU(), hostMemoryMb)
+	return NewVmPoolWithPorts(ports[:capacity], VmResources{MemoryMb: hostMemoryMb, Cores: runtime.NumCPU()}), nil
+}
+
+// NewVmPoolWithPorts makes a pool with a slot for each of ports, sharing the
+// memory and cores of host between their VMs
+func NewVmPoolWithPorts(ports []uint, host VmResources) *VmPool {
+	pool := VmPool{Capacity: len(ports), freePorts: make(chan uint, len(ports)), free: host}
+	for _, port := range ports {
+		pool.freePorts <- port
+	}
+	return &pool
+}
+
+// AcquireSlot waits for a slot to be free, returning its VNC port
+func (p *VmPool) AcquireSlot() uint {
+	return <-p.freePorts
+}
+
+// TryAcquireSlot is AcquireSlot without the waiting
+func (p *VmPool) TryAcquireSlot() (uint, bool) {
+	select {
+	case port := <-p.freePorts:
+		return port, true
+	default:
+		return 0, false
+	}
+}
+
+func (p *VmPool) ReleaseSlot(port uint) {
+	p.freePorts <- port
+}
+
+// FreeResources is what the host has left for the next VM. A host running
+// no VMs takes a VM of any size, overcommitted if it's too small for it, as
+// a spawner always has
+func (p *VmPool) FreeResources() VmResources {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running == 0 {
+		return VmResources{MemoryMb: math.MaxInt32, Cores: math.MaxInt32}
+	}
+	return p.free
+}
+
+// Reserve takes the resources of a VM from the host until they're released
+func (p *VmPool) Reserve(resources VmResources) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free.MemoryMb -= resources.MemoryMb
+	p.free.Cores -= resources.Cores
+	p.running++
+}
+
+func (p *VmPool) Release(resources VmResources) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free.MemoryMb += resources.MemoryMb
+	p.free.Cores += resources.Cores
+	p.running--
+}
+
+// ErrorBackoff is how long the pool waits after failures consecutive failures
+// to claim a test, doubling with each of them up to MaxErrorBackoff
+func ErrorBackoff(failures int) time.Duration {
+	delay := MinErrorBackoff
+	for range failures - 1 {
+		if delay >= MaxErrorBackoff {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, MaxErrorBackoff)
+}
+
+// StartTest claims a test the host can run for the slot on port, and runs it
+// in the background, the slot and its share of the host being the test's until
+// it's done. It returns false when there's no such test waiting, or the claim
+// failed, in which case the slot is free again
+func (p *VmPool) StartTest(port uint, spawnerHost string, Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) (bool, error) { // coverage-ignore
+	// each slot claims tests as a worker of its own
+	worker, err := database.WorkerName(fmt.Sprintf("spawner-%v", port))
+	if err != nil {
+		return false, err
+	}
+	id, uuid, err := ClaimRequestedTest(spawnerHost, worker, p.FreeResources(), SpawnerCfg, Driver)
+	if err != nil || uuid == "" {
+		return false, err
+	}
+	// the claim only fits the test in what was free, the VM holds on to
+	// its share of the host until it's gone
+	requirements, err := GetTestRequirements(id, "", Driver)
+	if err != nil {
+		// hand the test back, rather than leave it claimed until the
+		// scheduler finds it stale
+		return false, errors.Join(err, Driver.ReleaseClaimedTest(id, worker))
+	}
+	resources := VmResourcesFor(requirements, SpawnerCfg)
+	p.Reserve(resources)
+	go func() {
+		defer p.ReleaseSlot(port)
+		defer p.Release(resources)
+		err := RunTest(id, uuid, worker, port, Driver, SpawnerCfg)
+		if err != nil {
+			log.Printf("Test %v of %v failed to run on VNC port %v: %v", id, uuid, port, err)
+		}
+	}()
+	return true, nil
+}
+
+// Run claims requested tests the host can run while the pool has free slots
+// and the host has the memory and cores left for their VMs, running each in
+// the background in its own slot. A test failing in one slot doesn't disturb
+// the VMs in the others, and failing to reach the database only holds off
+// claiming more tests for a while, the running VMs carry on
+func (p *VmPool) Run(Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) error { // coverage-ignore
+	capabilities, err := DetectCapabilities(SpawnerCfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Spawning up to %v VMs at once with %+v", p.Capacity, capabilities)
+	err = RegisterSpawner(capabilities, Driver)
+	if err != nil {
+		return err
+	}
+	failures := 0
+	for {
+		port := p.AcquireSlot()
+		started, err := p.StartTest(port, capabilities.Hostname, Driver, SpawnerCfg)
+		if started {
+			failures = 0
+			continue
+		}
+		p.ReleaseSlot(port)
+		if err != nil {
+			failures++
+			delay := ErrorBackoff(failures)
+			log.Printf("Failed to claim a test for VNC port %v, trying again in %v: %v", port, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+		// wait somewhere between 30 and 90 seconds before checking for new jobs
+		pollSleepDuration := time.Second * time.Duration(rand.IntN(60)+30)
+		time.Sleep(pollSleepDuration)
+		// registering again while idle tells that the spawner is still
+		// around, and its updated_at when it was last looking for tests
+		err = RegisterSpawner(capabilities, Driver)
+		if err != nil {
+			log.Printf("Failed to register the spawner again: %v", err)
+		}
+	}
+}
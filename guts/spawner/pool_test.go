@@ -0,0 +1,176 @@
+package spawner
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVncPorts(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	ports, err := VncPorts(spawnerCfg)
+	utils.CheckError(err)
+	expectedPorts := []uint{1, 2, 3, 4}
+	if !reflect.DeepEqual(ports, expectedPorts) {
+		t.Errorf("unexpected vnc ports!\nexpected: %v\nactual: %v", expectedPorts, ports)
+	}
+
+	// without a range, the spawner runs a single VM on the -port arg
+	var singleVmCfg GutsSpawnerConfig
+	_, err = VncPorts(singleVmCfg)
+	if err == nil {
+		t.Errorf("getting vnc ports with neither a range nor -port should have failed")
+	}
+	VncPort = 5
+	defer func() { VncPort = 0 }()
+	ports, err = VncPorts(singleVmCfg)
+	utils.CheckError(err)
+	if !reflect.DeepEqual(ports, []uint{5}) {
+		t.Errorf("unexpected vnc ports!\nexpected: %v\nactual: %v", []uint{5}, ports)
+	}
+
+	spawnerCfg.Virtualisation.VncPortRangeEnd = 0
+	ports, err = VncPorts(spawnerCfg)
+	utils.CheckError(err)
+	if !reflect.DeepEqual(ports, []uint{1}) {
+		t.Errorf("unexpected vnc ports!\nexpected: %v\nactual: %v", []uint{1}, ports)
+	}
+}
+
+func TestVncPortsBackwardsRange(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.Virtualisation.VncPortRangeStart = 10
+	spawnerCfg.Virtualisation.VncPortRangeEnd = 5
+	_, err := VncPorts(spawnerCfg)
+	if err == nil {
+		t.Errorf("a vnc port range that ends before it starts should be rejected")
+	}
+}
+
+func TestVmCapacity(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+
+	testCases := []struct {
+		name         string
+		maxVms       int
+		ports        int
+		hostCores    int
+		hostMemoryMb int
+		expected     int
+	}{
+		{"limited by ports", 0, 4, 64, 65536, 4},
+		{"limited by cores", 0, 4, 24, 65536, 3},
+		{"limited by memory", 0, 4, 64, 10240, 2},
+		{"limited by max_vms", 1, 4, 64, 65536, 1},
+		{"too small for one vm", 0, 4, 4, 2048, 1},
+	}
+	for _, tc := range testCases {
+		spawnerCfg.Virtualisation.MaxVms = tc.maxVms
+		capacity := VmCapacity(spawnerCfg, tc.ports, tc.hostCores, tc.hostMemoryMb)
+		if capacity != tc.expected {
+			t.Errorf("unexpected capacity when %v!\nexpected: %v\nactual: %v", tc.name, tc.expected, capacity)
+		}
+	}
+}
+
+func TestHostMemoryMb(t *testing.T) {
+	memoryMb, err := HostMemoryMb()
+	utils.CheckError(err)
+	if memoryMb <= 0 {
+		t.Errorf("the host should have some memory, but has %v MB", memoryMb)
+	}
+}
+
+func TestVmPoolSlots(t *testing.T) {
+	pool := NewVmPoolWithPorts([]uint{1, 2}, VmResources{MemoryMb: 8192, Cores: 8})
+	first := pool.AcquireSlot()
+	second, ok := pool.TryAcquireSlot()
+	if !ok || first == second {
+		t.Errorf("the pool should have had a second, different slot, got %v and %v", first, second)
+	}
+	if _, ok = pool.TryAcquireSlot(); ok {
+		t.Errorf("a pool of %v slots shouldn't have a third slot", pool.Capacity)
+	}
+	pool.ReleaseSlot(first)
+	port, ok := pool.TryAcquireSlot()
+	if !ok || port != first {
+		t.Errorf("the released slot on port %v should be free again, got %v", first, port)
+	}
+}
+
+func TestVmPoolResources(t *testing.T) {
+	host := VmResources{MemoryMb: 8192, Cores: 8}
+	pool := NewVmPoolWithPorts([]uint{1, 2, 3}, host)
+
+	// an idle host takes a VM of any size
+	free := pool.FreeResources()
+	if free.MemoryMb < 65536 || free.Cores < 64 {
+		t.Errorf("an idle host should take a VM of any size, but only has %+v free", free)
+	}
+
+	big := VmResources{MemoryMb: 6144, Cores: 2}
+	pool.Reserve(big)
+	expected := VmResources{MemoryMb: 2048, Cores: 6}
+	if free = pool.FreeResources(); free != expected {
+		t.Errorf("unexpected free resources!\nexpected: %+v\nactual: %+v", expected, free)
+	}
+
+	small := VmResources{MemoryMb: 2048, Cores: 6}
+	pool.Reserve(small)
+	expected = VmResources{}
+	if free = pool.FreeResources(); free != expected {
+		t.Errorf("unexpected free resources!\nexpected: %+v\nactual: %+v", expected, free)
+	}
+
+	pool.Release(big)
+	expected = big
+	if free = pool.FreeResources(); free != expected {
+		t.Errorf("unexpected free resources!\nexpected: %+v\nactual: %+v", expected, free)
+	}
+}
+
+func TestVmResourcesFor(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+
+	resources := VmResourcesFor(TestRequirements{}, spawnerCfg)
+	expected := VmResources{MemoryMb: spawnerCfg.Virtualisation.Memory, Cores: spawnerCfg.Virtualisation.Cores}
+	if resources != expected {
+		t.Errorf("unexpected resources of a default VM!\nexpected: %+v\nactual: %+v", expected, resources)
+	}
+
+	resources = VmResourcesFor(TestRequirements{memoryMb: 16384, cores: 2}, spawnerCfg)
+	expected = VmResources{MemoryMb: 16384, Cores: 2}
+	if resources != expected {
+		t.Errorf("unexpected resources of a VM with requirements!\nexpected: %+v\nactual: %+v", expected, resources)
+	}
+}
+
+func TestErrorBackoff(t *testing.T) {
+	expectedDelays := map[int]time.Duration{
+		1:    5 * time.Second,
+		2:    10 * time.Second,
+		4:    40 * time.Second,
+		1000: MaxErrorBackoff,
+	}
+	for failures, expectedDelay := range expectedDelays {
+		delay := ErrorBackoff(failures)
+		if delay != expectedDelay {
+			t.Errorf("unexpected delay after %v failures!\nexpected: %v\nactual: %v", failures, expectedDelay, delay)
+		}
+	}
+}
+
+func TestNewVmPool(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	spawnerCfg.Virtualisation.MaxVms = 2
+	pool, err := NewVmPool(spawnerCfg)
+	utils.CheckError(err)
+	if pool.Capacity < 1 || pool.Capacity > 2 {
+		t.Errorf("unexpected pool capacity: %v", pool.Capacity)
+	}
+}
@@ -1,81 +1,104 @@
 package spawner
 
 import (
-	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
+	"hash"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
 )
 
+var (
+	// how many times an interrupted image download is resumed before giving up
+	DownloadAttempts = 3
+	// the disk live images are installed to, when a test doesn't ask for a size
+	DefaultDiskSizeGb = 40
+)
+
+// TestRequirements is what a test needs of its VM, the zero values of
+// memoryMb, cores, displayResolution and gpu fall back to the spawner's
+// defaults
 type TestRequirements struct {
 	tpmRequired       bool
 	liveImage         bool
-	defaultDiskSizeGb int
+	memoryMb          int
+	cores             int
+	diskSizeGb        int // 0 keeps the size of a pre-installed image
+	uefi              bool
+	secureBoot        bool
+	displayResolution string
+	gpu               string
 }
 
-func CreateCacheIfNotExists(SpawnerCfg GutsSpawnerConfig) error {
-	err := utils.FileOrDirExists(SpawnerCfg.General.ImageCachePath)
-	if err != nil {
-		err = os.MkdirAll(SpawnerCfg.General.ImageCachePath, 0755)
-	}
-	return err
+// VmResources is the memory and cores a VM takes of its host
+type VmResources struct {
+	MemoryMb int
+	Cores    int
 }
 
-func FindHighestPrioUuid(Driver database.DbDriver) (string, error) {
-	var uuid string
-	jobQuery := `SELECT tests.uuid FROM tests JOIN jobs ON jobs.uuid=tests.uuid WHERE state='requested' ORDER BY priority DESC LIMIT 1`
-	row, err := Driver.RunQueryRow(jobQuery)
-	if err != nil { // coverage-ignore
-		return uuid, err
+// VmResourcesFor is what the VM of a test with req takes, the memory and
+// cores the test asks for or the spawner's defaults
+func VmResourcesFor(req TestRequirements, SpawnerCfg GutsSpawnerConfig) VmResources {
+	resources := VmResources{MemoryMb: SpawnerCfg.Virtualisation.Memory, Cores: SpawnerCfg.Virtualisation.Cores}
+	if req.memoryMb > 0 {
+		resources.MemoryMb = req.memoryMb
 	}
-	err = row.Scan(
-		&uuid,
-	)
-	if err != nil { // coverage-ignore
-		if err == sql.ErrNoRows {
-			return "", nil
-		} else {
-			return "", err
-		}
+	if req.cores > 0 {
+		resources.Cores = req.cores
 	}
-	return uuid, nil
+	return resources
 }
 
-func FindRowIdForUuidInStateRequested(uuid string, Driver database.DbDriver) (int, error) {
-	var id int
-	idQuery := fmt.Sprintf(`SELECT id FROM tests WHERE uuid='%v' AND state='requested' LIMIT 1`, uuid)
-	row, err := Driver.RunQueryRow(idQuery)
-	if err != nil { // coverage-ignore
-		return id, err
-	}
-	err = row.Scan(
-		&id,
-	)
+func CreateCacheIfNotExists(SpawnerCfg GutsSpawnerConfig) error {
+	err := utils.FileOrDirExists(SpawnerCfg.General.ImageCachePath)
 	if err != nil {
-		return id, err
+		err = os.MkdirAll(SpawnerCfg.General.ImageCachePath, 0755)
 	}
-	return id, nil
+	return err
+}
+
+// requestedTestsForSpawner narrows the requested tests down to the ones the
+// spawner registered as spawnerHost in the spawners table can run. Tests
+// needing a TPM or secure boot need UEFI too, as in GetTestRequirements, and
+// images built for an architecture, named in their url as matched by
+// ImageArchitecturePattern, only run on spawners of that architecture
+func requestedTestsForSpawner(spawnerHost string, columns ...string) *database.Query {
+	return database.Select("tests", columns...).
+		Join("JOIN jobs ON jobs.uuid=tests.uuid").
+		Join("JOIN spawners ON spawners.hostname=?", spawnerHost).
+		Where("tests.state=?", "requested").
+		Where("spawners.kvm").
+		Where("spawners.tpm OR NOT tests.tpm").
+		Where("spawners.uefi OR NOT (tests.uefi OR tests.secure_boot OR tests.tpm)").
+		Where("spawners.secure_boot OR NOT tests.secure_boot").
+		Where("tests.memory<=spawners.max_memory").
+		Where("tests.cores<=spawners.max_cores").
+		Where("NOT ? OR ?",
+			database.Matches("jobs.image_url", "?", ImageArchitecturePattern),
+			database.Matches("jobs.image_url", "('-' || spawners.architecture || '[.+]')"))
 }
 
-func SetVncAddressForId(id int, Driver database.DbDriver) error {
-	addressString := fmt.Sprintf("%v:%v", VncHost, VncPort)
-	updateQuery := fmt.Sprintf(`UPDATE tests SET vnc_address='%v' WHERE id='%v'`, addressString, id)
-	err := Driver.UpdateRow(updateQuery)
+func SetVncAddressForId(id int, vncPort uint, Driver database.DbDriver) error {
+	addressString := fmt.Sprintf("%v:%v", VncHost, vncPort)
+	_, err := Driver.Exec(database.Update("tests").Set("vnc_address", addressString).Where("id=?", id))
 	return err
 }
 
 func GetImageUrl(id int, Driver database.DbDriver) (string, error) {
 	var imageUrl string
-	imageUrlQuery := fmt.Sprintf(`SELECT image_url FROM jobs JOIN tests ON jobs.uuid=tests.uuid WHERE id=%v`, id)
-	row, err := Driver.RunQueryRow(imageUrlQuery)
+	row, err := Driver.GetRow(database.Select("jobs", "image_url").Join("JOIN tests ON jobs.uuid=tests.uuid").Where("id=?", id))
 	if err != nil { // coverage-ignore
 		return "", err
 	}
@@ -87,20 +110,31 @@ func GetImageUrl(id int, Driver database.DbDriver) (string, error) {
 
 func GetTestRequirements(id int, imageUrl string, Driver database.DbDriver) (TestRequirements, error) {
 	var requirements TestRequirements
-	tpmQuery := fmt.Sprintf(`SELECT tpm FROM tests WHERE id=%v`, id)
-	row, err := Driver.RunQueryRow(tpmQuery)
+	row, err := Driver.GetRow(database.Select("tests", "tpm", "memory", "cores", "disk_gb", "uefi", "secure_boot", "display_resolution", "gpu").Where("id=?", id))
 	if err != nil { // coverage-ignore
 		return requirements, err
 	}
 	err = row.Scan(
 		&requirements.tpmRequired,
+		&requirements.memoryMb,
+		&requirements.cores,
+		&requirements.diskSizeGb,
+		&requirements.uefi,
+		&requirements.secureBoot,
+		&requirements.displayResolution,
+		&requirements.gpu,
 	)
 	if err != nil {
 		return requirements, err
 	}
 
 	requirements.liveImage = strings.HasSuffix(imageUrl, ".iso")
-	requirements.defaultDiskSizeGb = 40
+	// secure boot is a feature of UEFI firmware, and the FDE tests that need
+	// a TPM need the firmware to measure the boot into it
+	requirements.uefi = requirements.uefi || requirements.secureBoot || requirements.tpmRequired
+	if requirements.liveImage && requirements.diskSizeGb == 0 {
+		requirements.diskSizeGb = DefaultDiskSizeGb
+	}
 
 	return requirements, nil
 }
@@ -108,92 +142,235 @@ func GetTestRequirements(id int, imageUrl string, Driver database.DbDriver) (Tes
 func DownloadImage(imageUrl string, SpawnerCfg GutsSpawnerConfig) (string, error) {
 	// takes url, downloads image to cache, returns image path
 	// - parse file/image name
+	// - find the checksum provider configured for the image domain
 	// - if image already exists in cache:
-	//    - check image domain - have a list of domains we know about shasum files for
-	//      - check to see if imageUrl is accompanied with a SHA256sums file
-	//      - check shasum of local image and remote image
-	//      - if same, return image path, and continue without downloading
-	// - download image to .new, then move so it's atomic
+	//    - check checksum of local image and remote image
+	//    - if same, return image path, and continue without downloading
+	// - download image to .new, resuming an interrupted download, verify it
+	//   against the remote checksum, then move so it's atomic
+	// - let the checksum provider record what the image was downloaded against
 	// - return image path
 	splitUrl := strings.Split(imageUrl, "/")
 	imageName := splitUrl[len(splitUrl)-1]
 	imagePath := fmt.Sprintf("%v%v", SpawnerCfg.General.ImageCachePath, imageName)
 
-	err := utils.FileOrDirExists(imagePath)
-	if err == nil {
-		if IdenticalLocalAndRemoteShasum(imageUrl, imagePath) {
-			return imagePath, nil
+	provider, err := ChecksumProviderForUrl(imageUrl, SpawnerCfg)
+	if err != nil {
+		// with no way to tell whether a cached image is up to date, it's
+		// downloaded every time
+		err = AtomicDownloadImageToPath(imageUrl, imagePath, nil, "")
+		if err != nil {
+			return "", err
 		}
+		return imagePath, nil
 	}
 
-	err = AtomicDownloadImageToPath(imageUrl, imagePath)
-	if err != nil { // coverage-ignore
+	remoteChecksum, err := provider.RemoteChecksum(imageUrl)
+	if err != nil {
 		return "", err
 	}
+	localChecksum, err := provider.LocalChecksum(imagePath)
+	if err == nil && localChecksum == remoteChecksum {
+		return imagePath, nil
+	}
 
+	var newHash func() hash.Hash
+	if hashingProvider, ok := provider.(HashingChecksumProvider); ok {
+		newHash = hashingProvider.Hash
+	}
+	err = AtomicDownloadImageToPath(imageUrl, imagePath, newHash, remoteChecksum)
+	if err != nil {
+		return "", err
+	}
+	err = provider.Downloaded(imagePath, remoteChecksum)
+	if err != nil { // coverage-ignore
+		log.Printf("Couldn't record checksum of %v, it'll be downloaded again next time: %v", imageUrl, err)
+	}
 	return imagePath, nil
 }
 
-func IdenticalLocalAndRemoteShasum(imageUrl, imagePath string) bool {
-	remoteShasum, err := GetRemoteShaSum(imageUrl)
+func IdenticalLocalAndRemoteChecksum(provider ChecksumProvider, imageUrl, imagePath string) bool {
+	remoteChecksum, err := provider.RemoteChecksum(imageUrl)
 	if err != nil {
 		return false
 	}
-	localShasum, err := GetLocalShaSum(imagePath)
+	localChecksum, err := provider.LocalChecksum(imagePath)
 	if err != nil {
 		return false
 	}
-	if localShasum == remoteShasum {
-		return true
-	}
-	return false
+	return localChecksum == remoteChecksum
 }
 
-func AtomicDownloadImageToPath(imageUrl, imagePath string) error {
+// AtomicDownloadImageToPath streams an image to a .new file next to
+// imagePath, then moves it into place. An interrupted download is resumed
+// with a Range request, both when the connection drops and when a .new file
+// was left behind by an earlier spawner. With newHash, the image is hashed as
+// it's written, and rejected unless it matches expectedChecksum
+func AtomicDownloadImageToPath(imageUrl, imagePath string, newHash func() hash.Hash, expectedChecksum string) error {
 	newFile := fmt.Sprintf("%v.new", imagePath)
-	resp, err := http.Get(imageUrl)
+	err := os.MkdirAll(filepath.Dir(imagePath), 0755)
 	if err != nil { // coverage-ignore
 		return err
 	}
-	defer utils.DeferredErrCheck(resp.Body.Close)
-	b, err := io.ReadAll(resp.Body)
-	if err != nil { // coverage-ignore
+
+	var imageHash hash.Hash
+	if newHash != nil {
+		imageHash = newHash()
+	}
+	for attempt := 1; attempt <= DownloadAttempts; attempt++ {
+		err = ResumeDownload(imageUrl, newFile, imageHash)
+		if err == nil {
+			break
+		}
+		log.Printf("Download of %v interrupted on attempt %v of %v: %v", imageUrl, attempt, DownloadAttempts, err)
+	}
+	if err != nil {
 		return err
 	}
-	err = resp.Body.Close()
+
+	if imageHash != nil {
+		checksum := hex.EncodeToString(imageHash.Sum(nil))
+		if checksum != expectedChecksum {
+			mismatch := ChecksumMismatchError{url: imageUrl, expected: expectedChecksum, actual: checksum}
+			// a corrupted download can't be resumed, so start afresh next time
+			if err = os.Remove(newFile); err != nil { // coverage-ignore
+				return errors.Join(mismatch, err)
+			}
+			return mismatch
+		}
+	}
+	return os.Rename(newFile, imagePath)
+}
+
+// ResumeDownload downloads the rest of imageUrl onto the end of partialPath,
+// leaving imageHash with the hash of all of partialPath
+func ResumeDownload(imageUrl, partialPath string, imageHash hash.Hash) error {
+	f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil { // coverage-ignore
 		return err
 	}
+	defer utils.DeferredErrCheck(f.Close)
 
-	splitPath := strings.Split(imagePath, "/")
-	fileName := splitPath[len(splitPath)-1]
-	directoryNoFn := strings.Replace(imagePath, fileName, "", -1)
-	err = os.MkdirAll(directoryNoFn, 0755)
+	info, err := f.Stat()
 	if err != nil { // coverage-ignore
 		return err
 	}
+	offset := info.Size()
+	if imageHash != nil {
+		imageHash.Reset()
+		if _, err = io.Copy(imageHash, f); err != nil { // coverage-ignore
+			return err
+		}
+	}
 
-	err = os.WriteFile(newFile, b, 0644)
+	req, err := http.NewRequest(http.MethodGet, imageUrl, nil)
 	if err != nil { // coverage-ignore
 		return err
 	}
-	err = os.Rename(newFile, imagePath)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(resp.Body.Close)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, so the image starts over
+		offset = 0
+		if err = f.Truncate(0); err != nil { // coverage-ignore
+			return err
+		}
+		if imageHash != nil {
+			imageHash.Reset()
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the image changed since the partial download, so it starts over
+		if err = f.Truncate(0); err != nil { // coverage-ignore
+			return err
+		}
+		return fmt.Errorf("%v is shorter than the %v bytes already downloaded", imageUrl, offset)
+	default:
+		return fmt.Errorf("%v returned %v instead of 200", imageUrl, resp.StatusCode)
+	}
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil { // coverage-ignore
+		return err
+	}
+	var writer io.Writer = f
+	if imageHash != nil {
+		writer = io.MultiWriter(f, imageHash)
+	}
+	_, err = io.Copy(writer, resp.Body)
 	return err
 }
 
-func GetQemuCmdLine(imagePath, DiskPath string, req TestRequirements, SpawnerCfg GutsSpawnerConfig) []string {
+// GetQemuCmdLine builds the qemu command line of a test's VM. testbedDir holds
+// the test's NVRAM vars and swtpm socket, when it needs them
+func GetQemuCmdLine(imagePath, DiskPath, testbedDir string, vncPort uint, req TestRequirements, SpawnerCfg GutsSpawnerConfig) []string {
 	executable := "qemu-system-x86_64"
-	defaultFlags := fmt.Sprintf("-m %v -smp %v -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :%v,share=ignore", SpawnerCfg.Virtualisation.Memory, SpawnerCfg.Virtualisation.Cores, VncPort)
+	resources := VmResourcesFor(req, SpawnerCfg)
+	defaultFlags := fmt.Sprintf("-m %v -smp %v -enable-kvm %v -usbdevice tablet %v -vnc :%v,share=ignore", resources.MemoryMb, resources.Cores, GetQemuMachineArgs(req, testbedDir, SpawnerCfg), GetQemuDisplayArgs(req), vncPort)
+	if req.tpmRequired {
+		defaultFlags = fmt.Sprintf("%v %v", defaultFlags, GetQemuTpmArgs(testbedDir))
+	}
 	var imageArgs string
 	if req.liveImage {
 		imageArgs = fmt.Sprintf("-boot once=d -cdrom %v -hda %v", imagePath, DiskPath)
 	} else {
-		imageArgs = fmt.Sprintf("-drive format=raw,file=%v", imagePath)
+		// boot from an overlay on the cached image, so the test's writes
+		// never reach the image itself
+		imageArgs = fmt.Sprintf("-drive format=qcow2,file=%v", DiskPath)
 	}
 	cmdLineStr := fmt.Sprintf("%v %v %v", executable, defaultFlags, imageArgs)
 	return strings.Split(cmdLineStr, " ")
 }
 
+// GetQemuMachineArgs picks the machine type and firmware. UEFI VMs boot OVMF
+// from read-only flash, with the test's own copy of the NVRAM vars in a
+// second flash. Secure boot additionally needs SMM, so the vars can only be
+// written by the firmware and not from the guest
+func GetQemuMachineArgs(req TestRequirements, testbedDir string, SpawnerCfg GutsSpawnerConfig) string {
+	if !req.uefi {
+		return "-machine pc,accel=kvm"
+	}
+	machine := "q35,accel=kvm"
+	if req.secureBoot {
+		machine = fmt.Sprintf("%v,smm=on -global driver=cfi.pflash01,property=secure,value=on -global ICH9-LPC.disable_s3=1", machine)
+	}
+	firmware, _ := UefiFirmwarePaths(req, SpawnerCfg)
+	return fmt.Sprintf("-machine %v -drive if=pflash,format=raw,unit=0,file=%v,readonly=on -drive if=pflash,format=raw,unit=1,file=%v", machine, firmware, UefiVarsPath(testbedDir))
+}
+
+// GetQemuTpmArgs connects the VM to the test's swtpm as a TPM 2.0 device
+func GetQemuTpmArgs(testbedDir string) string {
+	return fmt.Sprintf("-chardev socket,id=chrtpm,path=%v -tpmdev emulator,id=tpm0,chardev=chrtpm -device tpm-tis,tpmdev=tpm0", SwtpmSocketPath(testbedDir))
+}
+
+// GetQemuDisplayArgs picks the virtio-gpu variant and the resolution of its
+// display, the -gl variants render on the host's GPU without a window
+func GetQemuDisplayArgs(req TestRequirements) string {
+	if req.gpu == "" && req.displayResolution == "" {
+		return "-vga virtio"
+	}
+	device := req.gpu
+	if device == "" {
+		device = "virtio-vga"
+	}
+	if req.displayResolution != "" {
+		xres, yres, _ := strings.Cut(req.displayResolution, "x")
+		device = fmt.Sprintf("%v,xres=%v,yres=%v", device, xres, yres)
+	}
+	displayArgs := fmt.Sprintf("-vga none -device %v", device)
+	if strings.HasSuffix(req.gpu, "-gl") {
+		displayArgs = fmt.Sprintf("%v -display egl-headless", displayArgs)
+	}
+	return displayArgs
+}
+
 func CreateQcowDisk(requirements TestRequirements, Uuid string, SpawnerCfg GutsSpawnerConfig) (string, string, error) {
 	secondaryUuid := uuid.New().String()
 	diskName := fmt.Sprintf("%v-%v.qcow2", Uuid, secondaryUuid)
@@ -204,8 +381,40 @@ func CreateQcowDisk(requirements TestRequirements, Uuid string, SpawnerCfg GutsS
 		"-f",
 		"qcow2",
 		DiskPath,
-		fmt.Sprintf("%vG", requirements.defaultDiskSizeGb),
+		fmt.Sprintf("%vG", requirements.diskSizeGb),
+	)
+	if err := qcowCreateCmd.Run(); err != nil { // coverage-ignore
+		return "", "", err
+	}
+	return DiskPath, diskName, nil
+}
+
+// CreateQcowOverlay creates a copy-on-write qcow2 disk backed by a cached
+// pre-installed image, for a test to boot from without modifying the image.
+// The overlay is grown to the disk size the test asks for, if any
+func CreateQcowOverlay(imagePath string, requirements TestRequirements, Uuid string, SpawnerCfg GutsSpawnerConfig) (string, string, error) {
+	secondaryUuid := uuid.New().String()
+	diskName := fmt.Sprintf("%v-%v.qcow2", Uuid, secondaryUuid)
+	DiskPath := fmt.Sprintf("%v/%v", SpawnerCfg.General.ImageCachePath, diskName)
+	// qemu resolves relative backing files against the overlay, not the cwd
+	backingPath, err := filepath.Abs(imagePath)
+	if err != nil { // coverage-ignore
+		return "", "", err
+	}
+	qcowCreateCmd := exec.Command(
+		"qemu-img",
+		"create",
+		"-f",
+		"qcow2",
+		"-b",
+		backingPath,
+		"-F",
+		"raw",
+		DiskPath,
 	)
+	if requirements.diskSizeGb > 0 {
+		qcowCreateCmd.Args = append(qcowCreateCmd.Args, fmt.Sprintf("%vG", requirements.diskSizeGb))
+	}
 	if err := qcowCreateCmd.Run(); err != nil { // coverage-ignore
 		return "", "", err
 	}
@@ -219,55 +428,62 @@ func SpawnVm(cmdLine []string) (*exec.Cmd, error) { // coverage-ignore
 	return qemuVmCreateCmd, err
 }
 
+// StopVm kills a VM if it's still running, and waits for it to be gone.
+// vmExited is its WaitInBackground
+func StopVm(vmProcess *exec.Cmd, vmExited <-chan struct{}) error {
+	err := vmProcess.Process.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	<-vmExited
+	return nil
+}
+
 func GetTestState(id int, Driver database.DbDriver) (string, error) {
-	var state string
-	stateQuery := fmt.Sprintf(`SELECT state FROM tests WHERE id=%v`, id)
-	row, err := Driver.RunQueryRow(stateQuery)
-	if err != nil { // coverage-ignore
-		return "", err
+	return Driver.GetTestState(id)
+}
+
+// ClaimRequestedTest claims the requested test with the highest priority that
+// the spawner can run for worker, and whose VM, sized as in VmResourcesFor,
+// fits in the free resources of the host, marking it as spawning. The uuid is
+// empty if there are no such tests waiting
+func ClaimRequestedTest(spawnerHost, worker string, free VmResources, SpawnerCfg GutsSpawnerConfig, Driver database.DbDriver) (int, string, error) {
+	candidate := requestedTestsForSpawner(spawnerHost, "tests.id").
+		Where("(CASE WHEN tests.memory>0 THEN tests.memory ELSE ? END)<=?", SpawnerCfg.Virtualisation.Memory, free.MemoryMb).
+		Where("(CASE WHEN tests.cores>0 THEN tests.cores ELSE ? END)<=?", SpawnerCfg.Virtualisation.Cores, free.Cores).
+		OrderBy("priority DESC").
+		Limit(1)
+	id, uuid, err := Driver.ClaimTest(candidate, "spawning", worker)
+	if err != nil || uuid == "" {
+		return 0, "", err
 	}
-	err = row.Scan(
-		&state,
-	)
+	// Update the heartbeat timestamp
+	err = Driver.HeartbeatClaimedTest(id, worker)
 	if err != nil { // coverage-ignore
-		return "", err
+		return 0, "", err
 	}
-	return state, nil
+	return id, uuid, nil
 }
 
-func SpawnerLoop(Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) error { // coverage-ignore
-	// Find the requested job with the highest priority
-	uuid, err := FindHighestPrioUuid(Driver)
-	// Perform a standard error check
-	if err != nil {
-		return err
-	}
-	// if the uuid is empty, there are no tests waiting
-	if uuid == "" {
-		return nil
-	}
-	// Get the id of the individual test
-	id, err := FindRowIdForUuidInStateRequested(uuid, Driver)
-	if err != nil {
-		return err
-	}
-	// Set the test state to spawning to indicate we are spawning the VM
-	err = Driver.SetTestStateTo(id, "spawning")
+// RunTest spawns the VM for a claimed test on vncPort, and waits for the test
+// to finish or the VM to die
+func RunTest(id int, uuid, worker string, vncPort uint, Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) (err error) { // coverage-ignore
+	// Set the vncaddress field to state where the test is running
+	err = SetVncAddressForId(id, vncPort, Driver)
 	if err != nil {
 		return err
 	}
-	// Update the heartbeat timestamp
-	err = database.UpdateUpdatedAt(id, Driver)
+	// Record the start of this attempt at the test, and where it's happening
+	spawnerHost, err := os.Hostname()
 	if err != nil {
 		return err
 	}
-	// Set the vncaddress field to state where the test is running
-	err = SetVncAddressForId(id, Driver)
+	err = database.StartTestAttempt(id, spawnerHost, Driver)
 	if err != nil {
 		return err
 	}
 	// Update the heartbeat timestamp
-	err = database.UpdateUpdatedAt(id, Driver)
+	err = Driver.HeartbeatClaimedTest(id, worker)
 	if err != nil {
 		return err
 	}
@@ -281,48 +497,105 @@ func SpawnerLoop(Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) error {
 	if err != nil {
 		return err
 	}
-	// Download the image to a local path
-	imagePath, err := DownloadImage(imageUrl, SpawnerCfg)
+	// fail tests needing a TPM on a host without swtpm, rather than let them
+	// pass without one
+	if requirements.tpmRequired {
+		if tpmErr := SwtpmAvailable(); tpmErr != nil {
+			err = database.FinishTestAttempt(id, "no_tpm", nil, Driver)
+			if err != nil {
+				return err
+			}
+			err = Driver.SetClaimedTestStateTo(id, "fail", worker)
+			if err != nil {
+				return err
+			}
+			return tpmErr
+		}
+	}
+	// Download the image to a local path, or use the cached one, keeping it
+	// from being evicted while the VM runs
+	imagePath, imageLock, err := AcquireImage(imageUrl, SpawnerCfg)
 	if err != nil {
 		return err
 	}
-	// the diskpath and image path are the same if an image is pre-installed
-	// otherwise they differ
-	DiskPath := imagePath
+	defer utils.DeferredErrCheck(imageLock.Unlock)
+	var DiskPath string
 	if requirements.liveImage {
 		// Create the qcow2 disk for qemu to use as storage for the test VM
 		DiskPath, _, err = CreateQcowDisk(requirements, uuid, SpawnerCfg)
+	} else {
+		// Create the qcow2 overlay of the pre-installed image for the test
+		// VM to boot from, keeping the cached image pristine
+		DiskPath, _, err = CreateQcowOverlay(imagePath, requirements, uuid, SpawnerCfg)
+	}
+	if err != nil {
+		return err
+	}
+	// lock the disk so it isn't cleaned up as an orphan while it's in use
+	diskLock, err := LockFile(DiskPath, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(diskLock.Unlock)
+	// keep the NVRAM vars and TPM state of the test apart from other tests
+	testbedDir, err := os.MkdirTemp("", fmt.Sprintf("guts-testbed-%v-", uuid))
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheckStringArg(os.RemoveAll, testbedDir)
+	if requirements.uefi {
+		err = CopyUefiVars(requirements, testbedDir, SpawnerCfg)
+		if err != nil {
+			return err
+		}
+	}
+	if requirements.tpmRequired {
+		swtpm, err := StartSwtpm(testbedDir)
 		if err != nil {
 			return err
 		}
+		defer utils.DeferredErrCheck(swtpm.Stop)
 	}
 
 	// Get the appropriate qemu command line given the test requirements
-	qemuCmdLine := GetQemuCmdLine(imagePath, DiskPath, requirements, SpawnerCfg)
+	qemuCmdLine := GetQemuCmdLine(imagePath, DiskPath, testbedDir, vncPort, requirements, SpawnerCfg)
 
 	// spawn the qemu VM
 	vmProcess, err := SpawnVm(qemuCmdLine)
 	if err != nil {
 		return err
 	}
+	// wait on the qemu process in the background so we notice if it dies
+	vmExited := utils.WaitInBackground(vmProcess)
+	// however the test ends, the VM doesn't outlive it, and its disk, or the
+	// overlay of a pre-installed image, is removed once it's gone
+	defer func() {
+		if stopErr := StopVm(vmProcess, vmExited); stopErr != nil {
+			err = errors.Join(err, stopErr)
+			return
+		}
+		err = errors.Join(err, os.Remove(DiskPath))
+	}()
 	// set state to spawned
-	err = Driver.SetTestStateTo(id, "spawned")
+	err = Driver.SetClaimedTestStateTo(id, "spawned", worker)
 	if err != nil {
 		return err
 	}
 	// update the heartbeat ts
-	err = database.UpdateUpdatedAt(id, Driver)
+	err = Driver.HeartbeatClaimedTest(id, worker)
 	if err != nil {
 		return err
 	}
 	// declare the states the spawner considers finished
-	finishStates := []string{"pass", "fail", "requested"}
+	finishStates := []string{"pass", "fail", "requested", "cancelled"}
 	finished := false
+	finalState := ""
+	var claimLostErr error
 
 	// define how often we check the test state
 	heartbeatDuration := time.Second * 5
 	// wait for either the qemu process to die or the test to finish
-	for !vmProcess.ProcessState.Exited() || finished {
+	for !utils.ProcessHasExited(vmExited) {
 		// get the test state
 		state, err := GetTestState(id, Driver)
 		if err != nil {
@@ -331,12 +604,21 @@ func SpawnerLoop(Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) error {
 		// see if it's in a "finished" state
 		if slices.Contains(finishStates, state) {
 			finished = true
+			finalState = state
+			break
 		}
 		// Only update the heartbeat timestamp
 		// when the runner is not already running the test
 		if state != "running" {
-			// update the heartbeat ts
-			err = database.UpdateUpdatedAt(id, Driver)
+			// update the heartbeat ts, and tear the VM down once the
+			// scheduler has released the claim on the test, as it's
+			// being spawned somewhere else by now
+			err = Driver.HeartbeatClaimedTest(id, worker)
+			if errors.As(err, &database.ClaimLostError{}) {
+				claimLostErr = err
+				finished = true
+				break
+			}
 			if err != nil {
 				return err
 			}
@@ -344,17 +626,48 @@ func SpawnerLoop(Driver database.DbDriver, SpawnerCfg GutsSpawnerConfig) error {
 		// wait
 		time.Sleep(heartbeatDuration)
 	}
-	if !finished {
-		// we reach this if the VM dies unexpectedly, set the state back to requested
-		err = Driver.SetTestStateTo(id, "requested")
-		return err
-	}
-	// kill the VM
-	err = vmProcess.Process.Kill()
-	if err != nil {
-		return err
+	if finished {
+		// kill the VM
+		err = StopVm(vmProcess, vmExited)
+		if err != nil {
+			return err
+		}
+		// the runner finishes the attempts it runs, but a test can be
+		// cancelled before the runner ever picks it up
+		if finalState == "cancelled" {
+			err = database.FinishTestAttempt(id, "cancelled", nil, Driver)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		// we reach this if the VM dies unexpectedly, set the state back to
+		// requested, unless the test was cancelled in the meantime
+		state, err := GetTestState(id, Driver)
+		if err != nil {
+			return err
+		}
+		if state == "cancelled" {
+			err = database.FinishTestAttempt(id, "cancelled", nil, Driver)
+			if err != nil {
+				return err
+			}
+		} else {
+			// once a runner has claimed the test, the VM dying is its to
+			// record as the test's outcome
+			err = Driver.SetClaimedTestStateTo(id, "requested", worker)
+			var claimLost database.ClaimLostError
+			if errors.As(err, &claimLost) {
+				log.Printf("VM of test %v of %v died: %v", id, uuid, err)
+			} else if err != nil {
+				return err
+			} else {
+				err = database.FinishTestAttempt(id, "vm_died", nil, Driver)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
-	// remove the disk
-	err = os.Remove(DiskPath)
-	return err
+	return claimLostErr
 }
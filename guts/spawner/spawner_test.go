@@ -1,60 +1,136 @@
 package spawner
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"guts.ubuntu.com/v2/database"
 	"guts.ubuntu.com/v2/utils"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
-func TestFindHighestPrioUuid(t *testing.T) {
+// the resources of an idle host with plenty of memory and cores
+var hostResources = VmResources{MemoryMb: 65536, Cores: 64}
+
+func TestClaimRequestedTest(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
 		utils.CheckError(err)
 	}
-	actualUuid, err := FindHighestPrioUuid(Driver)
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	id, actualUuid, err := ClaimRequestedTest("guts-spawner-test", "guts-spawner-test:spawner-1", hostResources, spawnerCfg, Driver)
 	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=$1`, id))
+	}()
 	expectedUuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
 	if actualUuid != expectedUuid {
 		t.Errorf("Unexpected uuid! Expected: %v\nActual: %v", expectedUuid, actualUuid)
 	}
+	state, err := GetTestState(id, Driver)
+	utils.CheckError(err)
+	if state != "spawning" {
+		t.Errorf("Unexpected state of claimed test! Expected: spawning\nActual: %v", state)
+	}
 }
 
-func TestFindRowIdForUuidInStateRequested(t *testing.T) {
+func TestClaimRequestedTestIncapableSpawner(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
 		utils.CheckError(err)
 	}
-	searchUuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
-	rowId, err := FindRowIdForUuidInStateRequested(searchUuid, Driver)
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
 	utils.CheckError(err)
-	expectedRowId := 3
-	if rowId != expectedRowId {
-		t.Errorf("Unexpected row id! Expected: %v\nActual: %v", expectedRowId, rowId)
+	// neither a host without kvm nor one that never registered can run tests
+	for _, spawnerHost := range []string{"guts-spawner-no-kvm", "guts-spawner-unregistered"} {
+		id, actualUuid, err := ClaimRequestedTest(spawnerHost, fmt.Sprintf("%v:spawner-1", spawnerHost), hostResources, spawnerCfg, Driver)
+		utils.CheckError(err)
+		if actualUuid != "" {
+			t.Errorf("%v shouldn't have claimed a test, but claimed %v of %v", spawnerHost, id, actualUuid)
+		}
 	}
 }
 
-func TestFindRowIdForUuidInStateRequestedFailure(t *testing.T) {
+func TestClaimRequestedTestResources(t *testing.T) {
 	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
 	if database.SkipTestIfPostgresInactive(err) {
 		t.Skip("Skipping test as postgresql service is not up")
 	} else {
 		utils.CheckError(err)
 	}
-	searchUuid := "3017c20c-8d0b-42fc-986b-c558683e72fa"
-	rowId, err := FindRowIdForUuidInStateRequested(searchUuid, Driver)
-	if err == nil {
-		t.Errorf("Finding row id for uuid %v should have failed but didn't", searchUuid)
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+
+	// the VMs of the spawner's default size don't fit in what's left
+	free := VmResources{MemoryMb: spawnerCfg.Virtualisation.Memory - 1, Cores: spawnerCfg.Virtualisation.Cores}
+	id, actualUuid, err := ClaimRequestedTest("guts-spawner-test", "guts-spawner-test:spawner-1", free, spawnerCfg, Driver)
+	utils.CheckError(err)
+	if actualUuid != "" {
+		t.Errorf("A test needing %v MB shouldn't have been claimed with %v MB free, but claimed %v of %v", spawnerCfg.Virtualisation.Memory, free.MemoryMb, id, actualUuid)
+	}
+
+	// but the tests asking for a smaller VM do
+	smallUuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	err = Driver.UpdateRow(`UPDATE tests SET memory=$1 WHERE uuid=$2`, free.MemoryMb, smallUuid)
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET memory=0 WHERE uuid=$1`, smallUuid))
+	}()
+	id, actualUuid, err = ClaimRequestedTest("guts-spawner-test", "guts-spawner-test:spawner-1", free, spawnerCfg, Driver)
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=$1`, id))
+	}()
+	if actualUuid != smallUuid {
+		t.Errorf("Unexpected uuid! Expected: %v\nActual: %v", smallUuid, actualUuid)
+	}
+
+	// and no test needs more cores than are free
+	_, actualUuid, err = ClaimRequestedTest("guts-spawner-test", "guts-spawner-test:spawner-2", VmResources{MemoryMb: free.MemoryMb}, spawnerCfg, Driver)
+	utils.CheckError(err)
+	if actualUuid != "" {
+		t.Errorf("No test should have been claimed without free cores, but claimed one of %v", actualUuid)
+	}
+}
+
+func TestClaimRequestedTestTpm(t *testing.T) {
+	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
+	if database.SkipTestIfPostgresInactive(err) {
+		t.Skip("Skipping test as postgresql service is not up")
+	} else {
+		utils.CheckError(err)
 	}
-	expectedRowId := 0
-	if rowId != expectedRowId {
-		t.Errorf("Unexpected row id! Expected: %v\nActual: %v", expectedRowId, rowId)
+	tpmUuid := "4ce9189f-561a-4886-aeef-1836f28b073b"
+	err = Driver.UpdateRow(`UPDATE tests SET tpm=true WHERE uuid=$1`, tpmUuid)
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET tpm=false WHERE uuid=$1`, tpmUuid))
+	}()
+
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	// guts-spawner-test has no swtpm, so it skips the TPM tests of the job
+	// with the highest priority
+	id, actualUuid, err := ClaimRequestedTest("guts-spawner-test", "guts-spawner-test:spawner-1", hostResources, spawnerCfg, Driver)
+	utils.CheckError(err)
+	defer func() {
+		utils.CheckError(Driver.UpdateRow(`UPDATE tests SET state='requested', claimed_by='' WHERE id=$1`, id))
+	}()
+	if actualUuid == tpmUuid {
+		t.Errorf("A spawner without a TPM shouldn't claim the TPM tests of %v", tpmUuid)
 	}
 }
 
@@ -78,7 +154,7 @@ func TestSetVncAddressForId(t *testing.T) {
 		utils.CheckError(err)
 	}
 	rowId := 22
-	err = SetVncAddressForId(rowId, Driver)
+	err = SetVncAddressForId(rowId, 5901, Driver)
 	utils.CheckError(err)
 }
 
@@ -109,7 +185,7 @@ func TestGetTestRequirements(t *testing.T) {
 	rowId := 1
 	expectedRequirements.tpmRequired = false
 	expectedRequirements.liveImage = true
-	expectedRequirements.defaultDiskSizeGb = 40
+	expectedRequirements.diskSizeGb = 40
 
 	imageUrl := "https://cdimage.ubuntu.com/daily-live/current/questing-desktop-amd64.iso"
 	actualRequirements, err := GetTestRequirements(rowId, imageUrl, Driver)
@@ -173,29 +249,141 @@ func TestDownloadImageAlreadyExists(t *testing.T) {
 	utils.CheckError(err)
 }
 
-func TestIdenticalLocalAndRemoteShasum(t *testing.T) {
+// ServeFlakyImage serves an image with Range support, cutting the first
+// download off halfway through
+func ServeFlakyImage(image []byte) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "SHA256SUMS") {
+			_, err := fmt.Fprintf(w, "%v *delta.img\n", deltaBrainwaveSha256)
+			utils.CheckError(err)
+			return
+		}
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(image)))
+			_, err := w.Write(image[:len(image)/2])
+			utils.CheckError(err)
+			return
+		}
+		http.ServeContent(w, r, "delta.img", time.Time{}, bytes.NewReader(image))
+	}))
+	return server, &requests
+}
+
+func TestAtomicDownloadImageToPathResumes(t *testing.T) {
+	image := []byte("delta-brainwave")
+	server, requests := ServeFlakyImage(image)
+	defer server.Close()
+
+	imagePath := filepath.Join(t.TempDir(), "images", "delta.img")
+	err := AtomicDownloadImageToPath(fmt.Sprintf("%v/delta.img", server.URL), imagePath, sha256.New, deltaBrainwaveSha256)
+	utils.CheckError(err)
+	downloaded, err := os.ReadFile(imagePath)
+	utils.CheckError(err)
+	if !bytes.Equal(downloaded, image) {
+		t.Errorf("unexpected image!\nexpected: %v\nactual: %v", string(image), string(downloaded))
+	}
+	if *requests != 2 {
+		t.Errorf("the interrupted download should have been resumed once, but took %v requests", *requests)
+	}
+}
+
+func TestAtomicDownloadImageToPathResumesPartialFile(t *testing.T) {
+	image := []byte("delta-brainwave")
+	server, requests := ServeFlakyImage(image)
+	defer server.Close()
+	// skip the flaky first request, as if it was made by an earlier spawner
+	*requests = 1
+
+	imagePath := filepath.Join(t.TempDir(), "delta.img")
+	utils.CheckError(os.WriteFile(fmt.Sprintf("%v.new", imagePath), image[:5], 0644))
+	err := AtomicDownloadImageToPath(fmt.Sprintf("%v/delta.img", server.URL), imagePath, sha256.New, deltaBrainwaveSha256)
+	utils.CheckError(err)
+	downloaded, err := os.ReadFile(imagePath)
+	utils.CheckError(err)
+	if !bytes.Equal(downloaded, image) {
+		t.Errorf("unexpected image!\nexpected: %v\nactual: %v", string(image), string(downloaded))
+	}
+}
+
+func TestAtomicDownloadImageToPathMismatch(t *testing.T) {
+	server, _ := ServeFlakyImage([]byte("delta-brainwave-corrupted"))
+	defer server.Close()
+
+	imageUrl := fmt.Sprintf("%v/delta.img", server.URL)
+	imagePath := filepath.Join(t.TempDir(), "delta.img")
+	err := AtomicDownloadImageToPath(imageUrl, imagePath, sha256.New, deltaBrainwaveSha256)
+	if _, ok := err.(ChecksumMismatchError); !ok {
+		t.Errorf("a corrupted image should be rejected, got: %v", err)
+	}
+	for _, path := range []string{imagePath, fmt.Sprintf("%v.new", imagePath)} {
+		if utils.FileOrDirExists(path) == nil {
+			t.Errorf("%v shouldn't be left behind by a corrupted download", path)
+		}
+	}
+}
+
+func TestDownloadImageVerifiesChecksum(t *testing.T) {
+	image := []byte("delta-brainwave")
+	server, requests := ServeFlakyImage(image)
+	defer server.Close()
+	*requests = 1
+
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.General.ImageCachePath = fmt.Sprintf("%v/", t.TempDir())
+	spawnerCfg.Checksums = []ChecksumProviderConfig{{Domain: "127.0.0.1", Provider: "sha256sums"}}
+	imageUrl := fmt.Sprintf("%v/delta.img", server.URL)
+	imagePath, err := DownloadImage(imageUrl, spawnerCfg)
+	utils.CheckError(err)
+	if imagePath != fmt.Sprintf("%vdelta.img", spawnerCfg.General.ImageCachePath) {
+		t.Errorf("unexpected image path: %v", imagePath)
+	}
+	_, err = DownloadImage(imageUrl, spawnerCfg)
+	utils.CheckError(err)
+	if *requests != 2 {
+		t.Errorf("an unchanged image should only be downloaded once, but took %v requests", *requests-1)
+	}
+
+	// an image corrupted in the cache is downloaded again
+	utils.CheckError(os.WriteFile(imagePath, []byte("delta-brainwav3"), 0644))
+	_, err = DownloadImage(imageUrl, spawnerCfg)
+	utils.CheckError(err)
+	downloaded, err := os.ReadFile(imagePath)
+	utils.CheckError(err)
+	if !bytes.Equal(downloaded, image) {
+		t.Errorf("unexpected image!\nexpected: %v\nactual: %v", string(image), string(downloaded))
+	}
+
+	_, err = DownloadImage(fmt.Sprintf("%v/missing.img", server.URL), spawnerCfg)
+	if err == nil {
+		t.Errorf("an image with no checksum to verify it against shouldn't be downloaded")
+	}
+}
+
+func TestIdenticalLocalAndRemoteChecksum(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
 
 	imageUrl := "http://localhost:9999/resting-mini-iso-amd64.iso"
 	imagePath := "/srv/guts/images/resting-mini-iso-amd64.iso"
-	if IdenticalLocalAndRemoteShasum(imageUrl, imagePath) {
+	if IdenticalLocalAndRemoteChecksum(localChecksumProvider, imageUrl, imagePath) {
 		t.Errorf("Retrieving shasum for %v should have failed but didn't!", imageUrl)
 	}
 }
 
-func TestIdenticalLocalAndRemoteShasumNoLocal(t *testing.T) {
+func TestIdenticalLocalAndRemoteChecksumNoLocal(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
 
 	imageUrl := "http://localhost:9999/questing-mini-iso-amd64.iso"
 	imagePath := "/srv/guts/images/questing-mini-iso-amd64.iso"
-	if IdenticalLocalAndRemoteShasum(imageUrl, imagePath) {
+	if IdenticalLocalAndRemoteChecksum(localChecksumProvider, imageUrl, imagePath) {
 		t.Errorf("comparing shasum for %v should have failed but didn't!", imageUrl)
 	}
 }
 
-func TestIdenticalLocalAndRemoteShasumWrongLocal(t *testing.T) {
+func TestIdenticalLocalAndRemoteChecksumWrongLocal(t *testing.T) {
 	servingProcess := utils.ServeRelativeDirectory("/../../postgres/test-data/test-files/")
 	defer utils.DeferredErrCheck(servingProcess.Kill)
 
@@ -204,7 +392,7 @@ func TestIdenticalLocalAndRemoteShasumWrongLocal(t *testing.T) {
 	dummyBytes := []byte("Welcome to guts")
 	err := os.WriteFile(imagePath, dummyBytes, 0644)
 	utils.CheckError(err)
-	identical := IdenticalLocalAndRemoteShasum(imageUrl, imagePath)
+	identical := IdenticalLocalAndRemoteChecksum(localChecksumProvider, imageUrl, imagePath)
 	os.Remove(imagePath)
 	if identical {
 		t.Errorf("Retrieving shasum for %v should have failed but didn't!", imageUrl)
@@ -221,26 +409,69 @@ func TestGetQemuCmdLine(t *testing.T) {
 	var dummyRequirements TestRequirements
 	dummyRequirements.tpmRequired = false
 	dummyRequirements.liveImage = true
-	dummyRequirements.defaultDiskSizeGb = 40
+	dummyRequirements.diskSizeGb = 40
 
-	cmdLine := GetQemuCmdLine(imagePath, diskPath, dummyRequirements, spawnerCfg)
-	expectedCmdLine := "qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :0,share=ignore -boot once=d -cdrom /srv/guts/images/questing-mini-iso-amd64.iso -hda /srv/guts/disks/mydisk.qcow2"
+	cmdLine := GetQemuCmdLine(imagePath, diskPath, "/tmp/guts-testbed", 1, dummyRequirements, spawnerCfg)
+	expectedCmdLine := "qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :1,share=ignore -boot once=d -cdrom /srv/guts/images/questing-mini-iso-amd64.iso -hda /srv/guts/disks/mydisk.qcow2"
 	if strings.Join(cmdLine, " ") != expectedCmdLine {
 		t.Errorf("unexpected qemu command line!\nExpected: %v\nActual: %v", expectedCmdLine, strings.Join(cmdLine, " "))
 	}
 
 	dummyRequirements.liveImage = false
 	imagePath = "/srv/guts/images/questing-mini-iso-amd64-preinstalled.img"
-	diskPath = "/srv/guts/images/questing-mini-iso-amd64-preinstalled.img"
+	diskPath = "/srv/guts/images/myoverlay.qcow2"
 
-	cmdLine = GetQemuCmdLine(imagePath, diskPath, dummyRequirements, spawnerCfg)
-	expectedCmdLine = "qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :0,share=ignore -drive format=raw,file=/srv/guts/images/questing-mini-iso-amd64-preinstalled.img"
+	cmdLine = GetQemuCmdLine(imagePath, diskPath, "/tmp/guts-testbed", 1, dummyRequirements, spawnerCfg)
+	expectedCmdLine = "qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2"
 
 	if strings.Join(cmdLine, " ") != expectedCmdLine {
 		t.Errorf("unexpected qemu command line!\nExpected: %v\nActual: %v", expectedCmdLine, strings.Join(cmdLine, " "))
 	}
 }
 
+func TestGetQemuCmdLineRequirements(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	imagePath := "/srv/guts/images/questing-mini-iso-amd64-preinstalled.img"
+	diskPath := "/srv/guts/images/myoverlay.qcow2"
+
+	testCases := []struct {
+		requirements    TestRequirements
+		expectedCmdLine string
+	}{
+		{
+			TestRequirements{memoryMb: 8192, cores: 2},
+			"qemu-system-x86_64 -m 8192 -smp 2 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga virtio -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+		{
+			TestRequirements{uefi: true},
+			"qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine q35,accel=kvm -drive if=pflash,format=raw,unit=0,file=/usr/share/OVMF/OVMF_CODE_4M.fd,readonly=on -drive if=pflash,format=raw,unit=1,file=/tmp/guts-testbed/OVMF_VARS.fd -usbdevice tablet -vga virtio -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+		{
+			TestRequirements{uefi: true, secureBoot: true},
+			"qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine q35,accel=kvm,smm=on -global driver=cfi.pflash01,property=secure,value=on -global ICH9-LPC.disable_s3=1 -drive if=pflash,format=raw,unit=0,file=/usr/share/OVMF/OVMF_CODE_4M.secboot.fd,readonly=on -drive if=pflash,format=raw,unit=1,file=/tmp/guts-testbed/OVMF_VARS.fd -usbdevice tablet -vga virtio -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+		{
+			TestRequirements{tpmRequired: true, uefi: true},
+			"qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine q35,accel=kvm -drive if=pflash,format=raw,unit=0,file=/usr/share/OVMF/OVMF_CODE_4M.fd,readonly=on -drive if=pflash,format=raw,unit=1,file=/tmp/guts-testbed/OVMF_VARS.fd -usbdevice tablet -vga virtio -vnc :1,share=ignore -chardev socket,id=chrtpm,path=/tmp/guts-testbed/swtpm.sock -tpmdev emulator,id=tpm0,chardev=chrtpm -device tpm-tis,tpmdev=tpm0 -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+		{
+			TestRequirements{displayResolution: "1920x1080"},
+			"qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga none -device virtio-vga,xres=1920,yres=1080 -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+		{
+			TestRequirements{gpu: "virtio-gpu-gl", displayResolution: "1280x800"},
+			"qemu-system-x86_64 -m 4096 -smp 8 -enable-kvm -machine pc,accel=kvm -usbdevice tablet -vga none -device virtio-gpu-gl,xres=1280,yres=800 -display egl-headless -vnc :1,share=ignore -drive format=qcow2,file=/srv/guts/images/myoverlay.qcow2",
+		},
+	}
+	for _, tc := range testCases {
+		cmdLine := strings.Join(GetQemuCmdLine(imagePath, diskPath, "/tmp/guts-testbed", 1, tc.requirements, spawnerCfg), " ")
+		if cmdLine != tc.expectedCmdLine {
+			t.Errorf("unexpected qemu command line for %+v!\nExpected: %v\nActual: %v", tc.requirements, tc.expectedCmdLine, cmdLine)
+		}
+	}
+}
+
 func TestCreateQcowDisk(t *testing.T) {
 	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
 	utils.CheckError(err)
@@ -248,7 +479,7 @@ func TestCreateQcowDisk(t *testing.T) {
 	var dummyRequirements TestRequirements
 	dummyRequirements.tpmRequired = false
 	dummyRequirements.liveImage = true
-	dummyRequirements.defaultDiskSizeGb = 10
+	dummyRequirements.diskSizeGb = 10
 
 	thisUuid := "92e234a6-6172-44b5-a690-086fe3037c46"
 
@@ -261,6 +492,40 @@ func TestCreateQcowDisk(t *testing.T) {
 	utils.CheckError(err)
 }
 
+func TestCreateQcowOverlay(t *testing.T) {
+	spawnerCfg := TempImageCacheConfig(t)
+	imagePath := filepath.Join(spawnerCfg.General.ImageCachePath, "questing-mini-iso-amd64-preinstalled.img")
+	err := os.WriteFile(imagePath, make([]byte, 1024*1024), 0644)
+	utils.CheckError(err)
+
+	thisUuid := "92e234a6-6172-44b5-a690-086fe3037c46"
+	diskPath, diskName, err := CreateQcowOverlay(imagePath, TestRequirements{}, thisUuid, spawnerCfg)
+	utils.CheckError(err)
+	if !strings.HasPrefix(diskName, thisUuid) || !strings.HasSuffix(diskName, ".qcow2") {
+		t.Errorf("unexpected overlay name: %v", diskName)
+	}
+
+	info, err := exec.Command("qemu-img", "info", diskPath).Output()
+	utils.CheckError(err)
+	expectedBacking := fmt.Sprintf("backing file: %v", imagePath)
+	if !strings.Contains(string(info), expectedBacking) {
+		t.Errorf("overlay isn't backed by the cached image!\nexpected: %v\nactual: %v", expectedBacking, string(info))
+	}
+}
+
+func TestStopVm(t *testing.T) {
+	vmProcess := exec.Command("sleep", "60")
+	utils.CheckError(vmProcess.Start())
+	vmExited := utils.WaitInBackground(vmProcess)
+
+	utils.CheckError(StopVm(vmProcess, vmExited))
+	if !utils.ProcessHasExited(vmExited) {
+		t.Errorf("the VM should be gone once it's stopped")
+	}
+	// stopping a VM that's already gone is a no-op
+	utils.CheckError(StopVm(vmProcess, vmExited))
+}
+
 func TestGetTestState(t *testing.T) {
 	id := 15
 	Driver, err := database.TestDbDriver("guts_spawner", "guts_spawner")
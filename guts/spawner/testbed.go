@@ -0,0 +1,148 @@
+package spawner
+
+import (
+	"errors"
+	"fmt"
+	"guts.ubuntu.com/v2/utils"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// the OVMF firmware and NVRAM vars templates of the ovmf package, used
+	// when the config doesn't name others
+	DefaultUefiFirmware       = "/usr/share/OVMF/OVMF_CODE_4M.fd"
+	DefaultUefiVars           = "/usr/share/OVMF/OVMF_VARS_4M.fd"
+	DefaultSecureBootFirmware = "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd"
+	// vars with the Microsoft keys enrolled, so signed Ubuntu images boot
+	DefaultSecureBootVars = "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"
+	// how long swtpm gets to create its socket before it's given up on
+	SwtpmStartTimeout = 10 * time.Second
+)
+
+type SwtpmUnavailableError struct {
+	err error
+}
+
+func (s SwtpmUnavailableError) Error() string {
+	return fmt.Sprintf("Test needs a TPM, but swtpm isn't available on this host: %v", s.err)
+}
+
+// UefiVarsPath is where a test's own copy of the NVRAM vars is kept, in the
+// directory holding the state of its testbed
+func UefiVarsPath(testbedDir string) string {
+	return filepath.Join(testbedDir, "OVMF_VARS.fd")
+}
+
+func SwtpmStatePath(testbedDir string) string {
+	return filepath.Join(testbedDir, "tpm")
+}
+
+func SwtpmSocketPath(testbedDir string) string {
+	return filepath.Join(testbedDir, "swtpm.sock")
+}
+
+// UefiFirmwarePaths picks the OVMF firmware a test boots and the template its
+// NVRAM vars are copied from
+func UefiFirmwarePaths(req TestRequirements, SpawnerCfg GutsSpawnerConfig) (string, string) {
+	firmware, vars := SpawnerCfg.Virtualisation.UefiFirmware, SpawnerCfg.Virtualisation.UefiVars
+	defaultFirmware, defaultVars := DefaultUefiFirmware, DefaultUefiVars
+	if req.secureBoot {
+		firmware, vars = SpawnerCfg.Virtualisation.SecureBootFirmware, SpawnerCfg.Virtualisation.SecureBootVars
+		defaultFirmware, defaultVars = DefaultSecureBootFirmware, DefaultSecureBootVars
+	}
+	if firmware == "" {
+		firmware = defaultFirmware
+	}
+	if vars == "" {
+		vars = defaultVars
+	}
+	return firmware, vars
+}
+
+// CopyUefiVars gives a test a fresh copy of the NVRAM vars template, so the
+// boot entries and keys it writes don't leak into other tests
+func CopyUefiVars(req TestRequirements, testbedDir string, SpawnerCfg GutsSpawnerConfig) error {
+	_, varsTemplate := UefiFirmwarePaths(req, SpawnerCfg)
+	src, err := os.Open(varsTemplate)
+	if err != nil {
+		return err
+	}
+	defer utils.DeferredErrCheck(src.Close)
+	dst, err := os.OpenFile(UefiVarsPath(testbedDir), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil { // coverage-ignore
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// SwtpmAvailable checks the host can give tests a TPM
+func SwtpmAvailable() error {
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		return SwtpmUnavailableError{err: err}
+	}
+	return nil
+}
+
+// Swtpm is the TPM 2.0 emulator of one test
+type Swtpm struct {
+	cmd    *exec.Cmd
+	exited <-chan struct{}
+}
+
+// StartSwtpm starts a TPM 2.0 emulator for a test, keeping its state in the
+// test's testbed directory. It terminates once qemu disconnects from it, but
+// should still be stopped in case qemu never connected
+func StartSwtpm(testbedDir string) (*Swtpm, error) {
+	if err := SwtpmAvailable(); err != nil {
+		return nil, err
+	}
+	err := os.MkdirAll(SwtpmStatePath(testbedDir), 0700)
+	if err != nil { // coverage-ignore
+		return nil, err
+	}
+	swtpmCmd := exec.Command(
+		"swtpm",
+		"socket",
+		"--tpm2",
+		"--tpmstate",
+		fmt.Sprintf("dir=%v", SwtpmStatePath(testbedDir)),
+		"--ctrl",
+		fmt.Sprintf("type=unixio,path=%v", SwtpmSocketPath(testbedDir)),
+		"--terminate",
+	)
+	if err = swtpmCmd.Start(); err != nil { // coverage-ignore
+		return nil, err
+	}
+	swtpm := &Swtpm{cmd: swtpmCmd, exited: utils.WaitInBackground(swtpmCmd)}
+	// qemu fails to start if the socket isn't there yet
+	deadline := time.Now().Add(SwtpmStartTimeout)
+	for utils.FileOrDirExists(SwtpmSocketPath(testbedDir)) != nil {
+		if utils.ProcessHasExited(swtpm.exited) {
+			return nil, fmt.Errorf("swtpm exited with %v before creating its socket", swtpmCmd.ProcessState)
+		}
+		if time.Now().After(deadline) { // coverage-ignore
+			_ = swtpm.Stop()
+			return nil, fmt.Errorf("swtpm didn't create its socket within %v", SwtpmStartTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return swtpm, nil
+}
+
+// Stop kills swtpm, if it hasn't already terminated with qemu
+func (s *Swtpm) Stop() error {
+	err := s.cmd.Process.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) { // coverage-ignore
+		return err
+	}
+	<-s.exited
+	return nil
+}
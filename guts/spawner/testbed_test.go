@@ -0,0 +1,79 @@
+package spawner
+
+import (
+	"guts.ubuntu.com/v2/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUefiFirmwarePaths(t *testing.T) {
+	spawnerCfg, err := ParseConfig("./guts-spawner.yaml")
+	utils.CheckError(err)
+	firmware, vars := UefiFirmwarePaths(TestRequirements{uefi: true}, spawnerCfg)
+	if firmware != "/usr/share/OVMF/OVMF_CODE_4M.fd" || vars != "/usr/share/OVMF/OVMF_VARS_4M.fd" {
+		t.Errorf("unexpected UEFI firmware %v and vars %v", firmware, vars)
+	}
+	firmware, vars = UefiFirmwarePaths(TestRequirements{uefi: true, secureBoot: true}, spawnerCfg)
+	if firmware != "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd" || vars != "/usr/share/OVMF/OVMF_VARS_4M.ms.fd" {
+		t.Errorf("unexpected secure boot firmware %v and vars %v", firmware, vars)
+	}
+
+	// the ovmf package's firmware is used when the config doesn't name any
+	firmware, vars = UefiFirmwarePaths(TestRequirements{uefi: true, secureBoot: true}, GutsSpawnerConfig{})
+	if firmware != DefaultSecureBootFirmware || vars != DefaultSecureBootVars {
+		t.Errorf("unexpected default secure boot firmware %v and vars %v", firmware, vars)
+	}
+}
+
+func TestCopyUefiVars(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.Virtualisation.UefiVars = filepath.Join(t.TempDir(), "OVMF_VARS_4M.fd")
+	utils.CheckError(os.WriteFile(spawnerCfg.Virtualisation.UefiVars, []byte("delta-brainwave"), 0644))
+	testbedDir := t.TempDir()
+
+	err := CopyUefiVars(TestRequirements{uefi: true}, testbedDir, spawnerCfg)
+	utils.CheckError(err)
+	vars, err := os.ReadFile(UefiVarsPath(testbedDir))
+	utils.CheckError(err)
+	if string(vars) != "delta-brainwave" {
+		t.Errorf("the test's vars aren't a copy of the template: %v", string(vars))
+	}
+	// writes of the test never reach the template
+	utils.CheckError(os.WriteFile(UefiVarsPath(testbedDir), []byte("boot entries"), 0644))
+	template, err := os.ReadFile(spawnerCfg.Virtualisation.UefiVars)
+	utils.CheckError(err)
+	if string(template) != "delta-brainwave" {
+		t.Errorf("the vars template was modified: %v", string(template))
+	}
+}
+
+func TestCopyUefiVarsMissingTemplate(t *testing.T) {
+	var spawnerCfg GutsSpawnerConfig
+	spawnerCfg.Virtualisation.UefiVars = filepath.Join(t.TempDir(), "OVMF_VARS_4M.fd")
+	err := CopyUefiVars(TestRequirements{uefi: true}, t.TempDir(), spawnerCfg)
+	if err == nil {
+		t.Errorf("copying vars from a missing template should have failed but didn't!")
+	}
+}
+
+func TestSwtpmUnavailable(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	_, err := StartSwtpm(t.TempDir())
+	if _, ok := err.(SwtpmUnavailableError); !ok {
+		t.Errorf("starting swtpm without it installed should fail with a SwtpmUnavailableError, got %v", err)
+	}
+}
+
+func TestStartSwtpm(t *testing.T) {
+	if SwtpmAvailable() != nil {
+		t.Skip("Skipping test as swtpm isn't installed")
+	}
+	testbedDir := t.TempDir()
+	swtpm, err := StartSwtpm(testbedDir)
+	utils.CheckError(err)
+	if utils.FileOrDirExists(SwtpmSocketPath(testbedDir)) != nil {
+		t.Errorf("swtpm should have created its socket at %v", SwtpmSocketPath(testbedDir))
+	}
+	utils.CheckError(swtpm.Stop())
+}
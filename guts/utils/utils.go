@@ -7,6 +7,7 @@ import (
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io"
@@ -18,15 +19,53 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// TestCaseRequirements is what a test case needs of its VM, zero values
+// leave it to the spawner
+type TestCaseRequirements struct {
+	Tpm               bool
+	Memory            MemoryMb
+	Cores             int
+	DiskGb            int `yaml:"disk_gb"`
+	Uefi              bool
+	SecureBoot        bool   `yaml:"secure_boot"`
+	DisplayResolution string `yaml:"display_resolution"` // e.g. 1920x1080
+	Gpu               string // one of GpuDevices
+}
+
+// MemoryMb is an amount of memory in MB. A plan gives it as a number of MB,
+// e.g. 8192, or as a size in M or G, e.g. 512M or 8G
+type MemoryMb int
+
+func (m *MemoryMb) UnmarshalYAML(value *yaml.Node) error {
+	var mb int
+	if value.Decode(&mb) == nil {
+		*m = MemoryMb(mb)
+		return nil
+	}
+	match := memorySizeFormat.FindStringSubmatch(value.Value)
+	if match == nil {
+		return InvalidMemorySizeError{size: value.Value}
+	}
+	mb, err := strconv.Atoi(match[1])
+	if err != nil {
+		return InvalidMemorySizeError{size: value.Value}
+	}
+	if strings.EqualFold(match[2], "G") {
+		mb *= 1024
+	}
+	*m = MemoryMb(mb)
+	return nil
+}
+
 type TestCaseData struct {
 	EntryPoint   string
-	Requirements struct {
-		Tpm bool
-	}
+	Requirements TestCaseRequirements
 }
 
 type TestCase struct {
@@ -40,6 +79,34 @@ type TestPlan struct {
 	Tests TestCases
 }
 
+var (
+	// the virtio-gpu variants a test case can ask for, the -gl ones render
+	// with the host's GPU
+	GpuDevices              = []string{"virtio-vga", "virtio-vga-gl", "virtio-gpu", "virtio-gpu-gl"}
+	displayResolutionFormat = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+	// G is 1024 M, as qemu takes it
+	memorySizeFormat = regexp.MustCompile(`^([0-9]+) ?([MmGg])(?:i?[Bb])?$`)
+	// less memory than this is taken to be a size given in G without its unit
+	MinVmMemoryMb = MemoryMb(256)
+)
+
+type InvalidRequirementsError struct {
+	testCase string
+	reason   string
+}
+
+func (i InvalidRequirementsError) Error() string {
+	return fmt.Sprintf("Requirements of test case %v are invalid: %v", i.testCase, i.reason)
+}
+
+type InvalidMemorySizeError struct {
+	size string
+}
+
+func (i InvalidMemorySizeError) Error() string {
+	return fmt.Sprintf("Invalid memory size %q, expected a number of MB like 8192, or a size like 512M or 8G", i.size)
+}
+
 type GenericGitError struct {
 	Command []string
 }
@@ -114,6 +181,39 @@ func AtomicWrite(data []byte, filename string) error { // coverage-ignore
 	return nil
 }
 
+// AtomicWriteFromReader writes everything read from r to filename, which
+// only appears once it's complete. Nothing is left behind if reading fails
+func AtomicWriteFromReader(r io.Reader, filename string) error {
+	newFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".new")
+	if err != nil {
+		return err
+	}
+	defer DeferredErrCheckStringArg(RemoveIfExists, newFile.Name())
+	_, err = io.Copy(newFile, r)
+	if err != nil {
+		_ = newFile.Close()
+		return err
+	}
+	err = newFile.Close()
+	if err != nil { // coverage-ignore
+		return err
+	}
+	err = os.Chmod(newFile.Name(), 0644)
+	if err != nil { // coverage-ignore
+		return err
+	}
+	return os.Rename(newFile.Name(), filename)
+}
+
+// RemoveIfExists removes a file, and doesn't mind if it's already gone
+func RemoveIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) { // coverage-ignore
+		return err
+	}
+	return nil
+}
+
 func CreateDirIfNotExists(directory string) error {
 	// Creates a directory if it doesn't exist
 	_, err := os.Open(directory)
@@ -354,6 +454,29 @@ func StartProcess(processArgs []string, envVars *[]string) (*exec.Cmd, error) {
 	return cmd, err
 }
 
+// WaitInBackground waits for a started process in a separate goroutine.
+// The returned channel is closed once the process has exited, after which
+// cmd.ProcessState is safe to read.
+func WaitInBackground(cmd *exec.Cmd) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		// a non-zero exit code is returned as an error here, callers
+		// inspect cmd.ProcessState instead
+		_ = cmd.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func ProcessHasExited(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
 func GitCloneToDir(repository, branch, directory string) error {
 	// leave directory as empty to just clone with repo name to current directory
 	cloneCmd := exec.Command(
@@ -404,5 +527,28 @@ func ParsePlan(planPath string) (TestPlan, error) {
 	if err != nil {
 		return testPlan, err
 	}
+	for _, testCase := range testPlan.Tests {
+		err = ValidateRequirements(testCase)
+		if err != nil {
+			return testPlan, err
+		}
+	}
 	return testPlan, nil
 }
+
+func ValidateRequirements(testCase TestCase) error {
+	req := testCase.Data.Requirements
+	if req.Memory < 0 || req.Cores < 0 || req.DiskGb < 0 {
+		return InvalidRequirementsError{testCase: testCase.Name, reason: "memory, cores and disk_gb can't be negative"}
+	}
+	if req.Memory > 0 && req.Memory < MinVmMemoryMb {
+		return InvalidRequirementsError{testCase: testCase.Name, reason: fmt.Sprintf("memory is in MB, a VM needs at least %v MB, use a size like 8G for GB", MinVmMemoryMb)}
+	}
+	if req.DisplayResolution != "" && !displayResolutionFormat.MatchString(req.DisplayResolution) {
+		return InvalidRequirementsError{testCase: testCase.Name, reason: fmt.Sprintf("display_resolution %v isn't of the form 1920x1080", req.DisplayResolution)}
+	}
+	if req.Gpu != "" && !slices.Contains(GpuDevices, req.Gpu) {
+		return InvalidRequirementsError{testCase: testCase.Name, reason: fmt.Sprintf("gpu %v isn't one of %v", req.Gpu, GpuDevices)}
+	}
+	return nil
+}
@@ -4,8 +4,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"fmt"
-	//"io"
 	"gopkg.in/yaml.v3"
+	"io"
 	"os"
 	"reflect"
 	"testing"
@@ -72,6 +72,46 @@ func TestCreateDirIfNotExistsDirExistsAlready(t *testing.T) {
 	CheckError(err)
 }
 
+func TestAtomicWriteFromReader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "atomic-write")
+	CheckError(err)
+	defer DeferredErrCheckStringArg(os.RemoveAll, dir)
+
+	filename := fmt.Sprintf("%v/results.tar.gz", dir)
+	err = AtomicWriteFromReader(bytes.NewReader([]byte("bite my shiny metal tarball")), filename)
+	CheckError(err)
+
+	data, err := os.ReadFile(filename)
+	CheckError(err)
+	if string(data) != "bite my shiny metal tarball" {
+		t.Errorf("Unexpected file contents!\nExpected: %v\nActual: %v", "bite my shiny metal tarball", string(data))
+	}
+}
+
+func TestAtomicWriteFromReaderFails(t *testing.T) {
+	dir, err := os.MkdirTemp("", "atomic-write")
+	CheckError(err)
+	defer DeferredErrCheckStringArg(os.RemoveAll, dir)
+
+	filename := fmt.Sprintf("%v/results.tar.gz", dir)
+	reader, writer := io.Pipe()
+	go func() {
+		_, _ = writer.Write([]byte("half a tarb"))
+		_ = writer.CloseWithError(fmt.Errorf("connection reset"))
+	}()
+	err = AtomicWriteFromReader(reader, filename)
+	if err == nil {
+		t.Errorf("Writing from a failing reader unexpectedly succeeded!")
+	}
+
+	// neither the file nor the partial write should be left behind
+	entries, err := os.ReadDir(dir)
+	CheckError(err)
+	if len(entries) != 0 {
+		t.Errorf("Expected no files to be left behind, but found %v", entries)
+	}
+}
+
 func TestIsValidUrl(t *testing.T) {
 	validUrl := "http://localhost:9999/res-1.tar.gz"
 	valid := IsValidUrl(validUrl)
@@ -381,6 +421,28 @@ func TestStartProcessWithEnv(t *testing.T) {
 	CheckError(err)
 }
 
+func TestWaitInBackground(t *testing.T) {
+	cmdArgs := []string{
+		"sleep",
+		"1",
+	}
+	process, err := StartProcess(cmdArgs, nil)
+	CheckError(err)
+
+	done := WaitInBackground(process)
+	if ProcessHasExited(done) {
+		t.Errorf("process shouldn't have exited yet")
+	}
+
+	<-done
+	if !ProcessHasExited(done) {
+		t.Errorf("process should have exited")
+	}
+	if process.ProcessState.ExitCode() != 0 {
+		t.Errorf("unexpected exit code %v", process.ProcessState.ExitCode())
+	}
+}
+
 func TestParsePlan(t *testing.T) {
 	fullPlan := `---
 tests:
@@ -420,6 +482,101 @@ tests:
 	}
 }
 
+func TestParsePlanRequirements(t *testing.T) {
+	fullPlan := `---
+tests:
+  Firmware-Updater-Tpm-Fde:
+    entrypoint: tests/firmware-updater
+    requirements:
+      tpm: true
+      memory: 8192
+      cores: 4
+      disk_gb: 60
+      uefi: true
+      secure_boot: true
+      display_resolution: 1920x1080
+      gpu: virtio-gpu-gl`
+
+	testPlanFn := fmt.Sprintf("%v/testPlan.yaml", t.TempDir())
+	err := os.WriteFile(testPlanFn, []byte(fullPlan), 0644)
+	CheckError(err)
+
+	parsedPlan, err := ParsePlan(testPlanFn)
+	CheckError(err)
+
+	expectedRequirements := TestCaseRequirements{
+		Tpm:               true,
+		Memory:            8192,
+		Cores:             4,
+		DiskGb:            60,
+		Uefi:              true,
+		SecureBoot:        true,
+		DisplayResolution: "1920x1080",
+		Gpu:               "virtio-gpu-gl",
+	}
+	if len(parsedPlan.Tests) != 1 || parsedPlan.Tests[0].Data.Requirements != expectedRequirements {
+		t.Errorf("unexpected requirements parsed!\nexpected: %v\nactual: %v", expectedRequirements, parsedPlan.Tests)
+	}
+}
+
+func TestParsePlanBadRequirements(t *testing.T) {
+	for _, requirements := range []string{"gpu: cirrus", "display_resolution: 1080p", "memory: -1", "memory: 8"} {
+		fullPlan := fmt.Sprintf(`---
+tests:
+  Firefox-Example-Basic:
+    entrypoint: tests/firefox-example
+    requirements:
+      %v`, requirements)
+
+		testPlanFn := fmt.Sprintf("%v/testPlan.yaml", t.TempDir())
+		err := os.WriteFile(testPlanFn, []byte(fullPlan), 0644)
+		CheckError(err)
+
+		_, err = ParsePlan(testPlanFn)
+		if _, ok := err.(InvalidRequirementsError); !ok {
+			t.Errorf("parsing a plan with %v should have failed with an InvalidRequirementsError, got %v", requirements, err)
+		}
+	}
+}
+
+func TestParsePlanMemorySizes(t *testing.T) {
+	testCases := map[string]MemoryMb{
+		"8192":                  8192,
+		"512M":                  512,
+		"8G":                    8192,
+		"8 GiB":                 8192,
+		"2gb":                   2048,
+		"8X":                    -1,
+		"G":                     -1,
+		"1.5G":                  -1,
+		"99999999999999999999G": -1,
+	}
+	for memory, expected := range testCases {
+		fullPlan := fmt.Sprintf(`---
+tests:
+  Firefox-Example-Basic:
+    entrypoint: tests/firefox-example
+    requirements:
+      memory: %v`, memory)
+
+		testPlanFn := fmt.Sprintf("%v/testPlan.yaml", t.TempDir())
+		err := os.WriteFile(testPlanFn, []byte(fullPlan), 0644)
+		CheckError(err)
+
+		parsedPlan, err := ParsePlan(testPlanFn)
+		if expected == -1 {
+			if _, ok := err.(InvalidMemorySizeError); !ok {
+				t.Errorf("parsing a plan with memory %v should have failed with an InvalidMemorySizeError, got %v", memory, err)
+			}
+			continue
+		}
+		CheckError(err)
+		if actual := parsedPlan.Tests[0].Data.Requirements.Memory; actual != expected {
+			t.Errorf("unexpected memory parsed from %v!\nexpected: %v\nactual: %v", memory, expected, actual)
+		}
+	}
+}
+
 func TestParsePlanBadFile(t *testing.T) {
 	fullPlan := `this-is-not-a-yaml-file`
 
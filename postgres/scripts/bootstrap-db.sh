@@ -30,30 +30,44 @@ fi
 
 CURRDIR=$(pwd)
 SCRIPT_DIR=$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )
-PATCH_DIR="${SCRIPT_DIR}/../schema/patches/"
+GUTS_DIR="${SCRIPT_DIR}/../../guts/"
 TEST_DATA_DIR="${SCRIPT_DIR}/../test-data/"
 
-PATCHES=$(ls "${PATCH_DIR}")
-
-# TEMP_DIR=$(mktemp -d)
-TEMP_DIR="/var/lib/postgresql/data/"
-sudo rm -r $TEMP_DIR || true
-echo "removed the data directory"
-sudo mkdir $TEMP_DIR
-
-sudo sudo cp -br "${PATCH_DIR}/" "${TEMP_DIR}"
+# the database may already exist, the migrations bring it up to date either way
+if [[ $LOCAL == "local" ]]; then
+    sudo -i -u postgres psql -a -c 'CREATE DATABASE guts;' || true
+else
+    psql --host="${PG_HOST}" --port="${PG_PORT}" --user="${PG_USER}" -a -c 'CREATE DATABASE guts;' || true
+fi
 
-sudo chown -R postgres:postgres "${TEMP_DIR}"
+# the migrations are embedded in guts-migrate, which applies the ones the
+# database doesn't have yet. $GUTS_MIGRATE can point at a prebuilt one,
+# otherwise it's run from this checkout
+if [ -n "${GUTS_MIGRATE}" ]; then
+    if [ ! -x "${GUTS_MIGRATE}" ]; then printf "\$GUTS_MIGRATE %s must be an executable" "${GUTS_MIGRATE}"; exit 1; fi
+    MIGRATE=("$(realpath "${GUTS_MIGRATE}")")
+elif [[ $LOCAL == "local" ]]; then
+    # the postgres user can't get at the binary go run builds, so it's built
+    # somewhere it can
+    MIGRATE_DIR=$(mktemp -d)
+    chmod 755 "${MIGRATE_DIR}"
+    cd "${GUTS_DIR}"
+    go build -o "${MIGRATE_DIR}/guts-migrate" ./cmd/migrate
+    cd "${CURRDIR}"
+    MIGRATE=("${MIGRATE_DIR}/guts-migrate")
+else
+    MIGRATE=(go run -C "${GUTS_DIR}" ./cmd/migrate)
+fi
 
-for patch in $PATCHES; do
-    if [[ $LOCAL == "local" ]]; then
-        sudo -i -u postgres psql -a -f "${TEMP_DIR}/patches/${patch}"
-    else
-        psql --host="${PG_HOST}" --port="${PG_PORT}" --user="${PG_USER}" -a -f "${TEMP_DIR}/patches/${patch}"
-    fi
-done
+if [[ $LOCAL == "local" ]]; then
+    sudo -u postgres "${MIGRATE[@]}" -connection-string "host=/var/run/postgresql dbname=guts sslmode=disable"
+else
+    "${MIGRATE[@]}" -connection-string "host=${PG_HOST} port=${PG_PORT} user=${PG_USER} dbname=guts sslmode=${PG_SSLMODE:-require}"
+fi
+if [ -n "${MIGRATE_DIR}" ]; then rm -r "${MIGRATE_DIR}"; fi
 
-# remove everything in the directory but preserve it
+# TEMP_DIR=$(mktemp -d)
+TEMP_DIR="/var/lib/postgresql/data/"
 sudo rm -r $TEMP_DIR || true
 echo "removed the data directory"
 sudo mkdir $TEMP_DIR
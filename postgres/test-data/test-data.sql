@@ -33,3 +33,45 @@ COPY users (
 COPY reporter (
     uuid, base_reporting_url
 ) FROM '/var/lib/postgresql/data/test-data/reporters.csv' DELIMITER ',' CSV HEADER; -- noqa:disable=layout.long_lines
+
+COPY test_attempts (
+    test_id,
+    uuid,
+    test_case,
+    attempt,
+    state,
+    results_url,
+    commit_hash,
+    finished_at,
+    spawner_host,
+    vnc_address,
+    started_at,
+    exit_code
+) FROM '/var/lib/postgresql/data/test-data/test_attempts.csv' DELIMITER ',' CSV HEADER;
+
+COPY test_results (
+    test_id,
+    uuid,
+    test_case,
+    attempt,
+    kind,
+    suite,
+    name,
+    status,
+    message,
+    started_at,
+    duration_ms,
+    screenshots
+) FROM '/var/lib/postgresql/data/test-data/test_results.csv' DELIMITER ',' CSV HEADER;
+
+COPY spawners (
+    hostname,
+    architecture,
+    kvm,
+    tpm,
+    uefi,
+    secure_boot,
+    max_memory,
+    max_cores,
+    updated_at
+) FROM '/var/lib/postgresql/data/test-data/spawners.csv' DELIMITER ',' CSV HEADER;